@@ -72,15 +72,9 @@ sensors:
       amplitude: 100.0
       offset: 50.0
 
+state_dir: "/var/tmp/cnc-agent"
+
 buffering:
-  hot_buffer:
-    capacity: 1048576  # 1MB
-  warm_buffer:
-    path: "/var/tmp/cnc-agent/warm.buffer"
-    size: 10485760    # 10MB
-  cold_buffer:
-    path: "/var/tmp/cnc-agent/cold.log"
-    max_size: 104857600  # 100MB
   batching:
     size: 100
     timeout: "200ms"
@@ -88,7 +82,7 @@ buffering:
 nats:
   url: "nats://$BACKEND_IP:4222"
   stream: "CNC_DATA"
-  subject_prefix: "CNC_DATA.edge"
+  subject_prefix: "CNC.EDGE"
   max_reconnects: -1  # -1 = infinite reconnection attempts
   reconnect_delay: "2s"
 EOF
@@ -138,12 +132,13 @@ if [ "$RUN_MODE" == "0" ]; then
     # Clear buffers and caches
     echo "Clearing buffers..."
     echo "raspy" | sudo -S bash -c "
-        mkdir -p /var/tmp/cnc-agent/offline
-        chown pi:pi /var/tmp/cnc-agent/offline
+        mkdir -p /var/tmp/cnc-agent
+        chown pi:pi /var/tmp/cnc-agent
         rm -f /var/tmp/cnc-agent/warm.buffer
         rm -f /var/tmp/cnc-agent/cold.log
     "
-    rm -rf /var/tmp/cnc-agent/offline/*
+    # Per-machine state: <state_dir>/<machine_id>/offline (the sequence file is kept)
+    rm -rf /var/tmp/cnc-agent/offline /var/tmp/cnc-agent/*/offline
     
     echo "✅ Buffers cleared"
     
@@ -164,8 +159,8 @@ fi
 
 # Ensure directories exist
 echo "raspy" | sudo -S bash -c "
-    mkdir -p /var/tmp/cnc-agent/offline
-    chown pi:pi /var/tmp/cnc-agent/offline
+    mkdir -p /var/tmp/cnc-agent
+    chown pi:pi /var/tmp/cnc-agent
 "
 
 # Change to edge_code directory and run
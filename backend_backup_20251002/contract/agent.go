@@ -0,0 +1,104 @@
+// contract/agent.go
+package contract
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultConfigBucket is the JetStream key-value bucket holding the desired
+// configuration of every agent, one key per machine ID. The backend writes it
+// and each agent watches its own key.
+const DefaultConfigBucket = "CNC_AGENT_CONFIG"
+
+// ConfigKeySubject returns the subject of machineID's key in bucket, which
+// the agent's watch consumer filters on.
+func ConfigKeySubject(bucket, machineID string) string {
+	return "$KV." + bucket + "." + machineID
+}
+
+// DesiredConfig is the value stored under a machine's key in the config
+// bucket.
+type DesiredConfig struct {
+	MachineID string    `json:"machine_id"`
+	Version   int64     `json:"version"` // Increases with every change
+	UpdatedAt time.Time `json:"updated_at"`
+	// Settings in the layout of edge-config.yaml. They are applied over the
+	// agent's config file; a list such as sensors replaces the file's.
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// AgentConfigReport tells the backend whether an agent applied a desired
+// configuration. It is published as StatusAgentConfig.
+type AgentConfigReport struct {
+	MachineID string    `json:"machine_id"`
+	Version   int64     `json:"version"` // Version of the DesiredConfig; 0 when the agent went back to its config file
+	Applied   bool      `json:"applied"`
+	Error     string    `json:"error,omitempty"` // Why the configuration was rejected
+	Time      time.Time `json:"time"`
+}
+
+// Agent conditions that move it out of the online state.
+const (
+	ConditionOffline = "offline" // The backend is unreachable; samples are buffered
+	ConditionStorage = "storage" // Unsent data over its quota or the disk nearly full
+	ConditionCPU     = "cpu"     // CPU usage above health.thresholds.cpu_percent
+	ConditionSensors = "sensors" // A sensor keeps failing to read
+)
+
+// AgentState reports a state transition of an agent: bootstrap, connecting,
+// online, buffering, degraded, recovering or shutdown. It is published as
+// StatusAgentState.
+type AgentState struct {
+	MachineID  string    `json:"machine_id"`
+	State      string    `json:"state"`
+	Previous   string    `json:"previous"`
+	Conditions []string  `json:"conditions,omitempty"` // Conditions in effect, e.g. offline or cpu
+	Failing    []string  `json:"failing,omitempty"`    // Names of the failing sensors
+	Time       time.Time `json:"time"`
+}
+
+// Agent commands.
+const (
+	CommandRestartSampling = "restart-sampling" // Restart the sensors and the sampling timeline
+	CommandFlushBuffers    = "flush-buffers"    // Publish queued samples and replay unsent data now
+	CommandSetSamplingRate = "set-sampling-rate"
+	CommandSetLogLevel     = "set-log-level"
+)
+
+// Command is a request on a machine's command subject. The agent answers
+// with a CommandResult.
+type Command struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	SamplingRate string `json:"sampling_rate,omitempty"` // For set-sampling-rate, e.g. "50ms"
+	LogLevel     string `json:"log_level,omitempty"`     // For set-log-level: debug, info, warn or error
+}
+
+// Validate checks that the command is known and has its argument.
+func (c Command) Validate() error {
+	switch c.Name {
+	case CommandRestartSampling, CommandFlushBuffers:
+	case CommandSetSamplingRate:
+		d, err := time.ParseDuration(c.SamplingRate)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%s: sampling_rate %q must be a positive duration", c.Name, c.SamplingRate)
+		}
+	case CommandSetLogLevel:
+		switch c.LogLevel {
+		case "debug", "info", "warn", "error":
+		default:
+			return fmt.Errorf("%s: log_level %q must be debug, info, warn or error", c.Name, c.LogLevel)
+		}
+	default:
+		return fmt.Errorf("unknown command %q", c.Name)
+	}
+	return nil
+}
+
+// CommandResult is an agent's answer to a Command.
+type CommandResult struct {
+	ID      string `json:"id"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
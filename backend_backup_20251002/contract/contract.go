@@ -0,0 +1,218 @@
+// contract/contract.go
+
+// Package contract defines the NATS subjects and the JetStream stream shared by
+// the edge agents, the DNC service and the backend. It has no dependencies so
+// both the backend and the edge agent modules can import it.
+//
+// Every machine publishes under its own subject tree:
+//
+//	<prefix>.<machine_id>.telemetry   sensor samples (length-prefixed frames)
+//	<prefix>.<machine_id>.status      agent state and health
+//	<prefix>.<machine_id>.dnc         DNC transfer progress events
+//	<prefix>.<machine_id>.command     commands to the agent (request/reply)
+//
+// The stream captures exactly the first three, so other subjects under a
+// machine's tree, such as commands, are not persisted.
+package contract
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Defaults shared by all components.
+const (
+	DefaultStream        = "CNC_DATA"
+	DefaultSubjectPrefix = "CNC.EDGE"
+)
+
+// Message kinds, the last token of a machine subject.
+const (
+	KindTelemetry = "telemetry"
+	KindStatus    = "status"
+	KindDNC       = "dnc"
+)
+
+// KindCommand is the subject an agent receives commands on. It is not in
+// Kinds: a stream capturing it would answer command requests itself.
+const KindCommand = "command"
+
+// Kinds lists the message kinds persisted in the stream.
+var Kinds = []string{KindTelemetry, KindStatus, KindDNC}
+
+// Subject returns the subject machineID publishes messages of kind to.
+func Subject(prefix, machineID, kind string) string {
+	return prefix + "." + machineID + "." + kind
+}
+
+// MachineSubjects returns the wildcard covering every subject of machineID,
+// the unit of per-machine publish permissions.
+func MachineSubjects(prefix, machineID string) string {
+	return prefix + "." + machineID + ".>"
+}
+
+// FilterSubject returns the subject matching messages of kind from all machines,
+// for consumer filters.
+func FilterSubject(prefix, kind string) string {
+	return prefix + ".*." + kind
+}
+
+// StreamSubjects returns the subjects the stream must capture.
+func StreamSubjects(prefix string) []string {
+	subjects := make([]string, len(Kinds))
+	for i, kind := range Kinds {
+		subjects[i] = FilterSubject(prefix, kind)
+	}
+	return subjects
+}
+
+// ParseSubject splits a machine subject into its machine ID and kind. ok is
+// false if subject is not <prefix>.<machine_id>.<kind>.
+func ParseSubject(prefix, subject string) (machineID, kind string, ok bool) {
+	if prefix == "" || !strings.HasPrefix(subject, prefix+".") {
+		return "", "", false
+	}
+	machineID, kind, found := strings.Cut(subject[len(prefix)+1:], ".")
+	if !found || machineID == "" || kind == "" || strings.Contains(kind, ".") {
+		return "", "", false
+	}
+	return machineID, kind, true
+}
+
+// ValidateMachineID reports whether id can be used as a single subject token.
+func ValidateMachineID(id string) error {
+	if id == "" {
+		return fmt.Errorf("machine_id must not be empty")
+	}
+	if strings.ContainsAny(id, ". *>\t\r\n") {
+		return fmt.Errorf("machine_id %q must not contain '.', '*', '>' or whitespace", id)
+	}
+	return nil
+}
+
+// Stream retention policies, as named in configuration.
+const (
+	RetentionLimits    = "limits"
+	RetentionInterest  = "interest"
+	RetentionWorkQueue = "workqueue"
+)
+
+// Stream defaults.
+const (
+	DefaultMaxAge     = 7 * 24 * time.Hour
+	DefaultReplicas   = 1
+	DefaultDuplicates = 10 * time.Minute // Window in which Nats-Msg-Id resends are dropped
+)
+
+// StreamSpec is the expected configuration of the stream. Zero MaxAge and
+// MaxBytes mean unlimited.
+type StreamSpec struct {
+	Name       string
+	Subjects   []string
+	Retention  string
+	MaxAge     time.Duration
+	MaxBytes   int64
+	Replicas   int
+	Duplicates time.Duration
+}
+
+// NewStreamSpec returns the default spec for stream name with machine subjects under prefix.
+func NewStreamSpec(name, prefix string) StreamSpec {
+	return StreamSpec{
+		Name:       name,
+		Subjects:   StreamSubjects(prefix),
+		Retention:  RetentionLimits,
+		MaxAge:     DefaultMaxAge,
+		Replicas:   DefaultReplicas,
+		Duplicates: DefaultDuplicates,
+	}
+}
+
+// Validate checks the spec's settings.
+func (s StreamSpec) Validate() error {
+	switch s.Retention {
+	case RetentionLimits, RetentionInterest, RetentionWorkQueue:
+	default:
+		return fmt.Errorf("stream %s: unknown retention %q (want limits, interest or workqueue)", s.Name, s.Retention)
+	}
+	if s.Replicas < 1 || s.Replicas > 5 {
+		return fmt.Errorf("stream %s: replicas must be between 1 and 5, got %d", s.Name, s.Replicas)
+	}
+	if s.MaxAge < 0 || s.MaxBytes < 0 || s.Duplicates < 0 {
+		return fmt.Errorf("stream %s: max_age, max_bytes and duplicates must not be negative", s.Name)
+	}
+	if s.MaxAge > 0 && s.Duplicates > s.MaxAge {
+		return fmt.Errorf("stream %s: duplicate window %s exceeds max_age %s", s.Name, s.Duplicates, s.MaxAge)
+	}
+	return nil
+}
+
+// Diff lists the settings in which actual differs from s, one human-readable
+// entry per setting. Subjects are compared as sets.
+func (s StreamSpec) Diff(actual StreamSpec) []string {
+	var diffs []string
+	if !sameSet(s.Subjects, actual.Subjects) {
+		diffs = append(diffs, fmt.Sprintf("subjects: want %v, have %v", s.Subjects, actual.Subjects))
+	}
+	if s.Retention != actual.Retention {
+		diffs = append(diffs, fmt.Sprintf("retention: want %s, have %s", s.Retention, actual.Retention))
+	}
+	if s.MaxAge != actual.MaxAge {
+		diffs = append(diffs, fmt.Sprintf("max_age: want %s, have %s", s.MaxAge, actual.MaxAge))
+	}
+	if s.MaxBytes != actual.MaxBytes {
+		diffs = append(diffs, fmt.Sprintf("max_bytes: want %d, have %d", s.MaxBytes, actual.MaxBytes))
+	}
+	if s.Replicas != actual.Replicas {
+		diffs = append(diffs, fmt.Sprintf("replicas: want %d, have %d", s.Replicas, actual.Replicas))
+	}
+	if s.Duplicates != actual.Duplicates {
+		diffs = append(diffs, fmt.Sprintf("duplicates: want %s, have %s", s.Duplicates, actual.Duplicates))
+	}
+	return diffs
+}
+
+// Captures reports whether a stream with the given subjects stores messages
+// published to subject.
+func Captures(streamSubjects []string, subject string) bool {
+	for _, filter := range streamSubjects {
+		if SubjectMatches(filter, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// SubjectMatches reports whether subject matches filter, which may contain the
+// NATS wildcards '*' (one token) and '>' (one or more trailing tokens).
+func SubjectMatches(filter, subject string) bool {
+	ft := strings.Split(filter, ".")
+	st := strings.Split(subject, ".")
+	for i, f := range ft {
+		if f == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) || (f != "*" && f != st[i]) {
+			return false
+		}
+	}
+	return len(ft) == len(st)
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, v := range a {
+		seen[v]++
+	}
+	for _, v := range b {
+		if seen[v] == 0 {
+			return false
+		}
+		seen[v]--
+	}
+	return true
+}
@@ -0,0 +1,3 @@
+module cnc-monitor/contract
+
+go 1.22.0
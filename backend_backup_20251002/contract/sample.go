@@ -0,0 +1,298 @@
+// contract/sample.go
+package contract
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Sample is one reading of a machine, as published on its telemetry subject.
+// Each message carries one or more length-prefixed frames (4-byte big-endian
+// length) of samples encoded with EncodeSample.
+type Sample struct {
+	MachineID          string    `json:"machine_id"`
+	SequenceNumber     uint64    `json:"sequence_number"` // Monotonic sequence per machine
+	Temperature        float64   `json:"temperature"`
+	SpindleSpeed       float64   `json:"spindle_speed"`
+	Timestamp          time.Time `json:"timestamp"`
+	XPosMM             float64   `json:"x_pos_mm"`
+	YPosMM             float64   `json:"y_pos_mm"`
+	ZPosMM             float64   `json:"z_pos_mm"`
+	FeedRateActual     float64   `json:"feed_rate_actual"`
+	SpindleLoadPercent float64   `json:"spindle_load_percent"`
+	MachineState       string    `json:"machine_state"`
+	ActiveProgramLine  int       `json:"active_program_line"`
+	TotalPowerKW       float64   `json:"total_power_kw"`
+
+	// Missing names the fields and channels no sensor delivered a usable
+	// value for; fields hold zero. Not carried by binary v1.
+	Missing []string `json:"missing,omitempty"`
+	// Channels holds readings of channels that are not fields above, e.g.
+	// coolant pressure. Not carried by binary v1.
+	Channels map[string]float64 `json:"channels,omitempty"`
+}
+
+// Sample encodings. The encoding of a published message is announced in the
+// SampleEncodingHeader NATS header; messages without it are JSON.
+const (
+	SampleEncodingHeader = "Sample-Encoding"
+
+	EncodingJSON     = "json"
+	EncodingBinaryV1 = "cncbin/1"
+	EncodingBinaryV2 = "cncbin/2"
+)
+
+// Compression of telemetry message bodies. The codec of a compressed body is
+// announced in the ContentEncodingHeader NATS header; bodies without it are
+// not compressed.
+const (
+	ContentEncodingHeader = "Content-Encoding"
+
+	ContentEncodingZstd = "zstd"
+	ContentEncodingS2   = "s2"
+)
+
+// binaryV1Magic and binaryV2Magic start every binary record. They can never
+// start a JSON document, so records written in any encoding can be told apart.
+const (
+	binaryV1Magic = 0xC1
+	binaryV2Magic = 0xC2
+)
+
+// ErrMalformedSample is returned for binary records that are truncated or malformed.
+var ErrMalformedSample = errors.New("malformed sensor sample")
+
+// EncodeSample encodes a reading in the given encoding ("json", "cncbin/1" or
+// "cncbin/2").
+//
+// Binary v1 layout, integers big-endian, varints as in encoding/binary:
+//
+//	0xC1                         magic / version
+//	uvarint len, bytes           machine_id
+//	uvarint                      sequence_number
+//	varint                       timestamp, Unix nanoseconds (0 = zero time)
+//	8 x float64                  temperature, spindle_speed, x_pos_mm, y_pos_mm,
+//	                             z_pos_mm, feed_rate_actual, spindle_load_percent,
+//	                             total_power_kw
+//	uvarint len, bytes           machine_state
+//	varint                       active_program_line
+//
+// Binary v2 starts with 0xC2, continues with the v1 fields and appends:
+//
+//	uvarint count, count x (uvarint len, bytes)     missing
+//	uvarint count, count x (uvarint len, bytes,     channels, sorted by name
+//	                        float64)
+//
+// Each record stands alone so the agent's WAL records can be replayed in any
+// grouping. v1 carries neither Missing nor Channels; it is still decoded for
+// WAL records written by older agents.
+func EncodeSample(encoding string, d Sample) ([]byte, error) {
+	switch encoding {
+	case "", EncodingJSON:
+		return json.Marshal(d)
+	case EncodingBinaryV1:
+		return appendBinaryV1(make([]byte, 0, 96+len(d.MachineID)+len(d.MachineState)), d), nil
+	case EncodingBinaryV2:
+		return appendBinaryV2(make([]byte, 0, 128+len(d.MachineID)+len(d.MachineState)+16*len(d.Channels)), d), nil
+	default:
+		return nil, fmt.Errorf("unsupported sample encoding %q", encoding)
+	}
+}
+
+// SampleEncoding reports the encoding of an encoded record.
+func SampleEncoding(record []byte) string {
+	if len(record) > 0 {
+		switch record[0] {
+		case binaryV1Magic:
+			return EncodingBinaryV1
+		case binaryV2Magic:
+			return EncodingBinaryV2
+		}
+	}
+	return EncodingJSON
+}
+
+// DecodeSample decodes a record produced by EncodeSample in any encoding.
+func DecodeSample(record []byte) (Sample, error) {
+	var d Sample
+	switch SampleEncoding(record) {
+	case EncodingBinaryV1:
+		return decodeBinary(record, binaryV1Magic)
+	case EncodingBinaryV2:
+		return decodeBinary(record, binaryV2Magic)
+	}
+	err := json.Unmarshal(record, &d)
+	return d, err
+}
+
+func appendBinaryV1(buf []byte, d Sample) []byte {
+	return appendBinaryFields(append(buf, binaryV1Magic), d)
+}
+
+func appendBinaryV2(buf []byte, d Sample) []byte {
+	buf = appendBinaryFields(append(buf, binaryV2Magic), d)
+	buf = binary.AppendUvarint(buf, uint64(len(d.Missing)))
+	for _, name := range d.Missing {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+	}
+	names := make([]string, 0, len(d.Channels))
+	for name := range d.Channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(d.Channels[name]))
+	}
+	return buf
+}
+
+// appendBinaryFields appends the fixed fields shared by v1 and v2.
+func appendBinaryFields(buf []byte, d Sample) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(d.MachineID)))
+	buf = append(buf, d.MachineID...)
+	buf = binary.AppendUvarint(buf, d.SequenceNumber)
+	var ts int64
+	if !d.Timestamp.IsZero() {
+		ts = d.Timestamp.UnixNano()
+	}
+	buf = binary.AppendVarint(buf, ts)
+	for _, v := range [...]float64{
+		d.Temperature, d.SpindleSpeed, d.XPosMM, d.YPosMM, d.ZPosMM,
+		d.FeedRateActual, d.SpindleLoadPercent, d.TotalPowerKW,
+	} {
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(d.MachineState)))
+	buf = append(buf, d.MachineState...)
+	buf = binary.AppendVarint(buf, int64(d.ActiveProgramLine))
+	return buf
+}
+
+func decodeBinary(record []byte, magic byte) (Sample, error) {
+	var d Sample
+	r := sampleReader{buf: record}
+
+	if r.byte() != magic {
+		return d, fmt.Errorf("%w: bad magic", ErrMalformedSample)
+	}
+	d.MachineID = r.string()
+	d.SequenceNumber = r.uvarint()
+	if ts := r.varint(); ts != 0 {
+		d.Timestamp = time.Unix(0, ts).UTC()
+	}
+	for _, f := range [...]*float64{
+		&d.Temperature, &d.SpindleSpeed, &d.XPosMM, &d.YPosMM, &d.ZPosMM,
+		&d.FeedRateActual, &d.SpindleLoadPercent, &d.TotalPowerKW,
+	} {
+		*f = math.Float64frombits(r.uint64())
+	}
+	d.MachineState = r.string()
+	d.ActiveProgramLine = int(r.varint())
+	if magic == binaryV2Magic {
+		if n := r.count(); n > 0 {
+			d.Missing = make([]string, n)
+			for i := range d.Missing {
+				d.Missing[i] = r.string()
+			}
+		}
+		if n := r.count(); n > 0 {
+			d.Channels = make(map[string]float64, n)
+			for i := 0; i < n; i++ {
+				name := r.string()
+				d.Channels[name] = math.Float64frombits(r.uint64())
+			}
+		}
+	}
+
+	if r.err != nil {
+		return Sample{}, r.err
+	}
+	if len(r.buf) != 0 {
+		return Sample{}, fmt.Errorf("%w: %d trailing bytes", ErrMalformedSample, len(r.buf))
+	}
+	return d, nil
+}
+
+// sampleReader consumes a binary record, remembering the first error.
+type sampleReader struct {
+	buf []byte
+	err error
+}
+
+func (r *sampleReader) fail(what string) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: truncated %s", ErrMalformedSample, what)
+	}
+	r.buf = nil
+}
+
+func (r *sampleReader) byte() byte {
+	if len(r.buf) < 1 {
+		r.fail("header")
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *sampleReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail("uvarint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *sampleReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail("varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// count reads a list length, bounded by the remaining bytes since every
+// element takes at least one.
+func (r *sampleReader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) {
+		r.fail("list")
+		return 0
+	}
+	return int(n)
+}
+
+func (r *sampleReader) uint64() uint64 {
+	if len(r.buf) < 8 {
+		r.fail("float")
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return v
+}
+
+func (r *sampleReader) string() string {
+	n := r.uvarint()
+	if uint64(len(r.buf)) < n {
+		r.fail("string")
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
@@ -0,0 +1,201 @@
+package contract
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func testSample() Sample {
+	return Sample{
+		MachineID:          "CNC-001",
+		SequenceNumber:     42,
+		Temperature:        36.6,
+		SpindleSpeed:       12000,
+		Timestamp:          time.Date(2025, 10, 1, 8, 0, 0, 123456789, time.UTC),
+		XPosMM:             -10.5,
+		YPosMM:             20.25,
+		ZPosMM:             0,
+		FeedRateActual:     1500,
+		SpindleLoadPercent: 73.2,
+		MachineState:       "RUNNING",
+		ActiveProgramLine:  17,
+		TotalPowerKW:       7.5,
+		Missing:            []string{"temperature", "coolant_pressure"},
+		Channels:           map[string]float64{"vibration_rms": 0.12, "coolant_pressure": 0},
+	}
+}
+
+func TestEncodeDecodeSample(t *testing.T) {
+	v1 := testSample()
+	v1.Missing, v1.Channels = nil, nil
+
+	tests := []struct {
+		encoding string
+		want     Sample
+	}{
+		{EncodingJSON, testSample()},
+		{EncodingBinaryV1, v1},
+		{EncodingBinaryV2, testSample()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			record, err := EncodeSample(tt.encoding, testSample())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := SampleEncoding(record); got != tt.encoding {
+				t.Errorf("SampleEncoding = %s, want %s", got, tt.encoding)
+			}
+			got, err := DecodeSample(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded\n%+v\nwant\n%+v", got, tt.want)
+			}
+
+			// Every truncation of a binary record is rejected
+			if tt.encoding == EncodingJSON {
+				return
+			}
+			for n := 1; n < len(record); n++ {
+				if _, err := DecodeSample(record[:n]); !errors.Is(err, ErrMalformedSample) {
+					t.Errorf("truncated to %d bytes: err %v, want ErrMalformedSample", n, err)
+				}
+			}
+			if _, err := DecodeSample(append(record, 0)); !errors.Is(err, ErrMalformedSample) {
+				t.Errorf("trailing byte: err %v, want ErrMalformedSample", err)
+			}
+		})
+	}
+
+	if _, err := EncodeSample("cncbin/9", testSample()); err == nil {
+		t.Error("unknown encoding accepted")
+	}
+}
+
+// sameSample reports how a and b differ, comparing floats bit for bit so NaNs
+// round-trip too.
+func sameSample(a, b Sample) error {
+	floats := func(s Sample) []float64 {
+		return []float64{s.Temperature, s.SpindleSpeed, s.XPosMM, s.YPosMM, s.ZPosMM, s.FeedRateActual, s.SpindleLoadPercent, s.TotalPowerKW}
+	}
+	fa, fb := floats(a), floats(b)
+	for i := range fa {
+		if math.Float64bits(fa[i]) != math.Float64bits(fb[i]) {
+			return fmt.Errorf("float field %d: %v != %v", i, fa[i], fb[i])
+		}
+	}
+	if a.MachineID != b.MachineID || a.SequenceNumber != b.SequenceNumber || !a.Timestamp.Equal(b.Timestamp) ||
+		a.MachineState != b.MachineState || a.ActiveProgramLine != b.ActiveProgramLine {
+		return fmt.Errorf("%+v != %+v", a, b)
+	}
+	if !reflect.DeepEqual(a.Missing, b.Missing) {
+		return fmt.Errorf("missing %q != %q", a.Missing, b.Missing)
+	}
+	if len(a.Channels) != len(b.Channels) {
+		return fmt.Errorf("channels %v != %v", a.Channels, b.Channels)
+	}
+	for name, v := range a.Channels {
+		if w, ok := b.Channels[name]; !ok || math.Float64bits(v) != math.Float64bits(w) {
+			return fmt.Errorf("channel %q: %v != %v", name, v, w)
+		}
+	}
+	return nil
+}
+
+func FuzzEncodeDecode(f *testing.F) {
+	s := testSample()
+	f.Add(s.MachineID, s.SequenceNumber, s.Timestamp.UnixNano(), s.Temperature, s.SpindleSpeed, s.MachineState, int64(s.ActiveProgramLine), "temperature", "vibration_rms", 0.12)
+	f.Add("", uint64(0), int64(0), math.NaN(), math.Inf(-1), "", int64(-1), "", "", math.Copysign(0, -1))
+
+	f.Fuzz(func(t *testing.T, machineID string, seq uint64, ts int64, temp, speed float64, state string, line int64, missing, channel string, value float64) {
+		in := Sample{
+			MachineID:         machineID,
+			SequenceNumber:    seq,
+			Temperature:       temp,
+			SpindleSpeed:      speed,
+			MachineState:      state,
+			ActiveProgramLine: int(line),
+			Missing:           []string{missing},
+			Channels:          map[string]float64{channel: value},
+		}
+		if ts != 0 {
+			in.Timestamp = time.Unix(0, ts).UTC()
+		}
+
+		for _, encoding := range []string{EncodingJSON, EncodingBinaryV1, EncodingBinaryV2} {
+			want := in
+			switch encoding {
+			case EncodingJSON:
+				// JSON has no NaN or infinities and replaces invalid UTF-8
+				if math.IsNaN(temp) || math.IsInf(temp, 0) || math.IsNaN(speed) || math.IsInf(speed, 0) ||
+					math.IsNaN(value) || math.IsInf(value, 0) ||
+					!utf8.ValidString(machineID) || !utf8.ValidString(state) || !utf8.ValidString(missing) || !utf8.ValidString(channel) ||
+					int64(int(line)) != line {
+					continue
+				}
+			case EncodingBinaryV1:
+				want.Missing, want.Channels = nil, nil
+			}
+
+			record, err := EncodeSample(encoding, in)
+			if err != nil {
+				t.Fatalf("%s: encode: %v", encoding, err)
+			}
+			if got := SampleEncoding(record); got != encoding {
+				t.Fatalf("%s: record sniffed as %s", encoding, got)
+			}
+			out, err := DecodeSample(record)
+			if err != nil {
+				t.Fatalf("%s: decode: %v", encoding, err)
+			}
+			if err := sameSample(out, want); err != nil {
+				t.Fatalf("%s: round trip: %v", encoding, err)
+			}
+		}
+	})
+}
+
+// FuzzDecodeSample feeds arbitrary records to DecodeSample. It must not
+// panic, and whatever it accepts must re-encode to a record that decodes to
+// the same sample.
+func FuzzDecodeSample(f *testing.F) {
+	for _, encoding := range []string{EncodingJSON, EncodingBinaryV1, EncodingBinaryV2} {
+		record, err := EncodeSample(encoding, testSample())
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(record)
+	}
+	f.Add([]byte{0xC2, 0x00})
+	f.Add([]byte{0xC1, 0xff, 0xff, 0xff, 0xff, 0x0f})
+
+	f.Fuzz(func(t *testing.T, record []byte) {
+		encoding := SampleEncoding(record)
+		d, err := DecodeSample(record)
+		if err != nil || encoding == EncodingJSON {
+			return
+		}
+		again, err := EncodeSample(encoding, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d2, err := DecodeSample(again)
+		if err != nil {
+			t.Fatalf("re-encoded record %x does not decode: %v", again, err)
+		}
+		if err := sameSample(d2, d); err != nil {
+			t.Fatal(err)
+		}
+		if again2, _ := EncodeSample(encoding, d2); !bytes.Equal(again, again2) {
+			t.Fatalf("encoding is not stable: %x then %x", again, again2)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+// contract/status.go
+package contract
+
+import "time"
+
+// StatusTypeHeader names the document carried by a message on a machine's
+// status subject. The body is JSON.
+const StatusTypeHeader = "Status-Type"
+
+// Status document types.
+const (
+	// StatusChannelCatalog is a ChannelCatalog, published by the agent on
+	// start-up and whenever its sensors change.
+	StatusChannelCatalog = "channel-catalog"
+
+	// StatusAlert is an Alert raised by the agent.
+	StatusAlert = "alert"
+
+	// StatusAgentConfig is an AgentConfigReport, published whenever the agent
+	// applies or rejects a desired configuration.
+	StatusAgentConfig = "agent-config"
+
+	// StatusAgentState is an AgentState, published on every state transition.
+	StatusAgentState = "agent-state"
+)
+
+// ChannelInfo describes one telemetry channel of a machine, from the
+// configuration of the sensor delivering it.
+type ChannelInfo struct {
+	Name        string            `json:"name"`
+	Sensor      string            `json:"sensor"`
+	Units       string            `json:"units,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Min         *float64          `json:"min,omitempty"`
+	Max         *float64          `json:"max,omitempty"`
+	Precision   *int              `json:"precision,omitempty"` // Decimal places; nil if readings are not rounded
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// ChannelCatalog lists every channel a machine's agent can deliver. Channels
+// that are not fields of the fixed sample travel in the sample's channels map.
+type ChannelCatalog struct {
+	MachineID   string        `json:"machine_id"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	Channels    []ChannelInfo `json:"channels"`
+}
+
+// Alert levels, in increasing severity.
+const (
+	AlertWarning  = "warning"
+	AlertError    = "error"
+	AlertCritical = "critical"
+)
+
+// Alert is a condition the agent detected on the machine or itself, such as a
+// reading outside its configured range.
+type Alert struct {
+	MachineID string    `json:"machine_id"`
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Source    string    `json:"source"`            // Sensor or component that raised it
+	Channel   string    `json:"channel,omitempty"` // Channel concerned, if any
+	Value     *float64  `json:"value,omitempty"`
+	Message   string    `json:"message"`
+}
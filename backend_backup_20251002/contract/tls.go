@@ -0,0 +1,169 @@
+// contract/tls.go
+package contract
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSFiles names the PEM files of a NATS client's TLS configuration. CertFile
+// and KeyFile are the client certificate for mutual TLS; CAFile verifies the
+// server, with the system roots used if it is empty.
+type TLSFiles struct {
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string // Overrides the host name verified against the server certificate
+}
+
+// NewTLSConfig builds a client tls.Config from files. The CA bundle and the
+// client certificate are re-read whenever their files change, so rotated
+// certificates take effect on the next (re)connect without a restart. logf,
+// if not nil, is told about reloads and about reloads that failed, after which
+// the previous files stay in use.
+func NewTLSConfig(files TLSFiles, logf func(format string, args ...interface{})) (*tls.Config, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("tls: cert_file and key_file must be set together")
+	}
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
+	}
+
+	r := &tlsReloader{certFile: files.CertFile, keyFile: files.KeyFile, caFile: files.CAFile, logf: logf}
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: files.ServerName,
+	}
+
+	if files.CAFile != "" {
+		if _, err := r.rootCAs(); err != nil {
+			return nil, err
+		}
+		// Chain verification happens in VerifyConnection against the current CA
+		// bundle; the static RootCAs field could not pick up a rotated CA.
+		tc.InsecureSkipVerify = true
+		tc.VerifyConnection = r.verifyConnection
+	}
+
+	if files.CertFile != "" {
+		if _, err := r.clientCertificate(nil); err != nil {
+			return nil, err
+		}
+		tc.GetClientCertificate = r.clientCertificate
+	}
+
+	return tc, nil
+}
+
+// tlsReloader caches the CA pool and client certificate and reloads them
+// when the files' modification times change.
+type tlsReloader struct {
+	certFile, keyFile, caFile string
+	logf                      func(format string, args ...interface{})
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	pool    *x509.CertPool
+	caMod   time.Time
+}
+
+func (r *tlsReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mod, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: client certificate: %w", err)
+	}
+	if r.cert != nil && mod.Equal(r.certMod) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			// Mid-rotation (e.g. cert written before key); keep using the old pair.
+			r.logf("TLS: failed to reload client certificate %s, keeping previous one: %v", r.certFile, err)
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("tls: load client certificate: %w", err)
+	}
+	if r.cert != nil {
+		r.logf("TLS: reloaded client certificate %s", r.certFile)
+	}
+	r.cert, r.certMod = &cert, mod
+	return r.cert, nil
+}
+
+func (r *tlsReloader) rootCAs() (*x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mod, err := latestModTime(r.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: CA file: %w", err)
+	}
+	if r.pool != nil && mod.Equal(r.caMod) {
+		return r.pool, nil
+	}
+
+	pem, err := os.ReadFile(r.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		if r.pool != nil {
+			r.logf("TLS: CA file %s has no usable certificates, keeping previous bundle", r.caFile)
+			return r.pool, nil
+		}
+		return nil, fmt.Errorf("tls: no certificates found in %s", r.caFile)
+	}
+	if r.pool != nil {
+		r.logf("TLS: reloaded CA bundle %s", r.caFile)
+	}
+	r.pool, r.caMod = pool, mod
+	return r.pool, nil
+}
+
+// verifyConnection does the chain and host name verification that
+// InsecureSkipVerify turned off, using the current CA bundle.
+func (r *tlsReloader) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: server presented no certificate")
+	}
+	pool, err := r.rootCAs()
+	if err != nil {
+		return err
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,209 @@
+package contract
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cnc-monitor/contract/tlstest"
+)
+
+// mtlsServer accepts TLS connections that present a client certificate of
+// the current CA, answers "ok" and hangs up.
+type mtlsServer struct {
+	addr   string
+	config atomic.Pointer[tls.Config]
+}
+
+func newMTLSServer(t *testing.T, ca *tlstest.CA, dir string) *mtlsServer {
+	t.Helper()
+	s := &mtlsServer{}
+	s.use(t, ca, dir)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) { return s.config.Load(), nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s.addr = ln.Addr().String()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+// use switches the server to a certificate of ca and to trusting only
+// client certificates of ca.
+func (s *mtlsServer) use(t *testing.T, ca *tlstest.CA, dir string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	ca.Issue(t, certFile, keyFile, "nats", "localhost", "127.0.0.1")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.config.Store(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.Pool(),
+	})
+}
+
+// dial connects with tc and returns the server's answer. With TLS 1.3 a
+// rejected client certificate only shows once the client reads.
+func (s *mtlsServer) dial(tc *tls.Config) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", s.addr, tc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	answer, err := io.ReadAll(conn)
+	if err == nil && string(answer) != "ok" {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// clientFiles issues a client certificate of ca into dir and returns the
+// files for a client trusting serverCA.
+func clientFiles(t *testing.T, dir string, ca, serverCA *tlstest.CA) TLSFiles {
+	t.Helper()
+	files := TLSFiles{
+		CertFile:   filepath.Join(dir, "client.crt"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		CAFile:     filepath.Join(dir, "ca.crt"),
+		ServerName: "localhost",
+	}
+	ca.Issue(t, files.CertFile, files.KeyFile, "CNC-001")
+	serverCA.WriteCA(t, files.CAFile)
+	return files
+}
+
+func TestTLSConfigMutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t, "cnc-ca")
+	other := tlstest.NewCA(t, "other-ca")
+	server := newMTLSServer(t, ca, t.TempDir())
+
+	tests := []struct {
+		name    string
+		files   func(dir string) TLSFiles
+		wantErr bool
+	}{
+		{
+			name:  "client certificate of the server's CA",
+			files: func(dir string) TLSFiles { return clientFiles(t, dir, ca, ca) },
+		},
+		{
+			name:    "client certificate of another CA",
+			files:   func(dir string) TLSFiles { return clientFiles(t, dir, other, ca) },
+			wantErr: true,
+		},
+		{
+			name: "no client certificate",
+			files: func(dir string) TLSFiles {
+				files := clientFiles(t, dir, ca, ca)
+				files.CertFile, files.KeyFile = "", ""
+				return files
+			},
+			wantErr: true,
+		},
+		{
+			name:    "server certificate of an untrusted CA",
+			files:   func(dir string) TLSFiles { return clientFiles(t, dir, ca, other) },
+			wantErr: true,
+		},
+		{
+			name: "server name mismatch",
+			files: func(dir string) TLSFiles {
+				files := clientFiles(t, dir, ca, ca)
+				files.ServerName = "nats.example.com"
+				return files
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewTLSConfig(tt.files(t.TempDir()), t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := server.dial(tc); (err != nil) != tt.wantErr {
+				t.Errorf("dial: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSConfigRotation(t *testing.T) {
+	oldCA := tlstest.NewCA(t, "cnc-ca-2024")
+	newCA := tlstest.NewCA(t, "cnc-ca-2025")
+	dir := t.TempDir()
+	server := newMTLSServer(t, oldCA, t.TempDir())
+
+	files := clientFiles(t, dir, oldCA, oldCA)
+	tc, err := NewTLSConfig(files, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.dial(tc); err != nil {
+		t.Fatalf("dial before rotation: %v", err)
+	}
+
+	// The server moves to the new CA first; the old files no longer work
+	server.use(t, newCA, t.TempDir())
+	if err := server.dial(tc); err == nil {
+		t.Fatal("dial with the old CA succeeded after the server rotated")
+	}
+
+	// Half-rotated: a new certificate next to the old key is not loaded
+	newCA.Issue(t, files.CertFile, filepath.Join(t.TempDir(), "unused.key"), "CNC-001")
+	newCA.WriteCA(t, files.CAFile)
+	if err := server.dial(tc); err == nil {
+		t.Fatal("dial with a mismatched certificate and key succeeded")
+	}
+
+	// Once both are in place the same tls.Config connects again
+	clientFiles(t, dir, newCA, newCA)
+	if err := server.dial(tc); err != nil {
+		t.Fatalf("dial after rotation: %v", err)
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := tlstest.NewCA(t, "cnc-ca")
+	files := clientFiles(t, dir, ca, ca)
+	otherKey := filepath.Join(dir, "other.key")
+	ca.Issue(t, filepath.Join(dir, "other.crt"), otherKey, "other")
+
+	for name, f := range map[string]TLSFiles{
+		"cert without key":    {CertFile: files.CertFile},
+		"key of another cert": {CertFile: files.CertFile, KeyFile: otherKey},
+		"missing CA file":     {CAFile: filepath.Join(dir, "missing.crt")},
+		"CA file not PEM":     {CAFile: files.KeyFile},
+	} {
+		if _, err := NewTLSConfig(f, nil); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
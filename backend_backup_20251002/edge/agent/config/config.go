@@ -2,15 +2,19 @@
 package config
 
 import (
+	"fmt"
 	"strings"
 	"time"
 
+	"cnc-monitor/contract"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
 // Config represents the complete edge agent configuration
 type Config struct {
+	StateDir  string          `mapstructure:"state_dir"` // Root of per-machine state: <state_dir>/<machine_id>/
 	Agent     AgentConfig     `mapstructure:"agent"`
 	Sensors   []SensorConfig  `mapstructure:"sensors"`
 	Buffering BufferingConfig `mapstructure:"buffering"`
@@ -24,6 +28,9 @@ type AgentConfig struct {
 	Location     string        `mapstructure:"location"`
 	SamplingRate time.Duration `mapstructure:"sampling_rate"`
 	LogLevel     string        `mapstructure:"log_level"`
+	Record       string        `mapstructure:"record"` // Capture file every sample is also written to, relative to the machine's state directory; off if empty
+	// Sampling interval while degraded; never faster than sampling_rate, 0 to keep sampling_rate
+	DegradedSamplingRate time.Duration `mapstructure:"degraded_sampling_rate"`
 }
 
 // SensorConfig defines individual sensor configurations
@@ -36,13 +43,25 @@ type SensorConfig struct {
 	Metadata SensorMetadata         `mapstructure:"metadata"`
 }
 
-// SensorMetadata contains sensor description and configuration
+// SensorMetadata contains sensor description and configuration.
+// Units, Range and Precision apply to every channel of the sensor unless the
+// channel has an entry in Channels.
 type SensorMetadata struct {
-	Description string             `mapstructure:"description"`
-	Units       string             `mapstructure:"units"`
-	Range       SensorRange        `mapstructure:"range"`
-	Precision   int                `mapstructure:"precision"`
-	Tags        map[string]string  `mapstructure:"tags"`
+	Description string                     `mapstructure:"description"`
+	Units       string                     `mapstructure:"units"`
+	Range       SensorRange                `mapstructure:"range"`
+	Precision   *int                       `mapstructure:"precision"` // Decimal places readings are rounded to; unset keeps them as read
+	Tags        map[string]string          `mapstructure:"tags"`
+	OutOfRange  string                     `mapstructure:"out_of_range"` // Readings outside Range: flag (default), clamp or drop
+	Alert       string                     `mapstructure:"alert"`        // Alert level raised when a reading leaves Range; none if empty
+	Channels    map[string]ChannelMetadata `mapstructure:"channels"`
+}
+
+// ChannelMetadata overrides the sensor's metadata for one of its channels.
+type ChannelMetadata struct {
+	Units     string      `mapstructure:"units"`
+	Range     SensorRange `mapstructure:"range"`
+	Precision *int        `mapstructure:"precision"`
 }
 
 // SensorRange defines the valid range for sensor readings
@@ -51,29 +70,34 @@ type SensorRange struct {
 	Max float64 `mapstructure:"max"`
 }
 
-// BufferingConfig controls the data buffering and batching strategy.
-type BufferingConfig struct {
-	HotBuffer  HotBufferConfig `mapstructure:"hot_buffer"`
-	WarmBuffer WarmBufferConfig `mapstructure:"warm_buffer"`
-	ColdBuffer ColdBufferConfig `mapstructure:"cold_buffer"`
-	Batching   BatchingConfig  `mapstructure:"batching"`
+// IsSet reports whether a range was configured; a zero range means none.
+func (r SensorRange) IsSet() bool {
+	return r.Min != 0 || r.Max != 0
 }
 
-// HotBufferConfig for the in-memory ring buffer.
-type HotBufferConfig struct {
-	Capacity uint64 `mapstructure:"capacity"` // Capacity of the ring buffer in bytes. Must be a power of two.
+// BufferingConfig controls the data buffering and batching strategy.
+// Unsent data is persisted in the offline buffer's write-ahead log.
+type BufferingConfig struct {
+	Batching BatchingConfig `mapstructure:"batching"`
+	Encoding string         `mapstructure:"encoding"` // Sample encoding on the wire and in the WAL: json or binary (cncbin/2)
+	Offline  OfflineConfig  `mapstructure:"offline"`
 }
 
-// WarmBufferConfig for the memory-mapped file buffer.
-type WarmBufferConfig struct {
-	Path string `mapstructure:"path"` // Path to the memory-mapped file.
-	Size int64  `mapstructure:"size"` // Size of the memory-mapped file in bytes.
+// OfflineConfig controls where unsent data is kept and how much of it.
+type OfflineConfig struct {
+	DataDir       string        `mapstructure:"data_dir"`       // Relative to the machine's state directory; default "offline"
+	SegmentSize   int64         `mapstructure:"segment_size"`   // Bytes per WAL segment
+	MaxRetention  time.Duration `mapstructure:"max_retention"`  // Unsent data older than this is dropped
+	SyncInterval  time.Duration `mapstructure:"sync_interval"`  // How often to replay unsent data
+	FsyncInterval time.Duration `mapstructure:"fsync_interval"` // How often WAL appends are fsynced together, 0 for every append
+	Quota         QuotaConfig   `mapstructure:"quota"`
 }
 
-// ColdBufferConfig for the append-only log file.
-type ColdBufferConfig struct {
-	Path    string `mapstructure:"path"`     // Path to the cold storage log file.
-	MaxSize int64  `mapstructure:"max_size"` // Max size in bytes before rotation.
+// QuotaConfig bounds the disk space used by unsent data.
+type QuotaConfig struct {
+	MaxBytes    int64   `mapstructure:"max_bytes"`    // 0 disables the byte quota
+	Policy      string  `mapstructure:"policy"`       // drop-oldest, downsample-older or stop-sampling
+	DiskPercent float64 `mapstructure:"disk_percent"` // Filesystem usage that counts as a breach; defaults to health.thresholds.disk_percent
 }
 
 // BatchingConfig defines how data is collected into batches before processing.
@@ -90,17 +114,23 @@ type NATSConfig struct {
 	ReconnectDelay    time.Duration `mapstructure:"reconnect_delay"`
 	MaxReconnects     int           `mapstructure:"max_reconnects"`
 	BufferSize        int           `mapstructure:"buffer_size"`
+	MaxInFlight       int           `mapstructure:"max_in_flight"` // Unacknowledged async publishes before publishing blocks
+	AckTimeout        time.Duration `mapstructure:"ack_timeout"`   // How long to wait for JetStream acks
+	Compression       string        `mapstructure:"compression"` // zstd, s2 or none
 	CompressionMinKB  int           `mapstructure:"compression_min_kb"`
-	Credentials       string        `mapstructure:"credentials"`
+	Credentials       string        `mapstructure:"credentials"`    // Per-machine .creds file (user JWT + seed)
+	NKeySeedFile      string        `mapstructure:"nkey_seed_file"` // Per-machine NKey seed, for servers without JWT auth
 	TLS               TLSConfig     `mapstructure:"tls"`
+	ConfigBucket      string        `mapstructure:"config_bucket"` // KV bucket with the desired config set through the backend; empty to ignore it
 }
 
 // TLSConfig for secure NATS connections
 type TLSConfig struct {
-	Enabled  bool   `mapstructure:"enabled"`
-	CertFile string `mapstructure:"cert_file"`
-	KeyFile  string `mapstructure:"key_file"`
-	CAFile   string `mapstructure:"ca_file"`
+	Enabled    bool   `mapstructure:"enabled"`
+	CertFile   string `mapstructure:"cert_file"`   // Client certificate for mutual TLS
+	KeyFile    string `mapstructure:"key_file"`    // Client key for mutual TLS
+	CAFile     string `mapstructure:"ca_file"`     // CA bundle used to verify the server; system roots if empty
+	ServerName string `mapstructure:"server_name"` // Overrides the host name verified against the server certificate
 }
 
 // HealthConfig for monitoring and alerting
@@ -125,14 +155,14 @@ type HealthThresholds struct {
 // AlertConfig defines alerting mechanisms
 type AlertConfig struct {
 	Type    string                 `mapstructure:"type"`    // "log", "nats", "webhook"
-	Level   string                 `mapstructure:"level"`   // "warning", "error", "critical"
+	Level   string                 `mapstructure:"level"`   // Lowest level sent: "warning", "error", "critical"
 	Config  map[string]interface{} `mapstructure:"config"`
 }
 
 // LoadConfig loads configuration from file and environment variables
 func LoadConfig() (*Config, error) {
 	// Set defaults
-	setDefaults()
+	setDefaults(viper.GetViper())
 
 	// Configure viper
 	viper.SetConfigName("edge-config")
@@ -143,9 +173,7 @@ func LoadConfig() (*Config, error) {
 	viper.AddConfigPath(".")
 
 	// Enable environment variable overrides
-	viper.AutomaticEnv()
-	viper.SetEnvPrefix("CNC_EDGE")
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	setEnv(viper.GetViper())
 
 	// Read configuration file
 	if err := viper.ReadInConfig(); err != nil {
@@ -172,48 +200,62 @@ func LoadConfig() (*Config, error) {
 	return &cfg, nil
 }
 
-// setDefaults sets reasonable default values
-func setDefaults() {
-	// Agent defaults
-	viper.SetDefault("agent.machine_id", "CNC-UNKNOWN")
-	viper.SetDefault("agent.location", "Factory-Unknown")
-	viper.SetDefault("agent.sampling_rate", "100ms")
-	viper.SetDefault("agent.log_level", "info")
-
-	// Hot buffer defaults (in-memory)
-	viper.SetDefault("buffering.hot_buffer.capacity", 1024*1024) // 1MB
+// setEnv lets CNC_EDGE_* environment variables override the file.
+func setEnv(v *viper.Viper) {
+	v.AutomaticEnv()
+	v.SetEnvPrefix("CNC_EDGE")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+}
 
-	// Warm buffer defaults (memory-mapped file)
-	viper.SetDefault("buffering.warm_buffer.path", "/var/tmp/cnc-agent/warm.buffer")
-	viper.SetDefault("buffering.warm_buffer.size", 10*1024*1024) // 10MB
+// setDefaults sets reasonable default values
+func setDefaults(v *viper.Viper) {
+	// State defaults
+	v.SetDefault("state_dir", "/var/tmp/cnc-agent")
 
-	// Cold buffer defaults (append-only log)
-	viper.SetDefault("buffering.cold_buffer.path", "/var/tmp/cnc-agent/cold.log")
-	viper.SetDefault("buffering.cold_buffer.max_size", 100*1024*1024) // 100MB
+	// Agent defaults
+	v.SetDefault("agent.machine_id", "CNC-UNKNOWN")
+	v.SetDefault("agent.location", "Factory-Unknown")
+	v.SetDefault("agent.sampling_rate", "100ms")
+	v.SetDefault("agent.log_level", "info")
+	v.SetDefault("agent.degraded_sampling_rate", "1s")
 
 	// Batching defaults
-	viper.SetDefault("buffering.batching.size", 100)
-	viper.SetDefault("buffering.batching.timeout", "200ms")
+	v.SetDefault("buffering.batching.size", 100)
+	v.SetDefault("buffering.batching.timeout", "200ms")
+	v.SetDefault("buffering.encoding", "json")
+
+	// Offline buffer defaults
+	v.SetDefault("buffering.offline.data_dir", "offline")
+	v.SetDefault("buffering.offline.segment_size", 10*1024*1024)
+	v.SetDefault("buffering.offline.max_retention", "168h")
+	v.SetDefault("buffering.offline.sync_interval", "30s")
+	v.SetDefault("buffering.offline.fsync_interval", "1s")
+	v.SetDefault("buffering.offline.quota.max_bytes", 512*1024*1024)
+	v.SetDefault("buffering.offline.quota.policy", "drop-oldest")
 
 	// NATS defaults
-	viper.SetDefault("nats.url", "nats://localhost:4222")
-	viper.SetDefault("nats.stream", "CNC_DATA")
-	viper.SetDefault("nats.subject_prefix", "CNC.EDGE")
-	viper.SetDefault("nats.reconnect_delay", "1s")
-	viper.SetDefault("nats.max_reconnects", 10)
-	viper.SetDefault("nats.buffer_size", 1000)
-	viper.SetDefault("nats.compression_min_kb", 10)
+	v.SetDefault("nats.url", "nats://localhost:4222")
+	v.SetDefault("nats.stream", contract.DefaultStream)
+	v.SetDefault("nats.subject_prefix", contract.DefaultSubjectPrefix)
+	v.SetDefault("nats.reconnect_delay", "1s")
+	v.SetDefault("nats.max_reconnects", 10)
+	v.SetDefault("nats.buffer_size", 1000)
+	v.SetDefault("nats.max_in_flight", 256)
+	v.SetDefault("nats.ack_timeout", "5s")
+	v.SetDefault("nats.compression", "zstd")
+	v.SetDefault("nats.compression_min_kb", 10)
+	v.SetDefault("nats.config_bucket", contract.DefaultConfigBucket)
 
 	// Health monitoring defaults
-	viper.SetDefault("health.check_interval", "30s")
-	viper.SetDefault("health.metrics_retention", "1h")
-	viper.SetDefault("health.thresholds.cpu_percent", 75.0)
-	viper.SetDefault("health.thresholds.memory_percent", 80.0)
-	viper.SetDefault("health.thresholds.disk_percent", 85.0)
-	viper.SetDefault("health.thresholds.temperature_c", 75.0)
-	viper.SetDefault("health.thresholds.buffer_percent", 90.0)
-	viper.SetDefault("health.thresholds.error_rate", 0.05)
-	viper.SetDefault("health.thresholds.network_latency_ms", 1000)
+	v.SetDefault("health.check_interval", "30s")
+	v.SetDefault("health.metrics_retention", "1h")
+	v.SetDefault("health.thresholds.cpu_percent", 75.0)
+	v.SetDefault("health.thresholds.memory_percent", 80.0)
+	v.SetDefault("health.thresholds.disk_percent", 85.0)
+	v.SetDefault("health.thresholds.temperature_c", 75.0)
+	v.SetDefault("health.thresholds.buffer_percent", 90.0)
+	v.SetDefault("health.thresholds.error_rate", 0.05)
+	v.SetDefault("health.thresholds.network_latency_ms", 1000)
 }
 
 // validateConfig performs basic validation of the configuration
@@ -224,29 +266,80 @@ func validateConfig(cfg *Config) error {
 		cfg.Agent.MachineID = "CNC-UNKNOWN"
 	}
 
+	// The machine ID is a NATS subject token and the unit of publish permissions
+	if err := contract.ValidateMachineID(cfg.Agent.MachineID); err != nil {
+		return err
+	}
+
+	switch cfg.Buffering.Offline.Quota.Policy {
+	case "drop-oldest", "downsample-older", "stop-sampling":
+	default:
+		return fmt.Errorf("buffering.offline.quota.policy %q must be drop-oldest, downsample-older or stop-sampling", cfg.Buffering.Offline.Quota.Policy)
+	}
+	if q := &cfg.Buffering.Offline.Quota; q.MaxBytes > 0 && q.MaxBytes < 2*cfg.Buffering.Offline.SegmentSize {
+		log.Warn().Int64("max_bytes", q.MaxBytes).Msg("Offline quota is below two WAL segments, raising it")
+		q.MaxBytes = 2 * cfg.Buffering.Offline.SegmentSize
+	}
+	if cfg.Buffering.Offline.Quota.DiskPercent == 0 {
+		cfg.Buffering.Offline.Quota.DiskPercent = cfg.Health.Thresholds.DiskPercent
+	}
+
+	names := make(map[string]bool)
+	for i := range cfg.Sensors {
+		// Sensors are told apart by name when the configuration is reloaded
+		if names[cfg.Sensors[i].Name] {
+			return fmt.Errorf("sensor name %q is used twice", cfg.Sensors[i].Name)
+		}
+		names[cfg.Sensors[i].Name] = true
+		meta := &cfg.Sensors[i].Metadata
+		switch meta.OutOfRange {
+		case "":
+			meta.OutOfRange = "flag"
+		case "flag", "clamp", "drop":
+		default:
+			return fmt.Errorf("sensor %s: metadata.out_of_range %q must be flag, clamp or drop", cfg.Sensors[i].Name, meta.OutOfRange)
+		}
+		if meta.Alert != "" && !validAlertLevel(meta.Alert) {
+			return fmt.Errorf("sensor %s: metadata.alert %q must be warning, error or critical", cfg.Sensors[i].Name, meta.Alert)
+		}
+		if r := meta.Range; r.IsSet() && r.Min > r.Max {
+			return fmt.Errorf("sensor %s: metadata.range min %g is above max %g", cfg.Sensors[i].Name, r.Min, r.Max)
+		}
+		for name, ch := range meta.Channels {
+			if ch.Range.IsSet() && ch.Range.Min > ch.Range.Max {
+				return fmt.Errorf("sensor %s: metadata.channels.%s.range min %g is above max %g", cfg.Sensors[i].Name, name, ch.Range.Min, ch.Range.Max)
+			}
+		}
+	}
+	for _, a := range cfg.Health.Alerts {
+		switch a.Type {
+		case "log", "nats", "webhook":
+		default:
+			return fmt.Errorf("health.alerts: unknown type %q", a.Type)
+		}
+		if !validAlertLevel(a.Level) {
+			return fmt.Errorf("health.alerts: %s level %q must be warning, error or critical", a.Type, a.Level)
+		}
+	}
+
+	if _, err := zerolog.ParseLevel(cfg.Agent.LogLevel); err != nil {
+		return fmt.Errorf("agent.log_level %q: %w", cfg.Agent.LogLevel, err)
+	}
+
 	if cfg.Agent.SamplingRate < time.Millisecond {
 		log.Warn().Dur("sampling_rate", cfg.Agent.SamplingRate).Msg("Sampling rate too low, setting to 1ms")
 		cfg.Agent.SamplingRate = time.Millisecond
 	}
-
-	if cfg.Buffering.HotBuffer.Capacity < 1024 {
-		log.Warn().Uint64("capacity", cfg.Buffering.HotBuffer.Capacity).Msg("Hot buffer capacity too small, setting to 1KB")
-		cfg.Buffering.HotBuffer.Capacity = 1024
+	if cfg.Agent.DegradedSamplingRate < 0 {
+		return fmt.Errorf("agent.degraded_sampling_rate must not be negative")
 	}
-
-	// Check if capacity is a power of two
-	if (cfg.Buffering.HotBuffer.Capacity & (cfg.Buffering.HotBuffer.Capacity - 1)) != 0 {
-		log.Warn().Uint64("capacity", cfg.Buffering.HotBuffer.Capacity).Msg("Hot buffer capacity is not a power of two. This can lead to performance issues. Rounding up to the next power of two.")
-		// Round up to the next power of two
-		cfg.Buffering.HotBuffer.Capacity--
-		cfg.Buffering.HotBuffer.Capacity |= cfg.Buffering.HotBuffer.Capacity >> 1
-		cfg.Buffering.HotBuffer.Capacity |= cfg.Buffering.HotBuffer.Capacity >> 2
-		cfg.Buffering.HotBuffer.Capacity |= cfg.Buffering.HotBuffer.Capacity >> 4
-		cfg.Buffering.HotBuffer.Capacity |= cfg.Buffering.HotBuffer.Capacity >> 8
-		cfg.Buffering.HotBuffer.Capacity |= cfg.Buffering.HotBuffer.Capacity >> 16
-		cfg.Buffering.HotBuffer.Capacity |= cfg.Buffering.HotBuffer.Capacity >> 32
-		cfg.Buffering.HotBuffer.Capacity++
+	if cfg.Buffering.Offline.FsyncInterval < 0 {
+		return fmt.Errorf("buffering.offline.fsync_interval must not be negative")
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func validAlertLevel(level string) bool {
+	return level == contract.AlertWarning || level == contract.AlertError || level == contract.AlertCritical
+}
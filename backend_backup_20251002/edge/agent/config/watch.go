@@ -0,0 +1,164 @@
+// config/watch.go
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// reloadDelay lets an editor finish saving before the file is read again.
+const reloadDelay = 500 * time.Millisecond
+
+// Watcher keeps the running configuration up to date. It reloads the config
+// file whenever it changes and applies the settings pushed by the backend over
+// it. Every new configuration is passed to apply. A file that cannot be read,
+// a configuration that fails validation and one that apply refuses are all
+// rejected, and the last good configuration stays in effect.
+//
+// Only the sensors, agent.sampling_rate, agent.degraded_sampling_rate,
+// agent.log_level, buffering.offline.quota and health.thresholds are reloaded. The other
+// settings take effect at start-up and are kept from the running
+// configuration.
+type Watcher struct {
+	mu     sync.Mutex
+	file   string
+	good   *Config                // Configuration in effect
+	remote map[string]interface{} // Settings from the backend, applied over the file
+	apply  func(*Config) error
+	timer  *time.Timer
+}
+
+// NewWatcher returns a watcher for the configuration loaded by LoadConfig.
+func NewWatcher(current *Config, apply func(*Config) error) *Watcher {
+	return &Watcher{file: viper.ConfigFileUsed(), good: current, apply: apply}
+}
+
+// Start watches the config file for changes.
+func (w *Watcher) Start() {
+	if w.file == "" {
+		log.Info().Msg("No config file to watch")
+		return
+	}
+	viper.OnConfigChange(func(fsnotify.Event) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		w.timer = time.AfterFunc(reloadDelay, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if err := w.reload(w.remote); err != nil {
+				log.Error().Err(err).Str("config_file", w.file).Msg("Configuration rejected, keeping the last good one")
+				return
+			}
+			log.Info().Str("config_file", w.file).Msg("Configuration reloaded")
+		})
+	})
+	viper.WatchConfig()
+	log.Info().Str("config_file", w.file).Msg("Watching configuration file for changes")
+}
+
+// SetRemote applies settings from the backend over the config file; nil
+// settings go back to the file alone. If the result is rejected, the previous
+// settings stay in effect and the error is returned.
+func (w *Watcher) SetRemote(settings map[string]interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.reload(settings); err != nil {
+		return err
+	}
+	w.remote = settings
+	return nil
+}
+
+// reload builds the configuration from the file and remote settings and
+// applies it.
+func (w *Watcher) reload(remote map[string]interface{}) error {
+	next, err := w.load(remote)
+	if err != nil {
+		return err
+	}
+	if err := w.apply(next); err != nil {
+		return err
+	}
+	w.good = next
+	return nil
+}
+
+// load reads and validates the configuration. It uses its own viper
+// instance, since the global one is rewritten by the file watcher.
+func (w *Watcher) load(remote map[string]interface{}) (*Config, error) {
+	v := viper.New()
+	setDefaults(v)
+	setEnv(v)
+	v.SetConfigType("yaml")
+	if w.file != "" {
+		// Editors may truncate the file before writing it
+		if info, err := os.Stat(w.file); err != nil {
+			return nil, err
+		} else if info.Size() == 0 {
+			return nil, fmt.Errorf("config file is empty")
+		}
+		v.SetConfigFile(w.file)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, err
+		}
+	} else if err := v.ReadConfig(strings.NewReader("")); err != nil {
+		return nil, err
+	}
+	if remote != nil {
+		if err := v.MergeConfigMap(remote); err != nil {
+			return nil, err
+		}
+	}
+
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+	if err := validateConfig(&cfg); err != nil {
+		return nil, err
+	}
+	keepStartupSettings(w.good, &cfg)
+	return &cfg, nil
+}
+
+// keepStartupSettings copies the settings that cannot change at runtime from
+// the running configuration, warning about those that were edited.
+func keepStartupSettings(good, next *Config) {
+	quota := next.Buffering.Offline.Quota
+	next.Buffering.Offline.Quota = good.Buffering.Offline.Quota
+
+	settings := []struct {
+		name      string
+		cur, edit interface{}
+	}{
+		{"state_dir", &good.StateDir, &next.StateDir},
+		{"agent.machine_id", &good.Agent.MachineID, &next.Agent.MachineID},
+		{"agent.location", &good.Agent.Location, &next.Agent.Location},
+		{"agent.record", &good.Agent.Record, &next.Agent.Record},
+		{"buffering", &good.Buffering, &next.Buffering},
+		{"nats", &good.NATS, &next.NATS},
+		{"health.check_interval", &good.Health.CheckInterval, &next.Health.CheckInterval},
+		{"health.metrics_retention", &good.Health.MetricsRetention, &next.Health.MetricsRetention},
+		{"health.alerts", &good.Health.Alerts, &next.Health.Alerts},
+	}
+	for _, s := range settings {
+		cur, edit := reflect.ValueOf(s.cur).Elem(), reflect.ValueOf(s.edit).Elem()
+		if !reflect.DeepEqual(cur.Interface(), edit.Interface()) {
+			log.Warn().Str("setting", s.name).Msg("Setting changed but only takes effect after a restart")
+			edit.Set(cur)
+		}
+	}
+
+	next.Buffering.Offline.Quota = quota
+}
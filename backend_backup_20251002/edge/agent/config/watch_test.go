@@ -0,0 +1,177 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const baseConfig = `
+agent:
+  machine_id: "CNC-001"
+  sampling_rate: 100ms
+buffering:
+  batching:
+    size: 100
+  offline:
+    quota:
+      max_bytes: 104857600
+      policy: drop-oldest
+nats:
+  url: nats://backend:4222
+sensors:
+  - name: spindle
+    type: simulator
+    enabled: true
+`
+
+// watchTest is a watcher of a config file in a temporary directory, loaded
+// the way the agent loads it at start-up, that counts calls to apply.
+type watchTest struct {
+	t       *testing.T
+	w       *Watcher
+	file    string
+	applied int
+	refuse  error // Returned by apply
+}
+
+func startWatcher(t *testing.T) *watchTest {
+	t.Helper()
+	wt := &watchTest{t: t, file: filepath.Join(t.TempDir(), "edge-config.yaml")}
+	wt.write(baseConfig)
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.AddConfigPath(filepath.Dir(wt.file)) // Searched before the standard locations
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.w = NewWatcher(cfg, func(*Config) error {
+		wt.applied++
+		return wt.refuse
+	})
+	return wt
+}
+
+func (wt *watchTest) write(content string) {
+	wt.t.Helper()
+	if err := os.WriteFile(wt.file, []byte(content), 0o644); err != nil {
+		wt.t.Fatal(err)
+	}
+}
+
+// reload reloads the file as the file watcher does.
+func (wt *watchTest) reload() error {
+	wt.w.mu.Lock()
+	defer wt.w.mu.Unlock()
+	return wt.w.reload(wt.w.remote)
+}
+
+func TestWatcherKeepsGoodConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		refuse  error
+		applied int
+	}{
+		{name: "invalid yaml", content: "agent: [unclosed\n"},
+		{name: "empty", content: ""},
+		{name: "truncated", content: baseConfig[:strings.Index(baseConfig, "CNC-001")+3]},
+		{name: "duplicate sensor", content: baseConfig + "  - name: spindle\n    type: simulator\n"},
+		{name: "invalid setting", content: strings.Replace(baseConfig, "drop-oldest", "drop-newest", 1)},
+		{
+			name:    "refused",
+			content: strings.Replace(baseConfig, "100ms", "200ms", 1),
+			refuse:  errors.New("sensor failed to start"),
+			applied: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wt := startWatcher(t)
+			good := wt.w.good
+			wt.refuse = tt.refuse
+			wt.write(tt.content)
+			if err := wt.reload(); err == nil {
+				t.Fatal("configuration accepted")
+			}
+			if wt.applied != tt.applied {
+				t.Errorf("applied %d times, want %d", wt.applied, tt.applied)
+			}
+			if wt.w.good != good {
+				t.Error("configuration in effect replaced")
+			}
+
+			// The next good file is applied
+			wt.refuse = nil
+			wt.write(strings.Replace(baseConfig, "100ms", "250ms", 1))
+			if err := wt.reload(); err != nil {
+				t.Fatal(err)
+			}
+			if got := wt.w.good.Agent.SamplingRate; got != 250*time.Millisecond {
+				t.Errorf("sampling rate %s after a good reload, want 250ms", got)
+			}
+		})
+	}
+}
+
+func TestWatcherRejectsRemote(t *testing.T) {
+	wt := startWatcher(t)
+	if err := wt.w.SetRemote(map[string]interface{}{"agent": map[string]interface{}{"sampling_rate": "200ms"}}); err != nil {
+		t.Fatal(err)
+	}
+	good, remote := wt.w.good, wt.w.remote
+
+	bad := map[string]interface{}{"buffering": map[string]interface{}{"offline": map[string]interface{}{"quota": map[string]interface{}{"policy": "none"}}}}
+	if err := wt.w.SetRemote(bad); err == nil {
+		t.Fatal("remote settings accepted")
+	}
+	if wt.applied != 1 {
+		t.Errorf("applied %d times, want 1", wt.applied)
+	}
+	if wt.w.good != good || wt.w.remote["agent"] == nil || len(wt.w.remote) != len(remote) {
+		t.Error("rejected remote settings replaced the ones in effect")
+	}
+
+	// File reloads keep the accepted remote settings on top
+	wt.write(strings.Replace(baseConfig, "size: 100", "size: 100\n    timeout: 200ms", 1))
+	if err := wt.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := wt.w.good.Agent.SamplingRate; got != 200*time.Millisecond {
+		t.Errorf("sampling rate %s after a file reload, want the remote 200ms", got)
+	}
+}
+
+func TestKeepStartupSettings(t *testing.T) {
+	wt := startWatcher(t)
+	edited := strings.NewReplacer(
+		`"CNC-001"`, `"CNC-002"`,
+		"nats://backend:4222", "nats://other:4222",
+		"size: 100", "size: 500",
+		"104857600", "209715200",
+		"drop-oldest", "stop-sampling",
+		"100ms", "1s",
+	).Replace(baseConfig)
+	wt.write(edited)
+	if err := wt.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := wt.w.good
+	if cfg.Agent.MachineID != "CNC-001" || cfg.NATS.URL != "nats://backend:4222" || cfg.Buffering.Batching.Size != 100 {
+		t.Errorf("start-up settings changed at runtime: machine %s, nats %s, batch size %d",
+			cfg.Agent.MachineID, cfg.NATS.URL, cfg.Buffering.Batching.Size)
+	}
+	if q := cfg.Buffering.Offline.Quota; q.MaxBytes != 209715200 || q.Policy != "stop-sampling" {
+		t.Errorf("quota %+v not reloaded", q)
+	}
+	if cfg.Agent.SamplingRate != time.Second {
+		t.Errorf("sampling rate %s not reloaded", cfg.Agent.SamplingRate)
+	}
+}
@@ -5,16 +5,16 @@ go 1.23.0
 toolchain go1.24.4
 
 require (
+	cnc-monitor/contract v0.0.0
+	github.com/fsnotify/fsnotify v1.8.0
+	github.com/klauspost/compress v1.17.11
 	github.com/nats-io/nats.go v1.37.0
 	github.com/rs/zerolog v1.32.0
 	github.com/spf13/viper v1.20.1
-	golang.org/x/exp v0.0.0-20250711185948-6ae5c78190dc
 )
 
 require (
-	github.com/fsnotify/fsnotify v1.8.0 // indirect
 	github.com/go-viper/mapstructure/v2 v2.2.1 // indirect
-	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	github.com/nats-io/nkeys v0.4.8 // indirect
@@ -33,3 +33,5 @@ require (
 	golang.org/x/text v0.21.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace cnc-monitor/contract => ../../contract
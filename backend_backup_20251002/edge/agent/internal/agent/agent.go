@@ -2,12 +2,18 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
+	"cnc-monitor/contract"
+	"cnc-monitor/edge/config"
+	"cnc-monitor/edge/internal/alerts"
 	"cnc-monitor/edge/internal/buffering"
 	"cnc-monitor/edge/internal/sensors"
 	"cnc-monitor/edge/internal/state"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -18,12 +24,33 @@ type EdgeAgent struct {
 
 	// Core components
 	bufferManager *buffering.Manager
+	buffers       bufferStates // bufferManager as the state machine sees it
 	sensorManager *sensors.Manager
 	stateMachine  *state.Machine
 
 	// Runtime state
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+	networkFault   bool                            // Simulated network drop in effect; owned by the sampling loop
+	rateChanges    chan time.Duration              // New sampling intervals for the sampling loop
+	catalogDirty   chan struct{}                   // Signals that the channel catalog must be published again
+	restarts       chan struct{}                   // Restarts the sampling timeline
+	configReports  chan contract.AgentConfigReport // Latest outcome of a desired configuration
+	desiredVersion int64                           // Last desired configuration handled; owned by the config watch
+	failing        []string                        // Failing sensors; owned by the sampling loop
+
+	// Sampling rate, slower while degraded
+	rateMu       sync.Mutex
+	normalRate   time.Duration
+	degradedRate time.Duration
+	degraded     bool
+
+	// What the state machine follows
+	condMu     sync.Mutex
+	conds      conditions
+	cpuPercent float64                  // CPU usage that degrades the agent, 0 to ignore
+	stateDirty chan struct{}            // Signals that the conditions changed
+	states     chan contract.AgentState // Transitions waiting to be published
 }
 
 // Config contains the configuration for the EdgeAgent.
@@ -34,15 +61,50 @@ type Config struct {
 	BufferManager *buffering.Manager
 	SensorManager *sensors.Manager
 	StateMachine  *state.Machine
+	Status        StatusPublisher
+	Alerts        *alerts.Dispatcher
+	Outage        OutageSimulator    // Applies network drops injected by simulator scenarios
+	Recorder      *sensors.Recorder  // Tees every sample to a capture file; none if nil
+	Remote        RemoteControl      // Desired configuration and commands from the backend; none if nil
+	Settings      RemoteSettings     // Applies the desired configuration
+	Connection    ConnectionNotifier // Reports connection drops as they happen
+
+	DegradedSamplingRate time.Duration // Sampling interval while degraded; 0 keeps SamplingRate
+	CPUPercent           float64       // CPU usage that degrades the agent, 0 to ignore
+	CheckInterval        time.Duration // How often CPU usage is checked
 }
 
+// OutageSimulator cuts the agent off from the backend during a simulated network drop.
+type OutageSimulator interface {
+	SimulateOutage(down bool)
+}
+
+// StatusPublisher publishes documents to the machine's status subject.
+type StatusPublisher interface {
+	PublishStatus(ctx context.Context, statusType string, doc interface{}) error
+}
+
+// catalogRetryInterval is how often publishing the channel catalog is retried
+// while the backend is unreachable.
+const catalogRetryInterval = 30 * time.Second
+
 // NewEdgeAgent creates a new EdgeAgent instance.
 func NewEdgeAgent(config *Config) *EdgeAgent {
 	return &EdgeAgent{
 		config:        *config,
 		bufferManager: config.BufferManager,
+		buffers:       config.BufferManager,
 		sensorManager: config.SensorManager,
 		stateMachine:  config.StateMachine,
+		rateChanges:   make(chan time.Duration, 1),
+		catalogDirty:  make(chan struct{}, 1),
+		restarts:      make(chan struct{}, 1),
+		configReports: make(chan contract.AgentConfigReport, 1),
+		normalRate:    config.SamplingRate,
+		degradedRate:  config.DegradedSamplingRate,
+		cpuPercent:    config.CPUPercent,
+		stateDirty:    make(chan struct{}, 1),
+		states:        make(chan contract.AgentState, 16),
 	}
 }
 
@@ -55,9 +117,20 @@ func (ea *EdgeAgent) Run(ctx context.Context) error {
 		Dur("sampling_rate", ea.config.SamplingRate).
 		Msg("Starting edge agent")
 
+	// Connectivity, storage, CPU and sensor failures drive the agent's state.
+	if ea.stateMachine != nil {
+		ea.startStateMachine(ctx)
+	}
+
 	// Start the buffer manager's processing loop.
 	ea.bufferManager.Start()
 
+	// Readings leaving their configured range raise alerts.
+	if ea.config.Alerts != nil {
+		ea.config.Alerts.Start(ctx)
+		ea.sensorManager.OnOutOfRange(ea.raiseRangeAlert)
+	}
+
 	// Start the sensor manager.
 	if err := ea.sensorManager.Start(ctx); err != nil {
 		return err
@@ -67,6 +140,17 @@ func (ea *EdgeAgent) Run(ctx context.Context) error {
 	ea.wg.Add(1)
 	go ea.sensorSamplingLoop(ctx)
 
+	// Tell the backend which channels to expect.
+	if ea.config.Status != nil {
+		ea.wg.Add(1)
+		go ea.publishCatalog(ctx)
+	}
+
+	// Follow the configuration and commands sent by the backend.
+	if ea.config.Remote != nil {
+		ea.startRemote(ctx)
+	}
+
 	log.Info().Msg("Edge agent started successfully")
 	return nil
 }
@@ -84,6 +168,10 @@ func (ea *EdgeAgent) Shutdown(ctx context.Context) error {
 
 	log.Info().Msg("Shutting down edge agent")
 
+	if ea.stateMachine != nil {
+		ea.shutdownState(ctx)
+	}
+
 	// Shutdown the buffer manager and its processor (NATS client).
 	ea.bufferManager.Shutdown()
 
@@ -97,6 +185,108 @@ func (ea *EdgeAgent) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// publishCatalog publishes the channel catalog, retrying until it is stored,
+// and again whenever the sensors change.
+func (ea *EdgeAgent) publishCatalog(ctx context.Context) {
+	defer ea.wg.Done()
+
+	for {
+		catalog := ea.sensorManager.Catalog(ea.config.MachineID)
+		pubCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err := ea.config.Status.PublishStatus(pubCtx, contract.StatusChannelCatalog, catalog)
+		cancel()
+		var retry <-chan time.Time
+		if err == nil {
+			log.Info().Int("channels", len(catalog.Channels)).Msg("Channel catalog published")
+		} else {
+			log.Warn().Err(err).Dur("retry_in", catalogRetryInterval).Msg("Failed to publish channel catalog")
+			retry = time.After(catalogRetryInterval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-retry:
+		case <-ea.catalogDirty:
+		}
+	}
+}
+
+// Reload applies a reloaded configuration: the sensors, the sampling rate, the
+// log level and the offline quota. An error means the sensors were left as
+// they were.
+func (ea *EdgeAgent) Reload(ctx context.Context, cfg *config.Config) error {
+	changed, err := ea.sensorManager.Reconfigure(ctx, cfg.Sensors)
+	if err != nil {
+		return err
+	}
+	if changed {
+		select {
+		case ea.catalogDirty <- struct{}{}:
+		default:
+		}
+	}
+	ea.rateMu.Lock()
+	ea.degradedRate = cfg.Agent.DegradedSamplingRate
+	ea.rateMu.Unlock()
+	ea.SetSamplingRate(cfg.Agent.SamplingRate)
+	ea.condMu.Lock()
+	ea.cpuPercent = cfg.Health.Thresholds.CPUPercent
+	ea.condMu.Unlock()
+	if level, err := zerolog.ParseLevel(cfg.Agent.LogLevel); err == nil {
+		zerolog.SetGlobalLevel(level)
+	}
+	ea.bufferManager.SetQuota(cfg.Buffering.Offline.Quota)
+	return nil
+}
+
+// SetSamplingRate changes the sampling interval; while degraded, it applies
+// once the agent recovers. The sampling loop keeps its timeline and takes the
+// next sample one new interval after the last one.
+func (ea *EdgeAgent) SetSamplingRate(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ea.rateMu.Lock()
+	ea.normalRate = interval
+	ea.rateMu.Unlock()
+	ea.applySamplingRate()
+}
+
+// setDegraded switches between the normal and the degraded sampling rate.
+func (ea *EdgeAgent) setDegraded(degraded bool) {
+	ea.rateMu.Lock()
+	ea.degraded = degraded
+	ea.rateMu.Unlock()
+	ea.applySamplingRate()
+}
+
+func (ea *EdgeAgent) applySamplingRate() {
+	ea.rateMu.Lock()
+	interval := ea.normalRate
+	if ea.degraded && ea.degradedRate > interval {
+		interval = ea.degradedRate
+	}
+	ea.rateMu.Unlock()
+	// Only the latest interval matters
+	offerLatest(ea.rateChanges, interval)
+}
+
+// offerLatest queues v on ch, dropping the oldest queued value if ch is full.
+func offerLatest[T any](ch chan T, v T) {
+	for {
+		select {
+		case ch <- v:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
 // sensorSamplingLoop handles regular sensor sampling with computer-precision timing.
 func (ea *EdgeAgent) sensorSamplingLoop(ctx context.Context) {
 	defer ea.wg.Done()
@@ -116,6 +306,22 @@ func (ea *EdgeAgent) sensorSamplingLoop(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			return
+		case interval := <-ea.rateChanges:
+			if interval == samplingInterval {
+				continue
+			}
+			// Restart the timeline at the last sample
+			startTime = startTime.Add(time.Duration(missedSamples) * samplingInterval)
+			missedSamples = 0
+			log.Info().
+				Dur("from", samplingInterval).
+				Dur("to", interval).
+				Msg("Sampling interval changed")
+			samplingInterval = interval
+		case <-ea.restarts:
+			startTime = time.Now()
+			missedSamples = 0
+			log.Info().Time("start_time", startTime).Msg("Sampling timeline restarted")
 		default:
 			now := time.Now()
 			
@@ -169,6 +375,36 @@ func (ea *EdgeAgent) sensorSamplingLoop(ctx context.Context) {
 	}
 }
 
+// raiseRangeAlert turns a reading outside its configured range into an alert.
+func (ea *EdgeAgent) raiseRangeAlert(e sensors.OutOfRange) {
+	value := e.Value
+	ea.config.Alerts.Raise(contract.Alert{
+		Level:   e.Alert,
+		Source:  e.Sensor,
+		Channel: e.Channel,
+		Value:   &value,
+		Message: fmt.Sprintf("%s reading %g outside range [%g, %g], %s", e.Channel, e.Value, e.Min, e.Max, rangeActions[e.Action]),
+	})
+}
+
+// rangeActions describes what happened to an out-of-range reading.
+var rangeActions = map[string]string{
+	"flag":  "kept as uncertain",
+	"clamp": "clamped",
+	"drop":  "dropped",
+}
+
+// applyNetworkFault follows the network drops injected by simulator scenarios.
+func (ea *EdgeAgent) applyNetworkFault() {
+	if ea.config.Outage == nil {
+		return
+	}
+	if down := ea.sensorManager.NetworkFault(); down != ea.networkFault {
+		ea.networkFault = down
+		ea.config.Outage.SimulateOutage(down)
+	}
+}
+
 // sampleSensors reads data from all configured sensors and writes it to the buffer.
 func (ea *EdgeAgent) sampleSensors(ctx context.Context) {
 	ea.sampleSensorsAtTime(ctx, time.Now(), false)
@@ -176,26 +412,45 @@ func (ea *EdgeAgent) sampleSensors(ctx context.Context) {
 
 // sampleSensorsAtTime reads sensors with a specific timestamp for computer precision.
 func (ea *EdgeAgent) sampleSensorsAtTime(ctx context.Context, timestamp time.Time, isMissed bool) {
-	// Read data from the actual sensor manager
-	data, err := ea.sensorManager.ReadAll(ctx)
+	// Under the stop-sampling quota policy there is nowhere to put new readings
+	if ea.bufferManager.SamplingPaused() {
+		return
+	}
+
+	// Read one merged machine sample from the sensor manager
+	sensorData, err := ea.sensorManager.ReadAll(ctx)
+	ea.applyNetworkFault()
+	ea.checkSensors(ea.sensorManager.FailingSensors())
+	if errors.Is(err, sensors.ErrNoReadings) {
+		// Failing sensors are logged by the manager
+		log.Debug().Msg("No sensor readings this tick")
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Error reading sensor data")
 		return
 	}
 
-	// Write all sensor readings to buffer with precise timestamp
-	for _, sensorData := range data {
-		// Override the timestamp with our computer-precision time
+	// Override the timestamp with our computer-precision time unless a replay
+	// keeps the recorded one; readings always belong to this agent's machine
+	if !ea.sensorManager.KeepsTimestamps() {
 		sensorData.Timestamp = timestamp
-		
-		if isMissed {
-			log.Debug().
-				Time("missed_time", timestamp).
-				Msg("Computer precision: generating missed sample")
-		}
-		
-		if err := ea.bufferManager.Write(sensorData); err != nil {
-			log.Error().Err(err).Msg("Error writing sensor data to buffer")
+	}
+	sensorData.MachineID = ea.config.MachineID
+
+	if ea.config.Recorder != nil {
+		if err := ea.config.Recorder.Write(sensorData); err != nil {
+			log.Error().Err(err).Msg("Error recording sample")
 		}
 	}
+
+	if isMissed {
+		log.Debug().
+			Time("missed_time", timestamp).
+			Msg("Computer precision: generating missed sample")
+	}
+
+	if err := ea.bufferManager.Write(sensorData); err != nil {
+		log.Error().Err(err).Msg("Error writing sensor data to buffer")
+	}
 }
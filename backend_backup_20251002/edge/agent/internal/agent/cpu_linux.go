@@ -0,0 +1,53 @@
+//go:build linux
+
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cpuSampler measures CPU usage from /proc/stat between two calls.
+type cpuSampler struct {
+	idle, total uint64
+}
+
+// usage returns the CPU usage in percent since the previous call; the first
+// call measures since boot.
+func (c *cpuSampler) usage() (float64, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, errors.New("/proc/stat is empty")
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, errors.New("unexpected /proc/stat format")
+	}
+	var idle, total uint64
+	for i, field := range fields[1:] {
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		total += v
+		if i == 3 || i == 4 { // idle and iowait
+			idle += v
+		}
+	}
+
+	dIdle, dTotal := idle-c.idle, total-c.total
+	c.idle, c.total = idle, total
+	if dTotal == 0 {
+		return 0, nil
+	}
+	return float64(dTotal-dIdle) / float64(dTotal) * 100, nil
+}
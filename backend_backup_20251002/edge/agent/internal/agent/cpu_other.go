@@ -0,0 +1,12 @@
+//go:build !linux
+
+package agent
+
+import "errors"
+
+// cpuSampler is not supported on this platform; CPU pressure is not detected.
+type cpuSampler struct{}
+
+func (c *cpuSampler) usage() (float64, error) {
+	return 0, errors.New("CPU usage not supported on this platform")
+}
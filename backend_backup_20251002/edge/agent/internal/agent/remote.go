@@ -0,0 +1,148 @@
+// internal/agent/remote.go
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cnc-monitor/contract"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// RemoteControl delivers the desired configuration and the commands the
+// backend sends to this machine.
+type RemoteControl interface {
+	WatchDesiredConfig(ctx context.Context, fn func(*contract.DesiredConfig))
+	HandleCommands(fn func(contract.Command) contract.CommandResult) error
+}
+
+// RemoteSettings applies settings pushed by the backend over the config file;
+// nil goes back to the file alone.
+type RemoteSettings interface {
+	SetRemote(settings map[string]interface{}) error
+}
+
+// startRemote begins following the backend's desired configuration and
+// answering its commands.
+func (ea *EdgeAgent) startRemote(ctx context.Context) {
+	remote := ea.config.Remote
+	if err := remote.HandleCommands(func(cmd contract.Command) contract.CommandResult {
+		return ea.handleCommand(ctx, cmd)
+	}); err != nil {
+		log.Error().Err(err).Msg("Failed to listen for commands")
+	}
+
+	if ea.config.Settings == nil {
+		return
+	}
+	if ea.config.Status != nil {
+		ea.wg.Add(1)
+		go ea.publishConfigReports(ctx)
+	}
+	remote.WatchDesiredConfig(ctx, ea.applyDesiredConfig)
+}
+
+// applyDesiredConfig applies a desired configuration from the backend, or
+// drops the remote settings when doc is nil, and reports the outcome.
+func (ea *EdgeAgent) applyDesiredConfig(doc *contract.DesiredConfig) {
+	report := contract.AgentConfigReport{MachineID: ea.config.MachineID}
+	var settings map[string]interface{}
+	if doc != nil {
+		if doc.Version == ea.desiredVersion {
+			return // Already handled, e.g. when the watch is restarted
+		}
+		report.Version = doc.Version
+		settings = doc.Settings
+	} else if ea.desiredVersion == 0 {
+		return
+	}
+	ea.desiredVersion = report.Version
+
+	var err error
+	if doc != nil && doc.MachineID != "" && doc.MachineID != ea.config.MachineID {
+		err = fmt.Errorf("desired configuration is for machine %s", doc.MachineID)
+	} else {
+		err = ea.config.Settings.SetRemote(settings)
+	}
+	report.Applied = err == nil
+	report.Time = time.Now().UTC()
+	if err != nil {
+		report.Error = err.Error()
+		log.Error().Err(err).Int64("version", report.Version).Msg("Desired configuration rejected")
+	} else {
+		log.Info().Int64("version", report.Version).Msg("Desired configuration applied")
+	}
+
+	if ea.config.Status == nil {
+		return
+	}
+	// Only the latest report matters
+	offerLatest(ea.configReports, report)
+}
+
+// publishConfigReports tells the backend which desired configuration is in
+// effect, retrying until the latest report is stored.
+func (ea *EdgeAgent) publishConfigReports(ctx context.Context) {
+	defer ea.wg.Done()
+
+	for {
+		var report contract.AgentConfigReport
+		select {
+		case <-ctx.Done():
+			return
+		case report = <-ea.configReports:
+		}
+
+		for {
+			pubCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err := ea.config.Status.PublishStatus(pubCtx, contract.StatusAgentConfig, report)
+			cancel()
+			if err == nil {
+				break
+			}
+			log.Warn().Err(err).Int64("version", report.Version).Dur("retry_in", catalogRetryInterval).Msg("Failed to report applied configuration")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(catalogRetryInterval):
+			case report = <-ea.configReports:
+			}
+		}
+	}
+}
+
+// handleCommand carries out a command from the backend.
+func (ea *EdgeAgent) handleCommand(ctx context.Context, cmd contract.Command) contract.CommandResult {
+	if err := cmd.Validate(); err != nil {
+		return contract.CommandResult{Message: err.Error()}
+	}
+	log.Info().Str("command", cmd.Name).Str("id", cmd.ID).Msg("Command received")
+
+	result := contract.CommandResult{OK: true}
+	switch cmd.Name {
+	case contract.CommandRestartSampling:
+		ea.sensorManager.Restart(ctx)
+		select {
+		case ea.restarts <- struct{}{}:
+		default:
+		}
+		result.Message = "Sensors and sampling restarted"
+	case contract.CommandFlushBuffers:
+		if ea.bufferManager.Flush() {
+			result.Message = "Flushing buffers"
+		} else {
+			result.Message = "Backend unreachable, buffers are flushed on reconnect"
+		}
+	case contract.CommandSetSamplingRate:
+		interval, _ := time.ParseDuration(cmd.SamplingRate)
+		ea.SetSamplingRate(interval)
+		result.Message = fmt.Sprintf("Sampling every %s until the configuration changes", interval)
+	case contract.CommandSetLogLevel:
+		level, _ := zerolog.ParseLevel(cmd.LogLevel)
+		zerolog.SetGlobalLevel(level)
+		result.Message = fmt.Sprintf("Log level set to %s until the configuration changes", level)
+	}
+	return result
+}
@@ -0,0 +1,301 @@
+// internal/agent/states.go
+package agent
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/edge/internal/state"
+	"github.com/rs/zerolog/log"
+)
+
+// ConnectionNotifier reports when the connection to the backend drops or
+// comes back.
+type ConnectionNotifier interface {
+	OnConnectionChange(fn func(connected bool))
+}
+
+// bufferStates is the part of the buffer manager the state machine follows
+// and drives.
+type bufferStates interface {
+	OnOnlineChange(fn func(online bool))
+	OnQuotaChange(fn func(exceeded bool))
+	CheckConnectivity()
+	IsOnline() bool
+	Flush() bool
+}
+
+// cpuHysteresisPct is how many points below the threshold CPU usage must fall
+// to clear CPU pressure, so that sampling slower does not flip it back.
+const cpuHysteresisPct = 10
+
+// stateRetryInterval is how often publishing a state transition is retried.
+const stateRetryInterval = 5 * time.Second
+
+// defaultCheckInterval is how often CPU usage is checked if no interval is set.
+const defaultCheckInterval = 30 * time.Second
+
+// conditions are what the agent's state follows.
+type conditions struct {
+	online  bool     // Readings are published in real time
+	storage bool     // Unsent data over its quota or the disk nearly full
+	cpu     bool     // CPU usage over its threshold
+	failing []string // Sensors that keep failing to read
+}
+
+// target is the state the conditions call for.
+func (c conditions) target() state.State {
+	switch {
+	case c.storage || c.cpu || len(c.failing) > 0:
+		return state.StateDegraded
+	case c.online:
+		return state.StateOnline
+	default:
+		return state.StateBuffering
+	}
+}
+
+// names lists the conditions in effect.
+func (c conditions) names() []string {
+	var names []string
+	if !c.online {
+		names = append(names, contract.ConditionOffline)
+	}
+	if c.storage {
+		names = append(names, contract.ConditionStorage)
+	}
+	if c.cpu {
+		names = append(names, contract.ConditionCPU)
+	}
+	if len(c.failing) > 0 {
+		names = append(names, contract.ConditionSensors)
+	}
+	return names
+}
+
+// startStateMachine makes the state machine follow connectivity, storage,
+// CPU and sensor failures. Degraded samples at the degraded sampling rate and
+// Recovering flushes the buffers. Every transition is published.
+func (ea *EdgeAgent) startStateMachine(ctx context.Context) {
+	sm := ea.stateMachine
+	sm.SetStateHandler(state.StateDegraded, func(ctx context.Context) error {
+		log.Warn().Msg("Resource constraints - degraded operation")
+		ea.setDegraded(true)
+		return nil
+	})
+	sm.SetStateHandler(state.StateRecovering, func(ctx context.Context) error {
+		log.Info().Msg("Recovering to normal operation")
+		ea.setDegraded(false)
+		ea.buffers.Flush()
+		return nil
+	})
+
+	ea.buffers.OnOnlineChange(func(online bool) {
+		ea.updateConditions(func(c *conditions) { c.online = online })
+	})
+	ea.buffers.OnQuotaChange(func(exceeded bool) {
+		ea.updateConditions(func(c *conditions) { c.storage = exceeded })
+	})
+	// The buffer checks connectivity periodically; a disconnect is noticed at once
+	if ea.config.Connection != nil {
+		ea.config.Connection.OnConnectionChange(func(bool) {
+			ea.buffers.CheckConnectivity()
+		})
+	}
+
+	if err := sm.Start(ctx); err != nil {
+		log.Error().Err(err).Msg("Failed to start state machine")
+	}
+	if err := sm.TransitionTo(ctx, state.StateConnecting); err != nil {
+		log.Warn().Err(err).Msg("Could not enter connecting state")
+	}
+	ea.queueState(state.StateBootstrap, state.StateConnecting, ea.currentConditions())
+
+	if ea.config.Status != nil {
+		ea.wg.Add(1)
+		go ea.publishStates(ctx)
+	}
+	ea.wg.Add(1)
+	go ea.stateLoop(ctx)
+}
+
+// updateConditions changes the conditions and has the state loop act on them.
+func (ea *EdgeAgent) updateConditions(fn func(c *conditions)) {
+	ea.condMu.Lock()
+	fn(&ea.conds)
+	ea.condMu.Unlock()
+	select {
+	case ea.stateDirty <- struct{}{}:
+	default:
+	}
+}
+
+func (ea *EdgeAgent) currentConditions() conditions {
+	ea.condMu.Lock()
+	defer ea.condMu.Unlock()
+	c := ea.conds
+	c.failing = slices.Clone(c.failing)
+	return c
+}
+
+// stateLoop moves the state machine whenever the conditions change, and
+// checks CPU usage every check interval.
+func (ea *EdgeAgent) stateLoop(ctx context.Context) {
+	defer ea.wg.Done()
+
+	interval := ea.config.CheckInterval
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var cpu cpuSampler
+	if _, err := cpu.usage(); err != nil {
+		log.Warn().Err(err).Msg("CPU pressure is not monitored")
+	}
+	ea.updateConditions(func(c *conditions) { c.online = ea.buffers.IsOnline() })
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if usage, err := cpu.usage(); err == nil {
+				ea.checkCPU(usage)
+			}
+		case <-ea.stateDirty:
+			ea.driveState(ctx)
+		}
+	}
+}
+
+// checkCPU sets the cpu condition from the usage in percent since the last
+// check.
+func (ea *EdgeAgent) checkCPU(usage float64) {
+	ea.condMu.Lock()
+	threshold, high := ea.cpuPercent, ea.conds.cpu
+	ea.condMu.Unlock()
+
+	next := threshold > 0 && usage >= threshold
+	if high && threshold > 0 {
+		next = usage >= threshold-cpuHysteresisPct
+	}
+	if next == high {
+		return
+	}
+	if next {
+		log.Warn().Float64("cpu_percent", usage).Float64("threshold", threshold).Msg("CPU pressure")
+	} else {
+		log.Info().Float64("cpu_percent", usage).Msg("CPU pressure over")
+	}
+	ea.updateConditions(func(c *conditions) { c.cpu = next })
+}
+
+// checkSensors sets the sensors condition from the sensors failing after a
+// read. It is called from the sampling loop, which owns ea.failing.
+func (ea *EdgeAgent) checkSensors(failing []string) {
+	if slices.Equal(failing, ea.failing) {
+		return
+	}
+	if len(failing) > 0 {
+		log.Warn().Strs("sensors", failing).Msg("Sensors keep failing to read")
+	} else {
+		log.Info().Msg("All sensors reading again")
+	}
+	ea.failing = failing
+	ea.updateConditions(func(c *conditions) { c.failing = failing })
+}
+
+// driveState moves the state machine to the state the conditions call for.
+// Leaving Degraded, and going back online from Buffering, pass through
+// Recovering.
+func (ea *EdgeAgent) driveState(ctx context.Context) {
+	c := ea.currentConditions()
+	want := c.target()
+	for {
+		cur := ea.stateMachine.GetCurrentState()
+		if cur == want || cur == state.StateShutdown {
+			return
+		}
+		next := want
+		if want != state.StateDegraded && (cur == state.StateDegraded || (cur == state.StateBuffering && want == state.StateOnline)) {
+			next = state.StateRecovering
+		}
+		if err := ea.stateMachine.TransitionTo(ctx, next); err != nil {
+			log.Warn().Err(err).Msg("State transition failed")
+			return
+		}
+		ea.queueState(cur, next, c)
+	}
+}
+
+// queueState queues a transition for publishing.
+func (ea *EdgeAgent) queueState(from, to state.State, c conditions) {
+	if ea.config.Status == nil {
+		return
+	}
+	offerLatest(ea.states, ea.stateReport(from, to, c))
+}
+
+func (ea *EdgeAgent) stateReport(from, to state.State, c conditions) contract.AgentState {
+	return contract.AgentState{
+		MachineID:  ea.config.MachineID,
+		State:      to.String(),
+		Previous:   from.String(),
+		Conditions: c.names(),
+		Failing:    c.failing,
+		Time:       time.Now().UTC(),
+	}
+}
+
+// publishStates publishes the transitions in order, retrying each until it is
+// stored. If too many pile up while the backend is unreachable, the oldest
+// are dropped.
+func (ea *EdgeAgent) publishStates(ctx context.Context) {
+	defer ea.wg.Done()
+
+	for {
+		var doc contract.AgentState
+		select {
+		case <-ctx.Done():
+			return
+		case doc = <-ea.states:
+		}
+
+		for {
+			pubCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err := ea.config.Status.PublishStatus(pubCtx, contract.StatusAgentState, doc)
+			cancel()
+			if err == nil {
+				break
+			}
+			log.Debug().Err(err).Str("state", doc.State).Msg("Failed to publish state transition")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(stateRetryInterval):
+			}
+		}
+	}
+}
+
+// shutdownState enters the shutdown state and tells the backend.
+func (ea *EdgeAgent) shutdownState(ctx context.Context) {
+	from := ea.stateMachine.GetCurrentState()
+	if err := ea.stateMachine.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("Could not enter shutdown state")
+		return
+	}
+	if ea.config.Status == nil {
+		return
+	}
+	pubCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	doc := ea.stateReport(from, state.StateShutdown, ea.currentConditions())
+	if err := ea.config.Status.PublishStatus(pubCtx, contract.StatusAgentState, doc); err != nil {
+		log.Warn().Err(err).Msg("Failed to publish shutdown state")
+	}
+}
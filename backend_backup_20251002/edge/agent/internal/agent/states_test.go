@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/edge/internal/state"
+)
+
+const (
+	testNormalRate   = 100 * time.Millisecond
+	testDegradedRate = time.Second
+)
+
+// fakeBuffers stands in for the buffer manager: the test flips connectivity
+// and the storage quota, and counts flushes and connectivity checks.
+type fakeBuffers struct {
+	mu       sync.Mutex
+	online   bool
+	onOnline func(bool)
+	onQuota  func(bool)
+	flushes  int
+	checks   int
+}
+
+func (b *fakeBuffers) OnOnlineChange(fn func(online bool))  { b.onOnline = fn }
+func (b *fakeBuffers) OnQuotaChange(fn func(exceeded bool)) { b.onQuota = fn }
+
+func (b *fakeBuffers) CheckConnectivity() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.checks++
+}
+
+func (b *fakeBuffers) IsOnline() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.online
+}
+
+func (b *fakeBuffers) Flush() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushes++
+	return true
+}
+
+func (b *fakeBuffers) setOnline(online bool) {
+	b.mu.Lock()
+	b.online = online
+	b.mu.Unlock()
+	b.onOnline(online)
+}
+
+func (b *fakeBuffers) counts() (flushes, checks int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushes, b.checks
+}
+
+// fakeStatus records the published agent states.
+type fakeStatus struct {
+	states chan contract.AgentState
+}
+
+func (s *fakeStatus) PublishStatus(ctx context.Context, statusType string, doc interface{}) error {
+	if statusType == contract.StatusAgentState {
+		s.states <- doc.(contract.AgentState)
+	}
+	return nil
+}
+
+// fakeConnection reports connection changes the test triggers.
+type fakeConnection struct {
+	fn func(connected bool)
+}
+
+func (c *fakeConnection) OnConnectionChange(fn func(connected bool)) { c.fn = fn }
+
+type stateTest struct {
+	t       *testing.T
+	ea      *EdgeAgent
+	buffers *fakeBuffers
+	status  *fakeStatus
+	conn    *fakeConnection
+}
+
+// startStates runs the agent's state machine against fakes until the test
+// ends, and consumes the transitions of the startup.
+func startStates(t *testing.T, online bool) *stateTest {
+	t.Helper()
+	st := &stateTest{
+		t:       t,
+		buffers: &fakeBuffers{online: online},
+		status:  &fakeStatus{states: make(chan contract.AgentState, 64)},
+		conn:    &fakeConnection{},
+	}
+	st.ea = NewEdgeAgent(&Config{
+		MachineID:            "CNC-001",
+		SamplingRate:         testNormalRate,
+		DegradedSamplingRate: testDegradedRate,
+		StateMachine:         state.NewMachine(),
+		Status:               st.status,
+		Connection:           st.conn,
+		CPUPercent:           80,
+		CheckInterval:        time.Hour, // CPU usage is fed by the tests
+	})
+	st.ea.buffers = st.buffers
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		st.ea.wg.Wait()
+	})
+	st.ea.startStateMachine(ctx)
+
+	st.expect("bootstrap>connecting")
+	if online {
+		st.expect("connecting>online")
+	} else {
+		st.expect("connecting>buffering")
+	}
+	return st
+}
+
+// expect waits for the published transitions, given as "from>to".
+func (st *stateTest) expect(transitions ...string) []contract.AgentState {
+	st.t.Helper()
+	var docs []contract.AgentState
+	for _, want := range transitions {
+		select {
+		case doc := <-st.status.states:
+			if got := doc.Previous + ">" + doc.State; got != want {
+				st.t.Fatalf("published %s, want %s", got, want)
+			}
+			if doc.MachineID != "CNC-001" {
+				st.t.Errorf("machine_id %q", doc.MachineID)
+			}
+			docs = append(docs, doc)
+		case <-time.After(5 * time.Second):
+			st.t.Fatalf("no transition published, want %s", want)
+		}
+	}
+	return docs
+}
+
+// expectRate checks the sampling interval last handed to the sampling loop.
+func (st *stateTest) expectRate(want time.Duration) {
+	st.t.Helper()
+	select {
+	case got := <-st.ea.rateChanges:
+		if got != want {
+			st.t.Errorf("sampling interval %s, want %s", got, want)
+		}
+	default:
+		st.t.Errorf("sampling interval not changed, want %s", want)
+	}
+}
+
+func TestStateOnlineBufferingRecovering(t *testing.T) {
+	st := startStates(t, true)
+
+	// A dropped connection makes the buffer check connectivity at once
+	st.conn.fn(false)
+	if _, checks := st.buffers.counts(); checks != 1 {
+		t.Errorf("%d connectivity checks after a disconnect, want 1", checks)
+	}
+
+	st.buffers.setOnline(false)
+	docs := st.expect("online>buffering")
+	if !slices.Equal(docs[0].Conditions, []string{contract.ConditionOffline}) {
+		t.Errorf("buffering conditions %v", docs[0].Conditions)
+	}
+
+	// Going back online passes through recovering, which flushes the buffers
+	st.buffers.setOnline(true)
+	docs = st.expect("buffering>recovering", "recovering>online")
+	if len(docs[1].Conditions) != 0 {
+		t.Errorf("online conditions %v", docs[1].Conditions)
+	}
+	if flushes, _ := st.buffers.counts(); flushes != 1 {
+		t.Errorf("%d flushes while recovering, want 1", flushes)
+	}
+	st.expectRate(testNormalRate)
+}
+
+func TestStateDegraded(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+		enter     func(st *stateTest)
+		exit      func(st *stateTest)
+		failing   []string
+	}{
+		{
+			name:      "storage",
+			condition: contract.ConditionStorage,
+			enter:     func(st *stateTest) { st.buffers.onQuota(true) },
+			exit:      func(st *stateTest) { st.buffers.onQuota(false) },
+		},
+		{
+			name:      "cpu",
+			condition: contract.ConditionCPU,
+			enter:     func(st *stateTest) { st.ea.checkCPU(95) },
+			exit:      func(st *stateTest) { st.ea.checkCPU(20) },
+		},
+		{
+			name:      "sensors",
+			condition: contract.ConditionSensors,
+			enter:     func(st *stateTest) { st.ea.checkSensors([]string{"spindle"}) },
+			exit:      func(st *stateTest) { st.ea.checkSensors(nil) },
+			failing:   []string{"spindle"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := startStates(t, true)
+
+			tt.enter(st)
+			docs := st.expect("online>degraded")
+			if !slices.Equal(docs[0].Conditions, []string{tt.condition}) || !slices.Equal(docs[0].Failing, tt.failing) {
+				t.Errorf("degraded conditions %v, failing %v", docs[0].Conditions, docs[0].Failing)
+			}
+			st.expectRate(testDegradedRate)
+
+			tt.exit(st)
+			st.expect("degraded>recovering", "recovering>online")
+			st.expectRate(testNormalRate)
+			if flushes, _ := st.buffers.counts(); flushes != 1 {
+				t.Errorf("%d flushes while recovering, want 1", flushes)
+			}
+		})
+	}
+}
+
+func TestStateDegradedWhileOffline(t *testing.T) {
+	st := startStates(t, false)
+
+	// Degraded wins over buffering; once it clears the agent is back to
+	// buffering, through recovering
+	st.buffers.onQuota(true)
+	docs := st.expect("buffering>degraded")
+	if !slices.Equal(docs[0].Conditions, []string{contract.ConditionOffline, contract.ConditionStorage}) {
+		t.Errorf("degraded conditions %v", docs[0].Conditions)
+	}
+	st.buffers.onQuota(false)
+	st.expect("degraded>recovering", "recovering>buffering")
+}
+
+func TestCPUHysteresis(t *testing.T) {
+	st := startStates(t, true)
+
+	for _, step := range []struct {
+		usage float64
+		cpu   bool
+	}{
+		{79, false},
+		{80, true},
+		{75, true}, // Within the hysteresis below the threshold
+		{70, true},
+		{69.9, false},
+		{75, false},
+		{90, true},
+	} {
+		st.ea.checkCPU(step.usage)
+		if got := st.ea.currentConditions().cpu; got != step.cpu {
+			t.Fatalf("cpu pressure %v at %g%%, want %v", got, step.usage, step.cpu)
+		}
+	}
+
+	// A threshold of 0 turns CPU pressure off
+	st.ea.condMu.Lock()
+	st.ea.cpuPercent = 0
+	st.ea.condMu.Unlock()
+	st.ea.checkCPU(100)
+	if st.ea.currentConditions().cpu {
+		t.Error("cpu pressure with the threshold off")
+	}
+}
+
+func TestStateShutdown(t *testing.T) {
+	st := startStates(t, true)
+
+	st.ea.shutdownState(context.Background())
+	st.expect("online>shutdown")
+
+	// Shutdown is final, whatever the conditions do afterwards
+	st.buffers.setOnline(false)
+	st.ea.checkCPU(95)
+	select {
+	case doc := <-st.status.states:
+		t.Errorf("published %s>%s after shutdown", doc.Previous, doc.State)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if cur := st.ea.stateMachine.GetCurrentState(); cur != state.StateShutdown {
+		t.Errorf("state %s after shutdown", cur)
+	}
+}
@@ -0,0 +1,212 @@
+// internal/alerts/alerts.go
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/edge/config"
+	"github.com/rs/zerolog/log"
+)
+
+// queueSize bounds the alerts waiting for delivery. Raise never blocks; when
+// the queue is full the alert is only logged.
+const queueSize = 64
+
+// sendTimeout bounds the delivery of one alert to one sink, retries included.
+const sendTimeout = 30 * time.Second
+
+// StatusPublisher publishes documents to the machine's status subject.
+type StatusPublisher interface {
+	PublishStatus(ctx context.Context, statusType string, doc interface{}) error
+}
+
+// Dispatcher delivers alerts to the sinks configured in health.alerts. Each
+// sink receives the alerts at or above its level.
+type Dispatcher struct {
+	machineID string
+	sinks     []sink
+	queue     chan contract.Alert
+	startOnce sync.Once
+}
+
+type sink struct {
+	kind  string
+	level int
+	send  func(ctx context.Context, a contract.Alert) error
+}
+
+// NewDispatcher creates a dispatcher for the configured alert sinks. status
+// carries "nats" alerts to the backend and may be nil if there are none.
+func NewDispatcher(machineID string, cfgs []config.AlertConfig, status StatusPublisher) (*Dispatcher, error) {
+	d := &Dispatcher{machineID: machineID, queue: make(chan contract.Alert, queueSize)}
+	for _, cfg := range cfgs {
+		s := sink{kind: cfg.Type, level: severity(cfg.Level)}
+		switch cfg.Type {
+		case "log":
+			s.send = logAlert
+		case "nats":
+			if status == nil {
+				return nil, fmt.Errorf("nats alerts need a NATS connection")
+			}
+			s.send = func(ctx context.Context, a contract.Alert) error {
+				return status.PublishStatus(ctx, contract.StatusAlert, a)
+			}
+		case "webhook":
+			send, err := newWebhook(cfg.Config)
+			if err != nil {
+				return nil, err
+			}
+			s.send = send
+		default:
+			return nil, fmt.Errorf("unknown alert type: %s", cfg.Type)
+		}
+		d.sinks = append(d.sinks, s)
+	}
+	return d, nil
+}
+
+// Start delivers queued alerts until ctx is cancelled.
+func (d *Dispatcher) Start(ctx context.Context) {
+	d.startOnce.Do(func() {
+		go d.run(ctx)
+	})
+}
+
+// Raise queues an alert of the agent's machine for delivery. The time is
+// filled in if missing.
+func (d *Dispatcher) Raise(a contract.Alert) {
+	a.MachineID = d.machineID
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+	select {
+	case d.queue <- a:
+	default:
+		log.Warn().Str("source", a.Source).Str("alert", a.Message).Msg("Alert queue full, alert not delivered")
+	}
+}
+
+func (d *Dispatcher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case a := <-d.queue:
+			level := severity(a.Level)
+			for _, s := range d.sinks {
+				if level < s.level {
+					continue
+				}
+				sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+				err := s.send(sendCtx, a)
+				cancel()
+				if err != nil {
+					log.Warn().Err(err).Str("sink", s.kind).Str("alert", a.Message).Msg("Failed to deliver alert")
+				}
+			}
+		}
+	}
+}
+
+// severity orders alert levels; unknown levels rank lowest.
+func severity(level string) int {
+	switch level {
+	case contract.AlertCritical:
+		return 3
+	case contract.AlertError:
+		return 2
+	case contract.AlertWarning:
+		return 1
+	}
+	return 0
+}
+
+func logAlert(_ context.Context, a contract.Alert) error {
+	event := log.Warn()
+	if severity(a.Level) >= severity(contract.AlertError) {
+		event = log.Error()
+	}
+	event = event.Str("level", a.Level).Str("source", a.Source)
+	if a.Channel != "" {
+		event = event.Str("channel", a.Channel)
+	}
+	if a.Value != nil {
+		event = event.Float64("value", *a.Value)
+	}
+	event.Msg("Alert: " + a.Message)
+	return nil
+}
+
+// newWebhook posts alerts as JSON to config["url"], retrying config["retry_count"]
+// times. config["timeout"] bounds each attempt.
+func newWebhook(cfg map[string]interface{}) (func(ctx context.Context, a contract.Alert) error, error) {
+	url, _ := cfg["url"].(string)
+	if url == "" {
+		return nil, fmt.Errorf("webhook alert: url is required")
+	}
+	timeout := 5 * time.Second
+	if v, ok := cfg["timeout"].(string); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("webhook alert: invalid timeout %q", v)
+		}
+		timeout = d
+	}
+	retries := 0
+	switch v := cfg["retry_count"].(type) {
+	case int:
+		retries = v
+	case float64:
+		retries = int(v)
+	case string:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("webhook alert: invalid retry_count %q", v)
+		}
+		retries = n
+	}
+	client := &http.Client{Timeout: timeout}
+
+	return func(ctx context.Context, a contract.Alert) error {
+		body, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		for attempt := 0; ; attempt++ {
+			err = postAlert(ctx, client, url, body)
+			if err == nil || attempt >= retries || ctx.Err() != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(time.Duration(attempt+1) * time.Second):
+			}
+		}
+	}, nil
+}
+
+func postAlert(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package buffering
+
+import "errors"
+
+// diskUsedPercent is not supported on this platform; only the byte quota applies.
+func diskUsedPercent(path string) (float64, error) {
+	return 0, errors.New("disk usage not supported on this platform")
+}
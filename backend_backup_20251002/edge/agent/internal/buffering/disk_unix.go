@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+package buffering
+
+import "syscall"
+
+// diskUsedPercent returns how full the filesystem holding path is.
+func diskUsedPercent(path string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	total := uint64(st.Blocks) * uint64(st.Bsize)
+	if total == 0 {
+		return 0, nil
+	}
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	return float64(total-free) / float64(total) * 100, nil
+}
@@ -2,34 +2,22 @@ package buffering
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"cnc-monitor/contract"
 	"cnc-monitor/edge/config"
 	"github.com/rs/zerolog/log"
 )
 
-// SensorData represents a complete CNC machine reading matching backend format
-type SensorData struct {
-	MachineID         string    `json:"machine_id"`
-	SequenceNumber    uint64    `json:"sequence_number"`    // Monotonic sequence per machine
-	Temperature       float64   `json:"temperature"`
-	SpindleSpeed      float64   `json:"spindle_speed"`
-	Timestamp         time.Time `json:"timestamp"`
-	XPosMM            float64   `json:"x_pos_mm"`
-	YPosMM            float64   `json:"y_pos_mm"`
-	ZPosMM            float64   `json:"z_pos_mm"`
-	FeedRateActual    float64   `json:"feed_rate_actual"`
-	SpindleLoadPercent float64   `json:"spindle_load_percent"`
-	MachineState      string    `json:"machine_state"`
-	ActiveProgramLine int       `json:"active_program_line"`
-	TotalPowerKW      float64   `json:"total_power_kw"`
-}
+// SensorData is a complete CNC machine reading, in the wire format the backend
+// ingests. See contract.EncodeSample for its encodings.
+type SensorData = contract.Sample
 
 // Batch represents a collection of sensor data to be processed.
 type Batch [][]byte
@@ -39,6 +27,46 @@ type Processor interface {
 	Process(ctx context.Context, batch Batch) error
 }
 
+// Message is a single payload with the ID used for broker-side deduplication.
+type Message struct {
+	ID       string // Nats-Msg-Id; empty disables deduplication
+	Encoding string // Sample encoding of Data, see contract.EncodeSample
+	Data     []byte
+	Resend   bool // Replayed from the WAL and may already be stored; packed only with other resends
+}
+
+// MessageProcessor is implemented by processors that can publish with a
+// deduplication ID, so a resend of the same record is dropped by the broker.
+// When only some messages fail, ProcessMessages returns a *PublishError.
+type MessageProcessor interface {
+	ProcessMessages(ctx context.Context, msgs []Message) error
+}
+
+// PublishError reports which messages of a ProcessMessages call were not
+// acknowledged. Failed holds their indices in the input slice, in ascending order;
+// all other messages were stored by the broker.
+type PublishError struct {
+	Failed []int
+	Err    error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("%d message(s) not acknowledged: %v", len(e.Failed), e.Err)
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// MessageID returns the deduplication ID of a reading: machineID:sequence.
+// Readings without a sequence number get no ID.
+func MessageID(machineID string, sequence uint64) string {
+	if sequence == 0 {
+		return ""
+	}
+	return machineID + ":" + strconv.FormatUint(sequence, 10)
+}
+
 // ConnectivityChecker extends Processor with connection status checking
 type ConnectivityChecker interface {
 	Processor
@@ -46,69 +74,81 @@ type ConnectivityChecker interface {
 }
 
 // Manager orchestrates the data flow from producers to a processor.
-// It uses offline buffering for reliability with real-time transmission.
+// It sends in real time and falls back to the offline buffer's WAL for reliability.
 type Manager struct {
-	config       config.BufferingConfig
-	hotBuffer    *HotBuffer
-	warmBuffer   *WarmBuffer
-	coldBuffer   *ColdBuffer
+	config        config.BufferingConfig
 	offlineBuffer *OfflineBuffer
-	processor    Processor
-	batchSize    int
-	batchTimeout time.Duration
-	cancel       context.CancelFunc
-	wg           sync.WaitGroup
+	processor     Processor
+	batchSize     int
+	batchTimeout  time.Duration
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
 	
 	// Sequence number tracking
-	seqMutex     sync.Mutex
-	sequenceNum  uint64
+	seqMutex    sync.Mutex
+	sequenceNum uint64
+	seqFile     string
+	reservedSeq uint64 // Highest sequence number persisted as reserved
 }
 
-// NewManager creates a new buffer manager with offline capabilities.
-func NewManager(config config.BufferingConfig, processor Processor) (*Manager, error) {
+// sequenceFile is the name of the sequence file in the state directory.
+const sequenceFile = "sequence.txt"
+
+// sequenceBlock is how many sequence numbers are reserved on disk at a time.
+// The file always holds a value at or above the last number issued, so after a
+// crash numbers are skipped (a gap) rather than issued twice.
+const sequenceBlock = 1000
+
+// NewManager creates a new buffer manager with offline capabilities. The
+// sequence file and, unless configured with an absolute path, the offline
+// buffer live in stateDir.
+func NewManager(stateDir string, config config.BufferingConfig, processor Processor) (*Manager, error) {
 	// Initialize offline buffer with configuration
 	offlineConfig := OfflineConfig{
-		DataDir:      "/var/tmp/cnc-agent/offline",
-		MaxFileSize:  10 * 1024 * 1024, // 10MB per file
-		MaxRetention: 7 * 24 * time.Hour, // Keep 7 days
-		SyncInterval: 30 * time.Second,   // Try sync every 30s
+		DataDir:       config.Offline.DataDir,
+		MaxFileSize:   config.Offline.SegmentSize,
+		MaxRetention:  config.Offline.MaxRetention,
+		SyncInterval:  config.Offline.SyncInterval,
+		FsyncInterval: config.Offline.FsyncInterval,
+		BatchSize:     config.Batching.Size,
+		BatchTimeout:  config.Batching.Timeout,
+		Encoding:      config.Encoding,
+		QuotaBytes:    config.Offline.Quota.MaxBytes,
+		QuotaPolicy:   config.Offline.Quota.Policy,
+		DiskPercent:   config.Offline.Quota.DiskPercent,
 	}
-
-	offlineBuffer, err := NewOfflineBuffer(offlineConfig, processor)
-	if err != nil {
-			return nil, fmt.Errorf("failed to create offline buffer: %w", err)
+	if offlineConfig.DataDir == "" {
+		offlineConfig.DataDir = "offline"
 	}
-
-	// Keep existing buffers for compatibility (but use offline buffer as primary)
-	hotBuffer, err := NewHotBuffer(config.HotBuffer.Capacity)
-	if err != nil {
-		return nil, err
+	if !filepath.IsAbs(offlineConfig.DataDir) {
+		offlineConfig.DataDir = filepath.Join(stateDir, offlineConfig.DataDir)
 	}
-
-	warmBuffer, err := NewWarmBuffer(config.WarmBuffer.Path, config.WarmBuffer.Size)
-	if err != nil {
-		return nil, err
+	if offlineConfig.MaxRetention <= 0 {
+		offlineConfig.MaxRetention = 7 * 24 * time.Hour // Keep 7 days
+	}
+	if offlineConfig.SyncInterval <= 0 {
+		offlineConfig.SyncInterval = 30 * time.Second // Try sync every 30s
 	}
 
-	coldBuffer, err := NewColdBuffer(config.ColdBuffer.Path, config.ColdBuffer.MaxSize)
+	offlineBuffer, err := NewOfflineBuffer(offlineConfig, processor)
 	if err != nil {
-		return nil, err
+			return nil, fmt.Errorf("failed to create offline buffer: %w", err)
 	}
 
 	manager := &Manager{
 		config:        config,
-		hotBuffer:     hotBuffer,
-		warmBuffer:    warmBuffer,
-		coldBuffer:    coldBuffer,
 		offlineBuffer: offlineBuffer,
 		processor:     processor,
 		batchSize:     config.Batching.Size,
 		batchTimeout:  config.Batching.Timeout,
+		seqFile:       filepath.Join(stateDir, sequenceFile),
 	}
 	
-	// Load persisted sequence number
+	// Starting from 0 would reuse sequence numbers the backend already holds
+	// and it would drop the new readings as conflicts
 	if err := manager.loadSequenceNumber(); err != nil {
-		log.Warn().Err(err).Msg("Failed to load sequence number, starting from 0")
+		offlineBuffer.Shutdown()
+		return nil, fmt.Errorf("%w (not starting over at 0, which would reuse sequence numbers)", err)
 	}
 	
 	return manager, nil
@@ -116,13 +156,10 @@ func NewManager(config config.BufferingConfig, processor Processor) (*Manager, e
 
 // Start launches the manager's processing loop.
 func (m *Manager) Start() {
-	ctx, cancel := context.WithCancel(context.Background())
+	_, cancel := context.WithCancel(context.Background())
 	m.cancel = cancel
 
-	// Only start warm buffer retry loop (direct sending bypasses batch accumulator)
-	m.wg.Add(1)
-	go m.warmBufferRetryLoop(ctx)
-
+	// Replay of unsent data is driven by the offline buffer's sync loop
 	log.Info().Msg("Buffer manager started (direct mode)")
 }
 
@@ -130,7 +167,7 @@ func (m *Manager) Start() {
 func (m *Manager) Shutdown() {
 	log.Info().Msg("Shutting down buffer manager")
 	
-	// Save sequence number before shutdown
+	// Release the unused part of the reserved block
 	if err := m.saveSequenceNumber(); err != nil {
 		log.Error().Err(err).Msg("Failed to save sequence number")
 	}
@@ -140,190 +177,101 @@ func (m *Manager) Shutdown() {
 	}
 	m.wg.Wait()
 	
-	// Shutdown offline buffer first (most important)
 	if m.offlineBuffer != nil {
 		m.offlineBuffer.Shutdown()
 	}
 	
-	// Shutdown other buffers
-	if m.warmBuffer != nil {
-		m.warmBuffer.Close()
-	}
-	if m.coldBuffer != nil {
-		m.coldBuffer.Close()
-	}
-	
 	log.Info().Msg("Buffer manager stopped")
 }
 
 // Write accepts data and handles both offline persistence and real-time transmission.
 func (m *Manager) Write(data SensorData) error {
-	// Assign sequence number atomically
-	m.seqMutex.Lock()
-	m.sequenceNum++
-	data.SequenceNumber = m.sequenceNum
-	seq := m.sequenceNum
-	m.seqMutex.Unlock()
-	
-	// Periodically save sequence number to disk (every 100 messages)
-	if seq%100 == 0 {
-		go func() {
-			if err := m.saveSequenceNumber(); err != nil {
-				log.Error().Err(err).Msg("Failed to save sequence number")
-			}
-		}()
+	seq, err := m.nextSequence()
+	if err != nil {
+		return err
 	}
-	
-	// Use offline buffer for dual-path processing (file + NATS)
+	data.SequenceNumber = seq
+
+	// Use offline buffer for dual-path processing (NATS, WAL on failure)
 	return m.offlineBuffer.Write(data)
 }
 
-// GetStats returns comprehensive buffer statistics
-func (m *Manager) GetStats() map[string]interface{} {
-	stats := make(map[string]interface{})
-	
-	if m.offlineBuffer != nil {
-		stats["offline"] = m.offlineBuffer.GetStats()
-	}
-	
-	// Add other buffer stats if needed
-	if m.hotBuffer != nil {
-		stats["hot_buffer_available"] = m.hotBuffer.AvailableBytes()
-		stats["hot_buffer_capacity"] = m.hotBuffer.Capacity()
-	}
-	
-	return stats
+// OnQuotaChange registers fn to be called when the offline quota is breached
+// or back within limits.
+func (m *Manager) OnQuotaChange(fn func(exceeded bool)) {
+	m.offlineBuffer.SetQuotaListener(fn)
 }
 
-func (m *Manager) batchAccumulator(ctx context.Context) {
-	defer m.wg.Done()
-
-	ticker := time.NewTicker(m.batchTimeout)
-	defer ticker.Stop()
-
-	batch := make(Batch, 0, m.batchSize)
-
-	for {
-		select {
-		case <-ctx.Done():
-			if len(batch) > 0 {
-				m.sendBatch(ctx, batch)
-			}
-			return
-
-		case <-ticker.C:
-			if len(batch) > 0 {
-				m.sendBatch(ctx, batch)
-				batch = make(Batch, 0, m.batchSize) // Create a new empty batch
-			}
-
-		default:
-			msgData, bytesRead := m.readFrame()
-
-			if msgData == nil {
-				time.Sleep(5 * time.Millisecond)
-				continue
-			}
-
-			batch = append(batch, msgData)
-			m.hotBuffer.CommitRead(bytesRead)
-
-			if len(batch) >= m.batchSize {
-				m.sendBatch(ctx, batch)
-				batch = make(Batch, 0, m.batchSize) // Create a new empty batch
-				ticker.Reset(m.batchTimeout)
-			}
-		}
-	}
+// OnOnlineChange registers fn to be called when readings start or stop being
+// published in real time.
+func (m *Manager) OnOnlineChange(fn func(online bool)) {
+	m.offlineBuffer.SetOnlineListener(fn)
 }
 
-func (m *Manager) readFrame() ([]byte, uint64) {
-	b1, b2 := m.hotBuffer.Read()
-	available := len(b1) + len(b2)
-
-	if available == 0 {
-		return nil, 0
-	}
-
-	// Combine b1 and b2 into single buffer for processing
-	var buffer []byte
-	if b2 == nil || len(b2) == 0 {
-		buffer = b1
-	} else {
-		buffer = make([]byte, len(b1)+len(b2))
-		copy(buffer, b1)
-		copy(buffer[len(b1):], b2)
-	}
+// CheckConnectivity tests the connection to the backend now, e.g. when the
+// NATS client reports a disconnect.
+func (m *Manager) CheckConnectivity() {
+	m.offlineBuffer.CheckConnectivity()
+}
 
-	// Find the first newline (message delimiter)
-	var msgEnd int = -1
-	for i, b := range buffer {
-		if b == '\n' {
-			msgEnd = i
-			break
-		}
-	}
+// Flush publishes queued samples and replays unsent data without waiting for
+// the next batch or sync. It reports whether the backend is reachable.
+func (m *Manager) Flush() bool {
+	return m.offlineBuffer.Flush()
+}
 
-	if msgEnd == -1 {
-		// No complete message found
-		return nil, 0
-	}
+// SetQuota applies new offline quota limits, e.g. after a configuration reload.
+func (m *Manager) SetQuota(quota config.QuotaConfig) {
+	m.offlineBuffer.SetQuota(quota.MaxBytes, quota.Policy, quota.DiskPercent)
+}
 
-	// Extract the JSON message (without the newline)
-	msgData := make([]byte, msgEnd)
-	copy(msgData, buffer[:msgEnd])
+// SamplingPaused reports whether sampling should stop because the offline
+// quota is exhausted under the stop-sampling policy.
+func (m *Manager) SamplingPaused() bool {
+	return m.offlineBuffer.SamplingPaused()
+}
 
-	// Return message data and total bytes consumed (including newline)
-	return msgData, uint64(msgEnd + 1)
+// IsOnline reports whether readings are currently published in real time.
+func (m *Manager) IsOnline() bool {
+	return m.offlineBuffer.online.Load()
 }
 
-func (m *Manager) sendBatch(ctx context.Context, batch Batch) {
-	if err := m.processor.Process(ctx, batch); err != nil {
-		log.Error().Err(err).Msg("Failed to process batch, writing to warm buffer")
-		for _, msg := range batch { // msg here is the raw JSON payload
-			// Re-add the length prefix before writing to warm buffer
-			msgLen := len(msg)
-			totalLen := 4 + msgLen
-			buf := make([]byte, totalLen)
-			binary.BigEndian.PutUint32(buf[:4], uint32(msgLen))
-			copy(buf[4:], msg)
-
-			if _, err := m.warmBuffer.Write(buf); err != nil { // Write the length-prefixed buffer
-				log.Error().Err(err).Msg("Failed to write to warm buffer, writing to cold buffer")
-				m.coldBuffer.Write(buf) // Also write length-prefixed to cold buffer
-			}
-		}
+// GetStats returns comprehensive buffer statistics
+func (m *Manager) GetStats() map[string]interface{} {
+	stats := make(map[string]interface{})
+	
+	if m.offlineBuffer != nil {
+		stats["offline"] = m.offlineBuffer.GetStats()
 	}
+	
+	return stats
 }
 
-func (m *Manager) warmBufferRetryLoop(ctx context.Context) {
-	defer m.wg.Done()
-	ticker := time.NewTicker(10 * time.Second) // Retry every 10 seconds
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			batch, err := m.warmBuffer.ReadBatch(m.batchSize)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to read from warm buffer")
-				continue
-			}
-
-			if len(batch) > 0 {
-				m.sendBatch(ctx, batch)
-			}
+// nextSequence issues the next sequence number, first reserving a new block on
+// disk if the current one is used up. A number is never issued unless it is
+// covered by a durable reservation.
+func (m *Manager) nextSequence() (uint64, error) {
+	m.seqMutex.Lock()
+	defer m.seqMutex.Unlock()
+
+	next := m.sequenceNum + 1
+	if next > m.reservedSeq {
+		reserved := next + sequenceBlock - 1
+		if err := writeFileAtomic(m.seqFile, []byte(strconv.FormatUint(reserved, 10))); err != nil {
+			return 0, fmt.Errorf("failed to reserve sequence numbers: %w", err)
 		}
+		m.reservedSeq = reserved
+		log.Debug().Uint64("from", next).Uint64("to", reserved).Msg("Reserved sequence block")
 	}
+	m.sequenceNum = next
+	return next, nil
 }
 
-// loadSequenceNumber loads the persisted sequence number from disk.
+// loadSequenceNumber loads the persisted sequence reservation from disk. After
+// an unclean shutdown numbers up to the reservation may have been issued, so
+// numbering resumes above it.
 func (m *Manager) loadSequenceNumber() error {
-	seqFile := "/var/tmp/cnc-agent/sequence.txt"
-	
-	data, err := os.ReadFile(seqFile)
+	data, err := os.ReadFile(m.seqFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			m.sequenceNum = 0
@@ -332,34 +280,34 @@ func (m *Manager) loadSequenceNumber() error {
 		return fmt.Errorf("failed to read sequence file: %w", err)
 	}
 	
-	seq, err := strconv.ParseUint(string(data), 10, 64)
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
 	if err != nil {
 		return fmt.Errorf("failed to parse sequence number: %w", err)
 	}
 	
 	m.sequenceNum = seq
-	log.Info().Uint64("sequence", seq).Msg("Loaded sequence number from disk")
+	m.reservedSeq = seq
+	log.Info().Uint64("sequence", seq).Str("file", m.seqFile).Msg("Loaded sequence number from disk")
 	return nil
 }
 
-// saveSequenceNumber persists the current sequence number to disk.
+// saveSequenceNumber persists the last issued sequence number, giving back the
+// unused part of the reserved block; a later Write simply reserves a new one.
+// The file is replaced atomically, so a crash mid-save leaves the previous
+// reservation intact.
 func (m *Manager) saveSequenceNumber() error {
-	seqFile := "/var/tmp/cnc-agent/sequence.txt"
-	
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(seqFile), 0755); err != nil {
-		return fmt.Errorf("failed to create sequence directory: %w", err)
-	}
-	
 	m.seqMutex.Lock()
+	defer m.seqMutex.Unlock()
+
 	seq := m.sequenceNum
-	m.seqMutex.Unlock()
-	
-	err := os.WriteFile(seqFile, []byte(strconv.FormatUint(seq, 10)), 0644)
-	if err != nil {
+	if seq == m.reservedSeq {
+		return nil
+	}
+	if err := writeFileAtomic(m.seqFile, []byte(strconv.FormatUint(seq, 10))); err != nil {
 		return fmt.Errorf("failed to write sequence file: %w", err)
 	}
+	m.reservedSeq = seq
 	
-	log.Info().Uint64("sequence", seq).Msg("Saved sequence number to disk")
+	log.Debug().Uint64("sequence", seq).Msg("Saved sequence number to disk")
 	return nil
 }
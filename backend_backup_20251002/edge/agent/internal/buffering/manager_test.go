@@ -0,0 +1,94 @@
+package buffering
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cnc-monitor/edge/config"
+)
+
+func newTestManager(t *testing.T, stateDir string) *Manager {
+	t.Helper()
+	m, err := NewManager(stateDir, config.BufferingConfig{
+		Offline: config.OfflineConfig{SyncInterval: time.Hour},
+	}, &switchProcessor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func readSequenceFile(t *testing.T, stateDir string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(stateDir, sequenceFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// issue draws n sequence numbers and returns the last one.
+func issue(t *testing.T, m *Manager, n int) uint64 {
+	t.Helper()
+	var seq uint64
+	for i := 0; i < n; i++ {
+		var err error
+		if seq, err = m.nextSequence(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return seq
+}
+
+func TestSequenceReservationAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+
+	m := newTestManager(t, dir)
+	if seq := issue(t, m, 1); seq != 1 {
+		t.Fatalf("first sequence %d, want 1", seq)
+	}
+	if got := readSequenceFile(t, dir); got != "1000" {
+		t.Errorf("reserved %q after the first number, want 1000", got)
+	}
+	if seq := issue(t, m, sequenceBlock); seq != sequenceBlock+1 {
+		t.Fatalf("sequence %d, want %d", seq, sequenceBlock+1)
+	}
+	if got := readSequenceFile(t, dir); got != "2000" {
+		t.Errorf("reserved %q once the first block is used up, want 2000", got)
+	}
+
+	// A crash skips the rest of the reserved block
+	m.offlineBuffer.Shutdown()
+	m = newTestManager(t, dir)
+	if seq := issue(t, m, 1); seq != 2001 {
+		t.Errorf("sequence %d after a crash, want 2001", seq)
+	}
+
+	// A clean shutdown gives the unused numbers back
+	issue(t, m, 4)
+	m.Shutdown()
+	if got := readSequenceFile(t, dir); got != "2005" {
+		t.Errorf("saved %q on shutdown, want 2005", got)
+	}
+	m = newTestManager(t, dir)
+	defer m.Shutdown()
+	if seq := issue(t, m, 1); seq != 2006 {
+		t.Errorf("sequence %d after a clean shutdown, want 2006", seq)
+	}
+}
+
+func TestNewManagerRejectsUnreadableSequence(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, sequenceFile), []byte("12x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewManager(dir, config.BufferingConfig{
+		Offline: config.OfflineConfig{SyncInterval: time.Hour},
+	}, &switchProcessor{})
+	if err == nil || !strings.Contains(err.Error(), "parse sequence number") {
+		t.Fatalf("NewManager returned %v, want a parse error", err)
+	}
+}
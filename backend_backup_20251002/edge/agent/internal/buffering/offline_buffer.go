@@ -3,7 +3,9 @@ package buffering
 import (
 	"bufio"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,26 +15,77 @@ import (
 	"sync/atomic"
 	"time"
 
+	"cnc-monitor/contract"
 	"github.com/rs/zerolog/log"
 )
 
-// OfflineBuffer provides file-based persistence with real-time NATS fallback
+// replayBatchSize is the number of WAL records sent between acknowledgements.
+const replayBatchSize = 500
+
+// Quota policies, applied when unsent data outgrows OfflineConfig.QuotaBytes.
+const (
+	QuotaDropOldest      = "drop-oldest"      // Drop the oldest WAL segments
+	QuotaDownsampleOlder = "downsample-older" // Thin out the oldest WAL segments, then drop them
+	QuotaStopSampling    = "stop-sampling"    // Keep what is stored and stop taking new samples
+)
+
+const (
+	quotaHighWater     = 0.9 // Share of the quota at which the buffer reports a breach
+	quotaLowWater      = 0.8 // Share of the quota below which a breach clears
+	diskHysteresisPct  = 5   // Points below DiskPercent at which a disk breach clears
+	maxDownsampleLevel = 4   // Each level halves a segment, so at most 1 in 16 records is kept
+)
+
+// ErrQuotaExceeded is returned by Write when the quota is exhausted under the
+// stop-sampling policy.
+var ErrQuotaExceeded = errors.New("offline buffer quota exceeded")
+
+// pendingRecord is an encoded reading queued for the next live publish.
+type pendingRecord struct {
+	id   string
+	data []byte
+}
+
+// OfflineBuffer provides WAL-backed persistence with real-time NATS fallback
 type OfflineBuffer struct {
 	// Configuration
 	dataDir       string
 	maxFileSize   int64
 	maxRetention  time.Duration
 	syncInterval  time.Duration
+	batchSize     int
+	batchTimeout  time.Duration
+	encoding      string
+	quotaBytes    int64   // Quota limits are guarded by quotaMutex; see SetQuota
+	quotaPolicy   string
+	diskPercent   float64
 
 	// State
 	online         atomic.Bool
 	lastOnline     time.Time
 	syncInProgress atomic.Bool
 	
-	// File handling
-	currentFile   *os.File
-	currentPath   string
-	fileMutex     sync.Mutex
+	// Durable storage for data that could not be sent
+	wal *WAL
+
+	// Quota enforcement
+	quotaExceeded    atomic.Bool
+	droppedBytes     atomic.Int64
+	downsampledBytes atomic.Int64
+	quotaMutex       sync.Mutex
+	quotaListener    func(exceeded bool)
+	onlineListener   func(online bool) // Guarded by quotaMutex
+	downsampled      map[uint64]int // WAL segment -> times halved
+	diskUsedPct      float64
+
+	// Readings waiting for the next live publish
+	pendingMutex sync.Mutex
+	pending      []pendingRecord
+	flushCh      chan struct{}
+
+	// Requests served by syncLoop, so nothing runs against the WAL after Shutdown
+	syncCh  chan struct{} // Replay unsent data now
+	checkCh chan struct{} // Test connectivity now
 	
 	// Network processor
 	processor Processor
@@ -49,9 +102,16 @@ type OfflineBuffer struct {
 // OfflineConfig configures the offline buffer
 type OfflineConfig struct {
 	DataDir       string        `yaml:"data_dir"`
-	MaxFileSize   int64         `yaml:"max_file_size"`   // Bytes before rotation
+	MaxFileSize   int64         `yaml:"max_file_size"`   // Bytes per WAL segment
 	MaxRetention  time.Duration `yaml:"max_retention"`   // How long to keep files
 	SyncInterval  time.Duration `yaml:"sync_interval"`   // How often to try sync
+	FsyncInterval time.Duration `yaml:"fsync_interval"`  // How often WAL appends are fsynced, 0 for every append
+	BatchSize     int           `yaml:"batch_size"`      // Readings per live publish
+	BatchTimeout  time.Duration `yaml:"batch_timeout"`   // Max delay before a partial batch is published
+	Encoding      string        `yaml:"encoding"`        // "json" or "binary" (cncbin/2)
+	QuotaBytes    int64         `yaml:"quota_bytes"`     // Disk space for unsent data, 0 for no limit
+	QuotaPolicy   string        `yaml:"quota_policy"`    // drop-oldest, downsample-older or stop-sampling
+	DiskPercent   float64       `yaml:"disk_percent"`    // Filesystem usage treated as a quota breach, 0 to ignore
 }
 
 // NewOfflineBuffer creates a new offline buffer with file persistence
@@ -61,10 +121,30 @@ func NewOfflineBuffer(config OfflineConfig, processor Processor) (*OfflineBuffer
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 	
-	// Create sync subdirectory
-	syncDir := filepath.Join(config.DataDir, "sync")
-	if err := os.MkdirAll(syncDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create sync directory: %w", err)
+	wal, err := OpenWAL(filepath.Join(config.DataDir, "wal"), config.MaxFileSize, config.FsyncInterval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal: %w", err)
+	}
+
+	if config.BatchSize < 1 {
+		config.BatchSize = 1
+	}
+	if config.BatchTimeout <= 0 {
+		config.BatchTimeout = 200 * time.Millisecond
+	}
+	if config.QuotaPolicy == "" {
+		config.QuotaPolicy = QuotaDropOldest
+	}
+	switch config.QuotaPolicy {
+	case QuotaDropOldest, QuotaDownsampleOlder, QuotaStopSampling:
+	default:
+		return nil, fmt.Errorf("unknown quota policy %q", config.QuotaPolicy)
+	}
+	if config.Encoding == "binary" {
+		config.Encoding = contract.EncodingBinaryV2
+	}
+	if _, err := contract.EncodeSample(config.Encoding, SensorData{}); err != nil {
+		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -74,6 +154,17 @@ func NewOfflineBuffer(config OfflineConfig, processor Processor) (*OfflineBuffer
 		maxFileSize:  config.MaxFileSize,
 		maxRetention: config.MaxRetention,
 		syncInterval: config.SyncInterval,
+		batchSize:    config.BatchSize,
+		batchTimeout: config.BatchTimeout,
+		encoding:     config.Encoding,
+		quotaBytes:   config.QuotaBytes,
+		quotaPolicy:  config.QuotaPolicy,
+		diskPercent:  config.DiskPercent,
+		downsampled:  make(map[uint64]int),
+		wal:          wal,
+		flushCh:      make(chan struct{}, 1),
+		syncCh:       make(chan struct{}, 1),
+		checkCh:      make(chan struct{}, 1),
 		processor:    processor,
 		ctx:          ctx,
 		cancel:       cancel,
@@ -87,18 +178,22 @@ func NewOfflineBuffer(config OfflineConfig, processor Processor) (*OfflineBuffer
 		log.Info().Msg("Using fallback connectivity test messages")
 	}
 
-	// Initialize current file
-	if err := buffer.initCurrentFile(); err != nil {
-		return nil, fmt.Errorf("failed to initialize current file: %w", err)
+	// Pick up .jsonl files left behind by agents that predate the WAL
+	if err := buffer.importLegacyFiles(); err != nil {
+		log.Error().Err(err).Msg("Failed to import legacy offline files")
 	}
 
 	// Start background sync loop
 	buffer.wg.Add(1)
 	go buffer.syncLoop()
+
+	// Start live publish loop
+	buffer.wg.Add(1)
+	go buffer.flushLoop()
 	
-	// Start file rotation monitor
+	// Start retention monitor
 	buffer.wg.Add(1)
-	go buffer.rotationLoop()
+	go buffer.retentionLoop()
 	
 	// Test initial connectivity
 	go buffer.testConnectivity()
@@ -107,150 +202,224 @@ func NewOfflineBuffer(config OfflineConfig, processor Processor) (*OfflineBuffer
 		Str("data_dir", config.DataDir).
 		Int64("max_file_size", config.MaxFileSize).
 		Dur("sync_interval", config.SyncInterval).
+		Int("batch_size", config.BatchSize).
+		Str("encoding", config.Encoding).
+		Int64("quota_bytes", config.QuotaBytes).
+		Str("quota_policy", config.QuotaPolicy).
 		Msg("Offline buffer initialized")
 
 	return buffer, nil
 }
 
-// Write stores data locally and attempts real-time transmission
+// Write queues data for real-time transmission, or stores it in the WAL when offline.
+// Queued readings are published in batches by flushLoop; any that the broker does
+// not acknowledge are written to the WAL, so Write never waits for a round trip.
 func (b *OfflineBuffer) Write(data SensorData) error {
-	jsonBytes, err := json.Marshal(data)
+	record, err := contract.EncodeSample(b.encoding, data)
 	if err != nil {
-		return fmt.Errorf("failed to marshal data: %w", err)
+		return fmt.Errorf("failed to encode data: %w", err)
 	}
 
-	// Attempt real-time transmission if online
 	if b.online.Load() {
-		if err := b.sendToNATS(jsonBytes); err != nil {
-			log.Warn().Err(err).Msg("NATS transmission failed, writing to file buffer")
-			// Only write to file if NATS fails
-			if writeErr := b.writeToFile(jsonBytes); writeErr != nil {
-				log.Error().Err(writeErr).Msg("Failed to write to local file")
-				return writeErr
+		b.pendingMutex.Lock()
+		queued := len(b.pending) < b.maxPending()
+		if queued {
+			b.pending = append(b.pending, pendingRecord{id: MessageID(data.MachineID, data.SequenceNumber), data: record})
+		}
+		full := len(b.pending) >= b.batchSize
+		b.pendingMutex.Unlock()
+
+		if full {
+			select {
+			case b.flushCh <- struct{}{}:
+			default:
 			}
-			b.setOffline()
 		}
-		// If NATS succeeds, don't write to file (no duplication)
-	} else {
-		// If offline, write to file only
-		if err := b.writeToFile(jsonBytes); err != nil {
-			log.Error().Err(err).Msg("Failed to write to local file")
-			return err
+		if queued {
+			return nil
 		}
+		// Publishing has fallen behind; keep the reading on disk instead.
+	}
+
+	// If offline (or backed up), write to WAL only
+	if b.SamplingPaused() {
+		return ErrQuotaExceeded
+	}
+	if err := b.writeToFile(record); err != nil {
+		log.Error().Err(err).Msg("Failed to write to WAL")
+		return err
 	}
 
 	return nil
 }
 
-// Process implements the Processor interface for compatibility
-func (b *OfflineBuffer) Process(ctx context.Context, batch Batch) error {
-	for _, data := range batch {
-		// Extract JSON from length-prefixed format
-		if len(data) < 4 {
-			continue
-		}
-		jsonData := data[4:] // Skip 4-byte length prefix
-		
-		var sensorData SensorData
-		if err := json.Unmarshal(jsonData, &sensorData); err != nil {
-			log.Error().Err(err).Msg("Failed to unmarshal sensor data")
-			continue
-		}
-		
-		if err := b.Write(sensorData); err != nil {
-			return err
+// maxPending bounds the live queue while a publish is waiting for acks.
+func (b *OfflineBuffer) maxPending() int {
+	return b.batchSize * 10
+}
+
+// flushLoop publishes queued readings when a batch is full or the batch timeout expires.
+func (b *OfflineBuffer) flushLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.batchTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			// Don't lose what is still queued
+			b.spillPending(b.takePending())
+			return
+		case <-ticker.C:
+			b.flushPending()
+		case <-b.flushCh:
+			b.flushPending()
 		}
 	}
-	return nil
 }
 
-// writeToFile atomically writes data to the current file
-func (b *OfflineBuffer) writeToFile(jsonBytes []byte) error {
-	b.fileMutex.Lock()
-	defer b.fileMutex.Unlock()
+// takePending removes and returns the queued readings.
+func (b *OfflineBuffer) takePending() []pendingRecord {
+	b.pendingMutex.Lock()
+	defer b.pendingMutex.Unlock()
 
-	if b.currentFile == nil {
-		if err := b.initCurrentFile(); err != nil {
-			return err
-		}
+	records := b.pending
+	b.pending = nil
+	return records
+}
+
+// flushPending publishes the queued readings and writes the ones that were
+// not acknowledged to the WAL.
+func (b *OfflineBuffer) flushPending() {
+	records := b.takePending()
+	if len(records) == 0 {
+		return
 	}
 
-	// Write JSON + newline
-	if _, err := b.currentFile.Write(jsonBytes); err != nil {
-		return err
+	msgs := make([]Message, len(records))
+	for i, r := range records {
+		msgs[i] = Message{ID: r.id, Encoding: contract.SampleEncoding(r.data), Data: frame(r.data)}
 	}
-	if _, err := b.currentFile.Write([]byte("\n")); err != nil {
-		return err
+
+	failed, err := b.publish(msgs)
+	if err == nil {
+		return
 	}
 
-	// Force to disk
-	if err := b.currentFile.Sync(); err != nil {
-		return err
+	log.Warn().Err(err).Int("failed", len(failed)).Int("batch", len(records)).Msg("NATS transmission failed, writing to WAL")
+	unsent := make([]pendingRecord, len(failed))
+	for i, idx := range failed {
+		unsent[i] = records[idx]
 	}
+	b.spillPending(unsent)
+	b.setOffline()
+}
 
-	return nil
+// spillPending writes readings that could not be published to the WAL.
+func (b *OfflineBuffer) spillPending(records []pendingRecord) {
+	for _, r := range records {
+		if err := b.writeToFile(r.data); err != nil {
+			log.Error().Err(err).Msg("Failed to write to WAL")
+		}
+	}
 }
 
-// sendToNATS attempts real-time transmission
-func (b *OfflineBuffer) sendToNATS(jsonBytes []byte) error {
-	// Add length prefix for NATS compatibility
-	msgLen := len(jsonBytes)
-	totalLen := 4 + msgLen
-	buf := make([]byte, totalLen)
-	
-	// Use binary encoding for length prefix
-	buf[0] = byte(msgLen >> 24)
-	buf[1] = byte(msgLen >> 16)
-	buf[2] = byte(msgLen >> 8)
-	buf[3] = byte(msgLen)
-	copy(buf[4:], jsonBytes)
+// publish sends msgs through the processor and returns the indices of the
+// messages that were not acknowledged.
+func (b *OfflineBuffer) publish(msgs []Message) ([]int, error) {
+	var err error
+	if mp, ok := b.processor.(MessageProcessor); ok {
+		err = mp.ProcessMessages(b.ctx, msgs)
+	} else {
+		batch := make(Batch, len(msgs))
+		for i, m := range msgs {
+			batch[i] = m.Data
+		}
+		err = b.processor.Process(b.ctx, batch)
+	}
+	if err == nil {
+		return nil, nil
+	}
 
-	batch := Batch{buf}
-	return b.processor.Process(b.ctx, batch)
+	// A PublishError that names no failed message, or one out of range, says
+	// nothing reliable about what was stored; treat it as a full failure.
+	var pubErr *PublishError
+	if errors.As(err, &pubErr) && validIndices(pubErr.Failed, len(msgs)) {
+		return pubErr.Failed, err
+	}
+	failed := make([]int, len(msgs))
+	for i := range failed {
+		failed[i] = i
+	}
+	return failed, err
 }
 
-// initCurrentFile creates or opens the current write file
-func (b *OfflineBuffer) initCurrentFile() error {
-	b.currentPath = filepath.Join(b.dataDir, "current.jsonl")
-	
-	file, err := os.OpenFile(b.currentPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return err
+// validIndices reports whether idx is a non-empty list of indices into a slice of length n.
+func validIndices(idx []int, n int) bool {
+	if len(idx) == 0 {
+		return false
 	}
-	
-	b.currentFile = file
-	return nil
+	for _, i := range idx {
+		if i < 0 || i >= n {
+			return false
+		}
+	}
+	return true
 }
 
-// rotateFile moves current file to sync directory with timestamp
-func (b *OfflineBuffer) rotateFile() error {
-	b.fileMutex.Lock()
-	defer b.fileMutex.Unlock()
-
-	if b.currentFile == nil {
-		return nil
+// acknowledgedPrefix returns how many messages at the start of a batch were
+// stored before the first failure. failed may be in any order; messages after
+// the first failure are not counted even if they were stored.
+func acknowledgedPrefix(failed []int) int {
+	prefix := failed[0]
+	for _, i := range failed[1:] {
+		if i < prefix {
+			prefix = i
+		}
 	}
+	return prefix
+}
 
-	// Close current file
-	if err := b.currentFile.Close(); err != nil {
-		log.Error().Err(err).Msg("Error closing current file")
+// Process implements the Processor interface for compatibility
+func (b *OfflineBuffer) Process(ctx context.Context, batch Batch) error {
+	for _, data := range batch {
+		// Extract JSON from length-prefixed format
+		if len(data) < 4 {
+			continue
+		}
+		jsonData := data[4:] // Skip 4-byte length prefix
+		
+		var sensorData SensorData
+		if err := json.Unmarshal(jsonData, &sensorData); err != nil {
+			log.Error().Err(err).Msg("Failed to unmarshal sensor data")
+			continue
+		}
+		
+		if err := b.Write(sensorData); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Move to sync directory with timestamp
-	timestamp := time.Now().Format("20060102_150405")
-	syncPath := filepath.Join(b.dataDir, "sync", fmt.Sprintf("%s.jsonl", timestamp))
-	
-	if err := os.Rename(b.currentPath, syncPath); err != nil {
-		log.Error().Err(err).Msg("Failed to rotate file")
-		// Try to reopen current file
-		b.initCurrentFile()
-		return err
-	}
+// writeToFile durably appends an encoded reading to the WAL
+func (b *OfflineBuffer) writeToFile(record []byte) error {
+	return b.wal.Append(record)
+}
 
-	log.Info().Str("file", syncPath).Msg("File rotated for sync")
+// sendToNATS attempts real-time transmission of a single record
+func (b *OfflineBuffer) sendToNATS(msgID string, record []byte) error {
+	_, err := b.publish([]Message{{ID: msgID, Encoding: contract.SampleEncoding(record), Data: frame(record)}})
+	return err
+}
 
-	// Create new current file
-	return b.initCurrentFile()
+// frame adds the 4-byte big-endian length prefix ingestion.Service expects.
+func frame(record []byte) []byte {
+	buf := make([]byte, 4+len(record))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(record)))
+	copy(buf[4:], record)
+	return buf
 }
 
 // testConnectivity checks if NATS is available
@@ -277,7 +446,7 @@ func (b *OfflineBuffer) testConnectivity() {
 	
 	// Fallback to test message approach
 	testData := []byte(`{"test":"connectivity"}`)
-	if err := b.sendToNATS(testData); err != nil {
+	if err := b.sendToNATS("", testData); err != nil {
 		b.setOffline()
 	} else {
 		b.setOnline()
@@ -286,10 +455,10 @@ func (b *OfflineBuffer) testConnectivity() {
 
 // setOnline marks the buffer as online
 func (b *OfflineBuffer) setOnline() {
-	if !b.online.Load() {
-		b.online.Store(true)
+	if b.online.CompareAndSwap(false, true) {
 		b.lastOnline = time.Now()
 		log.Info().Msg("🟢 Buffer ONLINE - real-time transmission + local persistence enabled")
+		b.notifyOnline(true)
 
 		// Immediately trigger sync when going online
 		log.Info().Msg("🚀 Triggering immediate sync after going online")
@@ -300,13 +469,31 @@ func (b *OfflineBuffer) setOnline() {
 
 // setOffline marks the buffer as offline
 func (b *OfflineBuffer) setOffline() {
-	if b.online.Load() {
-		b.online.Store(false)
+	if b.online.CompareAndSwap(true, false) {
 		offlineDuration := time.Since(b.lastOnline).Round(time.Second)
 		log.Warn().
 			Time("offline_since", time.Now()).
 			Dur("was_online_for", offlineDuration).
 			Msg("🔴 Buffer OFFLINE - local file persistence only")
+		b.notifyOnline(false)
+	}
+}
+
+func (b *OfflineBuffer) notifyOnline(online bool) {
+	b.quotaMutex.Lock()
+	listener := b.onlineListener
+	b.quotaMutex.Unlock()
+	if listener != nil {
+		listener(online)
+	}
+}
+
+// CheckConnectivity tests the connection now instead of at the next periodic
+// check, e.g. when the processor reports that it disconnected.
+func (b *OfflineBuffer) CheckConnectivity() {
+	select {
+	case b.checkCh <- struct{}{}:
+	default:
 	}
 }
 
@@ -328,6 +515,12 @@ func (b *OfflineBuffer) syncLoop() {
 		case <-connectivityTicker.C:
 			// Test connectivity more frequently
 			b.testConnectivity()
+		case <-b.checkCh:
+			b.testConnectivity()
+		case <-b.syncCh:
+			if b.online.Load() {
+				b.syncOfflineFiles()
+			}
 		case <-ticker.C:
 			// Main sync interval - attempt file sync if online
 			online := b.online.Load()
@@ -351,8 +544,8 @@ func (b *OfflineBuffer) syncLoop() {
 	}
 }
 
-// rotationLoop monitors file size and rotates when needed
-func (b *OfflineBuffer) rotationLoop() {
+// retentionLoop drops data older than the retention period and enforces the quota
+func (b *OfflineBuffer) retentionLoop() {
 	defer b.wg.Done()
 	
 	ticker := time.NewTicker(10 * time.Second)
@@ -363,238 +556,324 @@ func (b *OfflineBuffer) rotationLoop() {
 		case <-b.ctx.Done():
 			return
 		case <-ticker.C:
-			b.checkFileRotation()
 			b.cleanupOldFiles()
+			b.enforceQuota()
 		}
 	}
 }
 
-// checkFileRotation rotates file if it exceeds max size
-func (b *OfflineBuffer) checkFileRotation() {
-	if b.currentFile == nil {
+// syncOfflineFiles replays unacknowledged WAL records in order.
+// Records are published with Nats-Msg-Id machineID:sequence. The WAL offset is
+// checkpointed after every batch and up to the first unacknowledged record when a send fails,
+// so an interrupted sync resumes where it stopped; records resent after a crash
+// between checkpoints are dropped by JetStream deduplication.
+func (b *OfflineBuffer) syncOfflineFiles() {
+	if !b.syncInProgress.CompareAndSwap(false, true) {
+		log.Info().Msg("📍 Sync already in progress, skipping")
 		return
 	}
+	defer b.syncInProgress.Store(false)
 
-	stat, err := b.currentFile.Stat()
-	if err != nil {
+	pending := b.wal.PendingBytes()
+	if pending == 0 {
+		log.Info().Msg("📭 WAL empty, nothing to replay.")
 		return
 	}
 
-	if stat.Size() > b.maxFileSize {
-		log.Info().Int64("size", stat.Size()).Msg("Rotating file due to size limit")
-		if err := b.rotateFile(); err != nil {
-			log.Error().Err(err).Msg("File rotation failed")
+	log.Info().Int64("pending_bytes", pending).Int("segments", b.wal.SegmentCount()).Msg("🚀 Starting WAL replay")
+
+	sent := 0
+	skipped := 0
+	for b.ctx.Err() == nil {
+		records, err := b.wal.ReadBatch(replayBatchSize)
+		if err != nil && len(records) == 0 {
+			log.Error().Err(err).Msg("Failed to read WAL, stopping sync.")
+			b.wal.Rewind()
+			return
+		}
+		if len(records) == 0 {
+			break
 		}
-	}
-}
 
-// checkCurrentFileRotation rotates current file if it has data and we're online
-func (b *OfflineBuffer) checkCurrentFileRotation() error {
-	b.fileMutex.Lock()
-	defer b.fileMutex.Unlock()
+		msgs := make([]Message, 0, len(records))
+		msgRecords := make([]int, 0, len(records)) // Index into records of each message
+		for i, rec := range records {
+			key, err := contract.DecodeSample(rec.Data)
+			if err != nil {
+				// Checksummed, so this was written invalid; resending will not help.
+				log.Warn().Err(err).Str("record", fmt.Sprintf("%q", rec.Data)).Msg("Skipping undecodable record")
+				skipped++
+				continue
+			}
+			msgs = append(msgs, Message{ID: MessageID(key.MachineID, key.SequenceNumber), Encoding: contract.SampleEncoding(rec.Data), Data: frame(rec.Data), Resend: true})
+			msgRecords = append(msgRecords, i)
+		}
 
-	if b.currentFile == nil {
-		log.Info().Msg("🔄 No current file to rotate")
-		return nil
-	}
+		if failed, err := b.publish(msgs); err != nil {
+			// Records before the first failure are stored; checkpoint them so
+			// they are not published again. Later ones are resent and dropped
+			// by the broker as duplicates if they made it.
+			acked := acknowledgedPrefix(failed)
+			first := msgRecords[acked]
+			sent += acked
+			log.Error().Err(err).Int("sent", sent).Int("failed", len(failed)).Msg("Failed to replay WAL records, stopping sync.")
+			if first > 0 {
+				if ackErr := b.wal.Ack(records[first-1].Next); ackErr != nil {
+					log.Error().Err(ackErr).Msg("Failed to persist WAL offset")
+				}
+			}
+			b.wal.Rewind()
+			b.setOffline() // Go offline if we can't replay
+			return
+		}
+		sent += len(msgs)
 
-	stat, err := b.currentFile.Stat()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to stat current file")
-		return err
-	}
+		if err := b.wal.Ack(records[len(records)-1].Next); err != nil {
+			log.Error().Err(err).Msg("Failed to persist WAL offset")
+		}
 
-	// If current file has data and we're online, rotate it for sync
-	if stat.Size() > 0 && b.online.Load() {
-		log.Info().Int64("size", stat.Size()).Msg("🔄 Rotating current file for sync")
-		return b.rotateFileLocked()
+		log.Info().Int("records_sent", sent).Msg("📊 Replay progress")
+		time.Sleep(100 * time.Millisecond) // Rate limit replay
 	}
 
-	log.Info().Int64("size", stat.Size()).Bool("online", b.online.Load()).Msg("🔄 No rotation needed")
-	return nil
+	log.Info().Int("records", sent).Int("skipped", skipped).Msg("✅ WAL replay completed")
 }
 
-// rotateFileLocked moves current file to sync directory with timestamp.
-// It assumes the fileMutex is already held.
-func (b *OfflineBuffer) rotateFileLocked() error {
-	if b.currentFile == nil {
-		return nil // Should not happen if called correctly
+// cleanupOldFiles drops WAL segments older than the retention period,
+// whether or not they were sent
+func (b *OfflineBuffer) cleanupOldFiles() {
+	dropped, err := b.wal.DropBefore(time.Now().Add(-b.maxRetention))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to clean up old WAL segments")
 	}
-
-	// Close current file
-	if err := b.currentFile.Close(); err != nil {
-		log.Error().Err(err).Msg("Error closing current file for rotation")
-		// Attempt to reopen a new file anyway
-		b.currentFile = nil // Force re-initialization
-		return b.initCurrentFile()
+	if dropped > 0 {
+		log.Warn().Int64("bytes", dropped).Dur("retention", b.maxRetention).Msg("Dropped unsent WAL segments past retention")
 	}
+}
 
-	// Move to sync directory with timestamp
-	timestamp := time.Now().Format("20060102_150405")
-	syncPath := filepath.Join(b.dataDir, "sync", fmt.Sprintf("%s.jsonl", timestamp))
-
-	if err := os.Rename(b.currentPath, syncPath); err != nil {
-		log.Error().Err(err).Msg("Failed to rotate file")
-		// Try to reopen current file
-		return b.initCurrentFile()
+// enforceQuota applies the quota policy when the WAL outgrows the quota, then
+// updates the breach state from WAL and filesystem usage.
+func (b *OfflineBuffer) enforceQuota() {
+	quotaBytes, policy, diskPercent := b.quotaLimits()
+	used := b.wal.DiskBytes()
+	if quotaBytes > 0 && used > quotaBytes {
+		switch policy {
+		case QuotaDropOldest:
+			b.dropOldest(quotaBytes)
+		case QuotaDownsampleOlder:
+			b.downsampleOlder(used, quotaBytes)
+		}
+		used = b.wal.DiskBytes()
 	}
 
-	log.Info().Str("file", syncPath).Msg("File rotated for sync")
-
-	// Create new current file
-	return b.initCurrentFile()
-}
-
-// syncOfflineFiles replays files from sync directory.
-// This function is now synchronous and more robust.
-func (b *OfflineBuffer) syncOfflineFiles() {
-	if !b.syncInProgress.CompareAndSwap(false, true) {
-		log.Info().Msg("📍 Sync already in progress, skipping")
+	diskPct, err := diskUsedPercent(b.dataDir)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to read filesystem usage")
+	}
+
+	b.quotaMutex.Lock()
+	b.diskUsedPct = diskPct
+	wasExceeded := b.quotaExceeded.Load()
+	exceeded := wasExceeded
+	quotaHigh := quotaBytes > 0 && float64(used) >= float64(quotaBytes)*quotaHighWater
+	diskHigh := diskPercent > 0 && diskPct >= diskPercent
+	if quotaHigh || diskHigh {
+		exceeded = true
+	} else if (quotaBytes == 0 || float64(used) < float64(quotaBytes)*quotaLowWater) &&
+		(diskPercent == 0 || diskPct < diskPercent-diskHysteresisPct) {
+		exceeded = false
+	}
+	b.quotaExceeded.Store(exceeded)
+	listener := b.quotaListener
+	b.quotaMutex.Unlock()
+
+	if exceeded == wasExceeded {
 		return
 	}
-	defer b.syncInProgress.Store(false)
-
-	log.Info().Msg("🚀 Starting offline file sync")
-
-	// 1. Rotate the current file if it has data. This is a critical step.
-	if err := b.checkCurrentFileRotation(); err != nil {
-		log.Error().Err(err).Msg("Failed to rotate current file before sync. Sync may not proceed correctly.")
-		// Depending on the error, we might want to return here.
-		// For now, we'll attempt to sync any existing files.
+	if exceeded {
+		log.Warn().
+			Int64("used_bytes", used).
+			Int64("quota_bytes", quotaBytes).
+			Float64("disk_used_pct", diskPct).
+			Str("policy", policy).
+			Msg("💾 Offline buffer quota exceeded")
+	} else {
+		log.Info().Int64("used_bytes", used).Float64("disk_used_pct", diskPct).Msg("💾 Offline buffer back within quota")
+	}
+	if listener != nil {
+		listener(exceeded)
 	}
+}
 
-	// 2. Sync files from the sync directory
-	syncDir := filepath.Join(b.dataDir, "sync")
-	files, err := os.ReadDir(syncDir)
+// dropOldest drops the oldest WAL segments until the WAL fits the quota.
+func (b *OfflineBuffer) dropOldest(quotaBytes int64) {
+	dropped, err := b.wal.DropOldest(quotaBytes)
 	if err != nil {
-		log.Error().Err(err).Str("sync_dir", syncDir).Msg("Failed to read sync directory")
-		return
+		log.Error().Err(err).Msg("Failed to drop WAL segments over quota")
+	}
+	if dropped > 0 {
+		b.droppedBytes.Add(dropped)
+		log.Warn().Int64("bytes", dropped).Int64("quota_bytes", quotaBytes).Msg("🗑️ Dropped oldest unsent data over quota")
 	}
+}
 
-	if len(files) == 0 {
-		log.Info().Msg("📭 No files in sync directory to replay.")
+// downsampleOlder halves the least thinned of the oldest WAL segments until the
+// WAL fits the quota. Segments already at maxDownsampleLevel are dropped instead.
+func (b *OfflineBuffer) downsampleOlder(used, quotaBytes int64) {
+	// Rewriting a segment moves its records, so it must not overlap a replay.
+	if !b.syncInProgress.CompareAndSwap(false, true) {
 		return
 	}
+	defer b.syncInProgress.Store(false)
 
-	// Sort files by name (timestamp order) to ensure chronological replay
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].Name() < files[j].Name()
-	})
-
-	log.Info().Int("file_count", len(files)).Msg("Found files to sync, starting replay...")
+	sealed := b.wal.SealedSegments()
+	live := make(map[uint64]int, len(sealed))
+	for _, id := range sealed {
+		live[id] = b.downsampled[id]
+	}
+	b.downsampled = live
 
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".jsonl") {
-			continue
+	for used > quotaBytes {
+		var target uint64
+		level := maxDownsampleLevel
+		for _, id := range sealed {
+			if b.downsampled[id] < level {
+				target, level = id, b.downsampled[id]
+			}
 		}
-
-		filePath := filepath.Join(syncDir, file.Name())
-		log.Info().Str("file", filePath).Msg("Replaying file")
-		if err := b.replayFile(filePath); err != nil {
-			log.Error().Err(err).Str("file", filePath).Msg("Failed to replay file, stopping sync.")
-			b.setOffline() // Go offline if we can't replay
+		if level == maxDownsampleLevel {
+			// Everything is thinned as far as it goes
+			b.dropOldest(quotaBytes)
 			return
 		}
 
-		// Remove successfully synced file
-		if err := os.Remove(filePath); err != nil {
-			log.Error().Err(err).Str("file", filePath).Msg("Failed to remove synced file")
+		saved, err := b.wal.Downsample(target, 2)
+		if err != nil {
+			log.Error().Err(err).Uint64("segment", target).Msg("Failed to downsample WAL segment")
+			b.dropOldest(quotaBytes)
+			return
+		}
+		b.downsampled[target] = level + 1
+		if saved > 0 {
+			b.downsampledBytes.Add(saved)
+			used -= saved
+			log.Warn().Uint64("segment", target).Int("level", level+1).Int64("saved_bytes", saved).Msg("📉 Downsampled unsent data over quota")
 		} else {
-			log.Info().Str("file", file.Name()).Msg("✅ File synced and removed")
+			b.downsampled[target] = maxDownsampleLevel
 		}
 	}
-
-	log.Info().Msg("✅ Offline file sync completed successfully")
 }
 
-// replayFile sends all records from a file to NATS
-func (b *OfflineBuffer) replayFile(filePath string) error {
-	log.Info().Str("file", filePath).Msg("🔄 Starting file replay")
-	
-	file, err := os.Open(filePath)
-	if err != nil {
-		return err
+// Flush publishes the queued readings now and, when online, replays unsent
+// data from the WAL without waiting for the sync interval. It reports whether
+// the buffer is online; offline, queued readings go to the WAL.
+func (b *OfflineBuffer) Flush() bool {
+	select {
+	case b.flushCh <- struct{}{}:
+	default:
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	lineCount := 0
-	errorCount := 0
-	
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) == 0 {
-			continue
-		}
+	if !b.online.Load() {
+		return false
+	}
+	select {
+	case b.syncCh <- struct{}{}:
+	default:
+	}
+	return true
+}
 
-		// Validate JSON
-		if !json.Valid(line) {
-			log.Warn().Str("line", string(line)).Msg("Skipping invalid JSON")
-			errorCount++
-			if errorCount > 10 {
-				return fmt.Errorf("too many invalid JSON lines, aborting")
-			}
-			continue
-		}
+// SetQuotaListener registers fn to be called when the quota breach state changes.
+func (b *OfflineBuffer) SetQuotaListener(fn func(exceeded bool)) {
+	b.quotaMutex.Lock()
+	defer b.quotaMutex.Unlock()
+	b.quotaListener = fn
+}
 
-		// Send to NATS with timeout
-		if err := b.sendToNATS(line); err != nil {
-			log.Error().Err(err).Int("line", lineCount).Msg("Failed to send line to NATS")
-			return fmt.Errorf("failed to send line %d: %w", lineCount, err)
-		}
+// SetOnlineListener registers fn to be called when the buffer goes online or
+// offline.
+func (b *OfflineBuffer) SetOnlineListener(fn func(online bool)) {
+	b.quotaMutex.Lock()
+	defer b.quotaMutex.Unlock()
+	b.onlineListener = fn
+}
 
-		lineCount++
+// QuotaExceeded reports whether unsent data or the filesystem is over its limit.
+func (b *OfflineBuffer) QuotaExceeded() bool {
+	return b.quotaExceeded.Load()
+}
 
-		// Progress logging and rate limiting
-		if lineCount%100 == 0 {
-			log.Info().Int("lines_sent", lineCount).Msg("📊 Replay progress")
-			time.Sleep(100 * time.Millisecond) // Increased delay
-		}
-		
-		// Safety check - don't replay forever
-		if lineCount > 10000 {
-			log.Warn().Int("lines", lineCount).Msg("Replay limit reached, stopping")
-			break
-		}
-	}
+// SamplingPaused reports whether new samples should not be taken because the
+// quota is exhausted under the stop-sampling policy.
+func (b *OfflineBuffer) SamplingPaused() bool {
+	_, policy, _ := b.quotaLimits()
+	return policy == QuotaStopSampling && b.quotaExceeded.Load()
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading file: %w", err)
-	}
+// SetQuota replaces the quota limits. They take effect at the next quota check.
+func (b *OfflineBuffer) SetQuota(quotaBytes int64, policy string, diskPercent float64) {
+	b.quotaMutex.Lock()
+	defer b.quotaMutex.Unlock()
+	b.quotaBytes, b.quotaPolicy, b.diskPercent = quotaBytes, policy, diskPercent
+}
 
-	log.Info().Int("lines", lineCount).Int("errors", errorCount).Str("file", filepath.Base(filePath)).Msg("✅ File replay completed")
-	return nil
+func (b *OfflineBuffer) quotaLimits() (int64, string, float64) {
+	b.quotaMutex.Lock()
+	defer b.quotaMutex.Unlock()
+	return b.quotaBytes, b.quotaPolicy, b.diskPercent
 }
 
-// cleanupOldFiles removes files older than retention period
-func (b *OfflineBuffer) cleanupOldFiles() {
+// importLegacyFiles moves records from the pre-WAL current.jsonl and sync/*.jsonl
+// files into the WAL and removes the files once they are imported.
+func (b *OfflineBuffer) importLegacyFiles() error {
+	var files []string
 	syncDir := filepath.Join(b.dataDir, "sync")
-	files, err := os.ReadDir(syncDir)
-	if err != nil {
-		return
+	if entries, err := os.ReadDir(syncDir); err == nil {
+		for _, e := range entries {
+			if strings.HasSuffix(e.Name(), ".jsonl") {
+				files = append(files, filepath.Join(syncDir, e.Name()))
+			}
+		}
 	}
+	sort.Strings(files)
+	files = append(files, filepath.Join(b.dataDir, "current.jsonl"))
 
-	cutoff := time.Now().Add(-b.maxRetention)
-
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".jsonl") {
-			continue
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
 		}
 
-		info, err := file.Info()
+		count := 0
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), walMaxRecordSize)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(line) == 0 || !json.Valid(line) {
+				continue
+			}
+			if err := b.wal.Append(line); err != nil {
+				f.Close()
+				return err
+			}
+			count++
+		}
+		err = scanner.Err()
+		f.Close()
 		if err != nil {
-			continue
+			return fmt.Errorf("error reading %s: %w", path, err)
 		}
 
-		if info.ModTime().Before(cutoff) {
-			filePath := filepath.Join(syncDir, file.Name())
-			if err := os.Remove(filePath); err != nil {
-				log.Error().Err(err).Str("file", filePath).Msg("Failed to cleanup old file")
-			} else {
-				log.Info().Str("file", file.Name()).Msg("Cleaned up old file")
-			}
+		if err := os.Remove(path); err != nil {
+			return err
 		}
+		log.Info().Str("file", path).Int("records", count).Msg("Imported legacy offline file into WAL")
 	}
+
+	os.Remove(syncDir)
+	return nil
 }
 
 // Shutdown gracefully stops the offline buffer
@@ -604,11 +883,8 @@ func (b *OfflineBuffer) Shutdown() {
 	b.cancel()
 	b.wg.Wait()
 
-	b.fileMutex.Lock()
-	defer b.fileMutex.Unlock()
-	
-	if b.currentFile != nil {
-		b.currentFile.Close()
+	if err := b.wal.Close(); err != nil {
+		log.Error().Err(err).Msg("Error closing WAL")
 	}
 
 	log.Info().Msg("Offline buffer shutdown complete")
@@ -616,33 +892,33 @@ func (b *OfflineBuffer) Shutdown() {
 
 // GetStats returns buffer statistics
 func (b *OfflineBuffer) GetStats() map[string]interface{} {
-	b.fileMutex.Lock()
-	defer b.fileMutex.Unlock()
-
 	stats := map[string]interface{}{
-		"online":          b.online.Load(),
+		"online":           b.online.Load(),
 		"sync_in_progress": b.syncInProgress.Load(),
-		"last_online":     b.lastOnline,
-	}
-
-	// Count pending files
-	syncDir := filepath.Join(b.dataDir, "sync")
-	if files, err := os.ReadDir(syncDir); err == nil {
-		pendingFiles := 0
-		for _, file := range files {
-			if strings.HasSuffix(file.Name(), ".jsonl") {
-				pendingFiles++
-			}
-		}
-		stats["pending_files"] = pendingFiles
-	}
-
-	// Current file size
-	if b.currentFile != nil {
-		if stat, err := b.currentFile.Stat(); err == nil {
-			stats["current_file_size"] = stat.Size()
-		}
-	}
+		"last_online":      b.lastOnline,
+		"pending_bytes":    b.wal.PendingBytes(),
+		"wal_segments":     b.wal.SegmentCount(),
+	}
+
+	used := b.wal.DiskBytes()
+	b.quotaMutex.Lock()
+	diskPct := b.diskUsedPct
+	quotaBytes, policy, diskPercent := b.quotaBytes, b.quotaPolicy, b.diskPercent
+	b.quotaMutex.Unlock()
+	quota := map[string]interface{}{
+		"policy":            policy,
+		"limit_bytes":       quotaBytes,
+		"used_bytes":        used,
+		"exceeded":          b.quotaExceeded.Load(),
+		"dropped_bytes":     b.droppedBytes.Load(),
+		"downsampled_bytes": b.downsampledBytes.Load(),
+		"disk_used_pct":     diskPct,
+		"disk_limit_pct":    diskPercent,
+	}
+	if quotaBytes > 0 {
+		quota["used_pct"] = float64(used) / float64(quotaBytes) * 100
+	}
+	stats["quota"] = quota
 
 	return stats
-}
\ No newline at end of file
+}
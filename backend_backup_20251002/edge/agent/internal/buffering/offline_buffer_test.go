@@ -0,0 +1,317 @@
+package buffering
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cnc-monitor/contract"
+)
+
+// scriptedProcessor fails its first ProcessMessages call with err and
+// records the IDs of every message it is given.
+type scriptedProcessor struct {
+	err   error
+	calls [][]string
+}
+
+func (p *scriptedProcessor) Process(ctx context.Context, batch Batch) error {
+	return errors.New("not used")
+}
+
+func (p *scriptedProcessor) ProcessMessages(ctx context.Context, msgs []Message) error {
+	ids := make([]string, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	p.calls = append(p.calls, ids)
+	if len(p.calls) == 1 {
+		return p.err
+	}
+	return nil
+}
+
+func TestSyncOfflineFilesPartialFailure(t *testing.T) {
+	errNoAck := errors.New("no ack")
+	tests := []struct {
+		name   string
+		err    error
+		resent []string // Published by the replay after the failed one
+	}{
+		{
+			name:   "plain error",
+			err:    errNoAck,
+			resent: []string{"M:1", "M:2", "M:3", "M:4"},
+		},
+		{
+			name:   "publish error without failed messages",
+			err:    &PublishError{Err: errNoAck},
+			resent: []string{"M:1", "M:2", "M:3", "M:4"},
+		},
+		{
+			name:   "failed index out of range",
+			err:    &PublishError{Failed: []int{4}, Err: errNoAck},
+			resent: []string{"M:1", "M:2", "M:3", "M:4"},
+		},
+		{
+			name:   "failures out of order",
+			err:    &PublishError{Failed: []int{3, 1}, Err: errNoAck},
+			resent: []string{"M:2", "M:3", "M:4"},
+		},
+		{
+			name:   "failure after an undecodable record",
+			err:    &PublishError{Failed: []int{2}, Err: errNoAck},
+			resent: []string{"M:3", "M:4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := openTestWAL(t, t.TempDir(), 0)
+			defer w.Close()
+			for _, seq := range []uint64{1, 2, 0, 3, 4} {
+				record, err := contract.EncodeSample(contract.EncodingJSON, SensorData{MachineID: "M", SequenceNumber: seq})
+				if seq == 0 {
+					record, err = []byte("not a sample"), nil
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Append(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p := &scriptedProcessor{err: tt.err}
+			b := &OfflineBuffer{wal: w, processor: p, ctx: context.Background(), downsampled: make(map[uint64]int)}
+			b.syncOfflineFiles()
+			b.syncOfflineFiles()
+
+			if len(p.calls) != 2 {
+				t.Fatalf("%d publishes, want 2: %v", len(p.calls), p.calls)
+			}
+			if want := []string{"M:1", "M:2", "M:3", "M:4"}; !reflect.DeepEqual(p.calls[0], want) {
+				t.Errorf("first replay published %v, want %v", p.calls[0], want)
+			}
+			if !reflect.DeepEqual(p.calls[1], tt.resent) {
+				t.Errorf("second replay published %v, want %v", p.calls[1], tt.resent)
+			}
+			if got := w.PendingBytes(); got != 0 {
+				t.Errorf("%d bytes pending after a successful replay", got)
+			}
+		})
+	}
+}
+
+// switchProcessor reports the connectivity the test sets and counts the
+// messages published.
+type switchProcessor struct {
+	connected atomic.Bool
+	published atomic.Int64
+}
+
+func (p *switchProcessor) Process(ctx context.Context, batch Batch) error {
+	return errors.New("not used")
+}
+
+func (p *switchProcessor) IsConnected() bool { return p.connected.Load() }
+
+func (p *switchProcessor) ProcessMessages(ctx context.Context, msgs []Message) error {
+	p.published.Add(int64(len(msgs)))
+	return nil
+}
+
+func TestFlushDuringShutdown(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		p := &switchProcessor{}
+		p.connected.Store(true)
+		b, err := NewOfflineBuffer(OfflineConfig{
+			DataDir:      t.TempDir(),
+			MaxFileSize:  1 << 20,
+			MaxRetention: time.Hour,
+			SyncInterval: time.Hour,
+		}, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.online.Store(true)
+
+		// flush-buffers commands and the Recovering handler may arrive while
+		// the buffer shuts down; none may start work Shutdown does not wait for
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					b.Flush()
+					b.CheckConnectivity()
+				}
+			}
+		}()
+		b.Shutdown()
+
+		record, err := contract.EncodeSample(contract.EncodingJSON, SensorData{MachineID: "M", SequenceNumber: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		published := p.published.Load()
+		b.wal.Append(record)
+		time.Sleep(10 * time.Millisecond)
+		close(stop)
+		<-done
+		if n := p.published.Load(); n != published {
+			t.Fatalf("%d messages published after shutdown", n-published)
+		}
+	}
+}
+
+// quotaSegment is the size of a WAL segment holding ten records of
+// appendRecords with three-digit numbers.
+const quotaSegment = 10 * (walHeaderSize + int64(len("record-100")))
+
+// newQuotaBuffer returns an offline buffer whose WAL holds six full segments
+// of ten records each, record-100 through record-159, and records the quota
+// breach changes it reports.
+func newQuotaBuffer(t *testing.T, policy string, quotaBytes int64) (*OfflineBuffer, *[]bool) {
+	t.Helper()
+	b, err := NewOfflineBuffer(OfflineConfig{
+		DataDir:      t.TempDir(),
+		MaxFileSize:  quotaSegment,
+		MaxRetention: time.Hour,
+		SyncInterval: time.Hour,
+		QuotaBytes:   quotaBytes,
+		QuotaPolicy:  policy,
+	}, &switchProcessor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Shutdown)
+	appendRecords(t, b.wal, 100, 159)
+	if used := b.wal.DiskBytes(); used != 6*quotaSegment {
+		t.Fatalf("wal holds %d bytes, want %d", used, 6*quotaSegment)
+	}
+	var changes []bool
+	b.SetQuotaListener(func(exceeded bool) { changes = append(changes, exceeded) })
+	return b, &changes
+}
+
+func TestQuotaPolicies(t *testing.T) {
+	tests := []struct {
+		policy      string
+		quota       int64
+		kept        []string
+		used        int64
+		dropped     int64
+		downsampled int64
+		exceeded    bool
+	}{
+		{
+			// Whole segments go, oldest first, until the WAL fits
+			policy:  QuotaDropOldest,
+			quota:   4*quotaSegment - 1,
+			kept:    names(130, 159),
+			used:    3 * quotaSegment,
+			dropped: 3 * quotaSegment,
+		},
+		{
+			// Every other record of the oldest segments is dropped until the
+			// WAL fits; 5 of 6 segments is still above 90% of the quota
+			policy:      QuotaDownsampleOlder,
+			quota:       5 * quotaSegment,
+			kept:        append(evenNames(100, 119), names(120, 159)...),
+			used:        5 * quotaSegment,
+			downsampled: quotaSegment,
+			exceeded:    true,
+		},
+		{
+			// Nothing is dropped; sampling stops instead
+			policy:   QuotaStopSampling,
+			quota:    5 * quotaSegment,
+			kept:     names(100, 159),
+			used:     6 * quotaSegment,
+			exceeded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			b, changes := newQuotaBuffer(t, tt.policy, tt.quota)
+			b.enforceQuota()
+
+			if kept, _ := readAll(t, b.wal); !reflect.DeepEqual(kept, tt.kept) {
+				t.Errorf("kept %v, want %v", kept, tt.kept)
+			}
+			if used := b.wal.DiskBytes(); used != tt.used {
+				t.Errorf("wal holds %d bytes, want %d", used, tt.used)
+			}
+			if got := b.droppedBytes.Load(); got != tt.dropped {
+				t.Errorf("dropped %d bytes, want %d", got, tt.dropped)
+			}
+			if got := b.downsampledBytes.Load(); got != tt.downsampled {
+				t.Errorf("downsampled %d bytes, want %d", got, tt.downsampled)
+			}
+			if b.QuotaExceeded() != tt.exceeded {
+				t.Errorf("quota exceeded %v, want %v", b.QuotaExceeded(), tt.exceeded)
+			}
+			if paused := tt.policy == QuotaStopSampling && tt.exceeded; b.SamplingPaused() != paused {
+				t.Errorf("sampling paused %v, want %v", b.SamplingPaused(), paused)
+			}
+			var want []bool
+			if tt.exceeded {
+				want = []bool{true}
+			}
+			if !reflect.DeepEqual(*changes, want) {
+				t.Errorf("listener got %v, want %v", *changes, want)
+			}
+		})
+	}
+}
+
+// evenNames is names(from, to) with every other record left out.
+func evenNames(from, to int) []string {
+	var s []string
+	for i := from; i <= to; i += 2 {
+		s = append(s, fmt.Sprintf("record-%d", i))
+	}
+	return s
+}
+
+func TestQuotaHysteresis(t *testing.T) {
+	b, changes := newQuotaBuffer(t, QuotaStopSampling, 0)
+	used := 6 * quotaSegment
+
+	// The breach is reported from 90% of the quota and clears below 80%
+	for _, step := range []struct {
+		quota    int64
+		exceeded bool
+	}{
+		{used * 10 / 8, false}, // 80%
+		{used * 10 / 9, true},  // 90%
+		{used * 10 / 8, true},  // 80%, still breached
+		{used*10/8 + 1, false}, // Just below 80%
+		{used * 10 / 9, true},
+		{0, false}, // No byte quota
+	} {
+		b.SetQuota(step.quota, QuotaStopSampling, 0)
+		b.enforceQuota()
+		if b.QuotaExceeded() != step.exceeded {
+			t.Fatalf("quota %d for %d bytes: exceeded %v, want %v", step.quota, used, b.QuotaExceeded(), step.exceeded)
+		}
+		if b.SamplingPaused() != step.exceeded {
+			t.Errorf("quota %d: sampling paused %v", step.quota, b.SamplingPaused())
+		}
+	}
+	if want := []bool{true, false, true, false}; !reflect.DeepEqual(*changes, want) {
+		t.Errorf("listener got %v, want %v", *changes, want)
+	}
+	if kept, _ := readAll(t, b.wal); !reflect.DeepEqual(kept, names(100, 159)) {
+		t.Errorf("stop-sampling dropped data, kept %v", kept)
+	}
+}
@@ -0,0 +1,774 @@
+package buffering
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// walHeaderSize is the per-record header: 4-byte length + 4-byte CRC32C, both big-endian.
+	walHeaderSize = 8
+	// walMaxRecordSize guards against reading garbage lengths from a corrupt segment.
+	walMaxRecordSize = 1024 * 1024
+	walSegmentExt    = ".wal"
+	walOffsetFile    = "consumer.offset"
+)
+
+var (
+	walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrRecordTooLarge = errors.New("wal record exceeds maximum size")
+	ErrCorruptRecord  = errors.New("wal record is corrupt")
+)
+
+// WALPosition addresses a byte offset inside a WAL segment.
+type WALPosition struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// Before reports whether p is strictly before q.
+func (p WALPosition) Before(q WALPosition) bool {
+	return p.Segment < q.Segment || (p.Segment == q.Segment && p.Offset < q.Offset)
+}
+
+// WALRecord is a record read from the WAL. Next is the position just past the
+// record; acknowledging it marks this record and everything before it as delivered.
+type WALRecord struct {
+	Pos  WALPosition
+	Next WALPosition
+	Data []byte
+}
+
+// WAL is a segmented, append-only write-ahead log with a single consumer.
+//
+// Each record is framed as [len uint32][crc32c uint32][payload]. With a zero
+// sync interval appends are fsynced before returning; otherwise appends are
+// group-committed by an fsync every sync interval, so a power cut loses at most
+// that much data. The consumer reads from an in-memory cursor and
+// acknowledges positions once the backend has accepted the records; the
+// acknowledged position is persisted, and segments are only deleted once every
+// record in them has been acknowledged. On open, a torn or corrupt tail in the
+// newest segment (e.g. from a power cut mid-write) is truncated away.
+type WAL struct {
+	dir          string
+	segmentSize  int64
+	syncInterval time.Duration
+
+	mu         sync.Mutex
+	segments   []uint64 // Sorted segment IDs, the last one is active
+	active     *os.File
+	activeSize int64
+	dirty      bool        // Appends not yet fsynced
+	readPos    WALPosition // Next record to hand to the consumer
+	ackPos     WALPosition // Everything before this has been acknowledged
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// OpenWAL opens (or creates) a WAL in dir, recovering from torn writes.
+// syncInterval is how often appends are fsynced; zero fsyncs every append.
+func OpenWAL(dir string, segmentSize int64, syncInterval time.Duration) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create wal directory: %w", err)
+	}
+	if segmentSize <= 0 {
+		segmentSize = 10 * 1024 * 1024
+	}
+
+	w := &WAL{dir: dir, segmentSize: segmentSize, syncInterval: syncInterval, done: make(chan struct{})}
+
+	segments, err := w.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	w.segments = segments
+	if len(w.segments) == 0 {
+		w.segments = []uint64{1}
+	}
+
+	// Recover the active segment: keep only the prefix of valid records.
+	activeID := w.segments[len(w.segments)-1]
+	validSize, err := w.scanValid(activeID)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(w.segmentPath(activeID), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal segment: %w", err)
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > validSize {
+		log.Warn().
+			Uint64("segment", activeID).
+			Int64("size", info.Size()).
+			Int64("valid_size", validSize).
+			Msg("WAL: truncating torn or corrupt tail")
+		if err := f.Truncate(validSize); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to truncate wal segment: %w", err)
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(validSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.active = f
+	w.activeSize = validSize
+
+	if err := w.loadOffset(); err != nil {
+		log.Warn().Err(err).Msg("WAL: failed to load consumer offset, replaying from oldest segment")
+		w.ackPos = WALPosition{Segment: w.segments[0]}
+	}
+	w.readPos = w.ackPos
+
+	if syncInterval > 0 {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+
+	log.Info().
+		Str("dir", dir).
+		Int("segments", len(w.segments)).
+		Uint64("ack_segment", w.ackPos.Segment).
+		Int64("ack_offset", w.ackPos.Offset).
+		Dur("sync_interval", syncInterval).
+		Msg("WAL opened")
+
+	return w, nil
+}
+
+// syncLoop fsyncs the appends of the last sync interval in one go.
+func (w *WAL) syncLoop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				log.Error().Err(err).Msg("WAL: fsync failed")
+			}
+		}
+	}
+}
+
+// Sync fsyncs the records appended since the last sync.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.active == nil || !w.dirty {
+		return nil
+	}
+	if err := w.active.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// Append writes a record. With a zero sync interval it returns once the record
+// is on disk; otherwise the record is fsynced by the next group commit.
+func (w *WAL) Append(data []byte) error {
+	if len(data) > walMaxRecordSize {
+		return ErrRecordTooLarge
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.active == nil {
+		return errors.New("wal is closed")
+	}
+
+	if w.activeSize > 0 && w.activeSize+int64(walHeaderSize+len(data)) > w.segmentSize {
+		if err := w.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, walHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, walCRCTable))
+	copy(buf[walHeaderSize:], data)
+
+	n, err := w.active.Write(buf)
+	if err != nil {
+		// Drop whatever part of the record made it out so the segment stays well-formed.
+		if n > 0 {
+			_ = w.active.Truncate(w.activeSize)
+			_, _ = w.active.Seek(w.activeSize, io.SeekStart)
+		}
+		return err
+	}
+	w.activeSize += int64(n)
+	if w.syncInterval > 0 {
+		w.dirty = true
+		return nil
+	}
+	return w.active.Sync()
+}
+
+// ReadBatch returns up to max records starting at the consumer cursor and
+// advances the cursor. Records are not removed until they are acknowledged.
+func (w *WAL) ReadBatch(max int) ([]WALRecord, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var records []WALRecord
+	for len(records) < max {
+		segIdx := w.segmentIndex(w.readPos.Segment)
+		if segIdx < 0 {
+			// Cursor points at a deleted segment; move to the oldest remaining one.
+			w.readPos = WALPosition{Segment: w.segments[0]}
+			continue
+		}
+		isActive := segIdx == len(w.segments)-1
+
+		var size int64
+		if isActive {
+			size = w.activeSize
+		} else {
+			info, err := os.Stat(w.segmentPath(w.readPos.Segment))
+			if err != nil {
+				return records, err
+			}
+			size = info.Size()
+		}
+
+		if w.readPos.Offset >= size {
+			if isActive {
+				break
+			}
+			w.readPos = WALPosition{Segment: w.segments[segIdx+1]}
+			continue
+		}
+
+		batch, next, err := w.readSegment(w.readPos, size, max-len(records))
+		records = append(records, batch...)
+		w.readPos = next
+		if err != nil {
+			if errors.Is(err, ErrCorruptRecord) && !isActive {
+				// A sealed segment cannot be resynchronized past a bad header; skip its tail.
+				log.Error().Err(err).Uint64("segment", next.Segment).Int64("offset", next.Offset).Msg("WAL: skipping corrupt remainder of segment")
+				w.readPos = WALPosition{Segment: w.segments[segIdx+1]}
+				continue
+			}
+			return records, err
+		}
+	}
+	return records, nil
+}
+
+// Rewind moves the consumer cursor back to the last acknowledged position,
+// e.g. after a failed send, so unacknowledged records are read again.
+func (w *WAL) Rewind() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.readPos = w.ackPos
+}
+
+// Ack marks every record before pos as delivered, persists the consumer offset
+// and deletes segments that no longer hold unacknowledged records.
+func (w *WAL) Ack(pos WALPosition) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.ackPos.Before(pos) {
+		return nil
+	}
+
+	// Normalize "end of a sealed segment" to "start of the next one".
+	for {
+		idx := w.segmentIndex(pos.Segment)
+		if idx < 0 || idx == len(w.segments)-1 {
+			break
+		}
+		info, err := os.Stat(w.segmentPath(pos.Segment))
+		if err != nil || pos.Offset < info.Size() {
+			break
+		}
+		pos = WALPosition{Segment: w.segments[idx+1]}
+	}
+
+	w.ackPos = pos
+	if w.readPos.Before(pos) {
+		w.readPos = pos
+	}
+	if err := w.saveOffset(); err != nil {
+		return err
+	}
+	return w.deleteAckedSegmentsLocked()
+}
+
+// DropBefore discards sealed segments last written before cutoff, whether or not they
+// were acknowledged. It returns the number of bytes dropped. This is the retention
+// policy of last resort; the caller is expected to log the data loss.
+func (w *WAL) DropBefore(cutoff time.Time) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var dropped int64
+	for len(w.segments) > 1 {
+		id := w.segments[0]
+		info, err := os.Stat(w.segmentPath(id))
+		if err != nil {
+			return dropped, err
+		}
+		if !info.ModTime().Before(cutoff) {
+			break
+		}
+		if err := os.Remove(w.segmentPath(id)); err != nil {
+			return dropped, err
+		}
+		dropped += info.Size()
+		w.segments = w.segments[1:]
+	}
+
+	return dropped, w.clampPositionsLocked()
+}
+
+// DropOldest discards the oldest sealed segments, acknowledged or not, until the
+// WAL uses at most limit bytes on disk or only the active segment is left. It
+// returns the number of bytes dropped.
+func (w *WAL) DropOldest(limit int64) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	total := w.diskBytesLocked()
+	var dropped int64
+	for len(w.segments) > 1 && total > limit {
+		id := w.segments[0]
+		info, err := os.Stat(w.segmentPath(id))
+		if err != nil {
+			return dropped, err
+		}
+		if err := os.Remove(w.segmentPath(id)); err != nil {
+			return dropped, err
+		}
+		dropped += info.Size()
+		total -= info.Size()
+		w.segments = w.segments[1:]
+	}
+	return dropped, w.clampPositionsLocked()
+}
+
+// Downsample rewrites sealed segment id keeping only every keepEvery-th
+// unacknowledged record, and returns the number of bytes saved. The rewrite is
+// atomic. It must not run while the consumer has unacknowledged reads
+// outstanding, since record positions in the segment change.
+func (w *WAL) Downsample(id uint64, keepEvery int) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	idx := w.segmentIndex(id)
+	if idx < 0 || idx == len(w.segments)-1 {
+		return 0, fmt.Errorf("wal segment %d is not a sealed segment", id)
+	}
+	if keepEvery < 2 {
+		return 0, nil
+	}
+	path := w.segmentPath(id)
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	start := WALPosition{Segment: id}
+	if w.ackPos.Segment == id {
+		start = w.ackPos
+	}
+	records, _, err := w.readSegment(start, info.Size(), math.MaxInt)
+	if err != nil && !errors.Is(err, ErrCorruptRecord) {
+		return 0, err
+	}
+
+	var buf []byte
+	for i, rec := range records {
+		if i%keepEvery != 0 {
+			continue
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(rec.Data)))
+		buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(rec.Data, walCRCTable))
+		buf = append(buf, rec.Data...)
+	}
+	if err := writeFileAtomic(path, buf); err != nil {
+		return 0, err
+	}
+	// Keep the write time, which retention (DropBefore) goes by
+	_ = os.Chtimes(path, info.ModTime(), info.ModTime())
+
+	if w.ackPos.Segment == id {
+		w.ackPos = WALPosition{Segment: id}
+		if err := w.saveOffset(); err != nil {
+			return 0, err
+		}
+	}
+	if w.readPos.Segment == id {
+		w.readPos = WALPosition{Segment: id}
+	}
+	return info.Size() - int64(len(buf)), nil
+}
+
+// clampPositionsLocked moves the ack and read positions past dropped segments.
+func (w *WAL) clampPositionsLocked() error {
+	if w.ackPos.Segment < w.segments[0] {
+		w.ackPos = WALPosition{Segment: w.segments[0]}
+		if err := w.saveOffset(); err != nil {
+			return err
+		}
+	}
+	if w.readPos.Before(w.ackPos) {
+		w.readPos = w.ackPos
+	}
+	return nil
+}
+
+// DiskBytes returns the size of all segments on disk, acknowledged or not.
+func (w *WAL) DiskBytes() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.diskBytesLocked()
+}
+
+func (w *WAL) diskBytesLocked() int64 {
+	total := w.activeSize
+	for _, id := range w.segments[:len(w.segments)-1] {
+		if info, err := os.Stat(w.segmentPath(id)); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// SealedSegments returns the IDs of the segments no longer written to, oldest first.
+func (w *WAL) SealedSegments() []uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]uint64(nil), w.segments[:len(w.segments)-1]...)
+}
+
+// PendingBytes returns the number of bytes not yet acknowledged.
+func (w *WAL) PendingBytes() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var total int64
+	for i, id := range w.segments {
+		if id < w.ackPos.Segment {
+			continue
+		}
+		var size int64
+		if i == len(w.segments)-1 {
+			size = w.activeSize
+		} else if info, err := os.Stat(w.segmentPath(id)); err == nil {
+			size = info.Size()
+		}
+		if id == w.ackPos.Segment {
+			size -= w.ackPos.Offset
+		}
+		total += size
+	}
+	return total
+}
+
+// SegmentCount returns the number of segments on disk.
+func (w *WAL) SegmentCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.segments)
+}
+
+// Close syncs and closes the active segment.
+func (w *WAL) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.active == nil {
+		return nil
+	}
+	err := w.active.Sync()
+	if cerr := w.active.Close(); err == nil {
+		err = cerr
+	}
+	w.active = nil
+	return err
+}
+
+// ReadWALDir reads every record of the WAL in dir, acknowledged or not, without
+// opening it for writing, e.g. to replay what an agent buffered. dir may also
+// be an offline data directory holding the WAL in wal/, or a single segment
+// file. A corrupt record ends its segment, as for the consumer.
+func ReadWALDir(dir string) ([][]byte, error) {
+	w := &WAL{dir: dir}
+	var segments []uint64
+	if filepath.Ext(dir) == walSegmentExt {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(dir), walSegmentExt), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a wal segment", dir)
+		}
+		w.dir, segments = filepath.Dir(dir), []uint64{id}
+	} else {
+		if info, err := os.Stat(filepath.Join(dir, "wal")); err == nil && info.IsDir() {
+			w.dir = filepath.Join(dir, "wal")
+		}
+		var err error
+		if segments, err = w.listSegments(); err != nil {
+			return nil, err
+		}
+	}
+
+	var records [][]byte
+	for _, id := range segments {
+		info, err := os.Stat(w.segmentPath(id))
+		if err != nil {
+			return nil, err
+		}
+		segment, _, err := w.readSegment(WALPosition{Segment: id}, info.Size(), math.MaxInt)
+		if err != nil && !errors.Is(err, ErrCorruptRecord) {
+			return nil, err
+		}
+		for _, rec := range segment {
+			records = append(records, rec.Data)
+		}
+	}
+	return records, nil
+}
+
+// readSegment reads up to max records of one segment starting at pos, stopping at size.
+func (w *WAL) readSegment(pos WALPosition, size int64, max int) ([]WALRecord, WALPosition, error) {
+	f, err := os.Open(w.segmentPath(pos.Segment))
+	if err != nil {
+		return nil, pos, err
+	}
+	defer f.Close()
+
+	var records []WALRecord
+	header := make([]byte, walHeaderSize)
+	for len(records) < max && pos.Offset < size {
+		data, err := readRecordAt(f, header, pos.Offset, size)
+		if err != nil {
+			return records, pos, err
+		}
+		next := WALPosition{Segment: pos.Segment, Offset: pos.Offset + int64(walHeaderSize+len(data))}
+		records = append(records, WALRecord{Pos: pos, Next: next, Data: data})
+		pos = next
+	}
+	return records, pos, nil
+}
+
+// readRecordAt reads and verifies the record at offset. size bounds the readable region.
+func readRecordAt(f *os.File, header []byte, offset, size int64) ([]byte, error) {
+	if size-offset < walHeaderSize {
+		return nil, fmt.Errorf("%w: truncated header at offset %d", ErrCorruptRecord, offset)
+	}
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if length > walMaxRecordSize || int64(length) > size-offset-walHeaderSize {
+		return nil, fmt.Errorf("%w: bad length %d at offset %d", ErrCorruptRecord, length, offset)
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+walHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(data, walCRCTable) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorruptRecord, offset)
+	}
+	return data, nil
+}
+
+// scanValid returns the length of the longest prefix of valid records in a segment.
+func (w *WAL) scanValid(id uint64) (int64, error) {
+	f, err := os.Open(w.segmentPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, walHeaderSize)
+	var offset int64
+	for offset < info.Size() {
+		data, err := readRecordAt(f, header, offset, info.Size())
+		if err != nil {
+			break
+		}
+		offset += int64(walHeaderSize + len(data))
+	}
+	return offset, nil
+}
+
+// rotateLocked seals the active segment and starts a new one.
+func (w *WAL) rotateLocked() error {
+	if err := w.active.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	if err := w.active.Close(); err != nil {
+		return err
+	}
+
+	id := w.segments[len(w.segments)-1] + 1
+	f, err := os.OpenFile(w.segmentPath(id), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create wal segment: %w", err)
+	}
+	syncDir(w.dir)
+
+	w.active = f
+	w.activeSize = 0
+	w.segments = append(w.segments, id)
+	log.Debug().Uint64("segment", id).Msg("WAL: rotated segment")
+	return nil
+}
+
+// deleteAckedSegmentsLocked removes sealed segments that lie entirely before the ack position.
+func (w *WAL) deleteAckedSegmentsLocked() error {
+	for len(w.segments) > 1 && w.segments[0] < w.ackPos.Segment {
+		id := w.segments[0]
+		if err := os.Remove(w.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		w.segments = w.segments[1:]
+		log.Debug().Uint64("segment", id).Msg("WAL: deleted acknowledged segment")
+	}
+	return nil
+}
+
+func (w *WAL) loadOffset() error {
+	data, err := os.ReadFile(filepath.Join(w.dir, walOffsetFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.ackPos = WALPosition{Segment: w.segments[0]}
+			return nil
+		}
+		return err
+	}
+	var pos WALPosition
+	if err := json.Unmarshal(data, &pos); err != nil {
+		return err
+	}
+	if pos.Segment < w.segments[0] {
+		// The acknowledged segment was already deleted.
+		pos = WALPosition{Segment: w.segments[0]}
+	}
+	if pos.Segment == w.segments[len(w.segments)-1] && pos.Offset > w.activeSize {
+		// The tail was truncated during recovery.
+		pos.Offset = w.activeSize
+	}
+	w.ackPos = pos
+	return nil
+}
+
+// saveOffset persists the ack position with write-then-rename so a crash never
+// leaves a partially written offset file behind.
+func (w *WAL) saveOffset() error {
+	data, err := json.Marshal(w.ackPos)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(w.dir, walOffsetFile), data)
+}
+
+func (w *WAL) listSegments() ([]uint64, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (w *WAL) segmentIndex(id uint64) int {
+	for i, s := range w.segments {
+		if s == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (w *WAL) segmentPath(id uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%016d%s", id, walSegmentExt))
+}
+
+// writeFileAtomic writes data to a temporary file, fsyncs it and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir fsyncs a directory so that renames and new files survive a power cut.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+}
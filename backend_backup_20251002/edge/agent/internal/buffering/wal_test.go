@@ -0,0 +1,278 @@
+package buffering
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// walRecordSize is the on-disk size of the records written by appendRecords.
+const walRecordSize int64 = walHeaderSize + int64(len("record-1"))
+
+func openTestWAL(t *testing.T, dir string, segmentSize int64) *WAL {
+	t.Helper()
+	w, err := OpenWAL(dir, segmentSize, 0)
+	if err != nil {
+		t.Fatalf("open wal: %v", err)
+	}
+	return w
+}
+
+// appendRecords appends "record-<from>" through "record-<to>".
+func appendRecords(t *testing.T, w *WAL, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		if err := w.Append([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+}
+
+func readAll(t *testing.T, w *WAL) ([]string, []WALRecord) {
+	t.Helper()
+	records, err := w.ReadBatch(1000)
+	if err != nil {
+		t.Fatalf("read batch: %v", err)
+	}
+	var data []string
+	for _, r := range records {
+		data = append(data, string(r.Data))
+	}
+	return data, records
+}
+
+func names(from, to int) []string {
+	var s []string
+	for i := from; i <= to; i++ {
+		s = append(s, fmt.Sprintf("record-%d", i))
+	}
+	return s
+}
+
+// corrupt overwrites the segment file of id starting at offset, or appends
+// b to it when offset is negative.
+func corrupt(t *testing.T, w *WAL, id uint64, offset int64, b []byte) {
+	t.Helper()
+	f, err := os.OpenFile(w.segmentPath(id), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if offset < 0 {
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset = info.Size()
+	}
+	if _, err := f.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALRecoversTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		tear func(t *testing.T, w *WAL)
+		want []string
+	}{
+		{
+			name: "truncated header",
+			tear: func(t *testing.T, w *WAL) {
+				// Half a header of a fourth record made it to disk
+				corrupt(t, w, 1, -1, []byte{0, 0, 0, 8})
+			},
+			want: names(1, 3),
+		},
+		{
+			name: "truncated payload",
+			tear: func(t *testing.T, w *WAL) {
+				if err := os.Truncate(w.segmentPath(1), 3*walRecordSize-2); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: names(1, 2),
+		},
+		{
+			name: "checksum mismatch mid-segment",
+			tear: func(t *testing.T, w *WAL) {
+				// Flip a payload byte of the second record; nothing after it can be trusted
+				corrupt(t, w, 1, walRecordSize+walHeaderSize, []byte{'X'})
+			},
+			want: names(1, 1),
+		},
+		{
+			name: "bad length",
+			tear: func(t *testing.T, w *WAL) {
+				corrupt(t, w, 1, 2*walRecordSize, []byte{0xff, 0xff, 0xff, 0xff})
+			},
+			want: names(1, 2),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := openTestWAL(t, dir, 0)
+			appendRecords(t, w, 1, 3)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			tt.tear(t, w)
+
+			w = openTestWAL(t, dir, 0)
+			defer w.Close()
+			info, err := os.Stat(w.segmentPath(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := int64(len(tt.want)) * walRecordSize; info.Size() != want {
+				t.Errorf("segment is %d bytes after recovery, want %d", info.Size(), want)
+			}
+
+			// Appends continue right after the last valid record
+			appendRecords(t, w, 4, 4)
+			got, _ := readAll(t, w)
+			if want := append(tt.want, "record-4"); !reflect.DeepEqual(got, want) {
+				t.Errorf("read %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestWALSkipsCorruptRemainderOfSealedSegment(t *testing.T) {
+	w := openTestWAL(t, t.TempDir(), 3*walRecordSize)
+	defer w.Close()
+	appendRecords(t, w, 1, 7)
+	if got := w.SealedSegments(); !reflect.DeepEqual(got, []uint64{1, 2}) {
+		t.Fatalf("sealed segments %v, want [1 2]", got)
+	}
+
+	// Corrupt the second record of the first segment
+	corrupt(t, w, 1, walRecordSize+walHeaderSize, []byte{'X'})
+
+	got, _ := readAll(t, w)
+	if want := append(names(1, 1), names(4, 7)...); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+func TestWALOffsetSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 0)
+	appendRecords(t, w, 1, 5)
+
+	// Everything is read, but only the first three are acknowledged
+	_, records := readAll(t, w)
+	if err := w.Ack(records[2].Next); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = openTestWAL(t, dir, 0)
+	defer w.Close()
+	if got, want := w.PendingBytes(), 2*walRecordSize; got != want {
+		t.Errorf("pending %d bytes, want %d", got, want)
+	}
+	got, _ := readAll(t, w)
+	if want := names(4, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %q after reopen, want %q", got, want)
+	}
+
+	// Rewind goes back to the persisted offset, not to the start
+	w.Rewind()
+	got, _ = readAll(t, w)
+	if want := names(4, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %q after rewind, want %q", got, want)
+	}
+}
+
+func TestWALAckDeletesSegments(t *testing.T) {
+	w := openTestWAL(t, t.TempDir(), 3*walRecordSize)
+	defer w.Close()
+	appendRecords(t, w, 1, 8)
+	if got := w.SegmentCount(); got != 3 {
+		t.Fatalf("%d segments, want 3", got)
+	}
+	_, records := readAll(t, w)
+
+	// Acknowledging part of segment 2 frees segment 1 only
+	if err := w.Ack(records[4].Next); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(w.segmentPath(1)); !os.IsNotExist(err) {
+		t.Errorf("segment 1 still on disk after ack: %v", err)
+	}
+	if _, err := os.Stat(w.segmentPath(2)); err != nil {
+		t.Errorf("segment 2 with unacknowledged records deleted: %v", err)
+	}
+
+	// Acknowledging the end of a sealed segment frees it too
+	if err := w.Ack(records[5].Next); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(w.segmentPath(2)); !os.IsNotExist(err) {
+		t.Errorf("segment 2 still on disk after ack: %v", err)
+	}
+	if got := w.SegmentCount(); got != 1 {
+		t.Errorf("%d segments, want only the active one", got)
+	}
+
+	// The active segment is kept even when fully acknowledged
+	if err := w.Ack(records[7].Next); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.PendingBytes(); got != 0 {
+		t.Errorf("pending %d bytes, want 0", got)
+	}
+	if _, err := os.Stat(w.segmentPath(3)); err != nil {
+		t.Errorf("active segment deleted: %v", err)
+	}
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, 0, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, w, 1, 3)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		w.mu.Lock()
+		dirty := w.dirty
+		w.mu.Unlock()
+		if !dirty {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("appends not fsynced within a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Appends are readable before they are synced, and survive a close
+	appendRecords(t, w, 4, 4)
+	got, _ := readAll(t, w)
+	if want := names(1, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("second close: %v", err)
+	}
+
+	w = openTestWAL(t, dir, 0)
+	defer w.Close()
+	got, _ = readAll(t, w)
+	if want := names(1, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("read %q after reopen, want %q", got, want)
+	}
+}
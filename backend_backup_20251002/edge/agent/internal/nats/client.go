@@ -2,10 +2,15 @@ package nats
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"cnc-monitor/contract"
 	"cnc-monitor/edge/config"
 	"cnc-monitor/edge/internal/buffering"
 	"github.com/nats-io/nats.go"
@@ -15,9 +20,16 @@ import (
 // Client implements the buffering.Processor interface for NATS.
 // It connects to a NATS server and publishes batches of data.
 type Client struct {
-	config config.NATSConfig
-	conn   *nats.Conn
-	js     nats.JetStreamContext
+	machineID string
+	config    config.NATSConfig
+	batching  config.BatchingConfig
+	codec     *compressor
+	conn      *nats.Conn
+
+	// Replaced by the reconnect handler while publishers and the config watch
+	// use it; read through jetStream
+	jsMu sync.RWMutex
+	js   nats.JetStreamContext
 	
 	// Connection stability tracking
 	lastConnected    atomic.Value // time.Time
@@ -25,11 +37,35 @@ type Client struct {
 	reconnectCount   atomic.Uint64
 	messagesPublished atomic.Uint64
 	publishErrors    atomic.Uint64
+	duplicatesDropped atomic.Uint64
+	bytesRaw         atomic.Uint64 // Message bodies before compression
+	bytesSent        atomic.Uint64 // Message bodies as published
+
+	outage atomic.Bool // Simulated network drop: publishing fails while set
+
+	listenerMu sync.Mutex
+	listener   func(connected bool)
 }
 
-// NewClient creates a new NATS client.
-func NewClient(config config.NATSConfig) (*Client, error) {
-	client := &Client{config: config}
+// maxBatchBytes keeps batched messages well below the default 1MB NATS max payload.
+const maxBatchBytes = 512 * 1024
+
+// NewClient creates a new NATS client for machineID, which publishes telemetry
+// to <SubjectPrefix>.<machineID>.telemetry. Messages are packed into JetStream messages of up
+// to batching.Size samples, and packed messages of at least CompressionMinKB are
+// compressed.
+func NewClient(machineID string, config config.NATSConfig, batching config.BatchingConfig) (*Client, error) {
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 256
+	}
+	if config.AckTimeout <= 0 {
+		config.AckTimeout = 5 * time.Second
+	}
+	codec, err := newCompressor(config.Compression, config.CompressionMinKB)
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{machineID: machineID, config: config, batching: batching, codec: codec}
 	client.lastConnected.Store(time.Time{})
 	return client, nil
 }
@@ -53,6 +89,7 @@ func (c *Client) Start() error {
 				Uint64("disconnect_count", disconnects).
 				Dur("uptime", uptime).
 				Msg("NATS disconnected")
+			c.notify(false)
 		}),
 		nats.ReconnectHandler(func(nc *nats.Conn) {
 			c.reconnectCount.Add(1)
@@ -65,12 +102,13 @@ func (c *Client) Start() error {
 				Msg("NATS reconnected")
 			
 			// Recreate JetStream context after reconnection
-			if js, err := nc.JetStream(nats.PublishAsyncMaxPending(256)); err != nil {
+			if js, err := nc.JetStream(nats.PublishAsyncMaxPending(c.config.MaxInFlight)); err != nil {
 				log.Error().Err(err).Msg("Failed to recreate JetStream context after reconnection")
 			} else {
-				c.js = js
+				c.setJetStream(js)
 				log.Info().Msg("JetStream context recreated after NATS reconnection")
 			}
+			c.notify(true)
 		}),
 		nats.ClosedHandler(func(nc *nats.Conn) {
 			log.Info().Msg("NATS connection closed")
@@ -81,8 +119,20 @@ func (c *Client) Start() error {
 		opts = append(opts, nats.UserCredentials(c.config.Credentials))
 	}
 
+	if c.config.NKeySeedFile != "" {
+		nkeyOpt, err := nats.NkeyOptionFromSeed(c.config.NKeySeedFile)
+		if err != nil {
+			return fmt.Errorf("failed to load NKey seed: %w", err)
+		}
+		opts = append(opts, nkeyOpt)
+	}
+
 	if c.config.TLS.Enabled {
-		opts = append(opts, nats.Secure(nil)) // Basic TLS, can be enhanced with custom TLS config
+		tlsConfig, err := NewTLSConfig(c.config.TLS)
+		if err != nil {
+			return fmt.Errorf("failed to configure NATS TLS: %w", err)
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
 	}
 
 	nc, err := nats.Connect(c.config.URL, opts...)
@@ -92,43 +142,107 @@ func (c *Client) Start() error {
 	c.conn = nc
 	c.lastConnected.Store(time.Now())
 
-	js, err := nc.JetStream(nats.PublishAsyncMaxPending(256))
+	js, err := nc.JetStream(nats.PublishAsyncMaxPending(c.config.MaxInFlight))
 	if err != nil {
 		return fmt.Errorf("failed to create JetStream context: %w", err)
 	}
-	c.js = js
+	c.setJetStream(js)
+
+	if err := c.verifyStream(js); err != nil {
+		return err
+	}
 
-	// Check if the stream already exists.
-	streamInfo, err := js.StreamInfo(c.config.Stream)
+	log.Info().Str("url", c.config.URL).Msg("NATS client connected")
+	return nil
+}
+
+// verifyStream checks that the stream exists and stores the agent's subjects.
+// The backend owns the stream (see contract.StreamSpec); agents never create it,
+// so the two cannot race to create it with different settings. A missing stream
+// is not fatal: publishes fail and samples wait in the offline buffer until the
+// backend has created it.
+func (c *Client) verifyStream(js nats.JetStreamContext) error {
+	info, err := js.StreamInfo(c.config.Stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		log.Warn().Str("stream", c.config.Stream).Msg("JetStream stream not found; buffering until the backend creates it")
+		return nil
+	}
 	if err != nil {
-		if err == nats.ErrStreamNotFound {
-			log.Info().Str("stream", c.config.Stream).Msg("Stream not found, creating it...")
-			// If it doesn't exist, create it.
-			_, err = js.AddStream(&nats.StreamConfig{
-				Name:      c.config.Stream,
-				Subjects:  []string{c.config.SubjectPrefix + ".>"}, // Use wildcard for all sub-subjects
-				Storage:   nats.FileStorage,
-				Retention: nats.LimitsPolicy,
-			})
-			if err != nil {
-				return fmt.Errorf("failed to create JetStream stream: %w", err)
-			}
-			log.Info().Str("stream", c.config.Stream).Msg("Stream created successfully.")
-		} else {
-			// For other errors, return them.
-			return fmt.Errorf("failed to get stream info: %w", err)
+		return fmt.Errorf("failed to get stream info: %w", err)
+	}
+
+	for _, kind := range contract.Kinds {
+		subject := contract.Subject(c.config.SubjectPrefix, c.machineID, kind)
+		if !contract.Captures(info.Config.Subjects, subject) {
+			return fmt.Errorf("stream %s (subjects %v) does not capture %s; check nats.subject_prefix",
+				c.config.Stream, info.Config.Subjects, subject)
 		}
-	} else {
-		log.Info().Str("stream", streamInfo.Config.Name).Msg("JetStream stream already exists.")
+	}
+	if command := contract.Subject(c.config.SubjectPrefix, c.machineID, contract.KindCommand); contract.Captures(info.Config.Subjects, command) {
+		log.Warn().Str("stream", c.config.Stream).Str("subject", command).Msg("Stream captures the command subject; it would answer command requests in place of the agent")
+	}
+	if info.Config.Duplicates == 0 {
+		log.Warn().Str("stream", c.config.Stream).Msg("Stream has no duplicate window; replayed samples may be stored twice")
 	}
 
-	log.Info().Str("url", c.config.URL).Msg("NATS client connected and stream ensured")
+	log.Info().
+		Str("stream", info.Config.Name).
+		Strs("subjects", info.Config.Subjects).
+		Dur("max_age", info.Config.MaxAge).
+		Int64("max_bytes", info.Config.MaxBytes).
+		Int("replicas", info.Config.Replicas).
+		Dur("duplicates", info.Config.Duplicates).
+		Msg("JetStream stream verified")
 	return nil
 }
 
+// jetStream returns the current JetStream context, nil before Start.
+func (c *Client) jetStream() nats.JetStreamContext {
+	c.jsMu.RLock()
+	defer c.jsMu.RUnlock()
+	return c.js
+}
+
+func (c *Client) setJetStream(js nats.JetStreamContext) {
+	c.jsMu.Lock()
+	defer c.jsMu.Unlock()
+	c.js = js
+}
+
 // IsConnected returns true if the NATS connection is active
 func (c *Client) IsConnected() bool {
-	return c.conn != nil && c.conn.IsConnected() && c.js != nil
+	return c.conn != nil && c.conn.IsConnected() && c.jetStream() != nil && !c.outage.Load()
+}
+
+// SimulateOutage cuts the client off from the server while down is set, so
+// that simulated network drops exercise offline buffering and recovery.
+func (c *Client) SimulateOutage(down bool) {
+	if c.outage.Swap(down) == down {
+		return
+	}
+	if down {
+		log.Warn().Msg("Simulated network drop: publishing disabled")
+	} else {
+		log.Info().Msg("Simulated network drop over: publishing enabled")
+	}
+	c.notify(!down)
+}
+
+// OnConnectionChange registers fn to be called when the client disconnects
+// or reconnects, including simulated network drops.
+func (c *Client) OnConnectionChange(fn func(connected bool)) {
+	c.listenerMu.Lock()
+	defer c.listenerMu.Unlock()
+	c.listener = fn
+}
+
+func (c *Client) notify(connected bool) {
+	c.listenerMu.Lock()
+	fn := c.listener
+	c.listenerMu.Unlock()
+	if fn != nil {
+		fn(connected)
+	}
 }
 
 // Shutdown gracefully closes the NATS connection.
@@ -142,39 +256,201 @@ func (c *Client) Shutdown() {
 // Process publishes a batch of data to NATS JetStream.
 // It implements the buffering.Processor interface.
 func (c *Client) Process(ctx context.Context, batch buffering.Batch) error {
-	if c.js == nil {
+	msgs := make([]buffering.Message, len(batch))
+	for i, msgData := range batch {
+		msgs[i] = buffering.Message{Data: msgData}
+	}
+	return c.ProcessMessages(ctx, msgs)
+}
+
+// ProcessMessages publishes messages to NATS JetStream asynchronously.
+// Consecutive messages are packed into one JetStream message of up to
+// batching.Size length-prefixed frames, which ingestion.Service unpacks. At most
+// MaxInFlight publishes are unacknowledged at a time. Resent messages are packed
+// and compressed like live ones, but never together with them. A pack is
+// published under the range of sequence numbers it holds (see packID), so
+// JetStream drops a resend split like an earlier attempt within its duplicate
+// window. If some messages are not acknowledged, a *buffering.PublishError lists
+// them. Ingestion ignores samples it has already stored, which covers resends
+// split differently from the attempt that was stored.
+// It implements the buffering.MessageProcessor interface.
+func (c *Client) ProcessMessages(ctx context.Context, msgs []buffering.Message) error {
+	js := c.jetStream()
+	if js == nil {
 		log.Error().Msg("JetStream context is nil in Process")
 		return &NATSError{Message: "not connected to JetStream"}
 	}
+	if c.outage.Load() {
+		return &NATSError{Message: "simulated network drop"}
+	}
 
-		subject := c.config.SubjectPrefix + ".data"
+	// Per-machine credentials only allow publishing under the machine's own token
+	subject := contract.Subject(c.config.SubjectPrefix, c.machineID, contract.KindTelemetry)
 
-	for _, msgData := range batch {
-		// For now, we publish messages one by one. NATS recommends this for JetStream
-		// to get individual acknowledgements.
-		ack, err := c.js.Publish(subject, msgData)
-		if err != nil {
-			c.publishErrors.Add(1)
-			errors := c.publishErrors.Load()
-			published := c.messagesPublished.Load()
-			errorRate := float64(errors) / float64(published+errors) * 100
-			
-			log.Warn().
-				Err(err).
-				Uint64("publish_errors", errors).
-				Float64("error_rate_pct", errorRate).
-				Msg("Failed to publish message to NATS")
-			return err // Returning on first error
+	type pending struct {
+		start, end int // Range of msgs packed into this publish
+		future     nats.PubAckFuture
+		err        error
+	}
+	var publishes []pending
+
+	for start := 0; start < len(msgs); {
+		end := c.packEnd(msgs, start)
+
+		m := nats.NewMsg(subject)
+		if end-start == 1 {
+			m.Data = msgs[start].Data
+		} else {
+			for _, msg := range msgs[start:end] {
+				m.Data = append(m.Data, msg.Data...)
+			}
+		}
+		if id := packID(msgs[start:end]); id != "" {
+			m.Header.Set(nats.MsgIdHdr, id)
+		}
+		if msgs[start].Encoding != "" {
+			m.Header.Set(contract.SampleEncodingHeader, msgs[start].Encoding)
 		}
-		
-		c.messagesPublished.Add(1)
-		log.Debug().Str("stream", ack.Stream).Uint64("seq", ack.Sequence).Msg("Published message")
+		raw := len(m.Data)
+		var encoding string
+		if m.Data, encoding = c.codec.compress(m.Data); encoding != "" {
+			m.Header.Set(contract.ContentEncodingHeader, encoding)
+		}
+		c.bytesRaw.Add(uint64(raw))
+		c.bytesSent.Add(uint64(len(m.Data)))
+
+		// Blocks (up to the stall wait) while MaxInFlight publishes are unacknowledged.
+		future, err := js.PublishMsgAsync(m)
+		publishes = append(publishes, pending{start: start, end: end, future: future, err: err})
+		start = end
+	}
+
+	ackCtx, cancel := context.WithTimeout(ctx, c.config.AckTimeout)
+	defer cancel()
+
+	var failed []int
+	var firstErr error
+	for _, p := range publishes {
+		err := p.err
+		if err == nil {
+			var ack *nats.PubAck
+			if ack, err = awaitAck(ackCtx, p.future); err == nil {
+				if ack.Duplicate {
+					c.duplicatesDropped.Add(uint64(p.end - p.start))
+					log.Debug().Str("msg_id", p.future.Msg().Header.Get(nats.MsgIdHdr)).Msg("JetStream dropped duplicate message")
+				} else {
+					c.messagesPublished.Add(uint64(p.end - p.start))
+				}
+				continue
+			}
+		}
+
+		c.publishErrors.Add(uint64(p.end - p.start))
+		if firstErr == nil {
+			firstErr = err
+		}
+		for i := p.start; i < p.end; i++ {
+			failed = append(failed, i)
+		}
+	}
+
+	if len(failed) > 0 {
+		errCount := c.publishErrors.Load()
+		published := c.messagesPublished.Load()
+		errorRate := float64(errCount) / float64(published+errCount) * 100
+
+		log.Warn().
+			Err(firstErr).
+			Int("failed", len(failed)).
+			Int("total", len(msgs)).
+			Uint64("publish_errors", errCount).
+			Float64("error_rate_pct", errorRate).
+			Msg("Failed to publish messages to NATS")
+		return &buffering.PublishError{Failed: failed, Err: firstErr}
 	}
 
-	log.Debug().Int("batch_size", len(batch)).Str("subject", subject).Msg("Batch published to NATS")
+	log.Debug().Int("batch_size", len(msgs)).Int("publishes", len(publishes)).Str("subject", subject).Msg("Batch published to NATS")
+	return nil
+}
+
+// PublishStatus publishes a JSON document of statusType (see contract) to the
+// machine's status subject and waits for the stream to store it.
+func (c *Client) PublishStatus(ctx context.Context, statusType string, doc interface{}) error {
+	js := c.jetStream()
+	if js == nil {
+		return &NATSError{Message: "not connected to JetStream"}
+	}
+	if c.outage.Load() {
+		return &NATSError{Message: "simulated network drop"}
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", statusType, err)
+	}
+	m := nats.NewMsg(contract.Subject(c.config.SubjectPrefix, c.machineID, contract.KindStatus))
+	m.Header.Set(contract.StatusTypeHeader, statusType)
+	m.Data = data
+	if _, err := js.PublishMsg(m, nats.Context(ctx)); err != nil {
+		return fmt.Errorf("publish %s: %w", statusType, err)
+	}
 	return nil
 }
 
+// awaitAck waits for the acknowledgement of an async publish. An ack that has
+// already arrived wins over an expired context.
+func awaitAck(ctx context.Context, future nats.PubAckFuture) (*nats.PubAck, error) {
+	select {
+	case ack := <-future.Ok():
+		return ack, nil
+	case err := <-future.Err():
+		return nil, err
+	default:
+	}
+	select {
+	case ack := <-future.Ok():
+		return ack, nil
+	case err := <-future.Err():
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// packEnd returns the end of the run of messages starting at start that fits
+// in one JetStream message. A run never mixes sample encodings, nor live and
+// resent messages.
+func (c *Client) packEnd(msgs []buffering.Message, start int) int {
+	maxCount := c.batching.Size
+	if maxCount < 1 {
+		maxCount = 1
+	}
+	end := start + 1
+	size := len(msgs[start].Data)
+	for end < len(msgs) && end-start < maxCount && size+len(msgs[end].Data) <= maxBatchBytes &&
+		msgs[end].Encoding == msgs[start].Encoding && msgs[end].Resend == msgs[start].Resend {
+		size += len(msgs[end].Data)
+		end++
+	}
+	return end
+}
+
+// packID derives the Nats-Msg-Id of a packed message. A single message keeps
+// its own ID; a pack is named by the range of sequence numbers it holds, e.g.
+// M:5-14, so the same records packed the same way, live or resent, get the same
+// ID. A range alone is safe because records are only ever taken out of the WAL
+// (by downsampling): a pack sharing the range of a stored one holds a subset of
+// its records.
+func packID(msgs []buffering.Message) string {
+	first, last := msgs[0].ID, msgs[len(msgs)-1].ID
+	if first == "" || last == "" {
+		return ""
+	}
+	if len(msgs) == 1 {
+		return first
+	}
+	return first + "-" + last[strings.LastIndexByte(last, ':')+1:]
+}
+
 // NATSError represents NATS-related errors
 type NATSError struct {
 	Message string
@@ -206,6 +482,9 @@ func (c *Client) GetConnectionStats() map[string]interface{} {
 		"reconnect_count":    c.reconnectCount.Load(),
 		"messages_published": published,
 		"publish_errors":     errors,
+		"duplicates_dropped": c.duplicatesDropped.Load(),
+		"bytes_raw":          c.bytesRaw.Load(),
+		"bytes_sent":         c.bytesSent.Load(),
 		"error_rate_pct":     errorRate,
 		"last_connected":     lastConnected,
 	}
@@ -0,0 +1,126 @@
+package nats
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/edge/config"
+	"cnc-monitor/edge/internal/buffering"
+	"github.com/nats-io/nats.go"
+)
+
+// packs returns the IDs of the JetStream messages msgs are published as.
+func packs(c *Client, msgs []buffering.Message) []string {
+	var ids []string
+	for start := 0; start < len(msgs); {
+		end := c.packEnd(msgs, start)
+		ids = append(ids, packID(msgs[start:end]))
+		start = end
+	}
+	return ids
+}
+
+func TestPackIDs(t *testing.T) {
+	c := &Client{batching: config.BatchingConfig{Size: 3}}
+	msg := func(seq uint64, resend bool) buffering.Message {
+		return buffering.Message{ID: buffering.MessageID("M", seq), Encoding: contract.EncodingJSON, Data: []byte("{}"), Resend: resend}
+	}
+
+	live := []buffering.Message{msg(1, false), msg(2, false), msg(3, false), msg(4, false), msg(5, false)}
+	if got, want := packs(c, live), []string{"M:1-3", "M:4-5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("live packs %v, want %v", got, want)
+	}
+
+	// Resent as they were published live, the records get the same IDs, so
+	// JetStream drops whatever was stored
+	resent := []buffering.Message{msg(1, true), msg(2, true), msg(3, true), msg(4, true), msg(5, true)}
+	if got, want := packs(c, resent), []string{"M:1-3", "M:4-5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replay packs %v, want %v", got, want)
+	}
+
+	// Downsampled records span another range
+	thinned := []buffering.Message{msg(1, true), msg(3, true), msg(5, true), msg(7, true)}
+	if got, want := packs(c, thinned), []string{"M:1-5", "M:7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("downsampled packs %v, want %v", got, want)
+	}
+
+	// Live messages are not packed together with resends
+	mixed := []buffering.Message{msg(1, false), msg(2, true), msg(3, true), msg(4, false)}
+	if got, want := packs(c, mixed), []string{"M:1", "M:2-3", "M:4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mixed packs %v, want %v", got, want)
+	}
+
+	// Readings without a sequence number are not deduplicated
+	if got := packID([]buffering.Message{msg(1, false), {Data: []byte("{}")}}); got != "" {
+		t.Errorf("pack ID %q for a reading without sequence", got)
+	}
+}
+
+// fakeJetStream acknowledges every async publish and keeps the messages.
+type fakeJetStream struct {
+	nats.JetStreamContext
+	msgs []*nats.Msg
+}
+
+func (js *fakeJetStream) PublishMsgAsync(m *nats.Msg, opts ...nats.PubOpt) (nats.PubAckFuture, error) {
+	js.msgs = append(js.msgs, m)
+	return &ackedFuture{msg: m}, nil
+}
+
+type ackedFuture struct {
+	msg *nats.Msg
+}
+
+func (f *ackedFuture) Ok() <-chan *nats.PubAck {
+	ch := make(chan *nats.PubAck, 1)
+	ch <- &nats.PubAck{Stream: contract.DefaultStream}
+	return ch
+}
+
+func (f *ackedFuture) Err() <-chan error { return make(chan error) }
+func (f *ackedFuture) Msg() *nats.Msg    { return f.msg }
+
+func TestReplayIsCompressed(t *testing.T) {
+	codec, err := newCompressor(contract.ContentEncodingZstd, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{
+		machineID: "M",
+		config:    config.NATSConfig{SubjectPrefix: contract.DefaultSubjectPrefix, AckTimeout: time.Second},
+		batching:  config.BatchingConfig{Size: 100},
+		codec:     codec,
+	}
+	js := &fakeJetStream{}
+	c.setJetStream(js)
+
+	// A replayed WAL batch of 100 JSON samples, about 25KB
+	var msgs []buffering.Message
+	for seq := uint64(1); seq <= 100; seq++ {
+		data, err := contract.EncodeSample(contract.EncodingJSON, contract.Sample{MachineID: "M", SequenceNumber: seq, MachineState: "RUNNING"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, buffering.Message{ID: buffering.MessageID("M", seq), Encoding: contract.EncodingJSON, Data: data, Resend: true})
+	}
+	if err := c.ProcessMessages(context.Background(), msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(js.msgs) != 1 {
+		t.Fatalf("replay published as %d messages, want 1", len(js.msgs))
+	}
+	m := js.msgs[0]
+	if got := m.Header.Get(contract.ContentEncodingHeader); got != contract.ContentEncodingZstd {
+		t.Errorf("replay published with Content-Encoding %q, want zstd", got)
+	}
+	if got := m.Header.Get(nats.MsgIdHdr); got != "M:1-100" {
+		t.Errorf("replay published as %q, want M:1-100", got)
+	}
+	if raw, sent := c.bytesRaw.Load(), c.bytesSent.Load(); sent >= raw/2 {
+		t.Errorf("replay sent %d of %d bytes", sent, raw)
+	}
+}
@@ -0,0 +1,57 @@
+package nats
+
+import (
+	"fmt"
+
+	"cnc-monitor/contract"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressor compresses message bodies with a fixed codec. ingestion.Service on
+// the backend decodes them by their contract.ContentEncodingHeader.
+type compressor struct {
+	encoding string
+	minBytes int
+	zstd     *zstd.Encoder
+}
+
+// newCompressor returns a compressor for encoding ("zstd", "s2", or "none"/"" to
+// disable) that only touches bodies of at least minKB kilobytes.
+func newCompressor(encoding string, minKB int) (*compressor, error) {
+	c := &compressor{encoding: encoding, minBytes: minKB * 1024}
+	switch encoding {
+	case "", "none":
+		c.encoding = ""
+	case contract.ContentEncodingZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		if err != nil {
+			return nil, err
+		}
+		c.zstd = enc
+	case contract.ContentEncodingS2:
+	default:
+		return nil, fmt.Errorf("unsupported compression %q (use zstd, s2 or none)", encoding)
+	}
+	return c, nil
+}
+
+// compress returns the compressed body and its encoding, or the body unchanged
+// and "" when compression is disabled, the body is below the threshold or
+// compression would not make it smaller.
+func (c *compressor) compress(body []byte) ([]byte, string) {
+	if c.encoding == "" || len(body) < c.minBytes {
+		return body, ""
+	}
+	var out []byte
+	switch c.encoding {
+	case contract.ContentEncodingZstd:
+		out = c.zstd.EncodeAll(body, make([]byte, 0, len(body)/2))
+	case contract.ContentEncodingS2:
+		out = s2.Encode(nil, body)
+	}
+	if len(out) >= len(body) {
+		return body, ""
+	}
+	return out, c.encoding
+}
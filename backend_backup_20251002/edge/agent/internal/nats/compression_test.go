@@ -0,0 +1,74 @@
+package nats
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"cnc-monitor/contract"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressor(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"machine_id":"M","temperature":21.5,"machine_state":"RUNNING"}`), 200) // About 13KB
+	noise := make([]byte, 16*1024)
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	zstdDecoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zstdDecoder.Close()
+	decode := map[string]func([]byte) ([]byte, error){
+		contract.ContentEncodingZstd: func(b []byte) ([]byte, error) { return zstdDecoder.DecodeAll(b, nil) },
+		contract.ContentEncodingS2:   func(b []byte) ([]byte, error) { return s2.Decode(nil, b) },
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		minKB    int
+		body     []byte
+		want     string // Content-Encoding, "" if sent as is
+	}{
+		{"zstd", contract.ContentEncodingZstd, 10, body, contract.ContentEncodingZstd},
+		{"s2", contract.ContentEncodingS2, 10, body, contract.ContentEncodingS2},
+		{"below threshold", contract.ContentEncodingZstd, 14, body, ""},
+		{"incompressible", contract.ContentEncodingZstd, 10, noise, ""},
+		{"none", "none", 0, body, ""},
+		{"off", "", 0, body, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newCompressor(tt.encoding, tt.minKB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, encoding := c.compress(tt.body)
+			if encoding != tt.want {
+				t.Fatalf("encoding %q, want %q", encoding, tt.want)
+			}
+			if encoding == "" {
+				if !bytes.Equal(out, tt.body) {
+					t.Error("body changed without an encoding")
+				}
+				return
+			}
+			if len(out) >= len(tt.body) {
+				t.Errorf("compressed to %d of %d bytes", len(out), len(tt.body))
+			}
+			decoded, err := decode[encoding](out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, tt.body) {
+				t.Error("body does not round-trip")
+			}
+		})
+	}
+
+	if _, err := newCompressor("gzip", 10); err == nil {
+		t.Error("gzip accepted")
+	}
+}
@@ -0,0 +1,109 @@
+// internal/nats/remote.go
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"cnc-monitor/contract"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+)
+
+// bucketRetryInterval is how often the config bucket is looked up again while
+// it is missing or unreachable.
+const bucketRetryInterval = 30 * time.Second
+
+// WatchDesiredConfig calls fn with the machine's desired configuration from
+// the config bucket: the current value on start-up, then every change. fn gets
+// nil when the value is deleted. It runs until ctx ends; a missing bucket is
+// looked up again periodically, since the backend creates it.
+func (c *Client) WatchDesiredConfig(ctx context.Context, fn func(*contract.DesiredConfig)) {
+	bucket := c.config.ConfigBucket
+	if bucket == "" {
+		return
+	}
+	go func() {
+		for {
+			err := c.watchDesiredConfig(ctx, bucket, fn)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warn().Err(err).Str("bucket", bucket).Dur("retry_in", bucketRetryInterval).Msg("Not watching desired configuration")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(bucketRetryInterval):
+			}
+		}
+	}()
+}
+
+func (c *Client) watchDesiredConfig(ctx context.Context, bucket string, fn func(*contract.DesiredConfig)) error {
+	js := c.jetStream()
+	if js == nil {
+		return &NATSError{Message: "not connected to JetStream"}
+	}
+	kv, err := js.KeyValue(bucket)
+	if err != nil {
+		return err
+	}
+	watcher, err := kv.Watch(c.machineID, nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	// Credentials do not allow deleting the consumer (see mint_edge_creds); the
+	// server drops the ephemeral consumer once this subscription is gone.
+	defer watcher.Stop()
+	log.Info().Str("bucket", bucket).Str("key", c.machineID).Msg("Watching desired configuration")
+
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			continue // End of the initial values
+		}
+		if entry.Operation() != nats.KeyValuePut {
+			fn(nil)
+			continue
+		}
+		var doc contract.DesiredConfig
+		if err := json.Unmarshal(entry.Value(), &doc); err != nil {
+			log.Error().Err(err).Uint64("revision", entry.Revision()).Msg("Ignoring malformed desired configuration")
+			continue
+		}
+		fn(&doc)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.New("watch ended")
+}
+
+// HandleCommands answers the requests on the machine's command subject with
+// fn until the connection is closed.
+func (c *Client) HandleCommands(fn func(contract.Command) contract.CommandResult) error {
+	if c.conn == nil {
+		return &NATSError{Message: "not connected"}
+	}
+	subject := contract.Subject(c.config.SubjectPrefix, c.machineID, contract.KindCommand)
+	_, err := c.conn.Subscribe(subject, func(m *nats.Msg) {
+		var cmd contract.Command
+		var result contract.CommandResult
+		if err := json.Unmarshal(m.Data, &cmd); err != nil {
+			result.Message = "malformed command: " + err.Error()
+		} else {
+			result = fn(cmd)
+		}
+		result.ID = cmd.ID
+		data, _ := json.Marshal(result)
+		if err := m.Respond(data); err != nil {
+			log.Warn().Err(err).Str("command", cmd.Name).Msg("Failed to answer command")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Info().Str("subject", subject).Msg("Listening for commands")
+	return nil
+}
@@ -0,0 +1,18 @@
+package nats
+
+import (
+	"crypto/tls"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/edge/config"
+	"github.com/rs/zerolog/log"
+)
+
+// NewTLSConfig builds a client tls.Config from cfg that picks up rotated
+// certificates on the next (re)connect; see contract.NewTLSConfig.
+func NewTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	files := contract.TLSFiles{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile, CAFile: cfg.CAFile, ServerName: cfg.ServerName}
+	return contract.NewTLSConfig(files, func(format string, args ...interface{}) {
+		log.Warn().Msgf(format, args...)
+	})
+}
@@ -0,0 +1,340 @@
+// internal/sensors/capture.go
+package sensors
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/edge/internal/buffering"
+	"github.com/rs/zerolog/log"
+)
+
+// Capture formats
+const (
+	CaptureJSONL = "jsonl" // One sample per line, as recorded with agent.record
+	CaptureJSON  = "json"  // A JSON array of samples, as exported by the backend API
+	CaptureCSV   = "csv"   // A header of channel names with a timestamp column, one sample per row
+	CaptureWAL   = "wal"   // The offline buffer's WAL: its directory, the data directory above it or one segment
+)
+
+// captureRecord is one recorded sample.
+type captureRecord struct {
+	time   time.Time
+	values map[string]float64 // Numeric channels
+	texts  map[string]string  // Text channels such as machine_state
+}
+
+// captureFormat picks the format of a capture file from its extension. A
+// directory is a WAL.
+func captureFormat(path, format string) string {
+	if format != "" {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return CaptureCSV
+	case ".json":
+		return CaptureJSON
+	case ".wal":
+		return CaptureWAL
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return CaptureWAL
+	}
+	return CaptureJSONL
+}
+
+// loadCapture reads a capture file and returns its records in time order.
+func loadCapture(path, format string) ([]captureRecord, error) {
+	format = captureFormat(path, format)
+	var data []byte
+	if format != CaptureWAL {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if format == CaptureJSONL && bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		format = CaptureJSON
+	}
+
+	var records []captureRecord
+	var err error
+	switch format {
+	case CaptureJSONL:
+		records, err = parseJSONLCapture(data)
+	case CaptureJSON:
+		var samples []buffering.SensorData
+		if err = json.Unmarshal(data, &samples); err == nil {
+			for _, s := range samples {
+				records = append(records, sampleRecord(s))
+			}
+		}
+	case CaptureCSV:
+		records, err = parseCSVCapture(data)
+	case CaptureWAL:
+		records, err = parseWALCapture(path)
+	default:
+		return nil, fmt.Errorf("unknown capture format: %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s capture %s: %w", format, path, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("capture %s has no records", path)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].time.Before(records[j].time) })
+	return records, nil
+}
+
+func parseJSONLCapture(data []byte) ([]captureRecord, error) {
+	var records []captureRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var s buffering.SensorData
+		if err := json.Unmarshal(line, &s); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		records = append(records, sampleRecord(s))
+	}
+	return records, scanner.Err()
+}
+
+// parseWALCapture reads the samples left in an offline buffer's WAL, in
+// either sample encoding.
+func parseWALCapture(path string) ([]captureRecord, error) {
+	data, err := buffering.ReadWALDir(path)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]captureRecord, 0, len(data))
+	for n, rec := range data {
+		s, err := contract.DecodeSample(rec)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", n+1, err)
+		}
+		records = append(records, sampleRecord(s))
+	}
+	return records, nil
+}
+
+// sampleRecord turns a machine sample into the channels it carries. Fields
+// listed as missing are left out.
+func sampleRecord(s buffering.SensorData) captureRecord {
+	r := captureRecord{time: s.Timestamp, values: make(map[string]float64), texts: make(map[string]string)}
+	missing := make(map[string]bool, len(s.Missing))
+	for _, name := range s.Missing {
+		missing[name] = true
+	}
+	for name, get := range sampleValues {
+		if !missing[name] {
+			r.values[name] = get(&s)
+		}
+	}
+	if !missing[ChannelMachineState] && s.MachineState != "" {
+		r.texts[ChannelMachineState] = s.MachineState
+	}
+	for name, v := range s.Channels {
+		r.values[name] = v
+	}
+	return r
+}
+
+// sampleValues reads the numeric fields of a machine sample.
+var sampleValues = map[string]func(d *buffering.SensorData) float64{
+	ChannelTemperature:       func(d *buffering.SensorData) float64 { return d.Temperature },
+	ChannelSpindleSpeed:      func(d *buffering.SensorData) float64 { return d.SpindleSpeed },
+	ChannelXPos:              func(d *buffering.SensorData) float64 { return d.XPosMM },
+	ChannelYPos:              func(d *buffering.SensorData) float64 { return d.YPosMM },
+	ChannelZPos:              func(d *buffering.SensorData) float64 { return d.ZPosMM },
+	ChannelFeedRate:          func(d *buffering.SensorData) float64 { return d.FeedRateActual },
+	ChannelSpindleLoad:       func(d *buffering.SensorData) float64 { return d.SpindleLoadPercent },
+	ChannelActiveProgramLine: func(d *buffering.SensorData) float64 { return float64(d.ActiveProgramLine) },
+	ChannelTotalPower:        func(d *buffering.SensorData) float64 { return d.TotalPowerKW },
+}
+
+// csvTimeColumns are the accepted names of the timestamp column.
+var csvTimeColumns = []string{"timestamp", "time"}
+
+// csvSkipColumns are sample metadata rather than channels.
+var csvSkipColumns = map[string]bool{"machine_id": true, "sequence_number": true}
+
+func parseCSVCapture(data []byte) ([]captureRecord, error) {
+	rd := csv.NewReader(bytes.NewReader(data))
+	header, err := rd.Read()
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	timeCol := -1
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if timeCol < 0 && containsString(csvTimeColumns, strings.ToLower(header[i])) {
+			timeCol = i
+		}
+	}
+	if timeCol < 0 {
+		return nil, errors.New("no timestamp column")
+	}
+
+	var records []captureRecord
+	for {
+		row, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := rd.FieldPos(0)
+		ts, err := parseCaptureTime(row[timeCol])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		r := captureRecord{time: ts, values: make(map[string]float64), texts: make(map[string]string)}
+		for i, cell := range row {
+			cell = strings.TrimSpace(cell)
+			if i == timeCol || cell == "" || csvSkipColumns[header[i]] {
+				continue
+			}
+			if v, err := strconv.ParseFloat(cell, 64); err == nil {
+				r.values[header[i]] = v
+			} else {
+				r.texts[header[i]] = cell
+			}
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// parseCaptureTime accepts RFC 3339 timestamps and Unix times in seconds,
+// with or without a fraction.
+func parseCaptureTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return ts, nil
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(secs*float64(time.Second))).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
+
+// Recorder tees machine samples to a capture file that a replay sensor can
+// play back: JSONL, or CSV if the path ends in .csv.
+type Recorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	csv    *csv.Writer
+	header []string // CSV columns after the timestamp
+	warned map[string]bool
+}
+
+// NewRecorder opens a capture file for appending.
+func NewRecorder(path string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{f: f, w: bufio.NewWriter(f), warned: make(map[string]bool)}
+	if captureFormat(path, "") == CaptureCSV {
+		r.csv = csv.NewWriter(r.w)
+		if info, err := f.Stat(); err == nil && info.Size() > 0 {
+			// Appending to an existing capture: keep its columns
+			if header, err := readCSVHeader(path); err == nil && len(header) > 0 {
+				r.header = header[1:]
+			}
+		}
+	}
+	log.Info().Str("file", path).Msg("Recording samples to capture file")
+	return r, nil
+}
+
+func readCSVHeader(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return csv.NewReader(f).Read()
+}
+
+// Write appends a sample to the capture.
+func (r *Recorder) Write(d buffering.SensorData) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.csv == nil {
+		line, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		r.w.Write(line)
+		r.w.WriteByte('\n')
+		return r.w.Flush()
+	}
+
+	rec := sampleRecord(d)
+	if r.header == nil {
+		// The columns are fixed by the first sample
+		r.header = append([]string{}, sampleChannels...)
+		extra := make([]string, 0, len(d.Channels))
+		for name := range d.Channels {
+			extra = append(extra, name)
+		}
+		sort.Strings(extra)
+		r.header = append(r.header, extra...)
+		r.csv.Write(append([]string{"timestamp"}, r.header...))
+	}
+	row := make([]string, 0, len(r.header)+1)
+	row = append(row, d.Timestamp.UTC().Format(time.RFC3339Nano))
+	for _, name := range r.header {
+		if v, ok := rec.values[name]; ok {
+			row = append(row, strconv.FormatFloat(v, 'g', -1, 64))
+		} else {
+			row = append(row, rec.texts[name])
+		}
+	}
+	for name := range d.Channels {
+		if !containsString(r.header, name) && !r.warned[name] {
+			r.warned[name] = true
+			log.Warn().Str("channel", name).Msg("Channel is not a column of the CSV capture and is not recorded")
+		}
+	}
+	r.csv.Write(row)
+	r.csv.Flush()
+	if err := r.csv.Error(); err != nil {
+		return err
+	}
+	return r.w.Flush()
+}
+
+// Close flushes and closes the capture file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Flush()
+	return r.f.Close()
+}
@@ -0,0 +1,156 @@
+package sensors
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/edge/internal/buffering"
+)
+
+var captureStart = time.Date(2025, 10, 2, 8, 0, 0, 0, time.UTC)
+
+// writeCapture writes a capture file into a temporary directory.
+func writeCapture(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkRecords compares the temperatures and machine states of records.
+func checkRecords(t *testing.T, records []captureRecord, temps []float64, states []string) {
+	t.Helper()
+	if len(records) != len(temps) {
+		t.Fatalf("%d records, want %d", len(records), len(temps))
+	}
+	for i, r := range records {
+		if want := captureStart.Add(time.Duration(i) * time.Second); !r.time.Equal(want) {
+			t.Errorf("record %d at %s, want %s", i, r.time, want)
+		}
+		if r.values[ChannelTemperature] != temps[i] {
+			t.Errorf("record %d: temperature %v, want %v", i, r.values[ChannelTemperature], temps[i])
+		}
+		if r.texts[ChannelMachineState] != states[i] {
+			t.Errorf("record %d: machine state %q, want %q", i, r.texts[ChannelMachineState], states[i])
+		}
+	}
+}
+
+func TestLoadCapture(t *testing.T) {
+	temps := []float64{40, 41.5}
+	states := []string{"IDLE", "RUNNING"}
+	tests := []struct {
+		name, file, content string
+	}{
+		{
+			name: "jsonl",
+			file: "capture.jsonl",
+			// Out of order, with a blank line
+			content: `{"timestamp":"2025-10-02T08:00:01Z","temperature":41.5,"machine_state":"RUNNING"}
+
+{"timestamp":"2025-10-02T08:00:00Z","temperature":40,"machine_state":"IDLE"}
+`,
+		},
+		{
+			name:    "json",
+			file:    "capture.json",
+			content: `[{"timestamp":"2025-10-02T08:00:00Z","temperature":40,"machine_state":"IDLE"},{"timestamp":"2025-10-02T08:00:01Z","temperature":41.5,"machine_state":"RUNNING"}]`,
+		},
+		{
+			name:    "json array in a jsonl file",
+			file:    "capture.jsonl",
+			content: `[{"timestamp":"2025-10-02T08:00:00Z","temperature":40,"machine_state":"IDLE"},{"timestamp":"2025-10-02T08:00:01Z","temperature":41.5,"machine_state":"RUNNING"}]`,
+		},
+		{
+			name:    "csv",
+			file:    "capture.csv",
+			content: "machine_id,Timestamp,temperature,machine_state\nCNC-001,2025-10-02T08:00:00Z,40,IDLE\nCNC-001,1759392001,41.5,RUNNING\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := loadCapture(writeCapture(t, tt.file, tt.content), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRecords(t, records, temps, states)
+		})
+	}
+}
+
+func TestLoadCaptureMissingAndChannels(t *testing.T) {
+	path := writeCapture(t, "capture.jsonl",
+		`{"timestamp":"2025-10-02T08:00:00Z","temperature":40,"missing":["spindle_speed","machine_state"],"channels":{"coolant_flow":3.5}}`+"\n")
+	records, err := loadCapture(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := records[0]
+	if _, ok := r.values[ChannelSpindleSpeed]; ok {
+		t.Error("missing spindle speed replayed")
+	}
+	if _, ok := r.texts[ChannelMachineState]; ok {
+		t.Error("missing machine state replayed")
+	}
+	if r.values["coolant_flow"] != 3.5 || r.values[ChannelTemperature] != 40 {
+		t.Errorf("values %v", r.values)
+	}
+}
+
+func TestLoadCaptureErrors(t *testing.T) {
+	tests := []struct {
+		name, file, content, format string
+	}{
+		{name: "empty", file: "capture.jsonl"},
+		{name: "bad line", file: "capture.jsonl", content: "{\"timestamp\":\"2025-10-02T08:00:00Z\"}\nnot json\n"},
+		{name: "no timestamp column", file: "capture.csv", content: "temperature\n40\n"},
+		{name: "bad timestamp", file: "capture.csv", content: "timestamp,temperature\nyesterday,40\n"},
+		{name: "unknown format", file: "capture.txt", content: "x", format: "xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadCapture(writeCapture(t, tt.file, tt.content), tt.format); err == nil {
+				t.Error("capture loaded")
+			}
+		})
+	}
+}
+
+func TestLoadWALCapture(t *testing.T) {
+	dataDir := t.TempDir()
+	walDir := filepath.Join(dataDir, "wal")
+	w, err := buffering.OpenWAL(walDir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := []buffering.SensorData{
+		{MachineID: "CNC-001", Timestamp: captureStart, Temperature: 40, MachineState: "IDLE"},
+		{MachineID: "CNC-001", Timestamp: captureStart.Add(time.Second), Temperature: 41.5, MachineState: "RUNNING"},
+	}
+	// The buffer may hold samples in either encoding
+	for i, encoding := range []string{contract.EncodingJSON, contract.EncodingBinaryV2} {
+		data, err := contract.EncodeSample(encoding, samples[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Append(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{walDir, dataDir} {
+		records, err := loadCapture(path, "")
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		checkRecords(t, records, []float64{40, 41.5}, []string{"IDLE", "RUNNING"})
+	}
+}
@@ -0,0 +1,87 @@
+// internal/sensors/channel.go
+package sensors
+
+import (
+	"time"
+
+	"cnc-monitor/edge/internal/buffering"
+)
+
+// Quality tells how far a channel reading can be trusted.
+type Quality string
+
+const (
+	QualityGood      Quality = "good"
+	QualityUncertain Quality = "uncertain" // Usable, e.g. the last value of a device that just stopped answering
+	QualityBad       Quality = "bad"       // Not usable; the channel is reported missing
+)
+
+// rank orders qualities so the better of two readings of a channel wins.
+func (q Quality) rank() int {
+	switch q {
+	case QualityGood:
+		return 2
+	case QualityUncertain:
+		return 1
+	}
+	return 0
+}
+
+// ChannelReading is one named value contributed by a sensor. A sensor returns
+// only the channels it measures; the manager merges all sensors into one
+// machine sample per tick.
+type ChannelReading struct {
+	Name      string            `json:"name"`
+	Value     float64           `json:"value"`
+	Text      string            `json:"text,omitempty"` // Value of text channels such as machine_state
+	Units     string            `json:"units,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"` // From the sensor's metadata
+	Quality   Quality           `json:"quality"`
+	Timestamp time.Time         `json:"timestamp"` // When the sensor acquired the value
+}
+
+// ChannelSpec declares a channel a sensor delivers.
+type ChannelSpec struct {
+	Name  string
+	Units string
+}
+
+// goodReading is a numeric channel reading of good quality.
+func goodReading(name string, value float64, units string, ts time.Time) ChannelReading {
+	return ChannelReading{Name: name, Value: value, Units: units, Quality: QualityGood, Timestamp: ts}
+}
+
+// Channel names of the fields of a machine sample
+const (
+	ChannelTemperature       = "temperature"
+	ChannelSpindleSpeed      = "spindle_speed"
+	ChannelXPos              = "x_pos_mm"
+	ChannelYPos              = "y_pos_mm"
+	ChannelZPos              = "z_pos_mm"
+	ChannelFeedRate          = "feed_rate_actual"
+	ChannelSpindleLoad       = "spindle_load_percent"
+	ChannelMachineState      = "machine_state"
+	ChannelActiveProgramLine = "active_program_line"
+	ChannelTotalPower        = "total_power_kw"
+)
+
+// sampleFields sets the field of a machine sample a channel is merged into.
+var sampleFields = map[string]func(d *buffering.SensorData, r ChannelReading){
+	ChannelTemperature:       func(d *buffering.SensorData, r ChannelReading) { d.Temperature = r.Value },
+	ChannelSpindleSpeed:      func(d *buffering.SensorData, r ChannelReading) { d.SpindleSpeed = r.Value },
+	ChannelXPos:              func(d *buffering.SensorData, r ChannelReading) { d.XPosMM = r.Value },
+	ChannelYPos:              func(d *buffering.SensorData, r ChannelReading) { d.YPosMM = r.Value },
+	ChannelZPos:              func(d *buffering.SensorData, r ChannelReading) { d.ZPosMM = r.Value },
+	ChannelFeedRate:          func(d *buffering.SensorData, r ChannelReading) { d.FeedRateActual = r.Value },
+	ChannelSpindleLoad:       func(d *buffering.SensorData, r ChannelReading) { d.SpindleLoadPercent = r.Value },
+	ChannelMachineState:      func(d *buffering.SensorData, r ChannelReading) { d.MachineState = r.Text },
+	ChannelActiveProgramLine: func(d *buffering.SensorData, r ChannelReading) { d.ActiveProgramLine = int(r.Value) },
+	ChannelTotalPower:        func(d *buffering.SensorData, r ChannelReading) { d.TotalPowerKW = r.Value },
+}
+
+// sampleChannels lists the sample fields in the order they are reported missing.
+var sampleChannels = []string{
+	ChannelTemperature, ChannelSpindleSpeed, ChannelXPos, ChannelYPos, ChannelZPos,
+	ChannelFeedRate, ChannelSpindleLoad, ChannelMachineState, ChannelActiveProgramLine,
+	ChannelTotalPower,
+}
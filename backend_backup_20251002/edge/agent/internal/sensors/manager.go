@@ -3,17 +3,23 @@ package sensors
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
 	"sync"
+	"time"
 
+	"cnc-monitor/contract"
 	"cnc-monitor/edge/config"
 	"cnc-monitor/edge/internal/buffering"
 	"github.com/rs/zerolog/log"
 )
 
-// SensorInterface defines the interface that all sensors must implement
+// SensorInterface defines the interface that all sensors must implement.
+// Read returns the channels the sensor measures, not a complete sample.
 type SensorInterface interface {
-	Read(ctx context.Context) (buffering.SensorData, error)
+	Read(ctx context.Context) ([]ChannelReading, error)
+	Channels() []ChannelSpec
 	Configure(config map[string]interface{}) error
 	GetMetadata() config.SensorMetadata
 	Health() SensorHealth
@@ -27,21 +33,43 @@ type SensorHealth struct {
 	LastRead    int64     `json:"last_read"`    // Unix timestamp
 	ErrorCount  int64     `json:"error_count"`
 	ErrorRate   float64   `json:"error_rate"`
+	OutOfRange  int64     `json:"out_of_range"` // Readings outside the configured range
 	Message     string    `json:"message"`
 }
 
+// ErrNoReadings is returned by ReadAll when no sensor delivered a usable channel.
+var ErrNoReadings = errors.New("no usable sensor readings")
+
 // Manager coordinates multiple sensors
 type Manager struct {
 	sensors map[string]SensorInterface
+	order   []string // Sensor names in configuration order
 	configs []config.SensorConfig
+	rules   map[string]*validator // Metadata validation per sensor
 	mu      sync.RWMutex
+
+	reconfigureMu sync.Mutex // Serializes Reconfigure
+
+	onOutOfRange func(OutOfRange)
+
+	unknownMu sync.Mutex
+	unknown   map[string]bool // Text channels without a field, already warned about
+
+	failMu   sync.Mutex
+	failures map[string]int // Reads failed in a row, per sensor
 }
 
+// failingReads is how many reads in a row a sensor must fail to count as failing.
+const failingReads = 5
+
 // NewManager creates a new sensor manager
 func NewManager(configs []config.SensorConfig) (*Manager, error) {
 	manager := &Manager{
-		sensors: make(map[string]SensorInterface),
-		configs: configs,
+		sensors:  make(map[string]SensorInterface),
+		configs:  configs,
+		rules:    make(map[string]*validator),
+		unknown:  make(map[string]bool),
+		failures: make(map[string]int),
 	}
 	
 	// Initialize sensors based on configuration
@@ -57,6 +85,8 @@ func NewManager(configs []config.SensorConfig) (*Manager, error) {
 		}
 		
 		manager.sensors[cfg.Name] = sensor
+		manager.rules[cfg.Name] = newValidator(cfg.Name, cfg.Metadata)
+		manager.order = append(manager.order, cfg.Name)
 		log.Info().Str("sensor", cfg.Name).Str("type", cfg.Type).Msg("Sensor created")
 	}
 	
@@ -97,25 +127,359 @@ func (m *Manager) Shutdown(ctx context.Context) error {
 	return nil
 }
 
-// ReadAll reads from all enabled sensors
-func (m *Manager) ReadAll(ctx context.Context) ([]buffering.SensorData, error) {
+// Restart stops and starts every sensor, e.g. to reconnect to the devices.
+func (m *Manager) Restart(ctx context.Context) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	
-	var results []buffering.SensorData
-	
+	for _, name := range m.order {
+		sensor := m.sensors[name]
+		if err := sensor.Stop(ctx); err != nil {
+			log.Error().Err(err).Str("sensor", name).Msg("Failed to stop sensor")
+		}
+		if err := sensor.Start(ctx); err != nil {
+			log.Error().Err(err).Str("sensor", name).Msg("Failed to start sensor")
+		}
+	}
+	log.Info().Int("sensor_count", len(m.order)).Msg("Sensors restarted")
+}
+
+// Reconfigure applies a new sensor configuration while sampling goes on.
+// Sensors that were removed or disabled are stopped and new ones are started.
+// A sensor whose type, address or metadata changed is replaced; one whose
+// config alone changed is reconfigured in place through Configure. If a
+// sensor cannot be created or configured, nothing is changed and the error
+// is returned. It reports whether any sensor changed.
+func (m *Manager) Reconfigure(ctx context.Context, configs []config.SensorConfig) (bool, error) {
+	m.reconfigureMu.Lock()
+	defer m.reconfigureMu.Unlock()
+
+	m.mu.RLock()
+	previous := make(map[string]config.SensorConfig) // Including sensors that failed to be created
+	current := make(map[string]config.SensorConfig)
+	for _, cfg := range m.configs {
+		previous[cfg.Name] = cfg
+		if _, ok := m.sensors[cfg.Name]; ok && cfg.Enabled {
+			current[cfg.Name] = cfg
+		}
+	}
+	existing := make(map[string]SensorInterface, len(m.sensors))
 	for name, sensor := range m.sensors {
-		data, err := sensor.Read(ctx)
+		existing[name] = sensor
+	}
+	m.mu.RUnlock()
+
+	// Create new and replaced sensors first so that a bad entry changes nothing
+	created := make(map[string]SensorInterface)
+	var inPlace []config.SensorConfig
+	for _, cfg := range configs {
+		if !cfg.Enabled {
+			continue
+		}
+		old, ok := current[cfg.Name]
+		switch {
+		case ok && reflect.DeepEqual(old, cfg):
+		case ok && old.Type == cfg.Type && old.Address == cfg.Address && reflect.DeepEqual(old.Metadata, cfg.Metadata):
+			inPlace = append(inPlace, cfg)
+		default:
+			sensor, err := createSensor(cfg)
+			if err != nil && reflect.DeepEqual(previous[cfg.Name], cfg) {
+				// Unchanged and already failing; not a reason to reject the rest
+				log.Error().Err(err).Str("sensor", cfg.Name).Msg("Failed to create sensor")
+				continue
+			}
+			if err != nil {
+				return false, fmt.Errorf("sensor %s: %w", cfg.Name, err)
+			}
+			created[cfg.Name] = sensor
+		}
+	}
+	for i, cfg := range inPlace {
+		if err := existing[cfg.Name].Configure(cfg.Config); err != nil {
+			// Put back the sensors already reconfigured
+			for _, done := range inPlace[:i] {
+				if err := existing[done.Name].Configure(current[done.Name].Config); err != nil {
+					log.Error().Err(err).Str("sensor", done.Name).Msg("Failed to restore sensor configuration")
+				}
+			}
+			return false, fmt.Errorf("sensor %s: %w", cfg.Name, err)
+		}
+		log.Info().Str("sensor", cfg.Name).Msg("Sensor reconfigured")
+	}
+
+	// Stop the sensors that go away before their replacements start
+	enabled := make(map[string]bool)
+	for _, cfg := range configs {
+		enabled[cfg.Name] = cfg.Enabled
+	}
+	var stopped []string
+	for name, sensor := range existing {
+		if _, replaced := created[name]; replaced || !enabled[name] {
+			if err := sensor.Stop(ctx); err != nil {
+				log.Error().Err(err).Str("sensor", name).Msg("Failed to stop sensor")
+			}
+			stopped = append(stopped, name)
+		}
+	}
+	for name, sensor := range created {
+		if err := sensor.Start(ctx); err != nil {
+			log.Error().Err(err).Str("sensor", name).Msg("Failed to start sensor")
+		}
+	}
+
+	m.mu.Lock()
+	sensors := make(map[string]SensorInterface)
+	rules := make(map[string]*validator)
+	var order []string
+	for _, cfg := range configs {
+		if !cfg.Enabled {
+			continue
+		}
+		if sensor, ok := created[cfg.Name]; ok {
+			sensors[cfg.Name] = sensor
+			rules[cfg.Name] = newValidator(cfg.Name, cfg.Metadata)
+			log.Info().Str("sensor", cfg.Name).Str("type", cfg.Type).Msg("Sensor created")
+		} else if sensor, ok := existing[cfg.Name]; ok {
+			sensors[cfg.Name] = sensor
+			rules[cfg.Name] = m.rules[cfg.Name]
+		} else {
+			continue
+		}
+		order = append(order, cfg.Name)
+	}
+	m.sensors, m.rules, m.order, m.configs = sensors, rules, order, configs
+	m.mu.Unlock()
+
+	for _, name := range stopped {
+		if _, ok := created[name]; !ok {
+			log.Info().Str("sensor", name).Msg("Sensor removed")
+		}
+	}
+	return len(created) > 0 || len(inPlace) > 0 || len(stopped) > 0, nil
+}
+
+// OnOutOfRange registers a callback for readings leaving the range of a
+// sensor whose metadata sets an alert level. It is called from ReadAll and
+// must not block.
+func (m *Manager) OnOutOfRange(fn func(OutOfRange)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onOutOfRange = fn
+}
+
+// ReadAll reads all enabled sensors and merges their channels into one
+// machine sample. Each reading is first validated against the metadata of
+// its sensor. When several sensors deliver a channel, the better quality
+// wins, then the sensor listed first. Channels that are not sample fields go
+// to the Channels map. Fields and declared channels without a usable reading
+// are listed in Missing rather than passed off as zero. ErrNoReadings is
+// returned when nothing was read at all. The sample is stamped with the read
+// time, or with the recorded time when a replay keeps it.
+func (m *Manager) ReadAll(ctx context.Context) (buffering.SensorData, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	best := make(map[string]ChannelReading)
+	var recorded time.Time
+	for _, name := range m.order {
+		readings, err := m.sensors[name].Read(ctx)
+		m.countFailure(name, err != nil)
 		if err != nil {
 			log.Error().Err(err).Str("sensor", name).Msg("Failed to read sensor")
 			continue
 		}
-		
-		// Data already contains complete CNC machine reading
-		results = append(results, data)
+		if rt, ok := m.sensors[name].(recordedTimer); ok && rt.RecordedTime() && len(readings) > 0 && recorded.IsZero() {
+			recorded = readings[0].Timestamp
+		}
+		rules := m.rules[name]
+		for _, r := range readings {
+			if event := rules.apply(&r); event != nil {
+				m.reportOutOfRange(*event)
+			}
+			if r.Quality.rank() == 0 {
+				continue
+			}
+			if cur, ok := best[r.Name]; !ok || r.Quality.rank() > cur.Quality.rank() {
+				best[r.Name] = r
+			}
+		}
 	}
-	
-	return results, nil
+
+	var sample buffering.SensorData
+	if len(best) == 0 {
+		return sample, ErrNoReadings
+	}
+	sample.Timestamp = time.Now()
+	if !recorded.IsZero() {
+		sample.Timestamp = recorded
+	}
+	for name, r := range best {
+		if set, ok := sampleFields[name]; ok {
+			set(&sample, r)
+			continue
+		}
+		if r.Text != "" {
+			m.warnTextChannel(name)
+			continue
+		}
+		if sample.Channels == nil {
+			sample.Channels = make(map[string]float64)
+		}
+		sample.Channels[name] = r.Value
+	}
+
+	for _, name := range sampleChannels {
+		if _, ok := best[name]; !ok {
+			sample.Missing = append(sample.Missing, name)
+		}
+	}
+	for _, name := range m.order {
+		for _, spec := range m.sensors[name].Channels() {
+			if _, field := sampleFields[spec.Name]; field {
+				continue
+			}
+			if _, ok := best[spec.Name]; !ok && !containsString(sample.Missing, spec.Name) {
+				sample.Missing = append(sample.Missing, spec.Name)
+			}
+		}
+	}
+	return sample, nil
+}
+
+// reportOutOfRange logs an excursion and passes it on if an alert is configured.
+func (m *Manager) reportOutOfRange(e OutOfRange) {
+	log.Warn().
+		Str("sensor", e.Sensor).
+		Str("channel", e.Channel).
+		Float64("value", e.Value).
+		Float64("min", e.Min).
+		Float64("max", e.Max).
+		Str("action", e.Action).
+		Msg("Reading outside configured range")
+	if e.Alert != "" && m.onOutOfRange != nil {
+		m.onOutOfRange(e)
+	}
+}
+
+// warnTextChannel logs once per channel that only numeric channels can be
+// carried besides the sample fields.
+func (m *Manager) warnTextChannel(name string) {
+	m.unknownMu.Lock()
+	defer m.unknownMu.Unlock()
+	if !m.unknown[name] {
+		m.unknown[name] = true
+		log.Warn().Str("channel", name).Msg("Text channel has no sample field and is dropped")
+	}
+}
+
+// Catalog describes every channel the enabled sensors deliver, combining the
+// channels each sensor declares with its configured metadata. A channel
+// delivered by several sensors is listed once, for the first of them.
+func (m *Manager) Catalog(machineID string) contract.ChannelCatalog {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	catalog := contract.ChannelCatalog{MachineID: machineID, GeneratedAt: time.Now().UTC()}
+	seen := make(map[string]bool)
+	for _, name := range m.order {
+		sensor := m.sensors[name]
+		meta := sensor.GetMetadata()
+		rules := m.rules[name]
+		for _, spec := range sensor.Channels() {
+			if seen[spec.Name] {
+				continue
+			}
+			seen[spec.Name] = true
+			rule := rules.rule(spec.Name)
+			info := contract.ChannelInfo{
+				Name:        spec.Name,
+				Sensor:      name,
+				Units:       spec.Units,
+				Description: meta.Description,
+				Precision:   rule.precision,
+				Tags:        meta.Tags,
+			}
+			if info.Units == "" {
+				info.Units = rule.units
+			}
+			if rule.rng.IsSet() {
+				min, max := rule.rng.Min, rule.rng.Max
+				info.Min, info.Max = &min, &max
+			}
+			catalog.Channels = append(catalog.Channels, info)
+		}
+	}
+	return catalog
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// recordedTimer is implemented by sensors that replay readings with the time
+// they were recorded at.
+type recordedTimer interface {
+	RecordedTime() bool
+}
+
+// KeepsTimestamps reports whether samples carry recorded times that must not
+// be replaced by the time they were read.
+func (m *Manager) KeepsTimestamps() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, sensor := range m.sensors {
+		if rt, ok := sensor.(recordedTimer); ok && rt.RecordedTime() {
+			return true
+		}
+	}
+	return false
+}
+
+// networkFaulter is implemented by sensors that can simulate a network drop.
+type networkFaulter interface {
+	NetworkDown() bool
+}
+
+// NetworkFault reports whether a simulator currently injects a network drop.
+func (m *Manager) NetworkFault() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, sensor := range m.sensors {
+		if f, ok := sensor.(networkFaulter); ok && f.NetworkDown() {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) countFailure(name string, failed bool) {
+	m.failMu.Lock()
+	defer m.failMu.Unlock()
+	if failed {
+		m.failures[name]++
+	} else {
+		delete(m.failures, name)
+	}
+}
+
+// FailingSensors returns the sensors whose last reads all failed, in
+// configuration order.
+func (m *Manager) FailingSensors() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	m.failMu.Lock()
+	defer m.failMu.Unlock()
+	var failing []string
+	for _, name := range m.order {
+		if m.failures[name] >= failingReads {
+			failing = append(failing, name)
+		}
+	}
+	return failing
 }
 
 // GetHealth returns health status for all sensors
@@ -126,7 +490,9 @@ func (m *Manager) GetHealth() map[string]SensorHealth {
 	health := make(map[string]SensorHealth)
 	
 	for name, sensor := range m.sensors {
-		health[name] = sensor.Health()
+		h := sensor.Health()
+		h.OutOfRange = m.rules[name].outOfRange.Load()
+		health[name] = h
 	}
 	
 	return health
@@ -153,6 +519,8 @@ func createSensor(cfg config.SensorConfig) (SensorInterface, error) {
 		return NewModbusSensor(cfg)
 	case "simulator":
 		return NewSimulatorSensor(cfg)
+	case "replay":
+		return NewReplaySensor(cfg)
 	default:
 		return nil, fmt.Errorf("unknown sensor type: %s", cfg.Type)
 	}
@@ -169,8 +537,3 @@ func NewGPIOSensor(cfg config.SensorConfig) (SensorInterface, error) {
 func NewI2CSensor(cfg config.SensorConfig) (SensorInterface, error) {
 	return &SimulatorSensor{config: cfg}, nil // TODO: Implement I2C sensor
 }
-
-// NewModbusSensor creates a Modbus sensor
-func NewModbusSensor(cfg config.SensorConfig) (SensorInterface, error) {
-	return &SimulatorSensor{config: cfg}, nil // TODO: Implement Modbus sensor
-}
\ No newline at end of file
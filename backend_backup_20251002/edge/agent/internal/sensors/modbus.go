@@ -0,0 +1,706 @@
+// internal/sensors/modbus.go
+package sensors
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cnc-monitor/edge/config"
+	"github.com/rs/zerolog/log"
+)
+
+// ModbusSensor polls a Modbus TCP or RTU device in the background and maps
+// each configured register to a channel. Read returns the latest poll.
+type ModbusSensor struct {
+	config   config.SensorConfig
+	metadata config.SensorMetadata
+
+	mu       sync.Mutex
+	settings modbusSettings
+	gen      int // Incremented by Configure
+	conn     modbusConn
+	latest   []ChannelReading
+	polledAt time.Time
+
+	// Health tracking
+	polls      int64
+	errorCount int64
+	failures   int // Consecutive failed polls
+	lastErr    error
+	backoff    time.Duration
+	retryAt    time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// modbusSettings is the parsed sensor configuration.
+type modbusSettings struct {
+	Transport      string // "tcp" or "rtu"
+	Address        string // host:port, or a serial device for RTU
+	UnitID         byte
+	Timeout        time.Duration
+	PollInterval   time.Duration
+	StaleAfter     time.Duration // Read fails once the last good poll is older
+	ReconnectDelay time.Duration
+	MaxReconnect   time.Duration
+	Serial         serialSettings
+	Registers      []modbusRegister
+	blocks         []modbusBlock
+}
+
+type serialSettings struct {
+	BaudRate int
+	DataBits int
+	Parity   string
+	StopBits int
+}
+
+// modbusRegister maps one value on the device to a channel.
+type modbusRegister struct {
+	Channel   string
+	Units     string
+	Function  byte
+	Address   uint16
+	DataType  string
+	ByteOrder string
+	Scale     float64
+	Offset    float64
+	States    map[int64]string // Makes a text channel, e.g. machine_state
+}
+
+// modbusBlock is one read request covering adjacent registers.
+type modbusBlock struct {
+	Function  byte
+	Address   uint16
+	Quantity  uint16
+	Registers []int // Indexes into Registers
+}
+
+// Sizes in registers; bit types occupy one coil or input
+var modbusDataTypes = map[string]uint16{
+	"bool":    1,
+	"int16":   1,
+	"uint16":  1,
+	"int32":   2,
+	"uint32":  2,
+	"float32": 2,
+	"int64":   4,
+	"uint64":  4,
+	"float64": 4,
+}
+
+var modbusFunctions = map[string]byte{
+	"coil":     fcReadCoils,
+	"discrete": fcReadDiscreteInputs,
+	"holding":  fcReadHoldingRegisters,
+	"input":    fcReadInputRegisters,
+}
+
+// NewModbusSensor creates a Modbus sensor from its configuration. The
+// connection is opened by Start and re-established after failures.
+func NewModbusSensor(cfg config.SensorConfig) (*ModbusSensor, error) {
+	settings, err := parseModbusSettings(cfg.Address, cfg.Config)
+	if err != nil {
+		return nil, fmt.Errorf("modbus sensor %s: %w", cfg.Name, err)
+	}
+	return &ModbusSensor{
+		config:   cfg,
+		metadata: cfg.Metadata,
+		settings: settings,
+	}, nil
+}
+
+// Start launches the polling loop.
+func (s *ModbusSensor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		return nil
+	}
+
+	pollCtx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go s.pollLoop(pollCtx, s.done)
+
+	log.Info().
+		Str("sensor", s.config.Name).
+		Str("transport", s.settings.Transport).
+		Str("address", s.settings.Address).
+		Int("registers", len(s.settings.Registers)).
+		Int("requests_per_poll", len(s.settings.blocks)).
+		Msg("Modbus sensor started")
+	return nil
+}
+
+// Stop ends polling and closes the connection.
+func (s *ModbusSensor) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel = nil
+	s.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	s.closeConnLocked()
+	s.mu.Unlock()
+	return nil
+}
+
+// Read returns the channels of the latest successful poll. While later polls
+// fail they are marked uncertain, until they are older than stale_after.
+func (s *ModbusSensor) Read(ctx context.Context) ([]ChannelReading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel == nil {
+		return nil, &SensorError{Message: "sensor not running"}
+	}
+	if s.polledAt.IsZero() {
+		return nil, &SensorError{Message: fmt.Sprintf("no data from %s yet: %v", s.settings.Address, s.lastErr)}
+	}
+	if age := time.Since(s.polledAt); age > s.settings.StaleAfter {
+		return nil, &SensorError{Message: fmt.Sprintf("data from %s is %s old: %v", s.settings.Address, age.Round(time.Millisecond), s.lastErr)}
+	}
+	readings := make([]ChannelReading, len(s.latest))
+	copy(readings, s.latest)
+	if s.failures > 0 {
+		for i := range readings {
+			readings[i].Quality = QualityUncertain
+		}
+	}
+	return readings, nil
+}
+
+// Configure applies a new configuration. The connection is reopened with the
+// new settings on the next poll.
+func (s *ModbusSensor) Configure(cfg map[string]interface{}) error {
+	settings, err := parseModbusSettings(s.config.Address, cfg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.Config = cfg
+	s.settings = settings
+	s.gen++
+	s.closeConnLocked()
+	s.backoff = 0
+	s.retryAt = time.Time{}
+	return nil
+}
+
+// Channels declares one channel per configured register.
+func (s *ModbusSensor) Channels() []ChannelSpec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	specs := make([]ChannelSpec, len(s.settings.Registers))
+	for i, r := range s.settings.Registers {
+		specs[i] = ChannelSpec{Name: r.Channel, Units: r.Units}
+	}
+	return specs
+}
+
+// GetMetadata returns sensor metadata
+func (s *ModbusSensor) GetMetadata() config.SensorMetadata {
+	return s.metadata
+}
+
+// Health reports "ok" while polls succeed, "degraded" after isolated
+// failures and "failed" once the device has been unreachable for three polls.
+func (s *ModbusSensor) Health() SensorHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := SensorHealth{
+		Status:     "ok",
+		ErrorCount: s.errorCount,
+		Message:    fmt.Sprintf("Polling %s every %s", s.settings.Address, s.settings.PollInterval),
+	}
+	if !s.polledAt.IsZero() {
+		h.LastRead = s.polledAt.Unix()
+	}
+	if s.polls > 0 {
+		h.ErrorRate = float64(s.errorCount) / float64(s.polls)
+	}
+	switch {
+	case s.cancel == nil:
+		h.Status = "stopped"
+		h.Message = "Modbus sensor stopped"
+	case s.failures >= 3 || (s.polledAt.IsZero() && s.failures > 0):
+		h.Status = "failed"
+		h.Message = s.lastErr.Error()
+	case s.failures > 0:
+		h.Status = "degraded"
+		h.Message = s.lastErr.Error()
+	}
+	return h
+}
+
+func (s *ModbusSensor) pollLoop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for {
+		s.poll()
+
+		s.mu.Lock()
+		interval := s.settings.PollInterval
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// poll reads all register blocks once. Transport errors drop the connection,
+// which is reopened with exponential backoff; exception responses keep it.
+// Device I/O happens without the lock, so Read never waits on the bus.
+func (s *ModbusSensor) poll() {
+	s.mu.Lock()
+	settings, conn, gen := s.settings, s.conn, s.gen
+	wait := conn == nil && time.Now().Before(s.retryAt)
+	s.mu.Unlock()
+	if wait {
+		return
+	}
+
+	var (
+		readings []ChannelReading
+		err      error
+	)
+	dialed := conn == nil
+	if dialed {
+		conn, err = dialModbus(settings)
+		if err != nil {
+			err = fmt.Errorf("connect %s: %w", settings.Address, err)
+		}
+	}
+	if err == nil {
+		readings, err = readModbusBlocks(conn, settings)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gen != s.gen {
+		// Reconfigured meanwhile; results are for the old settings
+		if dialed && conn != nil {
+			_ = conn.Close()
+		}
+		return
+	}
+	if dialed && conn != nil {
+		s.conn = conn
+		s.backoff = 0
+		log.Info().Str("sensor", s.config.Name).Str("address", settings.Address).Msg("Modbus connected")
+	}
+	if err != nil {
+		s.recordFailureLocked(err)
+		var exc *ModbusException
+		if !errors.As(err, &exc) {
+			s.closeConnLocked()
+			s.scheduleReconnectLocked()
+		}
+		return
+	}
+
+	s.polls++
+	s.latest = readings
+	s.polledAt = time.Now()
+	if s.failures > 0 {
+		log.Info().Str("sensor", s.config.Name).Int("failed_polls", s.failures).Msg("Modbus polling recovered")
+	}
+	s.failures = 0
+	s.lastErr = nil
+}
+
+// readModbusBlocks issues the read requests of one poll and decodes a reading
+// per register.
+func readModbusBlocks(conn modbusConn, settings modbusSettings) ([]ChannelReading, error) {
+	readings := make([]ChannelReading, len(settings.Registers))
+	for _, b := range settings.blocks {
+		resp, err := conn.Transact(settings.UnitID, readRequest(b.Function, b.Address, b.Quantity), settings.Timeout)
+		if err == nil {
+			resp, err = readResponse(b.Function, b.Quantity, resp)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read function %#02x at %d: %w", b.Function, b.Address, err)
+		}
+		now := time.Now()
+		for _, i := range b.Registers {
+			readings[i] = settings.Registers[i].reading(b, resp, now)
+		}
+	}
+	return readings, nil
+}
+
+func (s *ModbusSensor) recordFailureLocked(err error) {
+	s.polls++
+	s.errorCount++
+	s.failures++
+	s.lastErr = err
+	// Log the first failure of a streak and then only occasionally
+	if s.failures == 1 || s.failures%100 == 0 {
+		log.Warn().Err(err).Str("sensor", s.config.Name).Int("consecutive_failures", s.failures).Msg("Modbus poll failed")
+	}
+}
+
+func (s *ModbusSensor) scheduleReconnectLocked() {
+	if s.backoff == 0 {
+		s.backoff = s.settings.ReconnectDelay
+	} else if s.backoff *= 2; s.backoff > s.settings.MaxReconnect {
+		s.backoff = s.settings.MaxReconnect
+	}
+	s.retryAt = time.Now().Add(s.backoff)
+}
+
+func (s *ModbusSensor) closeConnLocked() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// reading decodes the register from the response data of its block.
+func (r modbusRegister) reading(b modbusBlock, data []byte, ts time.Time) ChannelReading {
+	offset := int(r.Address - b.Address)
+	var raw float64
+	if b.Function == fcReadCoils || b.Function == fcReadDiscreteInputs {
+		if data[offset/8]&(1<<(offset%8)) != 0 {
+			raw = 1
+		}
+	} else {
+		raw = decodeRegisters(r.DataType, r.ByteOrder, data[offset*2:offset*2+int(modbusDataTypes[r.DataType])*2])
+	}
+
+	reading := ChannelReading{Name: r.Channel, Units: r.Units, Quality: QualityGood, Timestamp: ts}
+	if r.States != nil || r.Channel == ChannelMachineState {
+		reading.Value = raw
+		if state, ok := r.States[int64(raw)]; ok {
+			reading.Text = state
+		} else {
+			reading.Text = strconv.FormatInt(int64(raw), 10)
+		}
+		return reading
+	}
+	reading.Value = raw*r.Scale + r.Offset
+	return reading
+}
+
+// decodeRegisters converts big-endian register words to a value. byteOrder
+// names the order of the value's bytes on the wire, A being the most
+// significant: ABCD is standard Modbus, CDAB swaps words, BADC swaps the bytes
+// in each word and DCBA is fully little-endian.
+func decodeRegisters(dataType, byteOrder string, words []byte) float64 {
+	b := make([]byte, len(words))
+	copy(b, words)
+	if byteOrder == "CDAB" || byteOrder == "DCBA" {
+		for i, j := 0, len(b)-2; i < j; i, j = i+2, j-2 {
+			b[i], b[i+1], b[j], b[j+1] = b[j], b[j+1], b[i], b[i+1]
+		}
+	}
+	if byteOrder == "BADC" || byteOrder == "DCBA" {
+		for i := 0; i+1 < len(b); i += 2 {
+			b[i], b[i+1] = b[i+1], b[i]
+		}
+	}
+
+	switch dataType {
+	case "int16":
+		return float64(int16(binary.BigEndian.Uint16(b)))
+	case "uint16", "bool":
+		return float64(binary.BigEndian.Uint16(b))
+	case "int32":
+		return float64(int32(binary.BigEndian.Uint32(b)))
+	case "uint32":
+		return float64(binary.BigEndian.Uint32(b))
+	case "float32":
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case "int64":
+		return float64(int64(binary.BigEndian.Uint64(b)))
+	case "uint64":
+		return float64(binary.BigEndian.Uint64(b))
+	case "float64":
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// parseModbusSettings reads the sensor's config map, e.g.
+//
+//	transport: "tcp"            # tcp or rtu; rtu for /dev/ addresses by default
+//	unit_id: 1
+//	timeout: "1s"
+//	poll_interval: "100ms"
+//	byte_order: "ABCD"
+//	registers:
+//	  - channel: "spindle_speed"
+//	    address: 0x0001
+//	    function: 3             # or type: coil, discrete, holding, input
+//	    data_type: "uint16"
+//	    scale: 0.1
+func parseModbusSettings(address string, cfg map[string]interface{}) (modbusSettings, error) {
+	s := modbusSettings{
+		Address:        address,
+		Transport:      configString(cfg, "transport", ""),
+		Timeout:        configDuration(cfg, "timeout", time.Second),
+		PollInterval:   configDuration(cfg, "poll_interval", 500*time.Millisecond),
+		ReconnectDelay: configDuration(cfg, "reconnect_delay", time.Second),
+		MaxReconnect:   configDuration(cfg, "max_reconnect_delay", 30*time.Second),
+		Serial: serialSettings{
+			BaudRate: int(configInt(cfg, "baud_rate", 9600)),
+			DataBits: int(configInt(cfg, "data_bits", 8)),
+			Parity:   strings.ToLower(configString(cfg, "parity", "none")),
+			StopBits: int(configInt(cfg, "stop_bits", 1)),
+		},
+	}
+	if s.Address == "" {
+		return s, errors.New("address is required")
+	}
+	if s.Transport == "" {
+		s.Transport = "tcp"
+		if strings.HasPrefix(s.Address, "/dev/") {
+			s.Transport = "rtu"
+		}
+	}
+	if s.Transport != "tcp" && s.Transport != "rtu" {
+		return s, fmt.Errorf("transport must be tcp or rtu, got %q", s.Transport)
+	}
+	if _, _, err := net.SplitHostPort(s.Address); err != nil && s.Transport == "tcp" {
+		// A host or IP literal without a port, e.g. 10.0.0.5, ::1 or [::1]
+		s.Address = net.JoinHostPort(strings.Trim(s.Address, "[]"), "502")
+	}
+
+	// slave_id is accepted as the serial-line name of the unit ID
+	unit := configInt(cfg, "unit_id", configInt(cfg, "slave_id", 1))
+	if unit < 0 || unit > 255 {
+		return s, fmt.Errorf("unit_id %d out of range", unit)
+	}
+	s.UnitID = byte(unit)
+	if s.PollInterval <= 0 || s.Timeout <= 0 {
+		return s, errors.New("poll_interval and timeout must be positive")
+	}
+	s.StaleAfter = configDuration(cfg, "stale_after", 3*s.PollInterval+s.Timeout)
+	if s.MaxReconnect < s.ReconnectDelay {
+		s.MaxReconnect = s.ReconnectDelay
+	}
+
+	defaultOrder := strings.ToUpper(configString(cfg, "byte_order", "ABCD"))
+	list, _ := cfg["registers"].([]interface{})
+	if len(list) == 0 {
+		return s, errors.New("at least one register is required")
+	}
+	for i, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return s, fmt.Errorf("register %d: expected a map", i)
+		}
+		r, err := parseModbusRegister(m, defaultOrder)
+		if err != nil {
+			return s, fmt.Errorf("register %d: %w", i, err)
+		}
+		s.Registers = append(s.Registers, r)
+	}
+	s.blocks = planModbusBlocks(s.Registers)
+	return s, nil
+}
+
+func parseModbusRegister(m map[string]interface{}, defaultOrder string) (modbusRegister, error) {
+	r := modbusRegister{
+		Channel:   configString(m, "channel", ""),
+		Units:     configString(m, "units", ""),
+		DataType:  strings.ToLower(configString(m, "data_type", "")),
+		ByteOrder: strings.ToUpper(configString(m, "byte_order", defaultOrder)),
+		Scale:     configFloat(m, "scale", 1),
+		Offset:    configFloat(m, "offset", 0),
+	}
+	if r.Channel == "" {
+		return r, errors.New("channel is required")
+	}
+
+	addr := configInt(m, "address", -1)
+	if addr < 0 || addr > math.MaxUint16 {
+		return r, fmt.Errorf("address %d out of range", addr)
+	}
+	r.Address = uint16(addr)
+
+	if fc := configInt(m, "function", 0); fc != 0 {
+		r.Function = byte(fc)
+	} else {
+		r.Function = modbusFunctions[strings.ToLower(configString(m, "type", "holding"))]
+	}
+	bits := r.Function == fcReadCoils || r.Function == fcReadDiscreteInputs
+	if !bits && r.Function != fcReadHoldingRegisters && r.Function != fcReadInputRegisters {
+		return r, errors.New("function must be 1-4 or type coil, discrete, holding or input")
+	}
+
+	switch {
+	case r.DataType == "" && bits:
+		r.DataType = "bool"
+	case r.DataType == "":
+		r.DataType = "uint16"
+	case bits && r.DataType != "bool":
+		return r, fmt.Errorf("coils and discrete inputs are bool, not %s", r.DataType)
+	}
+	if _, ok := modbusDataTypes[r.DataType]; !ok {
+		return r, fmt.Errorf("unknown data_type %q", r.DataType)
+	}
+	switch r.ByteOrder {
+	case "ABCD", "CDAB", "BADC", "DCBA":
+	default:
+		return r, fmt.Errorf("byte_order must be ABCD, CDAB, BADC or DCBA, got %q", r.ByteOrder)
+	}
+
+	// YAML decodes numeric keys into a map[interface{}]interface{}
+	states := map[string]interface{}{}
+	switch v := m["states"].(type) {
+	case map[string]interface{}:
+		states = v
+	case map[interface{}]interface{}:
+		for k, name := range v {
+			states[fmt.Sprint(k)] = name
+		}
+	}
+	if len(states) > 0 {
+		r.States = make(map[int64]string, len(states))
+		for k, v := range states {
+			n, err := strconv.ParseInt(k, 0, 64)
+			if err != nil {
+				return r, fmt.Errorf("states: %q is not a number", k)
+			}
+			r.States[n] = fmt.Sprint(v)
+		}
+	}
+	return r, nil
+}
+
+// planModbusBlocks groups registers into as few read requests as possible.
+// Only contiguous or overlapping addresses are merged, since devices may
+// reject reads that touch unmapped addresses.
+func planModbusBlocks(regs []modbusRegister) []modbusBlock {
+	idx := make([]int, len(regs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		ra, rb := regs[idx[a]], regs[idx[b]]
+		if ra.Function != rb.Function {
+			return ra.Function < rb.Function
+		}
+		return ra.Address < rb.Address
+	})
+
+	var blocks []modbusBlock
+	for _, i := range idx {
+		r := regs[i]
+		size := modbusDataTypes[r.DataType]
+		limit := uint16(maxReadRegisters)
+		if r.Function == fcReadCoils || r.Function == fcReadDiscreteInputs {
+			size, limit = 1, maxReadBits
+		}
+		end := uint32(r.Address) + uint32(size)
+
+		if n := len(blocks); n > 0 {
+			b := &blocks[n-1]
+			bEnd := uint32(b.Address) + uint32(b.Quantity)
+			if b.Function == r.Function && uint32(r.Address) <= bEnd && end-uint32(b.Address) <= uint32(limit) {
+				if end > bEnd {
+					b.Quantity = uint16(end - uint32(b.Address))
+				}
+				b.Registers = append(b.Registers, i)
+				continue
+			}
+		}
+		blocks = append(blocks, modbusBlock{Function: r.Function, Address: r.Address, Quantity: size, Registers: []int{i}})
+	}
+	return blocks
+}
+
+// Config values come from YAML through viper, so numbers may be ints, floats
+// or strings such as "0x10".
+
+func configString(cfg map[string]interface{}, key, def string) string {
+	if v, ok := cfg[key]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return def
+}
+
+func configInt(cfg map[string]interface{}, key string, def int64) int64 {
+	switch v := cfg[key].(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case string:
+		if n, err := strconv.ParseInt(v, 0, 64); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func configFloat(cfg map[string]interface{}, key string, def float64) float64 {
+	switch v := cfg[key].(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float64:
+		return v
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func configDuration(cfg map[string]interface{}, key string, def time.Duration) time.Duration {
+	switch v := cfg[key].(type) {
+	case string:
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	case time.Duration:
+		return v
+	}
+	return def
+}
+
+func configBool(cfg map[string]interface{}, key string, def bool) bool {
+	switch v := cfg[key].(type) {
+	case bool:
+		return v
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
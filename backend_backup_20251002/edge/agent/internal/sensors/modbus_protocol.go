@@ -0,0 +1,248 @@
+// internal/sensors/modbus_protocol.go
+package sensors
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Modbus read function codes
+const (
+	fcReadCoils            = 0x01
+	fcReadDiscreteInputs   = 0x02
+	fcReadHoldingRegisters = 0x03
+	fcReadInputRegisters   = 0x04
+)
+
+// Request size limits from the Modbus application protocol specification
+const (
+	maxReadBits      = 2000
+	maxReadRegisters = 125
+)
+
+// ModbusException is an exception response from a Modbus device. The
+// connection stays usable; only the request was rejected.
+type ModbusException struct {
+	Function byte
+	Code     byte
+}
+
+func (e *ModbusException) Error() string {
+	name := map[byte]string{
+		0x01: "illegal function",
+		0x02: "illegal data address",
+		0x03: "illegal data value",
+		0x04: "server device failure",
+		0x06: "server device busy",
+		0x0A: "gateway path unavailable",
+		0x0B: "gateway target device failed to respond",
+	}[e.Code]
+	if name == "" {
+		name = "unknown exception"
+	}
+	return fmt.Sprintf("modbus exception %#02x (%s) for function %#02x", e.Code, name, e.Function)
+}
+
+// modbusConn is a connection to one device that exchanges request and response
+// PDUs (function code followed by data) with the framing of its transport.
+type modbusConn interface {
+	Transact(unitID byte, pdu []byte, timeout time.Duration) ([]byte, error)
+	Close() error
+}
+
+// deadliner is implemented by net.Conn and by serial ports opened non-blocking.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// tcpConn frames PDUs with the Modbus TCP (MBAP) header.
+type tcpConn struct {
+	rw  io.ReadWriteCloser
+	tid uint16
+}
+
+func (c *tcpConn) Transact(unitID byte, pdu []byte, timeout time.Duration) ([]byte, error) {
+	setDeadline(c.rw, timeout)
+	c.tid++
+
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], c.tid)
+	binary.BigEndian.PutUint16(frame[2:], 0) // Protocol identifier
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(pdu)+1))
+	frame[6] = unitID
+	frame = append(frame, pdu...)
+	if _, err := c.rw.Write(frame); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.rw, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 2 || length > 254 {
+		return nil, fmt.Errorf("modbus tcp: invalid length %d", length)
+	}
+	resp := make([]byte, length-1)
+	if _, err := io.ReadFull(c.rw, resp); err != nil {
+		return nil, err
+	}
+	if tid := binary.BigEndian.Uint16(header[0:]); tid != c.tid {
+		return nil, fmt.Errorf("modbus tcp: transaction id %d, expected %d", tid, c.tid)
+	}
+	if header[6] != unitID {
+		return nil, fmt.Errorf("modbus tcp: response from unit %d, expected %d", header[6], unitID)
+	}
+	return resp, nil
+}
+
+func (c *tcpConn) Close() error {
+	return c.rw.Close()
+}
+
+// rtuConn frames PDUs as Modbus RTU (address, PDU, CRC-16), over a serial
+// port or a TCP serial gateway.
+type rtuConn struct {
+	rw        io.ReadWriteCloser
+	frameGap  time.Duration // 3.5 character times of silence between frames
+	lastFrame time.Time
+}
+
+func newRTUConn(rw io.ReadWriteCloser, baudRate int) *rtuConn {
+	gap := 2 * time.Millisecond
+	if baudRate > 0 && baudRate <= 19200 {
+		// 11 bits per character, 3.5 characters
+		gap = time.Duration(38.5 / float64(baudRate) * float64(time.Second))
+	}
+	return &rtuConn{rw: rw, frameGap: gap}
+}
+
+func (c *rtuConn) Transact(unitID byte, pdu []byte, timeout time.Duration) ([]byte, error) {
+	if wait := c.frameGap - time.Since(c.lastFrame); wait > 0 {
+		time.Sleep(wait)
+	}
+	defer func() { c.lastFrame = time.Now() }()
+	setDeadline(c.rw, timeout)
+
+	frame := make([]byte, 0, len(pdu)+3)
+	frame = append(frame, unitID)
+	frame = append(frame, pdu...)
+	frame = binary.LittleEndian.AppendUint16(frame, crc16(frame))
+	if _, err := c.rw.Write(frame); err != nil {
+		return nil, err
+	}
+
+	// Address, function code and the byte count or exception code
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(c.rw, head); err != nil {
+		return nil, err
+	}
+	var rest int
+	switch {
+	case head[1]&0x80 != 0:
+		rest = 2
+	case head[1] == fcReadCoils || head[1] == fcReadDiscreteInputs ||
+		head[1] == fcReadHoldingRegisters || head[1] == fcReadInputRegisters:
+		rest = int(head[2]) + 2
+	default:
+		return nil, fmt.Errorf("modbus rtu: unsupported function %#02x in response", head[1])
+	}
+	tail := make([]byte, rest)
+	if _, err := io.ReadFull(c.rw, tail); err != nil {
+		return nil, err
+	}
+	resp := append(head, tail...)
+	n := len(resp) - 2
+	if crc := binary.LittleEndian.Uint16(resp[n:]); crc != crc16(resp[:n]) {
+		return nil, errors.New("modbus rtu: CRC mismatch")
+	}
+	if resp[0] != unitID {
+		return nil, fmt.Errorf("modbus rtu: response from unit %d, expected %d", resp[0], unitID)
+	}
+	return resp[1:n], nil
+}
+
+func (c *rtuConn) Close() error {
+	return c.rw.Close()
+}
+
+func setDeadline(rw io.ReadWriteCloser, timeout time.Duration) {
+	if d, ok := rw.(deadliner); ok && timeout > 0 {
+		_ = d.SetDeadline(time.Now().Add(timeout))
+	}
+}
+
+// crc16 is the Modbus RTU CRC (polynomial 0xA001, initial value 0xFFFF).
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// readRequest builds the PDU of a read request.
+func readRequest(function byte, address, quantity uint16) []byte {
+	pdu := []byte{function, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	binary.BigEndian.PutUint16(pdu[3:], quantity)
+	return pdu
+}
+
+// readResponse validates the response PDU of a read request and returns its
+// data: packed bits for coils and discrete inputs, big-endian registers otherwise.
+func readResponse(function byte, quantity uint16, resp []byte) ([]byte, error) {
+	if len(resp) == 2 && resp[0] == function|0x80 {
+		return nil, &ModbusException{Function: function, Code: resp[1]}
+	}
+	if len(resp) < 2 || resp[0] != function {
+		return nil, fmt.Errorf("modbus: unexpected response % x to function %#02x", resp, function)
+	}
+	want := int(quantity) * 2
+	if function == fcReadCoils || function == fcReadDiscreteInputs {
+		want = (int(quantity) + 7) / 8
+	}
+	if int(resp[1]) != want || len(resp) != want+2 {
+		return nil, fmt.Errorf("modbus: function %#02x returned %d bytes, expected %d", function, len(resp)-2, want)
+	}
+	return resp[2:], nil
+}
+
+// dialModbus opens a connection for the given transport. RTU addresses of the
+// form host:port go through a TCP serial gateway.
+func dialModbus(s modbusSettings) (modbusConn, error) {
+	switch s.Transport {
+	case "tcp":
+		c, err := net.DialTimeout("tcp", s.Address, s.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &tcpConn{rw: c}, nil
+	case "rtu":
+		if _, _, err := net.SplitHostPort(s.Address); err == nil {
+			c, err := net.DialTimeout("tcp", s.Address, s.Timeout)
+			if err != nil {
+				return nil, err
+			}
+			return newRTUConn(c, 0), nil
+		}
+		port, err := openSerial(s.Address, s.Serial)
+		if err != nil {
+			return nil, err
+		}
+		return newRTUConn(port, s.Serial.BaudRate), nil
+	default:
+		return nil, fmt.Errorf("unknown modbus transport: %s", s.Transport)
+	}
+}
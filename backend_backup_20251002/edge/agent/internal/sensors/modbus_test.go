@@ -0,0 +1,544 @@
+package sensors
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cnc-monitor/edge/config"
+)
+
+// modbusStub is an in-process Modbus device serving Modbus TCP, or RTU frames
+// over TCP like a serial gateway.
+type modbusStub struct {
+	addr string
+	rtu  bool
+
+	mu        sync.Mutex
+	registers map[byte]map[uint16]uint16 // Holding and input registers by function
+	bits      map[byte]map[uint16]bool   // Coils and discrete inputs by function
+	exception byte                       // Answer every request with this exception code
+	silent    bool                       // Read requests but never answer
+	tamper    func(frame []byte) []byte  // Applied to each response frame
+	conns     int
+}
+
+func newModbusStub(t *testing.T, rtu bool) *modbusStub {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &modbusStub{
+		addr: ln.Addr().String(),
+		rtu:  rtu,
+		registers: map[byte]map[uint16]uint16{
+			fcReadHoldingRegisters: {},
+			fcReadInputRegisters:   {},
+		},
+		bits: map[byte]map[uint16]bool{
+			fcReadCoils:          {},
+			fcReadDiscreteInputs: {},
+		},
+	}
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				// Let the connection die with the listener
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				s.serve(conn)
+			}()
+		}
+	}()
+	return s
+}
+
+// set changes the stub's state under its lock.
+func (s *modbusStub) set(f func(s *modbusStub)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func (s *modbusStub) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func (s *modbusStub) serve(conn net.Conn) {
+	for {
+		var (
+			unit byte
+			pdu  []byte
+			tid  []byte
+		)
+		if s.rtu {
+			// Read requests are always 8 bytes; a device ignores bad frames
+			frame := make([]byte, 8)
+			if _, err := io.ReadFull(conn, frame); err != nil {
+				return
+			}
+			if binary.LittleEndian.Uint16(frame[6:]) != crc16(frame[:6]) {
+				continue
+			}
+			unit, pdu = frame[0], frame[1:6]
+		} else {
+			header := make([]byte, 7)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			if binary.BigEndian.Uint16(header[2:]) != 0 {
+				return
+			}
+			pdu = make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+			if _, err := io.ReadFull(conn, pdu); err != nil {
+				return
+			}
+			unit, tid = header[6], header[0:2]
+		}
+
+		s.mu.Lock()
+		resp := s.handle(pdu)
+		silent, tamper := s.silent, s.tamper
+		s.mu.Unlock()
+		if silent {
+			continue
+		}
+
+		var frame []byte
+		if s.rtu {
+			frame = append([]byte{unit}, resp...)
+			frame = binary.LittleEndian.AppendUint16(frame, crc16(frame))
+		} else {
+			frame = append(frame, tid...)
+			frame = binary.BigEndian.AppendUint16(frame, 0)
+			frame = binary.BigEndian.AppendUint16(frame, uint16(len(resp)+1))
+			frame = append(frame, unit)
+			frame = append(frame, resp...)
+		}
+		if tamper != nil {
+			frame = tamper(frame)
+		}
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a read request PDU.
+func (s *modbusStub) handle(pdu []byte) []byte {
+	function := pdu[0]
+	if s.exception != 0 {
+		return []byte{function | 0x80, s.exception}
+	}
+	if len(pdu) != 5 {
+		return []byte{function | 0x80, 0x03}
+	}
+	address, quantity := binary.BigEndian.Uint16(pdu[1:]), binary.BigEndian.Uint16(pdu[3:])
+
+	if bits, ok := s.bits[function]; ok {
+		data := make([]byte, (quantity+7)/8)
+		for i := uint16(0); i < quantity; i++ {
+			if bits[address+i] {
+				data[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append([]byte{function, byte(len(data))}, data...)
+	}
+	if regs, ok := s.registers[function]; ok {
+		resp := []byte{function, byte(quantity * 2)}
+		for i := uint16(0); i < quantity; i++ {
+			resp = binary.BigEndian.AppendUint16(resp, regs[address+i])
+		}
+		return resp
+	}
+	return []byte{function | 0x80, 0x01}
+}
+
+func TestCRC16(t *testing.T) {
+	// Read 10 holding registers from unit 1, as in the Modbus over serial
+	// line specification: 01 03 00 00 00 0A C5 CD
+	frame := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0A}
+	if got := binary.LittleEndian.AppendUint16(nil, crc16(frame)); got[0] != 0xC5 || got[1] != 0xCD {
+		t.Errorf("crc16 % x, want c5 cd", got)
+	}
+}
+
+func TestModbusTransact(t *testing.T) {
+	for _, transport := range []string{"tcp", "rtu"} {
+		t.Run(transport, func(t *testing.T) {
+			stub := newModbusStub(t, transport == "rtu")
+			stub.set(func(s *modbusStub) {
+				s.registers[fcReadHoldingRegisters][100] = 0x1234
+				s.registers[fcReadHoldingRegisters][101] = 0xABCD
+				s.bits[fcReadCoils][2] = true
+				s.bits[fcReadCoils][9] = true
+			})
+			conn, err := dialModbus(modbusSettings{Transport: transport, Address: stub.addr, Timeout: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			transact := func(function byte, address, quantity uint16) ([]byte, error) {
+				resp, err := conn.Transact(7, readRequest(function, address, quantity), 200*time.Millisecond)
+				if err != nil {
+					return nil, err
+				}
+				return readResponse(function, quantity, resp)
+			}
+
+			data, err := transact(fcReadHoldingRegisters, 100, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "\x12\x34\xAB\xCD" {
+				t.Errorf("registers % x, want 12 34 ab cd", data)
+			}
+			data, err = transact(fcReadCoils, 0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != 2 || data[0] != 0x04 || data[1] != 0x02 {
+				t.Errorf("coils % x, want 04 02", data)
+			}
+
+			// An exception response is returned as such and the connection
+			// stays usable
+			stub.set(func(s *modbusStub) { s.exception = 0x02 })
+			_, err = transact(fcReadHoldingRegisters, 100, 2)
+			var exc *ModbusException
+			if !errors.As(err, &exc) || exc.Function != fcReadHoldingRegisters || exc.Code != 0x02 {
+				t.Fatalf("exception response: %v", err)
+			}
+			if !strings.Contains(err.Error(), "illegal data address") {
+				t.Errorf("exception message %q", err)
+			}
+			stub.set(func(s *modbusStub) { s.exception = 0 })
+			if _, err := transact(fcReadHoldingRegisters, 100, 2); err != nil {
+				t.Fatalf("read after exception: %v", err)
+			}
+
+			// A device that does not answer runs into the timeout
+			stub.set(func(s *modbusStub) { s.silent = true })
+			start := time.Now()
+			_, err = transact(fcReadHoldingRegisters, 100, 2)
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("unanswered request: %v, want a deadline error", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("timeout took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestModbusTransactRejectsBadFrames(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport string
+		tamper    func(frame []byte) []byte
+		wantErr   string
+	}{
+		{
+			name:      "transaction id",
+			transport: "tcp",
+			tamper:    func(f []byte) []byte { f[1]++; return f },
+			wantErr:   "transaction id",
+		},
+		{
+			name:      "tcp unit",
+			transport: "tcp",
+			tamper:    func(f []byte) []byte { f[6]++; return f },
+			wantErr:   "response from unit",
+		},
+		{
+			name:      "tcp length",
+			transport: "tcp",
+			tamper:    func(f []byte) []byte { binary.BigEndian.PutUint16(f[4:], 1); return f },
+			wantErr:   "invalid length",
+		},
+		{
+			name:      "crc",
+			transport: "rtu",
+			tamper:    func(f []byte) []byte { f[len(f)-1] ^= 0xFF; return f },
+			wantErr:   "CRC mismatch",
+		},
+		{
+			name:      "corrupted data",
+			transport: "rtu",
+			tamper:    func(f []byte) []byte { f[3] ^= 0x01; return f },
+			wantErr:   "CRC mismatch",
+		},
+		{
+			name:      "rtu unit",
+			transport: "rtu",
+			tamper: func(f []byte) []byte {
+				f[0]++
+				n := len(f) - 2
+				binary.LittleEndian.PutUint16(f[n:], crc16(f[:n]))
+				return f
+			},
+			wantErr: "response from unit",
+		},
+		{
+			name:      "rtu function",
+			transport: "rtu",
+			tamper: func(f []byte) []byte {
+				f[1] = 0x10
+				n := len(f) - 2
+				binary.LittleEndian.PutUint16(f[n:], crc16(f[:n]))
+				return f
+			},
+			wantErr: "unsupported function",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newModbusStub(t, tt.transport == "rtu")
+			stub.set(func(s *modbusStub) { s.tamper = tt.tamper })
+			conn, err := dialModbus(modbusSettings{Transport: tt.transport, Address: stub.addr, Timeout: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_, err = conn.Transact(1, readRequest(fcReadHoldingRegisters, 0, 2), 200*time.Millisecond)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Transact: %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		function byte
+		quantity uint16
+		resp     []byte
+		wantErr  bool
+	}{
+		{name: "registers", function: fcReadInputRegisters, quantity: 1, resp: []byte{0x04, 2, 0, 1}},
+		{name: "coils", function: fcReadCoils, quantity: 9, resp: []byte{0x01, 2, 0xFF, 0x01}},
+		{name: "short byte count", function: fcReadHoldingRegisters, quantity: 2, resp: []byte{0x03, 2, 0, 1}, wantErr: true},
+		{name: "truncated", function: fcReadHoldingRegisters, quantity: 2, resp: []byte{0x03, 4, 0, 1}, wantErr: true},
+		{name: "other function", function: fcReadHoldingRegisters, quantity: 1, resp: []byte{0x04, 2, 0, 1}, wantErr: true},
+		{name: "empty", function: fcReadHoldingRegisters, quantity: 1, resp: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := readResponse(tt.function, tt.quantity, tt.resp); (err != nil) != tt.wantErr {
+			t.Errorf("%s: %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestModbusSensorScaling(t *testing.T) {
+	for _, transport := range []string{"tcp", "rtu"} {
+		t.Run(transport, func(t *testing.T) {
+			stub := newModbusStub(t, transport == "rtu")
+			stub.set(func(s *modbusStub) {
+				holding := s.registers[fcReadHoldingRegisters]
+				holding[0] = 1234   // spindle_speed, uint16
+				holding[1] = 0xFF38 // -200, int16
+				// 12.5 as float32 with swapped words
+				holding[2], holding[3] = 0x0000, 0x4148
+				// 70000 as uint32
+				holding[4], holding[5] = 0x0001, 0x1170
+				holding[10] = 2
+				s.registers[fcReadInputRegisters][0] = 0x3F80 // BADC of 0x803F
+				s.bits[fcReadCoils][3] = true
+			})
+
+			cfg := config.SensorConfig{
+				Name:    "plc",
+				Type:    "modbus",
+				Address: stub.addr,
+				Config: map[string]interface{}{
+					"transport":     transport,
+					"unit_id":       3,
+					"timeout":       "500ms",
+					"poll_interval": "10ms",
+					"registers": []interface{}{
+						map[string]interface{}{"channel": "spindle_speed", "address": 0, "units": "rpm", "scale": 0.1},
+						map[string]interface{}{"channel": "temperature", "address": 1, "data_type": "int16", "scale": 0.5, "offset": 10.0},
+						map[string]interface{}{"channel": "load", "address": "0x2", "data_type": "float32", "byte_order": "CDAB"},
+						map[string]interface{}{"channel": "cycle_count", "address": 4, "data_type": "uint32"},
+						map[string]interface{}{"channel": "machine_state", "address": 10, "states": map[string]interface{}{"1": "IDLE", "2": "RUNNING"}},
+						map[string]interface{}{"channel": "coolant_flow", "address": 0, "function": 4, "byte_order": "BADC"},
+						map[string]interface{}{"channel": "door_open", "address": 3, "type": "coil"},
+					},
+				},
+			}
+			sensor, err := NewModbusSensor(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Coils, holding 0-5, holding 10 and the input register
+			if n := len(sensor.settings.blocks); n != 4 {
+				t.Errorf("%d read requests per poll, want 4", n)
+			}
+			if err := sensor.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			defer sensor.Stop(context.Background())
+
+			readings := waitForModbusReadings(t, sensor)
+			want := map[string]struct {
+				value float64
+				text  string
+			}{
+				"spindle_speed": {value: 123.4},
+				"temperature":   {value: -90},
+				"load":          {value: 12.5},
+				"cycle_count":   {value: 70000},
+				"machine_state": {value: 2, text: "RUNNING"},
+				"coolant_flow":  {value: 0x803F},
+				"door_open":     {value: 1},
+			}
+			if len(readings) != len(want) {
+				t.Fatalf("%d readings, want %d: %+v", len(readings), len(want), readings)
+			}
+			for _, r := range readings {
+				w, ok := want[r.Name]
+				if !ok {
+					t.Errorf("unexpected channel %s", r.Name)
+					continue
+				}
+				if math.Abs(r.Value-w.value) > 1e-9 || r.Text != w.text || r.Quality != QualityGood {
+					t.Errorf("%s = %v %q %s, want %v %q good", r.Name, r.Value, r.Text, r.Quality, w.value, w.text)
+				}
+			}
+			if readings[0].Units != "rpm" {
+				t.Errorf("spindle_speed units %q", readings[0].Units)
+			}
+		})
+	}
+}
+
+func TestModbusSensorFailures(t *testing.T) {
+	stub := newModbusStub(t, false)
+	sensor, err := NewModbusSensor(config.SensorConfig{
+		Name:    "plc",
+		Address: stub.addr,
+		Config: map[string]interface{}{
+			"timeout":         "50ms",
+			"poll_interval":   "10ms",
+			"stale_after":     "10s",
+			"reconnect_delay": "10ms",
+			"registers":       []interface{}{map[string]interface{}{"channel": "spindle_speed", "address": 0}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sensor.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer sensor.Stop(context.Background())
+	waitForModbusReadings(t, sensor)
+
+	// Exceptions keep the last readings, marked uncertain, and the connection
+	stub.set(func(s *modbusStub) { s.exception = 0x04 })
+	waitForModbusHealth(t, sensor, "failed")
+	readings, err := sensor.Read(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readings[0].Quality != QualityUncertain {
+		t.Errorf("quality %s after failed polls, want uncertain", readings[0].Quality)
+	}
+	if n := stub.connections(); n != 1 {
+		t.Errorf("%d connections after exceptions, want 1", n)
+	}
+
+	// Timeouts drop the connection, which is reopened once the device answers
+	stub.set(func(s *modbusStub) { s.exception, s.silent = 0, true })
+	deadline := time.Now().Add(5 * time.Second)
+	for stub.connections() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("no reconnect after timeouts")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stub.set(func(s *modbusStub) { s.silent = false })
+	waitForModbusHealth(t, sensor, "ok")
+}
+
+func waitForModbusReadings(t *testing.T, sensor *ModbusSensor) []ChannelReading {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		readings, err := sensor.Read(context.Background())
+		if err == nil {
+			return readings
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no readings: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForModbusHealth(t *testing.T, sensor *ModbusSensor, status string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h := sensor.Health()
+		if h.Status == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("health %s (%s), want %s", h.Status, h.Message, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseModbusAddress(t *testing.T) {
+	registers := []interface{}{map[string]interface{}{"channel": "spindle_speed", "address": 0}}
+	for address, want := range map[string]string{
+		"10.0.0.5":       "10.0.0.5:502",
+		"10.0.0.5:5020":  "10.0.0.5:5020",
+		"plc.local":      "plc.local:502",
+		"::1":            "[::1]:502",
+		"[::1]":          "[::1]:502",
+		"[fe80::1]:5020": "[fe80::1]:5020",
+	} {
+		s, err := parseModbusSettings(address, map[string]interface{}{"registers": registers})
+		if err != nil {
+			t.Errorf("%s: %v", address, err)
+			continue
+		}
+		if s.Address != want {
+			t.Errorf("%s: address %s, want %s", address, s.Address, want)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// internal/sensors/ncprogram.go
+package sensors
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// segment is a stretch of simulated machine activity with constant commands:
+// a straight move, a dwell, a tool change or a setup/idle phase. A scenario is
+// a timeline of segments.
+type segment struct {
+	start, dur float64    // Seconds into the scenario cycle
+	from, to   [3]float64 // Axis positions, mm
+	feed       float64    // Feed of the move, mm/min; 0 when the axes stand still
+	spindle    float64    // Commanded spindle speed, rpm; 0 when stopped
+	load       float64    // Spindle load while cutting, percent; 0 when not cutting
+	line       int        // NC block being executed; 0 outside the program
+	tool       int
+	state      string // machine_state
+}
+
+// Machine states of the simulator
+const (
+	simStateIdle       = "idle"
+	simStateSetup      = "setup"
+	simStateRunning    = "running"
+	simStateToolChange = "tool_change"
+	simStateAlarm      = "alarm"
+)
+
+// ncInterpreter "executes" a Heidenhain conversational (klartext) program into
+// segments. It understands straight moves (L; arcs C/CR/CT are approximated by
+// a straight move to their end point), F and F MAX, TOOL CALL with S, the
+// spindle and end-of-program M functions, and cycles 1 (peck drilling) and 17
+// (rigid tapping) with CYCL CALL. Other blocks are skipped and listed in
+// unsupported.
+type ncInterpreter struct {
+	machine MachineModel
+	tools   map[int]ToolSpec
+
+	pos       [3]float64
+	tool      int
+	speed     float64 // Programmed spindle speed
+	spindleOn bool
+	feed      float64 // Modal feed, mm/min
+
+	cycle       int
+	cycleParams map[int]float64
+
+	segments    []segment
+	clock       float64
+	unsupported []string
+}
+
+var (
+	ncBlockNumber = regexp.MustCompile(`^\s*(\d+)\s*(.*)$`)
+	ncCoordinate  = regexp.MustCompile(`\b(I?)([XYZ])([+-]?\d+(?:\.\d+)?)`)
+	ncFeed        = regexp.MustCompile(`\bF\s*(MAX|\d+(?:\.\d+)?)`)
+	ncMFunction   = regexp.MustCompile(`\bM(\d+)\b`)
+	ncToolCall    = regexp.MustCompile(`^TOOL CALL\s+(\d+)`)
+	ncSpindle     = regexp.MustCompile(`\bS(\d+(?:\.\d+)?)`)
+	ncCycleDef    = regexp.MustCompile(`^CYCL DEF\s+(\d+)\.(\d+)(.*)$`)
+	ncNumber      = regexp.MustCompile(`[+-]?\d+(?:\.\d+)?`)
+)
+
+func newNCInterpreter(machine MachineModel, tools []ToolSpec, start [3]float64, tool int) *ncInterpreter {
+	in := &ncInterpreter{
+		machine:     machine,
+		tools:       make(map[int]ToolSpec),
+		pos:         start,
+		tool:        tool,
+		cycleParams: make(map[int]float64),
+	}
+	for _, t := range tools {
+		in.tools[t.Number] = t
+	}
+	return in
+}
+
+// run executes the program once, appending its segments. A program starts
+// with the machine's initial tool, so a tool changed by the previous run is
+// changed back first.
+func (in *ncInterpreter) run(program string) error {
+	if initial := in.machine.InitialTool; in.tool != initial {
+		in.toolChange(0, initial, in.tools[initial].SpindleSpeed)
+	}
+	for i, raw := range strings.Split(program, "\n") {
+		text := strings.TrimSpace(raw)
+		if idx := strings.Index(text, ";"); idx >= 0 {
+			text = strings.TrimSpace(text[:idx])
+		}
+		line := i
+		if m := ncBlockNumber.FindStringSubmatch(text); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			text = strings.TrimSpace(m[2])
+		}
+		text = strings.ToUpper(text)
+		if text == "" {
+			continue
+		}
+		end, err := in.block(line, text)
+		if err != nil {
+			return fmt.Errorf("block %d %q: %w", line, text, err)
+		}
+		if end {
+			break
+		}
+	}
+	in.spindleOn = false
+	return nil
+}
+
+// block executes one NC block and reports whether it ended the program.
+func (in *ncInterpreter) block(line int, text string) (bool, error) {
+	mFuncs := ncMFunction.FindAllStringSubmatch(text, -1)
+	end := false
+	// Spindle starts take effect at the start of the block, stops at its end
+	for _, m := range mFuncs {
+		switch m[1] {
+		case "3", "4", "13", "14":
+			in.spindleOn = true
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(text, "BEGIN PGM"), strings.HasPrefix(text, "BLK FORM"):
+	case strings.HasPrefix(text, "END PGM"):
+		end = true
+	case strings.HasPrefix(text, "TOOL CALL"):
+		m := ncToolCall.FindStringSubmatch(text)
+		if m == nil {
+			return false, fmt.Errorf("tool number missing")
+		}
+		tool, _ := strconv.Atoi(m[1])
+		speed := in.tools[tool].SpindleSpeed
+		if s := ncSpindle.FindStringSubmatch(text); s != nil {
+			speed, _ = strconv.ParseFloat(s[1], 64)
+		}
+		in.toolChange(line, tool, speed)
+	case strings.HasPrefix(text, "CYCL DEF"):
+		m := ncCycleDef.FindStringSubmatch(text)
+		if m == nil {
+			return false, fmt.Errorf("malformed cycle definition")
+		}
+		number, _ := strconv.Atoi(m[1])
+		param, _ := strconv.Atoi(m[2])
+		if param == 0 {
+			in.cycle = number
+			in.cycleParams = make(map[int]float64)
+			break
+		}
+		if nums := ncNumber.FindAllString(m[3], -1); len(nums) > 0 {
+			in.cycleParams[param], _ = strconv.ParseFloat(nums[len(nums)-1], 64)
+		}
+	case strings.HasPrefix(text, "CYCL CALL"):
+		in.cycleCall(line, text)
+	case strings.HasPrefix(text, "L ") || text == "L" ||
+		strings.HasPrefix(text, "C ") || strings.HasPrefix(text, "CR ") || strings.HasPrefix(text, "CT "):
+		in.linear(line, text)
+	default:
+		if len(mFuncs) == 0 {
+			in.unsupported = append(in.unsupported, fmt.Sprintf("%d %s", line, text))
+		}
+	}
+
+	for _, m := range mFuncs {
+		switch m[1] {
+		case "5":
+			in.spindleOn = false
+		case "2", "30":
+			in.spindleOn = false
+			end = true
+		}
+	}
+	return end, nil
+}
+
+// linear executes a positioning block.
+func (in *ncInterpreter) linear(line int, text string) {
+	to := in.pos
+	for _, m := range ncCoordinate.FindAllStringSubmatch(text, -1) {
+		v, _ := strconv.ParseFloat(m[3], 64)
+		axis := strings.IndexByte("XYZ", m[2][0])
+		if m[1] == "I" {
+			to[axis] += v
+		} else {
+			to[axis] = v
+		}
+	}
+	rapid := false
+	if m := ncFeed.FindStringSubmatch(text); m != nil {
+		if m[1] == "MAX" {
+			rapid = true // F MAX only applies to its own block
+		} else {
+			in.feed, _ = strconv.ParseFloat(m[1], 64)
+		}
+	}
+	if rapid || in.feed <= 0 {
+		in.rapid(line, to)
+	} else {
+		in.move(line, to, in.feed, 1)
+	}
+}
+
+// cycleCall runs the defined cycle at the current position.
+func (in *ncInterpreter) cycleCall(line int, text string) {
+	p := in.cycleParams
+	start := in.pos
+	switch in.cycle {
+	case 1: // Peck drilling: set-up clearance, depth, plunging depth, dwell, feed
+		surface := start[2] - math.Abs(p[1])
+		depth := surface - math.Abs(p[2])
+		peck := math.Abs(p[3])
+		if peck == 0 {
+			peck = math.Abs(p[2])
+		}
+		feed := p[5]
+		if feed <= 0 {
+			feed = in.feed
+		}
+		bottom := surface
+		for {
+			next := math.Max(depth, bottom-peck)
+			in.move(line, [3]float64{start[0], start[1], next}, feed, 1)
+			bottom = next
+			if bottom <= depth {
+				break
+			}
+			in.rapid(line, start)
+			in.rapid(line, [3]float64{start[0], start[1], bottom})
+		}
+		in.dwell(line, p[4])
+		in.rapid(line, start)
+	case 17: // Rigid tapping: set-up clearance, depth, thread pitch
+		surface := start[2] - math.Abs(p[1])
+		depth := surface - math.Abs(p[2])
+		feed := in.spindleSpeed() * math.Abs(p[3])
+		if feed <= 0 {
+			feed = in.feed
+		}
+		in.move(line, [3]float64{start[0], start[1], depth}, feed, 1.25)
+		in.move(line, start, feed, 1.25)
+	default:
+		in.unsupported = append(in.unsupported, fmt.Sprintf("%d %s (cycle %d)", line, text, in.cycle))
+	}
+}
+
+// spindleSpeed is the speed the spindle turns at when on.
+func (in *ncInterpreter) spindleSpeed() float64 {
+	if in.speed > 0 {
+		return in.speed
+	}
+	if s := in.tools[in.tool].SpindleSpeed; s > 0 {
+		return s
+	}
+	return defaultSpindleSpeed
+}
+
+func (in *ncInterpreter) commandedSpindle() float64 {
+	if !in.spindleOn {
+		return 0
+	}
+	return in.spindleSpeed()
+}
+
+func (in *ncInterpreter) rapid(line int, to [3]float64) {
+	in.move(line, to, in.machine.RapidRate, 0)
+}
+
+// move adds a straight move. Feed moves with the spindle on that go below the
+// stock top cut, with the tool's load scaled by loadFactor.
+func (in *ncInterpreter) move(line int, to [3]float64, feed, loadFactor float64) {
+	dist := math.Sqrt(sq(to[0]-in.pos[0]) + sq(to[1]-in.pos[1]) + sq(to[2]-in.pos[2]))
+	if dist == 0 || feed <= 0 {
+		return
+	}
+	load := 0.0
+	if loadFactor > 0 && in.spindleOn && math.Min(in.pos[2], to[2]) < in.machine.StockTop {
+		load = in.cutLoad() * loadFactor
+	}
+	in.add(segment{dur: dist / feed * 60, from: in.pos, to: to, feed: feed, load: load, line: line, state: simStateRunning})
+	in.pos = to
+}
+
+func (in *ncInterpreter) dwell(line int, seconds float64) {
+	if seconds > 0 {
+		in.add(segment{dur: seconds, from: in.pos, to: in.pos, line: line, state: simStateRunning})
+	}
+}
+
+func (in *ncInterpreter) toolChange(line int, tool int, speed float64) {
+	in.spindleOn = false
+	if tool != in.tool {
+		in.add(segment{dur: in.machine.ToolChangeTime.Seconds(), from: in.pos, to: in.pos, line: line, state: simStateToolChange})
+	}
+	in.tool = tool
+	in.speed = speed
+}
+
+func (in *ncInterpreter) cutLoad() float64 {
+	if l := in.tools[in.tool].CutLoad; l > 0 {
+		return l
+	}
+	return defaultCutLoad
+}
+
+// add appends a segment at the end of the timeline, filling in the spindle and tool.
+func (in *ncInterpreter) add(s segment) {
+	s.start = in.clock
+	if s.state != simStateToolChange {
+		s.spindle = in.commandedSpindle()
+	}
+	if s.tool == 0 {
+		s.tool = in.tool
+	}
+	in.segments = append(in.segments, s)
+	in.clock += s.dur
+}
+
+func sq(v float64) float64 { return v * v }
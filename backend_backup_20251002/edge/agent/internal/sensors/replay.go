@@ -0,0 +1,240 @@
+// internal/sensors/replay.go
+package sensors
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"cnc-monitor/edge/config"
+	"github.com/rs/zerolog/log"
+)
+
+// ReplaySensor plays back a recorded capture to reproduce what a machine sent.
+// The address is the capture file.
+//
+// Config keys:
+//   - format: jsonl, json, csv or wal; by default from the file extension, and
+//     wal for a directory
+//   - speed: playback speed, 1 for the original pace; 0 steps one record per read,
+//     which makes a replay independent of timing
+//   - loop: start over after the last record
+//   - rebase: stamp readings with the playback time (default) rather than the
+//     recorded time, which then becomes the sample time
+type ReplaySensor struct {
+	config   config.SensorConfig
+	metadata config.SensorMetadata
+
+	mu       sync.Mutex
+	records  []captureRecord
+	channels []ChannelSpec
+	speed    float64
+	loop     bool
+	rebase   bool
+
+	running   bool
+	startTime time.Time
+	step      int // Next record to deliver, counting every loop
+	finished  bool
+	lastRead  time.Time
+}
+
+// NewReplaySensor creates a replay sensor and loads its capture.
+func NewReplaySensor(cfg config.SensorConfig) (*ReplaySensor, error) {
+	s := &ReplaySensor{config: cfg, metadata: cfg.Metadata}
+	if err := s.Configure(cfg.Config); err != nil {
+		return nil, fmt.Errorf("replay sensor %s: %w", cfg.Name, err)
+	}
+	return s, nil
+}
+
+// Configure loads the capture and playback settings and restarts playback.
+func (s *ReplaySensor) Configure(cfg map[string]interface{}) error {
+	file := configString(cfg, "file", s.config.Address)
+	if file == "" {
+		return fmt.Errorf("no capture file")
+	}
+	records, err := loadCapture(file, configString(cfg, "format", ""))
+	if err != nil {
+		return err
+	}
+	speed := configFloat(cfg, "speed", 1)
+	if speed < 0 {
+		return fmt.Errorf("speed must not be negative")
+	}
+
+	seen := make(map[string]bool)
+	var channels []ChannelSpec
+	for _, r := range records {
+		for name := range r.values {
+			if !seen[name] {
+				seen[name] = true
+				channels = append(channels, ChannelSpec{Name: name})
+			}
+		}
+		for name := range r.texts {
+			if !seen[name] {
+				seen[name] = true
+				channels = append(channels, ChannelSpec{Name: name})
+			}
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.Config = cfg
+	s.records = records
+	s.channels = channels
+	s.speed = speed
+	s.loop = configBool(cfg, "loop", false)
+	s.rebase = configBool(cfg, "rebase", true)
+	s.restart()
+	log.Info().
+		Str("sensor", s.config.Name).
+		Str("file", file).
+		Int("records", len(records)).
+		Dur("span", records[len(records)-1].time.Sub(records[0].time)).
+		Float64("speed", speed).
+		Msg("Replay capture loaded")
+	return nil
+}
+
+func (s *ReplaySensor) restart() {
+	s.startTime = time.Now()
+	s.step = 0
+	s.finished = false
+}
+
+// Start begins playback
+func (s *ReplaySensor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = true
+	s.restart()
+	return nil
+}
+
+// Stop ends playback
+func (s *ReplaySensor) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	return nil
+}
+
+// Read returns the channels of the next record once it is due. It returns
+// nothing while the record is not yet due, and after the last record of a
+// capture that does not loop.
+func (s *ReplaySensor) Read(ctx context.Context) ([]ChannelReading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		return nil, &SensorError{Message: "sensor not running"}
+	}
+	now := time.Now()
+	s.lastRead = now
+
+	rec, cycle, ok := s.next(now)
+	if !ok {
+		return nil, nil
+	}
+
+	ts := rec.time
+	if s.rebase {
+		ts = now
+	} else if cycle > 0 {
+		// Later loops continue after the recording instead of repeating its times
+		ts = ts.Add(time.Duration(cycle) * s.period())
+	}
+	readings := make([]ChannelReading, 0, len(rec.values)+len(rec.texts))
+	for name, v := range rec.values {
+		readings = append(readings, goodReading(name, v, "", ts))
+	}
+	for name, text := range rec.texts {
+		readings = append(readings, ChannelReading{Name: name, Text: text, Quality: QualityGood, Timestamp: ts})
+	}
+	return readings, nil
+}
+
+// next returns the next record if it is due at now, and how many times
+// playback has looped. Every record is delivered once and in order: in step
+// mode one per call, otherwise once its time into the capture, divided by the
+// speed, has passed since the start. A reader slower than the capture falls
+// behind rather than skipping records.
+func (s *ReplaySensor) next(now time.Time) (captureRecord, int, bool) {
+	n := len(s.records)
+	cycle := s.step / n
+	if cycle > 0 && !s.loop {
+		if !s.finished {
+			s.finished = true
+			log.Info().Str("sensor", s.config.Name).Msg("Replay finished")
+		}
+		return captureRecord{}, 0, false
+	}
+	rec := s.records[s.step%n]
+	if s.speed > 0 {
+		offset := time.Duration(cycle)*s.period() + rec.time.Sub(s.records[0].time)
+		if now.Before(s.startTime.Add(time.Duration(float64(offset) / s.speed))) {
+			return captureRecord{}, 0, false
+		}
+	}
+	s.step++
+	return rec, cycle, true
+}
+
+// period is the length of one playback of the capture: its span plus one
+// sample interval for the last record.
+func (s *ReplaySensor) period() time.Duration {
+	n := len(s.records)
+	span := s.records[n-1].time.Sub(s.records[0].time)
+	interval := time.Second
+	if n > 1 {
+		interval = span / time.Duration(n-1)
+	}
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	return span + interval
+}
+
+// RecordedTime reports whether readings carry the recorded time rather than
+// the playback time.
+func (s *ReplaySensor) RecordedTime() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.rebase
+}
+
+// Channels declares every channel found in the capture
+func (s *ReplaySensor) Channels() []ChannelSpec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ChannelSpec(nil), s.channels...)
+}
+
+// GetMetadata returns sensor metadata
+func (s *ReplaySensor) GetMetadata() config.SensorMetadata {
+	return s.metadata
+}
+
+// Health returns the playback status
+func (s *ReplaySensor) Health() SensorHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, message := "ok", fmt.Sprintf("Replaying %d records", len(s.records))
+	switch {
+	case !s.running:
+		status = "stopped"
+	case s.finished:
+		status, message = "finished", "Replay finished"
+	}
+	var lastRead int64
+	if !s.lastRead.IsZero() {
+		lastRead = s.lastRead.Unix()
+	}
+	return SensorHealth{Status: status, LastRead: lastRead, Message: message}
+}
@@ -0,0 +1,158 @@
+package sensors
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cnc-monitor/edge/config"
+)
+
+// newTestReplay replays a JSONL capture of records whose temperature is their
+// index, recorded at the given offsets from captureStart.
+func newTestReplay(t *testing.T, offsets []time.Duration, settings map[string]interface{}) *ReplaySensor {
+	t.Helper()
+	var b strings.Builder
+	for i, off := range offsets {
+		fmt.Fprintf(&b, `{"timestamp":%q,"temperature":%d}`+"\n", captureStart.Add(off).Format(time.RFC3339Nano), i)
+	}
+	s, err := NewReplaySensor(config.SensorConfig{
+		Name:    "replay",
+		Type:    "replay",
+		Address: writeCapture(t, "capture.jsonl", b.String()),
+		Config:  settings,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// temperature returns the record's temperature, which is its index in the capture.
+func temperature(r captureRecord) int {
+	return int(r.values[ChannelTemperature])
+}
+
+func TestReplayDeliversEachRecordOnce(t *testing.T) {
+	// Records at 0s, 1s, 1.5s and 4s played at double speed are due at 0s,
+	// 0.5s, 0.75s and 2s
+	s := newTestReplay(t, []time.Duration{0, time.Second, 1500 * time.Millisecond, 4 * time.Second},
+		map[string]interface{}{"speed": 2})
+	start := s.startTime
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	type read struct {
+		at   time.Duration
+		want int // Record delivered, -1 for none
+	}
+	for _, r := range []read{
+		{0, 0},
+		{100 * time.Millisecond, -1}, // Read faster than the capture: nothing twice
+		{400 * time.Millisecond, -1},
+		{500 * time.Millisecond, 1},
+		// Read slower than the capture: the record at 0.75s is not skipped
+		{1900 * time.Millisecond, 2},
+		{1900 * time.Millisecond, -1},
+		{2 * time.Second, 3},
+		{time.Hour, -1}, // Finished
+	} {
+		rec, _, ok := s.next(at(r.at))
+		switch {
+		case !ok && r.want >= 0:
+			t.Errorf("at %s: nothing, want record %d", r.at, r.want)
+		case ok && r.want < 0:
+			t.Errorf("at %s: record %d, want nothing", r.at, temperature(rec))
+		case ok && temperature(rec) != r.want:
+			t.Errorf("at %s: record %d, want %d", r.at, temperature(rec), r.want)
+		}
+	}
+	if !s.finished {
+		t.Error("replay not finished")
+	}
+}
+
+func TestReplayLoop(t *testing.T) {
+	// Two records a second apart loop every 2s
+	s := newTestReplay(t, []time.Duration{0, time.Second}, map[string]interface{}{"speed": 1, "loop": true})
+	start := s.startTime
+	var got []string
+	for _, at := range []time.Duration{0, time.Second, 1500 * time.Millisecond, 2 * time.Second, 3 * time.Second, 4 * time.Second} {
+		if rec, cycle, ok := s.next(start.Add(at)); ok {
+			got = append(got, fmt.Sprintf("%d/%d", temperature(rec), cycle))
+		}
+	}
+	if want := "0/0 1/0 0/1 1/1 0/2"; strings.Join(got, " ") != want {
+		t.Errorf("delivered %s, want %s", strings.Join(got, " "), want)
+	}
+}
+
+func TestReplayStepMode(t *testing.T) {
+	s := newTestReplay(t, []time.Duration{0, time.Hour, 2 * time.Hour}, map[string]interface{}{"speed": 0})
+	for want := 0; want < 3; want++ {
+		rec, _, ok := s.next(s.startTime)
+		if !ok || temperature(rec) != want {
+			t.Fatalf("step %d: record %d, %v", want, temperature(rec), ok)
+		}
+	}
+	if _, _, ok := s.next(s.startTime); ok {
+		t.Error("record delivered after the end of the capture")
+	}
+
+	// Looping steps start over
+	s = newTestReplay(t, []time.Duration{0, time.Hour}, map[string]interface{}{"speed": "0", "loop": "true"})
+	var got []int
+	for i := 0; i < 5; i++ {
+		rec, _, _ := s.next(s.startTime)
+		got = append(got, temperature(rec))
+	}
+	if fmt.Sprint(got) != "[0 1 0 1 0]" {
+		t.Errorf("delivered %v, want [0 1 0 1 0]", got)
+	}
+}
+
+func TestReplayRebase(t *testing.T) {
+	ctx := context.Background()
+	offsets := []time.Duration{0, time.Second}
+	for _, rebase := range []bool{true, false} {
+		t.Run(fmt.Sprintf("rebase %v", rebase), func(t *testing.T) {
+			s := newTestReplay(t, offsets, map[string]interface{}{"speed": 0, "loop": true, "rebase": rebase})
+			if s.RecordedTime() == rebase {
+				t.Errorf("RecordedTime %v", s.RecordedTime())
+			}
+			if err := s.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				before := time.Now()
+				readings, err := s.Read(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(readings) == 0 {
+					t.Fatalf("read %d returned nothing", i)
+				}
+				for _, r := range readings {
+					if rebase {
+						if r.Timestamp.Before(before) {
+							t.Errorf("read %d: %s stamped %s, before the read", i, r.Name, r.Timestamp)
+						}
+						continue
+					}
+					// Recorded times continue after the recording on later loops
+					if want := captureStart.Add(time.Duration(i) * time.Second); !r.Timestamp.Equal(want) {
+						t.Errorf("read %d: %s stamped %s, want %s", i, r.Name, r.Timestamp, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReplayNotRunning(t *testing.T) {
+	s := newTestReplay(t, []time.Duration{0}, nil)
+	if _, err := s.Read(context.Background()); err == nil {
+		t.Error("read from a stopped replay")
+	}
+}
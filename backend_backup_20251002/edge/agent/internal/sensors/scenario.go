@@ -0,0 +1,424 @@
+// internal/sensors/scenario.go
+package sensors
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Scenarios shipped with the agent, selected with scenario: "builtin:<name>"
+//
+//go:embed scenarios
+var builtinScenarios embed.FS
+
+// defaultScenario is run by simulators without a scenario or waveform.
+const defaultScenario = "builtin:bor2"
+
+const (
+	defaultSpindleSpeed = 1000.0 // rpm, for M3 without any S
+	defaultCutLoad      = 40.0   // percent
+	thermalTimeConstant = 120.0  // seconds
+	alarmHysteresis     = 5.0    // degrees below max_temp at which an overheat alarm clears
+)
+
+// Scenario describes a simulated machine and the job it runs. It is loaded
+// from YAML.
+type Scenario struct {
+	Name    string       `mapstructure:"name"`
+	Program string       `mapstructure:"program"` // NC program, relative to the scenario file
+	Speed   float64      `mapstructure:"speed"`   // Simulated seconds per second
+	Loop    bool         `mapstructure:"loop"`    // Start over after the last phase
+	Seed    int64        `mapstructure:"seed"`    // Noise seed; runs with the same seed and read times are identical
+	Machine MachineModel `mapstructure:"machine"`
+	Tools   []ToolSpec   `mapstructure:"tools"`
+	Phases  []PhaseSpec  `mapstructure:"phases"`
+	Faults  []FaultSpec  `mapstructure:"faults"`
+}
+
+// MachineModel holds the physical parameters of the simulated machine.
+type MachineModel struct {
+	Home           AxisPosition  `mapstructure:"home"`
+	RapidRate      float64       `mapstructure:"rapid_rate"`    // mm/min for F MAX
+	SpindleAccel   float64       `mapstructure:"spindle_accel"` // rpm/s
+	StockTop       float64       `mapstructure:"stock_top"`     // Z of the workpiece surface; feed moves below it cut
+	ToolChangeTime time.Duration `mapstructure:"tool_change_time"`
+	InitialTool    int           `mapstructure:"initial_tool"`
+	AmbientTemp    float64       `mapstructure:"ambient_temp"`
+	HeatRise       float64       `mapstructure:"heat_rise"` // Temperature rise at a sustained 100% spindle load
+	MaxTemp        float64       `mapstructure:"max_temp"`  // The machine alarms above this temperature
+	IdlePowerKW    float64       `mapstructure:"idle_power_kw"`
+	SpindlePowerKW float64       `mapstructure:"spindle_power_kw"` // At 100% spindle load
+	AxisPowerKW    float64       `mapstructure:"axis_power_kw"`    // While the axes move
+}
+
+// AxisPosition is a machine position in mm.
+type AxisPosition struct {
+	X float64 `mapstructure:"x"`
+	Y float64 `mapstructure:"y"`
+	Z float64 `mapstructure:"z"`
+}
+
+// ToolSpec describes a tool of the program.
+type ToolSpec struct {
+	Number       int     `mapstructure:"number"`
+	Name         string  `mapstructure:"name"`
+	SpindleSpeed float64 `mapstructure:"spindle_speed"` // Used when TOOL CALL has no S
+	CutLoad      float64 `mapstructure:"cut_load"`      // Spindle load while cutting, percent
+}
+
+// PhaseSpec is a step of the job: setup, program or idle.
+type PhaseSpec struct {
+	Type     string        `mapstructure:"type"`
+	Duration time.Duration `mapstructure:"duration"` // setup and idle
+	Repeat   int           `mapstructure:"repeat"`   // program: parts machined back to back
+}
+
+// FaultSpec injects a fault: overheat, spindle_stall or network_drop.
+type FaultSpec struct {
+	Type     string        `mapstructure:"type"`
+	At       time.Duration `mapstructure:"at"` // Simulated time since the scenario started
+	Duration time.Duration `mapstructure:"duration"`
+	Every    time.Duration `mapstructure:"every"` // Repeat period; 0 for once
+	Rise     float64       `mapstructure:"rise"`  // overheat: extra temperature, degrees
+}
+
+// Fault types
+const (
+	FaultOverheat     = "overheat"
+	FaultSpindleStall = "spindle_stall"
+	FaultNetworkDrop  = "network_drop"
+)
+
+// active reports whether the fault is in effect at simulated time t.
+func (f FaultSpec) active(t float64) bool {
+	at, dur := f.At.Seconds(), f.Duration.Seconds()
+	if t < at {
+		return false
+	}
+	if every := f.Every.Seconds(); every > 0 {
+		return math.Mod(t-at, every) < dur
+	}
+	return t < at+dur
+}
+
+// LoadScenario reads a scenario file, or a built-in scenario named
+// "builtin:<name>", together with its NC program.
+func LoadScenario(name string) (*Scenario, string, error) {
+	var data []byte
+	var err error
+	if name == "builtin" {
+		name = defaultScenario
+	}
+	builtin := strings.HasPrefix(name, "builtin:")
+	if builtin {
+		name = "scenarios/" + strings.TrimPrefix(name, "builtin:") + ".yaml"
+		data, err = builtinScenarios.ReadFile(name)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("read scenario: %w", err)
+	}
+
+	v := viper.New()
+	v.SetConfigType("yaml")
+	setScenarioDefaults(v)
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, "", fmt.Errorf("parse scenario %s: %w", name, err)
+	}
+	var sc Scenario
+	if err := v.Unmarshal(&sc); err != nil {
+		return nil, "", fmt.Errorf("parse scenario %s: %w", name, err)
+	}
+	if err := sc.validate(); err != nil {
+		return nil, "", fmt.Errorf("scenario %s: %w", name, err)
+	}
+
+	var program []byte
+	if sc.Program != "" {
+		if builtin {
+			program, err = builtinScenarios.ReadFile(path.Join(path.Dir(name), sc.Program))
+		} else {
+			p := sc.Program
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(filepath.Dir(name), p)
+			}
+			program, err = os.ReadFile(p)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("scenario %s: read program: %w", name, err)
+		}
+	}
+	return &sc, string(program), nil
+}
+
+func setScenarioDefaults(v *viper.Viper) {
+	v.SetDefault("speed", 1.0)
+	v.SetDefault("loop", true)
+	v.SetDefault("seed", 1)
+	v.SetDefault("machine.home.z", 300.0)
+	v.SetDefault("machine.rapid_rate", 10000.0)
+	v.SetDefault("machine.spindle_accel", 2000.0)
+	v.SetDefault("machine.tool_change_time", "8s")
+	v.SetDefault("machine.initial_tool", 1)
+	v.SetDefault("machine.ambient_temp", 22.0)
+	v.SetDefault("machine.heat_rise", 25.0)
+	v.SetDefault("machine.max_temp", 60.0)
+	v.SetDefault("machine.idle_power_kw", 0.8)
+	v.SetDefault("machine.spindle_power_kw", 7.5)
+	v.SetDefault("machine.axis_power_kw", 0.4)
+}
+
+func (sc *Scenario) validate() error {
+	if sc.Speed <= 0 {
+		return fmt.Errorf("speed must be positive")
+	}
+	if sc.Machine.RapidRate <= 0 || sc.Machine.SpindleAccel <= 0 {
+		return fmt.Errorf("machine.rapid_rate and machine.spindle_accel must be positive")
+	}
+	if len(sc.Phases) == 0 {
+		sc.Phases = []PhaseSpec{
+			{Type: "setup", Duration: 2 * time.Minute},
+			{Type: "program", Repeat: 1},
+			{Type: "idle", Duration: time.Minute},
+		}
+	}
+	for _, p := range sc.Phases {
+		switch p.Type {
+		case "setup", "idle":
+			if p.Duration <= 0 {
+				return fmt.Errorf("%s phase needs a duration", p.Type)
+			}
+		case "program":
+			if sc.Program == "" {
+				return fmt.Errorf("program phase without a program")
+			}
+		default:
+			return fmt.Errorf("unknown phase type %q", p.Type)
+		}
+	}
+	for _, f := range sc.Faults {
+		switch f.Type {
+		case FaultOverheat, FaultSpindleStall, FaultNetworkDrop:
+		default:
+			return fmt.Errorf("unknown fault type %q", f.Type)
+		}
+		if f.Duration <= 0 {
+			return fmt.Errorf("%s fault needs a duration", f.Type)
+		}
+	}
+	return nil
+}
+
+// buildTimeline executes the phases of the scenario into one cycle of
+// segments. The cycle ends with a rapid back to the home position so that a
+// looping scenario stays continuous.
+func (sc *Scenario) buildTimeline(program string) ([]segment, error) {
+	home := [3]float64{sc.Machine.Home.X, sc.Machine.Home.Y, sc.Machine.Home.Z}
+	in := newNCInterpreter(sc.Machine, sc.Tools, home, sc.Machine.InitialTool)
+	for _, p := range sc.Phases {
+		switch p.Type {
+		case "setup":
+			in.add(segment{dur: p.Duration.Seconds(), from: in.pos, to: in.pos, state: simStateSetup})
+		case "idle":
+			in.add(segment{dur: p.Duration.Seconds(), from: in.pos, to: in.pos, state: simStateIdle})
+		case "program":
+			repeat := p.Repeat
+			if repeat <= 0 {
+				repeat = 1
+			}
+			for i := 0; i < repeat; i++ {
+				if err := in.run(program); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if in.pos != home {
+		in.rapid(0, home)
+		in.segments[len(in.segments)-1].state = simStateIdle
+	}
+	if len(in.unsupported) > 0 {
+		log.Warn().Str("scenario", sc.Name).Strs("blocks", in.unsupported).Msg("NC blocks not simulated")
+	}
+	if in.clock <= 0 {
+		return nil, fmt.Errorf("scenario has no duration")
+	}
+	return in.segments, nil
+}
+
+// machineSnapshot is the simulated machine at one instant.
+type machineSnapshot struct {
+	pos         [3]float64
+	spindle     float64
+	feed        float64
+	load        float64
+	temperature float64
+	power       float64
+	state       string
+	line        int
+	faults      []string // Active faults
+}
+
+// scenarioRun advances a scenario through simulated time.
+type scenarioRun struct {
+	sc       *Scenario
+	timeline []segment
+	length   float64
+
+	clock       float64 // Simulated seconds since the start
+	jobClock    float64 // Position in the timeline; held while the machine is in alarm
+	spindle     float64 // Actual spindle speed
+	temperature float64
+	overheated  bool
+	rng         *rand.Rand
+}
+
+func newScenarioRun(sc *Scenario, program string) (*scenarioRun, error) {
+	timeline, err := sc.buildTimeline(program)
+	if err != nil {
+		return nil, err
+	}
+	last := timeline[len(timeline)-1]
+	return &scenarioRun{
+		sc:          sc,
+		timeline:    timeline,
+		length:      last.start + last.dur,
+		temperature: sc.Machine.AmbientTemp,
+		rng:         rand.New(rand.NewSource(sc.Seed)),
+	}, nil
+}
+
+// segmentAt returns the segment at job time t and the time into it.
+func (r *scenarioRun) segmentAt(t float64) (segment, float64) {
+	if r.sc.Loop {
+		t = math.Mod(t, r.length)
+	} else if t >= r.length {
+		last := r.timeline[len(r.timeline)-1]
+		return segment{start: t, from: last.to, to: last.to, tool: last.tool, state: simStateIdle}, 0
+	}
+	i := sort.Search(len(r.timeline), func(i int) bool {
+		return r.timeline[i].start+r.timeline[i].dur > t
+	})
+	if i == len(r.timeline) {
+		i--
+	}
+	return r.timeline[i], t - r.timeline[i].start
+}
+
+// advance moves the simulation dt simulated seconds forward.
+func (r *scenarioRun) advance(dt float64) machineSnapshot {
+	m := r.sc.Machine
+	r.clock += dt
+
+	var snap machineSnapshot
+	stalled := false
+	heat := 0.0
+	for _, f := range r.sc.Faults {
+		if !f.active(r.clock) {
+			continue
+		}
+		snap.faults = append(snap.faults, f.Type)
+		switch f.Type {
+		case FaultSpindleStall:
+			stalled = true
+		case FaultOverheat:
+			rise := f.Rise
+			if rise == 0 {
+				rise = 40
+			}
+			heat += rise
+		}
+	}
+	alarm := stalled || r.overheated
+	if !alarm {
+		r.jobClock += dt
+	}
+
+	seg, into := r.segmentAt(r.jobClock)
+	frac := 0.0
+	if seg.dur > 0 {
+		frac = math.Min(1, into/seg.dur)
+	}
+	for i := range snap.pos {
+		snap.pos[i] = seg.from[i] + (seg.to[i]-seg.from[i])*frac
+	}
+
+	// The spindle ramps towards its commanded speed; a stall stops it at once
+	target := seg.spindle
+	if alarm {
+		target = 0
+	}
+	if stalled {
+		r.spindle = 0
+	} else if step := m.SpindleAccel * dt; math.Abs(target-r.spindle) <= step {
+		r.spindle = target
+	} else if target > r.spindle {
+		r.spindle += step
+	} else {
+		r.spindle -= step
+	}
+	snap.spindle = r.spindle
+	if r.spindle > 0 {
+		snap.spindle += r.rng.NormFloat64() * r.spindle * 0.002
+	}
+
+	moving := !alarm && seg.from != seg.to
+	if moving {
+		snap.feed = seg.feed
+	}
+
+	switch {
+	case stalled:
+		snap.load = 150 + r.rng.NormFloat64()*5
+	case !alarm && seg.load > 0 && r.spindle >= seg.spindle*0.95:
+		snap.load = seg.load + r.rng.NormFloat64()*3
+	case r.spindle > 0:
+		snap.load = 5 + r.rng.NormFloat64()
+	}
+	snap.load = math.Max(0, snap.load)
+
+	// First-order thermal model driven by the spindle load and overheat faults
+	targetTemp := m.AmbientTemp + m.HeatRise*snap.load/100 + heat
+	r.temperature += (targetTemp - r.temperature) * (1 - math.Exp(-dt/thermalTimeConstant))
+	if r.temperature > m.MaxTemp {
+		r.overheated = true
+	} else if r.temperature < m.MaxTemp-alarmHysteresis {
+		r.overheated = false
+	}
+	snap.temperature = r.temperature + r.rng.NormFloat64()*0.1
+
+	snap.power = m.IdlePowerKW + m.SpindlePowerKW*snap.load/100
+	if moving {
+		snap.power += m.AxisPowerKW
+	}
+
+	snap.state = seg.state
+	if alarm || r.overheated {
+		snap.state = simStateAlarm
+	}
+	snap.line = seg.line
+	return snap
+}
+
+// networkDown reports whether a network drop is injected at the current time.
+func (r *scenarioRun) networkDown() bool {
+	for _, f := range r.sc.Faults {
+		if f.Type == FaultNetworkDrop && f.active(r.clock) {
+			return true
+		}
+	}
+	return false
+}
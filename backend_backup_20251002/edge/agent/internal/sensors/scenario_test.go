@@ -0,0 +1,120 @@
+package sensors
+
+import (
+	"io/fs"
+	"math"
+	"path"
+	"strings"
+	"testing"
+)
+
+// TestBuiltinScenarios loads every scenario shipped in scenarios/ and runs it
+// for a full cycle, so a broken scenario or NC program fails the build rather
+// than a simulator at startup.
+func TestBuiltinScenarios(t *testing.T) {
+	files, err := fs.Glob(builtinScenarios, "scenarios/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	programs := map[string]bool{}
+	scenarios := 0
+	for _, file := range files {
+		if path.Ext(file) != ".yaml" {
+			continue
+		}
+		scenarios++
+		name := strings.TrimSuffix(path.Base(file), ".yaml")
+		t.Run(name, func(t *testing.T) {
+			sc, program, err := LoadScenario("builtin:" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sc.Name != name {
+				t.Errorf("scenario name %q, want %q", sc.Name, name)
+			}
+			if sc.Program != "" {
+				programs[path.Join("scenarios", sc.Program)] = true
+				home := [3]float64{sc.Machine.Home.X, sc.Machine.Home.Y, sc.Machine.Home.Z}
+				in := newNCInterpreter(sc.Machine, sc.Tools, home, sc.Machine.InitialTool)
+				if err := in.run(program); err != nil {
+					t.Fatal(err)
+				}
+				if len(in.unsupported) > 0 {
+					t.Errorf("NC blocks not simulated: %v", in.unsupported)
+				}
+			}
+
+			run, err := newScenarioRun(sc, program)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runScenario(t, sc, run)
+		})
+	}
+	if scenarios == 0 {
+		t.Fatal("no built-in scenarios")
+	}
+
+	// Everything else in the directory is the program of a scenario
+	for _, file := range files {
+		if path.Ext(file) != ".yaml" && !programs[file] {
+			t.Errorf("%s is not used by any scenario", file)
+		}
+	}
+}
+
+// runScenario advances run in one second steps through a whole cycle, or
+// through every fault period if that is longer, and checks that the machine
+// stays physical and that the job and each configured fault show up.
+func runScenario(t *testing.T, sc *Scenario, run *scenarioRun) {
+	t.Helper()
+	duration := run.length
+	for _, f := range sc.Faults {
+		end := f.At.Seconds() + f.Duration.Seconds()
+		if f.Every > 0 {
+			end = f.At.Seconds() + f.Every.Seconds()
+		}
+		duration = math.Max(duration, end)
+	}
+
+	states := map[string]bool{}
+	faults := map[string]bool{}
+	alarms := map[string]bool{} // Faults during which the machine alarmed
+	networkDown := false
+	for elapsed := 0.0; elapsed < duration; elapsed++ {
+		m := run.advance(1)
+		for _, v := range []float64{m.pos[0], m.pos[1], m.pos[2], m.spindle, m.feed, m.load, m.temperature, m.power} {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				t.Fatalf("t=%.0fs: non-finite value in %+v", run.clock, m)
+			}
+		}
+		if m.load < 0 || m.feed < 0 || m.power < sc.Machine.IdlePowerKW {
+			t.Fatalf("t=%.0fs: negative load or feed, or power below idle, in %+v", run.clock, m)
+		}
+		states[m.state] = true
+		for _, f := range m.faults {
+			faults[f] = true
+			alarms[f] = alarms[f] || m.state == simStateAlarm
+		}
+		networkDown = networkDown || run.networkDown()
+	}
+
+	if !states[simStateRunning] {
+		t.Errorf("machine never running, states %v", states)
+	}
+	for _, f := range sc.Faults {
+		if !faults[f.Type] {
+			t.Errorf("%s fault never active", f.Type)
+		}
+		switch f.Type {
+		case FaultSpindleStall, FaultOverheat:
+			if !alarms[f.Type] {
+				t.Errorf("%s fault never raised an alarm", f.Type)
+			}
+		case FaultNetworkDrop:
+			if !networkDown {
+				t.Errorf("network never down")
+			}
+		}
+	}
+}
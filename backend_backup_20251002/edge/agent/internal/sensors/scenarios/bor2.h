@@ -0,0 +1,34 @@
+0  BEGIN PGM BOR2 MM
+1  
+2  
+3  CYCL DEF 1.0 TALADRADO PROF.
+4  CYCL DEF 1.1 DIST. +5
+5  CYCL DEF 1.2 PROF. -14
+6  CYCL DEF 1.3 APROX. +5
+7  CYCL DEF 1.4 T.ESPR 0
+8  CYCL DEF 1.5 F200
+9  L X+0 Y+21 R0 F MAX M3
+10  L Z+5 R0 F MAX M8
+11  CYCL CALL
+12  L Z+50 R0 F MAX
+13  L Y-21 R0 F MAX
+14  L Z+5 R0 F MAX
+15  CYCL CALL
+16  L Z+200 R0 F MAX M9
+17  TOOL CALL 2 Z S600
+18  
+19
+20  CYCL DEF 17.0 ROSCADO RIGIDO
+21  CYCL DEF 17.1 DIST. +5
+22  CYCL DEF 17.2 PROF. -14
+23  CYCL DEF 17.3 PEND. +1
+24  L X+0 Y-21 R0 F MAX M3
+25  L Z+5 R0 F MAX
+26  CYCL CALL
+27  L Z+50 R0 F MAX
+28  L Y+21 R0 F MAX
+29  L Z+5 R0 F MAX
+30  CYCL CALL
+31  L Z+300 R0 F MAX
+32  L Y+150 R0 F MAX M30
+33  END PGM BOR2 MM
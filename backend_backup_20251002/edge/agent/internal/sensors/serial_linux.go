@@ -0,0 +1,74 @@
+//go:build linux
+
+package sensors
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var baudRates = map[int]uint32{
+	1200:   syscall.B1200,
+	2400:   syscall.B2400,
+	4800:   syscall.B4800,
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+}
+
+// openSerial opens a serial port in raw mode. The port is non-blocking, so
+// read and write deadlines apply to it like to a network connection.
+func openSerial(path string, s serialSettings) (*os.File, error) {
+	baud, ok := baudRates[s.BaudRate]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate: %d", s.BaudRate)
+	}
+	size := map[int]uint32{5: syscall.CS5, 6: syscall.CS6, 7: syscall.CS7, 8: syscall.CS8}[s.DataBits]
+	if size == 0 {
+		return nil, fmt.Errorf("unsupported data bits: %d", s.DataBits)
+	}
+
+	cflag := baud | size | syscall.CREAD | syscall.CLOCAL
+	switch s.Parity {
+	case "none":
+	case "even":
+		cflag |= syscall.PARENB
+	case "odd":
+		cflag |= syscall.PARENB | syscall.PARODD
+	default:
+		return nil, fmt.Errorf("unsupported parity: %s", s.Parity)
+	}
+	if s.StopBits == 2 {
+		cflag |= syscall.CSTOPB
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	t := syscall.Termios{Cflag: cflag, Ispeed: baud, Ospeed: baud}
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TCSETS), uintptr(unsafe.Pointer(&t)))
+	}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if errno != 0 {
+		f.Close()
+		return nil, fmt.Errorf("configure %s: %w", path, errno)
+	}
+	return f, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sensors
+
+import (
+	"errors"
+	"os"
+)
+
+// openSerial is only implemented on Linux; elsewhere Modbus RTU needs a TCP
+// serial gateway (an address of the form host:port).
+func openSerial(path string, s serialSettings) (*os.File, error) {
+	return nil, errors.New("serial ports are only supported on linux")
+}
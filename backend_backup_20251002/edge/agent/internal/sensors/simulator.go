@@ -3,150 +3,246 @@ package sensors
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"cnc-monitor/edge/config"
-	"cnc-monitor/edge/internal/buffering"
+	"github.com/rs/zerolog/log"
 )
 
-// SimulatorSensor implements a simulated sensor for testing
+// SimulatorSensor implements a simulated sensor for testing. It runs either a
+// scenario, a simulated machine executing an NC program with injectable
+// faults, or a waveform on a single channel.
+//
+// Config keys:
+//   - scenario: scenario file, or "builtin:<name>"; the default without a pattern
+//   - speed: overrides the speed of the scenario
+//   - pattern: sine, square, triangle, sawtooth, random or constant; selects waveform mode
+//   - frequency (Hz), amplitude, offset, channel: the waveform and the channel it drives
 type SimulatorSensor struct {
-	config    config.SensorConfig
-	metadata  config.SensorMetadata
+	config   config.SensorConfig
+	metadata config.SensorMetadata
+
+	mu        sync.Mutex
 	running   bool
 	startTime time.Time
-	
-	// Simulation parameters
-	pattern   string  // "sine", "random", "constant"
-	frequency float64 // Hz
-	amplitude float64
-	offset    float64
-	
+	lastTick  time.Time
+
+	scenario *scenarioRun // Scenario mode
+	speed    float64
+	wave     *waveform // Waveform mode
+
 	// Health tracking
 	errorCount int64
 	lastRead   time.Time
+	faults     []string // Faults active at the last read
 }
 
+// waveform is a periodic signal on one channel.
+type waveform struct {
+	channel   string
+	pattern   string  // "sine", "square", "triangle", "sawtooth", "random", "constant"
+	frequency float64 // Hz
+	amplitude float64
+	offset    float64
+	rng       *rand.Rand
+}
+
+// defaultWaveChannel is the channel a waveform drives unless configured.
+const defaultWaveChannel = "simulated_value"
+
 // NewSimulatorSensor creates a new simulator sensor
 func NewSimulatorSensor(cfg config.SensorConfig) (*SimulatorSensor, error) {
 	s := &SimulatorSensor{
 		config:   cfg,
 		metadata: cfg.Metadata,
 	}
-	
-	// Parse simulation config
-	if pattern, ok := cfg.Config["pattern"].(string); ok {
-		s.pattern = pattern
-	} else {
-		s.pattern = "sine"
-	}
-	
-	if freq, ok := cfg.Config["frequency"].(float64); ok {
-		s.frequency = freq
-	} else {
-		s.frequency = 0.1 // 0.1 Hz default
-	}
-	
-	if amp, ok := cfg.Config["amplitude"].(float64); ok {
-		s.amplitude = amp
-	} else {
-		s.amplitude = 100.0
-	}
-	
-	if offset, ok := cfg.Config["offset"].(float64); ok {
-		s.offset = offset
-	} else {
-		s.offset = 0.0
-	}
-	
+	if err := s.apply(cfg.Config); err != nil {
+		return nil, fmt.Errorf("simulator sensor %s: %w", cfg.Name, err)
+	}
 	return s, nil
 }
 
+// apply sets up the scenario or waveform described by a sensor config.
+func (s *SimulatorSensor) apply(cfg map[string]interface{}) error {
+	if _, ok := cfg["pattern"]; ok {
+		w := &waveform{
+			channel:   configString(cfg, "channel", defaultWaveChannel),
+			pattern:   configString(cfg, "pattern", "sine"),
+			frequency: configFloat(cfg, "frequency", 0.1),
+			amplitude: configFloat(cfg, "amplitude", 100.0),
+			offset:    configFloat(cfg, "offset", 0.0),
+			rng:       rand.New(rand.NewSource(configInt(cfg, "seed", 1))),
+		}
+		switch w.pattern {
+		case "sine", "square", "triangle", "sawtooth", "random", "constant":
+		default:
+			return fmt.Errorf("unknown pattern: %s", w.pattern)
+		}
+		s.wave, s.scenario = w, nil
+		return nil
+	}
+
+	sc, program, err := LoadScenario(configString(cfg, "scenario", defaultScenario))
+	if err != nil {
+		return err
+	}
+	if _, ok := cfg["seed"]; ok {
+		sc.Seed = configInt(cfg, "seed", sc.Seed)
+	}
+	run, err := newScenarioRun(sc, program)
+	if err != nil {
+		return fmt.Errorf("scenario %s: %w", sc.Name, err)
+	}
+	s.scenario, s.wave = run, nil
+	s.speed = configFloat(cfg, "speed", sc.Speed)
+	if s.speed <= 0 {
+		return fmt.Errorf("speed must be positive")
+	}
+	return nil
+}
+
 // Start initializes the simulator sensor
 func (s *SimulatorSensor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scenario == nil && s.wave == nil {
+		// Sensors built around a bare SimulatorSensor run the default scenario
+		if err := s.apply(s.config.Config); err != nil {
+			return err
+		}
+	}
 	s.running = true
 	s.startTime = time.Now()
+	s.lastTick = s.startTime
+	if s.scenario != nil {
+		log.Info().
+			Str("sensor", s.config.Name).
+			Str("scenario", s.scenario.sc.Name).
+			Float64("speed", s.speed).
+			Dur("cycle", time.Duration(s.scenario.length*float64(time.Second))).
+			Msg("Simulator scenario started")
+	}
 	return nil
 }
 
 // Stop shuts down the simulator sensor
 func (s *SimulatorSensor) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.running = false
 	return nil
 }
 
-// Read generates complete CNC machine data
-func (s *SimulatorSensor) Read(ctx context.Context) (buffering.SensorData, error) {
+// Read returns every channel of the simulated machine, or the waveform channel
+func (s *SimulatorSensor) Read(ctx context.Context) ([]ChannelReading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if !s.running {
-		return buffering.SensorData{}, &SensorError{Message: "sensor not running"}
-	}
-	
-	s.lastRead = time.Now()
-	// Use absolute time instead of relative to startTime for continuous patterns
-	elapsed := float64(s.lastRead.Unix())
-	
-	// Generate realistic CNC machine data with faster cycles for testing
-	baseTemp := 25.0
-	tempVariation := 15.0 * math.Sin(2*math.Pi*0.01*elapsed) // 0.01 Hz = 100 second cycle
-	temperature := baseTemp + tempVariation + (rand.Float64()-0.5)*2.0
-	
-	baseSpindleSpeed := 2500.0
-	spindleVariation := 500.0 * math.Sin(2*math.Pi*0.005*elapsed) // 0.005 Hz = 200 second cycle
-	spindleSpeed := baseSpindleSpeed + spindleVariation + (rand.Float64()-0.5)*100.0
-	
-	// Generate position data (simulated tool path)
-	xPos := 100.0 + 50.0*math.Sin(2*math.Pi*0.001*elapsed) // 1000 second cycle
-	yPos := 100.0 + 50.0*math.Cos(2*math.Pi*0.001*elapsed) // 1000 second cycle  
-	zPos := 10.0 + 5.0*math.Sin(2*math.Pi*0.002*elapsed)    // 500 second cycle
-	
-	// Generate operational data
-	feedRate := 800.0 + (rand.Float64()-0.5)*200.0
-	spindleLoad := 45.0 + 20.0*math.Sin(2*math.Pi*0.003*elapsed) + (rand.Float64()-0.5)*10.0  // 333 second cycle
-	totalPower := 5.5 + 2.0*math.Sin(2*math.Pi*0.004*elapsed) + (rand.Float64()-0.5)*0.5      // 250 second cycle
-	
-	// Machine state simulation
-	states := []string{"running", "idle", "alarm", "hold"}
-	stateIndex := int(elapsed/120) % len(states) // Change state every 2 minutes
-	
-	programLine := int(elapsed/5) % 1000 // Increment program line every 5 seconds
-	
-	return buffering.SensorData{
-		MachineID:         "CNC-PI-001", // Default machine ID
-		Temperature:       temperature,
-		SpindleSpeed:      spindleSpeed,
-		Timestamp:         s.lastRead,
-		XPosMM:            xPos,
-		YPosMM:            yPos,
-		ZPosMM:            zPos,
-		FeedRateActual:    feedRate,
-		SpindleLoadPercent: spindleLoad,
-		MachineState:      states[stateIndex],
-		ActiveProgramLine: programLine,
-		TotalPowerKW:      totalPower,
+		return nil, &SensorError{Message: "sensor not running"}
+	}
+
+	now := time.Now()
+	dt := now.Sub(s.lastTick).Seconds()
+	s.lastTick = now
+	s.lastRead = now
+
+	if s.wave != nil {
+		value := s.wave.value(now.Sub(s.startTime).Seconds())
+		return []ChannelReading{goodReading(s.wave.channel, value, s.metadata.Units, now)}, nil
+	}
+
+	m := s.scenario.advance(dt * s.speed)
+	s.faults = m.faults
+	u := simulatorUnits
+	return []ChannelReading{
+		goodReading(ChannelTemperature, m.temperature, u[ChannelTemperature], now),
+		goodReading(ChannelSpindleSpeed, m.spindle, u[ChannelSpindleSpeed], now),
+		goodReading(ChannelXPos, m.pos[0], u[ChannelXPos], now),
+		goodReading(ChannelYPos, m.pos[1], u[ChannelYPos], now),
+		goodReading(ChannelZPos, m.pos[2], u[ChannelZPos], now),
+		goodReading(ChannelFeedRate, m.feed, u[ChannelFeedRate], now),
+		goodReading(ChannelSpindleLoad, m.load, u[ChannelSpindleLoad], now),
+		{Name: ChannelMachineState, Text: m.state, Quality: QualityGood, Timestamp: now},
+		goodReading(ChannelActiveProgramLine, float64(m.line), u[ChannelActiveProgramLine], now),
+		goodReading(ChannelTotalPower, m.power, u[ChannelTotalPower], now),
 	}, nil
 }
 
-// Configure updates sensor configuration
-func (s *SimulatorSensor) Configure(config map[string]interface{}) error {
-	// Update simulation parameters
-	if pattern, ok := config["pattern"].(string); ok {
-		s.pattern = pattern
+// value returns the waveform t seconds after the start.
+func (w *waveform) value(t float64) float64 {
+	phase := math.Mod(w.frequency*t, 1)
+	var v float64
+	switch w.pattern {
+	case "sine":
+		v = math.Sin(2 * math.Pi * phase)
+	case "square":
+		v = 1
+		if phase >= 0.5 {
+			v = -1
+		}
+	case "triangle":
+		v = 1 - 4*math.Abs(phase-0.5)
+	case "sawtooth":
+		v = 2*phase - 1
+	case "random":
+		v = 2*w.rng.Float64() - 1
+	case "constant":
+		v = 0
 	}
-	
-	if freq, ok := config["frequency"].(float64); ok {
-		s.frequency = freq
+	return w.offset + w.amplitude*v
+}
+
+// NetworkDown reports whether the scenario injects a network drop right now.
+func (s *SimulatorSensor) NetworkDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running && s.scenario != nil && s.scenario.networkDown()
+}
+
+// simulatorUnits are the units of the simulated channels.
+var simulatorUnits = map[string]string{
+	ChannelTemperature:  "celsius",
+	ChannelSpindleSpeed: "rpm",
+	ChannelXPos:         "mm",
+	ChannelYPos:         "mm",
+	ChannelZPos:         "mm",
+	ChannelFeedRate:     "mm/min",
+	ChannelSpindleLoad:  "percent",
+	ChannelTotalPower:   "kW",
+}
+
+// Channels declares every sample field, or the waveform channel
+func (s *SimulatorSensor) Channels() []ChannelSpec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wave != nil {
+		return []ChannelSpec{{Name: s.wave.channel, Units: s.metadata.Units}}
 	}
-	
-	if amp, ok := config["amplitude"].(float64); ok {
-		s.amplitude = amp
+	specs := make([]ChannelSpec, len(sampleChannels))
+	for i, name := range sampleChannels {
+		specs[i] = ChannelSpec{Name: name, Units: simulatorUnits[name]}
 	}
-	
-	if offset, ok := config["offset"].(float64); ok {
-		s.offset = offset
+	return specs
+}
+
+// Configure replaces the scenario or waveform and restarts it
+func (s *SimulatorSensor) Configure(config map[string]interface{}) error {
+	next := &SimulatorSensor{config: s.config, metadata: s.metadata}
+	if err := next.apply(config); err != nil {
+		return err
 	}
-	
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.Config = config
+	s.scenario, s.wave, s.speed = next.scenario, next.wave, next.speed
+	s.startTime = time.Now()
+	s.lastTick = s.startTime
 	return nil
 }
 
@@ -157,25 +253,31 @@ func (s *SimulatorSensor) GetMetadata() config.SensorMetadata {
 
 // Health returns the sensor health status
 func (s *SimulatorSensor) Health() SensorHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	status := "ok"
+	message := "Simulator sensor operating normally"
 	if !s.running {
 		status = "stopped"
 	}
-	
-	var errorRate float64
-	if s.lastRead.IsZero() {
-		errorRate = 0.0
-	} else {
-		// Simulate very low error rate for simulator
-		errorRate = 0.001
+	if s.scenario != nil {
+		message = "Running scenario " + s.scenario.sc.Name
+		if s.running && len(s.faults) > 0 {
+			status = "degraded"
+			message += ", injected faults: " + strings.Join(s.faults, ", ")
+		}
+	}
+
+	var lastRead int64
+	if !s.lastRead.IsZero() {
+		lastRead = s.lastRead.Unix()
 	}
-	
 	return SensorHealth{
 		Status:     status,
-		LastRead:   s.lastRead.Unix(),
+		LastRead:   lastRead,
 		ErrorCount: s.errorCount,
-		ErrorRate:  errorRate,
-		Message:    "Simulator sensor operating normally",
+		Message:    message,
 	}
 }
 
@@ -186,4 +288,4 @@ type SensorError struct {
 
 func (e *SensorError) Error() string {
 	return e.Message
-}
\ No newline at end of file
+}
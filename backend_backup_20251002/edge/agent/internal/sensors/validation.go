@@ -0,0 +1,119 @@
+// internal/sensors/validation.go
+package sensors
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"cnc-monitor/edge/config"
+)
+
+// OutOfRange reports a channel whose reading left its configured range. It is
+// raised once per excursion, when the first reading outside the range arrives.
+type OutOfRange struct {
+	Sensor  string
+	Channel string
+	Value   float64 // As read, before clamping
+	Min     float64
+	Max     float64
+	Action  string // flag, clamp or drop
+	Alert   string // Configured alert level
+}
+
+// channelRule is the metadata that applies to one channel of a sensor.
+type channelRule struct {
+	units     string
+	rng       config.SensorRange
+	precision *int // Decimal places; nil keeps readings as read
+}
+
+// validator applies a sensor's metadata to its readings: it attaches units and
+// tags, checks ranges and rounds to the configured precision.
+type validator struct {
+	sensor   string
+	action   string
+	alert    string
+	tags     map[string]string
+	def      channelRule
+	channels map[string]channelRule
+
+	outOfRange atomic.Int64
+
+	mu     sync.Mutex
+	active map[string]bool // Channels currently outside their range
+}
+
+func newValidator(sensor string, meta config.SensorMetadata) *validator {
+	v := &validator{
+		sensor:   sensor,
+		action:   meta.OutOfRange,
+		alert:    meta.Alert,
+		tags:     meta.Tags,
+		def:      channelRule{units: meta.Units, rng: meta.Range, precision: meta.Precision},
+		channels: make(map[string]channelRule),
+		active:   make(map[string]bool),
+	}
+	if v.action == "" {
+		v.action = "flag"
+	}
+	for name, ch := range meta.Channels {
+		v.channels[name] = channelRule{units: ch.Units, rng: ch.Range, precision: ch.Precision}
+	}
+	return v
+}
+
+// rule returns the metadata of a channel.
+func (v *validator) rule(channel string) channelRule {
+	if r, ok := v.channels[channel]; ok {
+		return r
+	}
+	return v.def
+}
+
+// apply validates a reading in place. Readings outside the range are flagged
+// as uncertain, clamped to the range (and flagged) or dropped as bad. It
+// returns the excursion when the reading is the first outside the range.
+func (v *validator) apply(r *ChannelReading) *OutOfRange {
+	rule := v.rule(r.Name)
+	if r.Units == "" {
+		r.Units = rule.units
+	}
+	if r.Tags == nil {
+		r.Tags = v.tags
+	}
+	if r.Text != "" || r.Quality.rank() == 0 {
+		return nil
+	}
+
+	var event *OutOfRange
+	outside := rule.rng.IsSet() && (r.Value < rule.rng.Min || r.Value > rule.rng.Max)
+	v.mu.Lock()
+	if outside && !v.active[r.Name] {
+		event = &OutOfRange{
+			Sensor: v.sensor, Channel: r.Name, Value: r.Value,
+			Min: rule.rng.Min, Max: rule.rng.Max, Action: v.action, Alert: v.alert,
+		}
+	}
+	v.active[r.Name] = outside
+	v.mu.Unlock()
+
+	if outside {
+		v.outOfRange.Add(1)
+		switch v.action {
+		case "drop":
+			r.Quality = QualityBad
+			return event
+		case "clamp":
+			r.Value = math.Max(rule.rng.Min, math.Min(rule.rng.Max, r.Value))
+		}
+		if r.Quality == QualityGood {
+			r.Quality = QualityUncertain
+		}
+	}
+	if rule.precision != nil {
+		scale := math.Pow(10, float64(*rule.precision))
+		r.Value = math.Round(r.Value*scale) / scale
+	}
+	return event
+}
@@ -0,0 +1,142 @@
+package sensors
+
+import (
+	"reflect"
+	"testing"
+
+	"cnc-monitor/edge/config"
+)
+
+func TestValidatorApply(t *testing.T) {
+	places := func(n int) *int { return &n }
+	tags := map[string]string{"cell": "A"}
+	rng := config.SensorRange{Min: 0, Max: 100}
+
+	type step struct {
+		in    ChannelReading
+		want  ChannelReading
+		event bool // An OutOfRange is returned
+	}
+	reading := func(name string, value float64, units string, q Quality) ChannelReading {
+		return ChannelReading{Name: name, Value: value, Units: units, Quality: q}
+	}
+	tagged := func(r ChannelReading) ChannelReading {
+		r.Tags = tags
+		return r
+	}
+	tests := []struct {
+		name       string
+		meta       config.SensorMetadata
+		steps      []step
+		outOfRange int64
+	}{
+		{
+			name: "flag",
+			meta: config.SensorMetadata{Range: rng},
+			steps: []step{
+				{reading("t", 50, "", QualityGood), reading("t", 50, "", QualityGood), false},
+				{reading("t", 120, "", QualityGood), reading("t", 120, "", QualityUncertain), true},
+				{reading("t", 130, "", QualityGood), reading("t", 130, "", QualityUncertain), false},
+				{reading("t", 90, "", QualityGood), reading("t", 90, "", QualityGood), false},
+				// A new excursion raises a new event
+				{reading("t", -1, "", QualityGood), reading("t", -1, "", QualityUncertain), true},
+			},
+			outOfRange: 3,
+		},
+		{
+			name: "clamp",
+			meta: config.SensorMetadata{Range: rng, OutOfRange: "clamp"},
+			steps: []step{
+				{reading("t", 120, "", QualityGood), reading("t", 100, "", QualityUncertain), true},
+				{reading("t", -5, "", QualityGood), reading("t", 0, "", QualityUncertain), false},
+			},
+			outOfRange: 2,
+		},
+		{
+			name: "drop",
+			meta: config.SensorMetadata{Range: rng, OutOfRange: "drop"},
+			steps: []step{
+				{reading("t", 120, "", QualityGood), reading("t", 120, "", QualityBad), true},
+				{reading("t", 60, "", QualityGood), reading("t", 60, "", QualityGood), false},
+			},
+			outOfRange: 1,
+		},
+		{
+			name: "no range",
+			meta: config.SensorMetadata{},
+			steps: []step{
+				{reading("t", 1e6, "", QualityGood), reading("t", 1e6, "", QualityGood), false},
+			},
+		},
+		{
+			name: "precision",
+			meta: config.SensorMetadata{
+				Precision: places(2),
+				Channels: map[string]config.ChannelMetadata{
+					"whole": {Precision: places(0)},
+					"raw":   {},
+				},
+			},
+			steps: []step{
+				{reading("t", 1.23456, "", QualityGood), reading("t", 1.23, "", QualityGood), false},
+				{reading("whole", 7.6, "", QualityGood), reading("whole", 8, "", QualityGood), false},
+				{reading("raw", 1.23456, "", QualityGood), reading("raw", 1.23456, "", QualityGood), false},
+			},
+		},
+		{
+			name: "rounded after clamp",
+			meta: config.SensorMetadata{Range: config.SensorRange{Min: 0, Max: 9.99}, OutOfRange: "clamp", Precision: places(1)},
+			steps: []step{
+				{reading("t", 12, "", QualityGood), reading("t", 10, "", QualityUncertain), true},
+			},
+			outOfRange: 1,
+		},
+		{
+			name: "units and tags",
+			meta: config.SensorMetadata{
+				Units: "celsius",
+				Tags:  tags,
+				Channels: map[string]config.ChannelMetadata{
+					"rpm": {Units: "rpm"},
+				},
+			},
+			steps: []step{
+				{reading("t", 20, "", QualityGood), tagged(reading("t", 20, "celsius", QualityGood)), false},
+				{reading("rpm", 900, "", QualityGood), tagged(reading("rpm", 900, "rpm", QualityGood)), false},
+				// Units the sensor reports win
+				{reading("t", 68, "fahrenheit", QualityGood), tagged(reading("t", 68, "fahrenheit", QualityGood)), false},
+			},
+		},
+		{
+			name: "not checked",
+			meta: config.SensorMetadata{Range: rng, OutOfRange: "clamp"},
+			steps: []step{
+				// Bad readings and text channels are passed through
+				{reading("t", 120, "", QualityBad), reading("t", 120, "", QualityBad), false},
+				{ChannelReading{Name: "state", Value: 120, Text: "RUNNING", Quality: QualityGood},
+					ChannelReading{Name: "state", Value: 120, Text: "RUNNING", Quality: QualityGood}, false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newValidator("probe", tt.meta)
+			for i, s := range tt.steps {
+				r := s.in
+				event := v.apply(&r)
+				if !reflect.DeepEqual(r, s.want) {
+					t.Errorf("step %d: got %+v, want %+v", i, r, s.want)
+				}
+				if (event != nil) != s.event {
+					t.Errorf("step %d: event %+v, want event %v", i, event, s.event)
+				}
+				if event != nil && (event.Sensor != "probe" || event.Channel != s.in.Name || event.Value != s.in.Value) {
+					t.Errorf("step %d: event %+v for %+v", i, event, s.in)
+				}
+			}
+			if got := v.outOfRange.Load(); got != tt.outOfRange {
+				t.Errorf("out of range counter %d, want %d", got, tt.outOfRange)
+			}
+		})
+	}
+}
@@ -73,8 +73,8 @@ func NewMachine() *Machine {
 	}
 	
 	// Define valid state transitions
-	sm.transitions[StateBootstrap] = []State{StateConnecting, StateShutdown}
-	sm.transitions[StateConnecting] = []State{StateOnline, StateBuffering, StateShutdown}
+	sm.transitions[StateBootstrap] = []State{StateConnecting, StateDegraded, StateShutdown}
+	sm.transitions[StateConnecting] = []State{StateOnline, StateBuffering, StateDegraded, StateShutdown}
 	sm.transitions[StateOnline] = []State{StateBuffering, StateDegraded, StateShutdown}
 	sm.transitions[StateBuffering] = []State{StateOnline, StateRecovering, StateDegraded, StateShutdown}
 	sm.transitions[StateDegraded] = []State{StateRecovering, StateOnline, StateShutdown}
@@ -222,13 +222,13 @@ func (sm *Machine) setDefaultHandlers() {
 	
 	sm.handlers[StateDegraded] = func(ctx context.Context) error {
 		log.Warn().Msg("Resource constraints - degraded operation")
-		// TODO: Reduce sampling rate, disable non-essential features
+		// The edge agent replaces this handler to reduce the sampling rate
 		return nil
 	}
 	
 	sm.handlers[StateRecovering] = func(ctx context.Context) error {
 		log.Info().Msg("Recovering to normal operation")
-		// TODO: Restore normal sampling, flush buffers
+		// The edge agent replaces this handler to restore sampling and flush buffers
 		return nil
 	}
 	
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd)
+
+package statedir
+
+import "os"
+
+// lockFile is a no-op where flock is unavailable; the agent only runs on Linux.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
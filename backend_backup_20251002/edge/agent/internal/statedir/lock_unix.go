@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package statedir
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive, non-blocking flock. The kernel releases it when
+// the process exits, so a crashed agent never leaves a stale lock behind.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,110 @@
+// internal/statedir/statedir.go
+package statedir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LockFile is the name of the lock file inside a machine's state directory.
+const LockFile = "agent.lock"
+
+// ErrLocked is returned by Open when another agent holds the state directory.
+var ErrLocked = errors.New("state directory is locked by another agent")
+
+// Dir is the state directory of one machine, <root>/<machine_id>. It holds the
+// sequence file and the offline buffer, and is locked for as long as it is open
+// so two agents for the same machine cannot share it.
+type Dir struct {
+	path string
+	lock *os.File
+}
+
+// Open creates and locks the state directory of machineID under root. Files
+// left directly in root by agents that predate per-machine directories are
+// moved into it.
+func Open(root, machineID string) (*Dir, error) {
+	if machineID == "" || filepath.Base(machineID) != machineID {
+		return nil, fmt.Errorf("invalid machine ID %q for a state directory", machineID)
+	}
+	path := filepath.Join(root, machineID)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(path, LockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		holder, _ := os.ReadFile(f.Name())
+		f.Close()
+		if len(holder) > 0 {
+			return nil, fmt.Errorf("%w (%s, pid %s)", ErrLocked, path, holder)
+		}
+		return nil, fmt.Errorf("%w (%s): %v", ErrLocked, path, err)
+	}
+	// Record the holder for operators; the lock itself is the flock.
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+
+	d := &Dir{path: path, lock: f}
+	d.migrateLegacy(root)
+
+	log.Info().Str("state_dir", path).Msg("State directory locked")
+	return d, nil
+}
+
+// Path returns the machine's state directory.
+func (d *Dir) Path() string {
+	return d.path
+}
+
+// Join returns the path of name inside the state directory. Absolute names are
+// returned unchanged.
+func (d *Dir) Join(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(d.path, name)
+}
+
+// Close releases the lock.
+func (d *Dir) Close() error {
+	if d.lock == nil {
+		return nil
+	}
+	_ = d.lock.Truncate(0)
+	err := unlockFile(d.lock)
+	if cerr := d.lock.Close(); err == nil {
+		err = cerr
+	}
+	d.lock = nil
+	return err
+}
+
+// migrateLegacy moves the single-instance layout (<root>/sequence.txt and
+// <root>/offline) into the machine directory, unless it already has its own.
+func (d *Dir) migrateLegacy(root string) {
+	for _, name := range []string{"sequence.txt", "offline"} {
+		from := filepath.Join(root, name)
+		to := filepath.Join(d.path, name)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		if _, err := os.Stat(to); err == nil {
+			continue
+		}
+		if err := os.Rename(from, to); err != nil {
+			log.Warn().Err(err).Str("from", from).Str("to", to).Msg("Failed to move legacy state into machine directory")
+			continue
+		}
+		log.Info().Str("from", from).Str("to", to).Msg("Moved legacy state into machine directory")
+	}
+}
@@ -9,10 +9,12 @@ import (
 
 	"cnc-monitor/edge/config"
 	"cnc-monitor/edge/internal/agent"
+	"cnc-monitor/edge/internal/alerts"
 	"cnc-monitor/edge/internal/buffering"
 	"cnc-monitor/edge/internal/nats"
 	"cnc-monitor/edge/internal/sensors"
 	"cnc-monitor/edge/internal/state"
+	"cnc-monitor/edge/internal/statedir"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -28,8 +30,15 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to load configuration")
 	}
 
+	// Claim this machine's state directory; a second agent for it fails here.
+	stateDir, err := statedir.Open(cfg.StateDir, cfg.Agent.MachineID)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to open state directory")
+	}
+	defer stateDir.Close()
+
 	// 1. Create the NATS client, which will process our data batches.
-	natsClient, err := nats.NewClient(cfg.NATS)
+	natsClient, err := nats.NewClient(cfg.Agent.MachineID, cfg.NATS, cfg.Buffering.Batching)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create NATS client")
 	}
@@ -38,7 +47,7 @@ func main() {
 	}
 
 	// 2. Create the buffer manager, using the NATS client as the processor.
-	bufferManager, err := buffering.NewManager(cfg.Buffering, natsClient)
+	bufferManager, err := buffering.NewManager(stateDir.Path(), cfg.Buffering, natsClient)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create buffer manager")
 	}
@@ -49,23 +58,63 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to create sensor manager")
 	}
 
-	// 4. Create the main agent.
-	edgeAgent := agent.NewEdgeAgent(&agent.Config{
+	// 4. Create the alert dispatcher for health.alerts.
+	alertDispatcher, err := alerts.NewDispatcher(cfg.Agent.MachineID, cfg.Health.Alerts, natsClient)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create alert dispatcher")
+	}
+
+	// Tee samples to a capture file for later replay if agent.record is set.
+	var recorder *sensors.Recorder
+	if cfg.Agent.Record != "" {
+		recorder, err = sensors.NewRecorder(stateDir.Join(cfg.Agent.Record))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open capture file")
+		}
+		defer recorder.Close()
+	}
+
+	if level, err := zerolog.ParseLevel(cfg.Agent.LogLevel); err == nil {
+		zerolog.SetGlobalLevel(level)
+	}
+
+	// Run the agent in the background.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Apply edits to the config file and the backend's desired configuration
+	// without a restart.
+	var edgeAgent *agent.EdgeAgent
+	watcher := config.NewWatcher(cfg, func(next *config.Config) error {
+		return edgeAgent.Reload(ctx, next)
+	})
+
+	// 5. Create the main agent.
+	edgeAgent = agent.NewEdgeAgent(&agent.Config{
 		MachineID:     cfg.Agent.MachineID,
 		Location:      cfg.Agent.Location,
 		SamplingRate:  cfg.Agent.SamplingRate,
 		BufferManager: bufferManager,
 		SensorManager: sensorManager,
-		StateMachine:  state.NewMachine(), // State machine is currently basic.
+		Status:        natsClient,
+		Alerts:        alertDispatcher,
+		Outage:        natsClient,
+		Recorder:      recorder,
+		Remote:        natsClient,
+		Settings:      watcher,
+		Connection:    natsClient,
+		StateMachine:  state.NewMachine(),
+
+		DegradedSamplingRate: cfg.Agent.DegradedSamplingRate,
+		CPUPercent:           cfg.Health.Thresholds.CPUPercent,
+		CheckInterval:        cfg.Health.CheckInterval,
 	})
 
-	// Run the agent in the background.
-	ctx, cancel := context.WithCancel(context.Background())
-
 	if err := edgeAgent.Run(ctx); err != nil {
 		log.Fatal().Err(err).Msg("Failed to run edge agent")
 	}
 
+	watcher.Start()
+
 	// Wait for shutdown signal.
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -34,12 +34,13 @@ if [ "$RUN_MODE" == "0" ]; then
     # Clear buffers and caches
     echo "Clearing buffers..."
     echo "raspy" | sudo -S bash -c "
-        mkdir -p /var/tmp/cnc-agent/offline
-        chown pi:pi /var/tmp/cnc-agent/offline
+        mkdir -p /var/tmp/cnc-agent
+        chown pi:pi /var/tmp/cnc-agent
         rm -f /var/tmp/cnc-agent/warm.buffer
         rm -f /var/tmp/cnc-agent/cold.log
     "
-    rm -rf /var/tmp/cnc-agent/offline/*
+    # Per-machine state: <state_dir>/<machine_id>/offline (the sequence file is kept)
+    rm -rf /var/tmp/cnc-agent/offline /var/tmp/cnc-agent/*/offline
     
     echo "✅ Buffers cleared"
     
@@ -60,8 +61,8 @@ fi
 
 # Ensure directories exist
 echo "raspy" | sudo -S bash -c "
-    mkdir -p /var/tmp/cnc-agent/offline
-    chown pi:pi /var/tmp/cnc-agent/offline
+    mkdir -p /var/tmp/cnc-agent
+    chown pi:pi /var/tmp/cnc-agent
 "
 
 # Change to edge_code directory and run
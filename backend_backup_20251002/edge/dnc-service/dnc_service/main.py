@@ -47,7 +47,7 @@ async def startup():
         js = nc.jetstream()
         app.state.nc = nc
         app.state.js = js
-        app.state.publisher = NatsPublisher(js, cfg.nats_stream, cfg.machine_id)
+        app.state.publisher = NatsPublisher(js, cfg.nats_subject_prefix, cfg.machine_id)
     except Exception:
         app.state.nc = None
         app.state.js = None
@@ -23,6 +23,7 @@ class TransferStatus(BaseModel):
     state: str  # queued|running|paused|completed|canceled|error
     port: str
     file_name: str
+    dialect: str = "heidenhain"
     line: int = 0
     lines_total: int = 0
     bytes_sent: int = 0
@@ -0,0 +1,35 @@
+import json
+import urllib.error
+import urllib.request
+from typing import Any, Dict
+
+# Dialect the sender has always assumed; used when no backend is configured
+DEFAULT_DIALECT = "heidenhain"
+
+
+class PrepareError(Exception):
+    def __init__(self, status_code: int, detail: Any):
+        super().__init__(str(detail))
+        self.status_code = status_code
+        self.detail = detail
+
+
+def prepare_program(backend_url: str, machine_id: str, program_name: str, content: str, timeout: float = 10.0) -> Dict[str, Any]:
+    """Sanitize a program for the machine's controller via the backend.
+
+    The backend picks the dialect (HEIDENHAIN, Fanuc, Siemens, ...) from the
+    machine's controller_type and returns the cleaned program with a report.
+    Raises PrepareError if the backend is unreachable or rejects the request.
+    """
+    url = f"{backend_url.rstrip('/')}/api/v1/machines/{machine_id}/programs/prepare"
+    body = json.dumps({"program_name": program_name, "content": content}).encode("utf-8")
+    req = urllib.request.Request(url, data=body, method="POST", headers={"Content-Type": "application/json"})
+    try:
+        with urllib.request.urlopen(req, timeout=timeout) as resp:
+            return json.loads(resp.read().decode("utf-8"))
+    except urllib.error.HTTPError as e:
+        detail = e.read().decode("utf-8", errors="ignore").strip() or e.reason
+        status = 404 if e.code == 404 else 502
+        raise PrepareError(status, f"Backend could not prepare program for {machine_id}: {detail}")
+    except (urllib.error.URLError, OSError, ValueError) as e:
+        raise PrepareError(502, f"Backend unreachable, program not prepared: {e}")
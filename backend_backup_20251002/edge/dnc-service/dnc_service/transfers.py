@@ -8,7 +8,7 @@ import threading
 import time
 import uuid
 from pathlib import Path
-from typing import Dict, Optional
+from typing import Any, Dict, Optional, Set, Tuple
 
 from fastapi import APIRouter, HTTPException, Request
 from fastapi.responses import JSONResponse, HTMLResponse
@@ -17,6 +17,7 @@ from starlette.templating import Jinja2Templates
 from .models import TransferRequest, TransferStatus, ProgressEvent
 from .locks import port_lock
 from .nats_pub import NatsPublisher
+from .prepare import DEFAULT_DIALECT, PrepareError, prepare_program
 
 router = APIRouter()
 
@@ -30,6 +31,8 @@ class TransferManager:
         self._procs: Dict[str, subprocess.Popen] = {}
         self._queues: Dict[str, asyncio.Queue] = {}
         self._port_in_use: Dict[str, str] = {}  # port -> transfer_id
+        self._requests: Dict[str, TransferRequest] = {}
+        self._canceled: Set[str] = set()
 
     def _program_path(self, file_name: str) -> Path:
         return self.cfg.program_dir / file_name
@@ -41,6 +44,83 @@ class TransferManager:
         except Exception:
             return 0
 
+    async def _prepare(self, req: TransferRequest, program_path: Path, transfer_id: str) -> Tuple[str, Path]:
+        """Sanitize the program for the dialect of the machine's controller.
+
+        Returns the dialect and the file to send. Without a backend the program
+        is sent as it is, as HEIDENHAIN.
+        """
+        if not self.cfg.backend_url:
+            return DEFAULT_DIALECT, program_path
+        machine_id = req.machine_id or self.cfg.machine_id
+        content = program_path.read_text(encoding="utf-8", errors="ignore")
+        try:
+            prepared = await asyncio.to_thread(
+                prepare_program, self.cfg.backend_url, machine_id, req.program_name or req.file_name, content
+            )
+        except PrepareError as e:
+            raise HTTPException(status_code=e.status_code, detail=e.detail)
+
+        dialect = prepared.get("dialect") or DEFAULT_DIALECT
+        if not prepared.get("ready"):
+            errors = (prepared.get("result") or {}).get("errors") or []
+            raise HTTPException(status_code=422, detail={"dialect": dialect, "errors": errors})
+        if dialect != DEFAULT_DIALECT and req.mode != "standard":
+            # The BCC block protocols are specific to HEIDENHAIN controls
+            raise HTTPException(status_code=422, detail=f"{dialect} programs can only be sent in standard mode, not {req.mode}")
+
+        prepared_dir = self.cfg.program_dir / ".prepared"
+        prepared_dir.mkdir(parents=True, exist_ok=True)
+        send_path = prepared_dir / f"{transfer_id}{program_path.suffix}"
+        lines = prepared.get("content", "").splitlines()
+        send_path.write_text(("\r\n").join(lines) + "\r\n", encoding="ascii", errors="ignore")
+        return dialect, send_path
+
+    def _event(self, transfer_id: str, event: str) -> Dict[str, Any]:
+        """Progress event for the transfer's current status, as published to NATS."""
+        req = self._requests[transfer_id]
+        st = self._statuses[transfer_id]
+        return {
+            "transfer_id": transfer_id,
+            "machine_id": req.machine_id or self.cfg.machine_id,
+            "program_name": req.program_name or req.file_name,
+            "mode": req.mode,
+            "state": st.state,
+            "line": st.line,
+            "lines_total": st.lines_total,
+            "bytes_sent": st.bytes_sent,
+            "rate_lps": st.rate_lps,
+            "eta_sec": st.eta_sec,
+            "event": event,
+            "error": st.error,
+            "ts": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }
+
+    def _emit(self, ev: Dict[str, Any], attempts: int = 1) -> None:
+        """Send an event to the SSE queue and publish it, from the transfer thread.
+
+        Terminal events are retried; the Nats-Msg-Id makes a retry that did get
+        stored harmless.
+        """
+        self.loop.call_soon_threadsafe(self._queues[ev["transfer_id"]].put_nowait, ev)
+        if not self.publisher:
+            return
+        for _ in range(attempts):
+            fut = asyncio.run_coroutine_threadsafe(self.publisher.publish_event(ev), self.loop)
+            try:
+                fut.result(timeout=2)
+                return
+            except Exception:
+                continue
+
+    def _finish(self, transfer_id: str, state: str, error: Optional[str] = None) -> None:
+        """Move the transfer to a terminal state and publish it."""
+        st = self._statuses[transfer_id]
+        st.state = state
+        st.error = error
+        st.eta_sec = None
+        self._emit(self._event(transfer_id, state), attempts=3)
+
     def _build_cmd(self, req: TransferRequest, program_path: Path) -> [str]:
         args = [
             "python3",
@@ -70,21 +150,27 @@ class TransferManager:
         if not program_path.exists():
             raise HTTPException(status_code=404, detail="Program file not found")
 
+        transfer_id = str(uuid.uuid4())
+        dialect, send_path = await self._prepare(req, program_path, transfer_id)
+
         # Lock the port
         if req.port in self._port_in_use:
+            if send_path != program_path:
+                send_path.unlink(missing_ok=True)
             raise HTTPException(status_code=409, detail=f"Port {req.port} already in use by transfer {self._port_in_use[req.port]}")
 
-        transfer_id = str(uuid.uuid4())
         self._port_in_use[req.port] = transfer_id
         self._queues[transfer_id] = asyncio.Queue()
+        self._requests[transfer_id] = req
 
         status = TransferStatus(
             transfer_id=transfer_id,
             state="queued",
             port=req.port,
             file_name=req.file_name,
+            dialect=dialect,
             line=0,
-            lines_total=self._count_lines(program_path),
+            lines_total=self._count_lines(send_path),
             bytes_sent=0,
             rate_lps=0.0,
             eta_sec=None,
@@ -95,12 +181,12 @@ class TransferManager:
         def _run():
             try:
                 with port_lock(req.port):
-                    cmd = self._build_cmd(req, program_path)
+                    cmd = self._build_cmd(req, send_path)
                     env = os.environ.copy()
                     env["PYTHONUNBUFFERED"] = "1"
                     start_time = time.time()
                     self._statuses[transfer_id].state = "running"
-                    self.loop.call_soon_threadsafe(self._queues[transfer_id].put_nowait, {"state": "running"})
+                    self._emit(self._event(transfer_id, "start"))
                     try:
                         proc = subprocess.Popen(
                             cmd,
@@ -113,14 +199,13 @@ class TransferManager:
                         )
                         self._procs[transfer_id] = proc
                     except Exception as e:
-                        self._statuses[transfer_id].state = "error"
-                        self._statuses[transfer_id].error = str(e)
-                        self.loop.call_soon_threadsafe(self._queues[transfer_id].put_nowait, {"state": "error", "error": str(e)})
+                        self._finish(transfer_id, "error", str(e))
                         return
 
                     ack_re = re.compile(r"RX: ACK on (?:block\s*)?(\d+)")
                     last_line = 0
                     last_ts = start_time
+                    last_output = ""
                     while True:
                         line = proc.stdout.readline()
                         if not line:
@@ -128,6 +213,8 @@ class TransferManager:
                                 break
                             time.sleep(0.05)
                             continue
+                        if line.strip():
+                            last_output = line.strip()
                         m = ack_re.search(line)
                         if m:
                             cur = int(m.group(1))
@@ -144,39 +231,24 @@ class TransferManager:
                             rate = self._statuses[transfer_id].rate_lps or 0.0001
                             self._statuses[transfer_id].eta_sec = remaining / rate
 
-                            ev = {
-                                "transfer_id": transfer_id,
-                                "machine_id": req.machine_id or self.cfg.machine_id,
-                                "program_name": req.program_name or req.file_name,
-                                "mode": req.mode,
-                                "state": self._statuses[transfer_id].state,
-                                "line": self._statuses[transfer_id].line,
-                                "lines_total": self._statuses[transfer_id].lines_total,
-                                "bytes_sent": self._statuses[transfer_id].bytes_sent,
-                                "rate_lps": self._statuses[transfer_id].rate_lps,
-                                "eta_sec": self._statuses[transfer_id].eta_sec,
-                                "event": "ack",
-                                "ts": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
-                            }
-                            self.loop.call_soon_threadsafe(self._queues[transfer_id].put_nowait, ev)
-                            if self.publisher:
-                                fut = asyncio.run_coroutine_threadsafe(self.publisher.publish_event(ev), self.loop)
-                                try:
-                                    fut.result(timeout=2)
-                                except Exception:
-                                    pass
+                            self._emit(self._event(transfer_id, "ack"))
                         # Optional: parse other sender outputs for TX, EOT/ETX, etc.
 
                     rc = proc.poll()
-                    if rc == 0:
-                        self._statuses[transfer_id].state = "completed"
-                        self.loop.call_soon_threadsafe(self._queues[transfer_id].put_nowait, {"state": "completed"})
+                    if transfer_id in self._canceled:
+                        self._finish(transfer_id, "canceled")
+                    elif rc == 0:
+                        self._finish(transfer_id, "completed")
                     else:
-                        self._statuses[transfer_id].state = "error"
-                        self._statuses[transfer_id].error = f"sender exited rc={rc}"
-                        self.loop.call_soon_threadsafe(self._queues[transfer_id].put_nowait, {"state": "error", "error": self._statuses[transfer_id].error})
+                        # The sender's last words are its error, e.g. a handshake timeout
+                        error = f"sender exited rc={rc}"
+                        if last_output:
+                            error += f": {last_output}"
+                        self._finish(transfer_id, "error", error)
             finally:
                 self._port_in_use.pop(req.port, None)
+                if send_path != program_path:
+                    send_path.unlink(missing_ok=True)
 
         threading.Thread(target=_run, daemon=True).start()
         return transfer_id
@@ -185,6 +257,8 @@ class TransferManager:
         proc = self._procs.get(transfer_id)
         if not proc:
             return
+        # The transfer thread reports the cancel once the sender has exited
+        self._canceled.add(transfer_id)
         try:
             os.killpg(os.getpgid(proc.pid), signal.SIGTERM)
         except Exception:
@@ -192,8 +266,6 @@ class TransferManager:
                 proc.terminate()
             except Exception:
                 pass
-        self._statuses[transfer_id].state = "canceled"
-        await self._queues[transfer_id].put({"state": "canceled"})
 
     def get_status(self, transfer_id: str) -> Optional[TransferStatus]:
         return self._statuses.get(transfer_id)
@@ -0,0 +1,63 @@
+import asyncio
+import json
+import unittest
+
+from dnc_service.nats_pub import NatsPublisher, event_msg_id
+
+
+def progress_event(**overrides):
+    ev = {
+        "transfer_id": "7f0c",
+        "machine_id": "CNC-PI-001",
+        "state": "running",
+        "line": 12,
+        "lines_total": 40,
+        "bytes_sent": 310,
+        "rate_lps": 2.5,
+        "eta_sec": 11.2,
+        "event": "ack",
+        "error": None,
+        "ts": "2025-10-01T08:00:05Z",
+    }
+    ev.update(overrides)
+    return ev
+
+
+class FakeJetStream:
+    def __init__(self):
+        self.published = []
+
+    async def publish(self, subject, data, headers=None):
+        self.published.append((subject, json.loads(data), headers))
+
+
+class EventMsgIdTest(unittest.TestCase):
+    def test_natural_key(self):
+        self.assertEqual(event_msg_id(progress_event()), "7f0c:2025-10-01T08:00:05Z:ack:running:12")
+
+    def test_retry_has_same_id(self):
+        # A retried terminal event is rebuilt with fresh counters but keeps its key
+        first = progress_event(event="completed", state="completed", line=40)
+        retry = progress_event(event="completed", state="completed", line=40, rate_lps=2.4, eta_sec=None)
+        self.assertEqual(event_msg_id(first), event_msg_id(retry))
+
+    def test_key_fields_differ(self):
+        ev = progress_event()
+        for key, value in (("line", 13), ("event", "error"), ("state", "error"), ("ts", "2025-10-01T08:00:06Z")):
+            with self.subTest(key=key):
+                self.assertNotEqual(event_msg_id(ev), event_msg_id(progress_event(**{key: value})))
+
+    def test_missing_line(self):
+        self.assertEqual(event_msg_id(progress_event(line=None)), "7f0c:2025-10-01T08:00:05Z:ack:running:")
+
+
+class NatsPublisherTest(unittest.TestCase):
+    def test_publishes_with_msg_id(self):
+        js = FakeJetStream()
+        ev = progress_event()
+        asyncio.run(NatsPublisher(js, "CNC.EDGE", "CNC-PI-001").publish_event(ev))
+        self.assertEqual(js.published, [("CNC.EDGE.CNC-PI-001.dnc", ev, {"Nats-Msg-Id": event_msg_id(ev)})])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -44,19 +44,11 @@ machine:
 nats:
   url: "nats://$NATS_HOST:4222"
   stream: "CNC_DATA"
-  subject_prefix: "CNC_DATA.edge"
+  subject_prefix: "CNC.EDGE"
   reconnect_delay: "1s"
   max_reconnects: 10
 
 buffering:
-  hot_buffer:
-    capacity: 1048576
-  warm_buffer:
-    path: "/tmp/cnc-agent/warm.buffer"
-    size: 10485760
-  cold_buffer:
-    path: "/tmp/cnc-agent/cold.log"
-    max_size: 104857600
   batching:
     size: 10
     timeout: "200ms"
@@ -102,5 +94,5 @@ echo "Or use this one-liner:"
 echo "   ./cnc-edge-agent --config ~/cnc-config/edge-agent.yaml"
 echo ""
 echo "📊 Data will be stored with machine ID: $MACHINE_ID"
-echo "🎯 Publishing to: CNC_DATA.edge.data"
+echo "🎯 Publishing to: CNC.EDGE.${MACHINE_ID}.telemetry"
 echo "📡 NATS server: $NATS_HOST:4222"
\ No newline at end of file
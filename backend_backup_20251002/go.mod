@@ -5,11 +5,15 @@ go 1.22.0
 toolchain go1.24.4
 
 require (
+	cnc-monitor/contract v0.0.0
 	github.com/google/uuid v1.6.0
 	github.com/jackc/pgx/v5 v5.7.1
 	github.com/khepin/liteq v0.1.0
+	github.com/klauspost/compress v1.17.11
 	github.com/mattn/go-sqlite3 v1.14.28
+	github.com/nats-io/jwt/v2 v2.5.8
 	github.com/nats-io/nats.go v1.37.0
+	github.com/nats-io/nkeys v0.4.8
 	github.com/rs/zerolog v1.34.0
 	github.com/spf13/viper v1.20.1
 )
@@ -21,10 +25,8 @@ require (
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
 	github.com/jackc/puddle/v2 v2.2.2 // indirect
-	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/nats-io/nkeys v0.4.8 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/pelletier/go-toml/v2 v2.2.3 // indirect
 	github.com/sagikazarmark/locafero v0.7.0 // indirect
@@ -41,3 +43,5 @@ require (
 	golang.org/x/text v0.21.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace cnc-monitor/contract => ./contract
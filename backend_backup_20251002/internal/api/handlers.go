@@ -1,23 +1,29 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
+	"cnc-monitor/contract"
 	"cnc-monitor/internal/ingestion"
+	"cnc-monitor/internal/ncprogram"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"log"
 	"strings"
 )
 
 type APIHandler struct {
-	repo *ingestion.Repository
+	repo   *ingestion.Repository
+	agents *ingestion.AgentControl
 }
 
-func NewAPIHandler(repo *ingestion.Repository) *APIHandler {
-	return &APIHandler{repo: repo}
+func NewAPIHandler(repo *ingestion.Repository, agents *ingestion.AgentControl) *APIHandler {
+	return &APIHandler{repo: repo, agents: agents}
 }
 
 func (h *APIHandler) GetMachines(w http.ResponseWriter, r *http.Request) {
@@ -96,6 +102,62 @@ func (h *APIHandler) GetMachineData(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// GetMachineChannels returns the channel catalog a machine's agent last reported.
+func (h *APIHandler) GetMachineChannels(w http.ResponseWriter, r *http.Request) {
+	// e.g. /api/v1/machines/CNC-001/channels
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 6 || pathParts[4] == "" {
+		http.Error(w, "Machine ID not provided", http.StatusBadRequest)
+		return
+	}
+	machineID := pathParts[4]
+
+	channels, err := h.repo.GetChannelCatalog(r.Context(), machineID)
+	if err != nil {
+		log.Printf("Error getting channel catalog for machine %s: %v", machineID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(channels)
+}
+
+// GetMachineChannelData returns the values of one channel, a fixed field such as
+// spindle_speed or an extra channel, within an optional time range (default: last 24h).
+func (h *APIHandler) GetMachineChannelData(w http.ResponseWriter, r *http.Request) {
+	// e.g. /api/v1/machines/CNC-001/channels/coolant_pressure/data
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 8 || pathParts[4] == "" || pathParts[6] == "" {
+		http.Error(w, "Machine ID or channel not provided", http.StatusBadRequest)
+		return
+	}
+	machineID, channel := pathParts[4], pathParts[6]
+
+	startTimeStr := r.URL.Query().Get("start_time")
+	endTimeStr := r.URL.Query().Get("end_time")
+	var startTime, endTime time.Time
+	var err error
+	if startTimeStr != "" {
+		startTime, err = time.Parse(time.RFC3339, startTimeStr)
+		if err != nil { http.Error(w, "Invalid start_time", http.StatusBadRequest); return }
+	} else {
+		startTime = time.Now().Add(-24 * time.Hour)
+	}
+	if endTimeStr != "" {
+		endTime, err = time.Parse(time.RFC3339, endTimeStr)
+		if err != nil { http.Error(w, "Invalid end_time", http.StatusBadRequest); return }
+	} else {
+		endTime = time.Now().Add(1 * time.Hour)
+	}
+
+	points, err := h.repo.GetChannelData(r.Context(), machineID, channel, startTime, endTime)
+	if err != nil {
+		log.Printf("Error getting channel %s for machine %s: %v", channel, machineID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(points)
+}
+
 // GetDNCTransfers lists recent DNC transfers within an optional time range and optional limit
 func (h *APIHandler) GetDNCTransfers(w http.ResponseWriter, r *http.Request) {
 	startTimeStr := r.URL.Query().Get("start_time")
@@ -154,3 +216,229 @@ func (h *APIHandler) GetDNCTransferEvents(w http.ResponseWriter, r *http.Request
 	if err != nil { http.Error(w, err.Error(), http.StatusInternalServerError); return }
 	json.NewEncoder(w).Encode(events)
 }
+
+// GetDNCTransferTimeline returns per-program-line telemetry aggregates for a transfer
+func (h *APIHandler) GetDNCTransferTimeline(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 7 || pathParts[5] == "" {
+		http.Error(w, "Transfer ID not provided", http.StatusBadRequest)
+		return
+	}
+	transferID := pathParts[5]
+
+	timeline, err := h.repo.GetDNCTransferTimeline(r.Context(), transferID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Transfer not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error building timeline for transfer %s: %v", transferID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(timeline)
+}
+
+// GetDNCAnalytics reports transfer success rates, durations and top errors grouped by
+// machine, program and/or mode (e.g. ?group_by=machine,mode). Defaults to the last 7 days.
+func (h *APIHandler) GetDNCAnalytics(w http.ResponseWriter, r *http.Request) {
+	startTimeStr := r.URL.Query().Get("start_time")
+	endTimeStr := r.URL.Query().Get("end_time")
+	topErrorsStr := r.URL.Query().Get("top_errors")
+
+	dims, err := ingestion.ParseDNCGroupBy(r.URL.Query().Get("group_by"))
+	if err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+
+	var startTime, endTime time.Time
+	if startTimeStr != "" {
+		startTime, err = time.Parse(time.RFC3339, startTimeStr)
+		if err != nil { http.Error(w, "Invalid start_time", http.StatusBadRequest); return }
+	} else {
+		startTime = time.Now().Add(-7 * 24 * time.Hour)
+	}
+	if endTimeStr != "" {
+		endTime, err = time.Parse(time.RFC3339, endTimeStr)
+		if err != nil { http.Error(w, "Invalid end_time", http.StatusBadRequest); return }
+	} else {
+		endTime = time.Now().Add(1 * time.Hour)
+	}
+	topErrors := 5
+	if topErrorsStr != "" {
+		if v, err := strconv.Atoi(topErrorsStr); err == nil { topErrors = v }
+	}
+
+	stats, err := h.repo.GetDNCTransferStats(r.Context(), dims, startTime, endTime, topErrors)
+	if err != nil {
+		log.Printf("Error computing DNC analytics: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+// prepareProgramRequest is the body accepted by PrepareProgram.
+type prepareProgramRequest struct {
+	ProgramName string `json:"program_name"`
+	Content     string `json:"content"`
+}
+
+// preparedProgram is the sanitized program returned by PrepareProgram.
+type preparedProgram struct {
+	MachineID   string                    `json:"machine_id"`
+	ProgramName string                    `json:"program_name"`
+	Dialect     string                    `json:"dialect"`
+	Content     string                    `json:"content"`
+	Ready       bool                      `json:"ready"`
+	Result      *ncprogram.SanitizeResult `json:"result"`
+}
+
+// PrepareProgram sanitizes an NC program for the machine's controller before it is sent via DNC.
+// The dialect (HEIDENHAIN, Fanuc, Siemens, ...) is picked from the machine's controller_type.
+func (h *APIHandler) PrepareProgram(w http.ResponseWriter, r *http.Request) {
+	// e.g. /api/v1/machines/CNC-001/programs/prepare
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 7 || pathParts[4] == "" {
+		http.Error(w, "Machine ID not provided", http.StatusBadRequest)
+		return
+	}
+	machineID := pathParts[4]
+
+	var req prepareProgramRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	machine, err := h.repo.GetMachine(r.Context(), machineID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Machine not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dialect := ncprogram.ForController(machine.ControllerType)
+	content, result := dialect.Sanitize(req.Content)
+
+	json.NewEncoder(w).Encode(preparedProgram{
+		MachineID:   machine.ID,
+		ProgramName: req.ProgramName,
+		Dialect:     dialect.Name(),
+		Content:     content,
+		Ready:       !result.HasErrors(),
+		Result:      result,
+	})
+}
+
+// commandTimeout is how long SendAgentCommand waits for the agent's answer.
+const commandTimeout = 15 * time.Second
+
+// GetMachineAgent returns the desired configuration of a machine's agent and
+// the version the agent last reported applying.
+func (h *APIHandler) GetMachineAgent(w http.ResponseWriter, r *http.Request) {
+	// e.g. /api/v1/machines/CNC-001/agent
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 6 || pathParts[4] == "" {
+		http.Error(w, "Machine ID not provided", http.StatusBadRequest)
+		return
+	}
+	machineID := pathParts[4]
+
+	cfg, err := h.repo.GetAgentConfig(r.Context(), machineID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "No agent configuration for machine", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error getting agent config for machine %s: %v", machineID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// agentConfigRequest is the body accepted by SetMachineAgentConfig.
+type agentConfigRequest struct {
+	// Settings in the layout of edge-config.yaml, applied over the agent's
+	// config file
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// SetMachineAgentConfig replaces the desired configuration of a machine's
+// agent and pushes it to the agent. Whether the agent applied it shows up in
+// GetMachineAgent once the agent reports back.
+func (h *APIHandler) SetMachineAgentConfig(w http.ResponseWriter, r *http.Request) {
+	// e.g. /api/v1/machines/CNC-001/agent/config
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 7 || pathParts[4] == "" {
+		http.Error(w, "Machine ID not provided", http.StatusBadRequest)
+		return
+	}
+	machineID := pathParts[4]
+	if h.agents == nil {
+		http.Error(w, "Agent control not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req agentConfigRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Settings == nil {
+		http.Error(w, "settings not provided", http.StatusBadRequest)
+		return
+	}
+
+	cfg, err := h.agents.SetDesiredConfig(r.Context(), machineID, req.Settings)
+	if err != nil {
+		log.Printf("Error setting agent config for machine %s: %v", machineID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// SendAgentCommand sends a command to a machine's agent and returns its result.
+func (h *APIHandler) SendAgentCommand(w http.ResponseWriter, r *http.Request) {
+	// e.g. /api/v1/machines/CNC-001/agent/commands
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 7 || pathParts[4] == "" {
+		http.Error(w, "Machine ID not provided", http.StatusBadRequest)
+		return
+	}
+	machineID := pathParts[4]
+	if h.agents == nil {
+		http.Error(w, "Agent control not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var cmd contract.Command
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := cmd.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), commandTimeout)
+	defer cancel()
+	result, err := h.agents.SendCommand(ctx, machineID, cmd)
+	switch {
+	case errors.Is(err, ingestion.ErrAgentOffline):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Agent did not answer in time", http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		log.Printf("Error sending %s to machine %s: %v", cmd.Name, machineID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
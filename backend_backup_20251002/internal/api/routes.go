@@ -10,10 +10,20 @@ func NewRouter(handler *APIHandler) *http.ServeMux {
 	mux.HandleFunc("GET /api/v1/machines", handler.GetMachines)
 	mux.HandleFunc("POST /api/v1/machines", handler.CreateMachine)
 	mux.HandleFunc("GET /api/v1/machines/{id}/data", handler.GetMachineData)
+	mux.HandleFunc("GET /api/v1/machines/{id}/channels", handler.GetMachineChannels)
+	mux.HandleFunc("GET /api/v1/machines/{id}/channels/{channel}/data", handler.GetMachineChannelData)
+	mux.HandleFunc("POST /api/v1/machines/{id}/programs/prepare", handler.PrepareProgram)
+
+	// Remote agent management
+	mux.HandleFunc("GET /api/v1/machines/{id}/agent", handler.GetMachineAgent)
+	mux.HandleFunc("PUT /api/v1/machines/{id}/agent/config", handler.SetMachineAgentConfig)
+	mux.HandleFunc("POST /api/v1/machines/{id}/agent/commands", handler.SendAgentCommand)
 
 	// DNC history
 	mux.HandleFunc("GET /api/v1/dnc/transfers", handler.GetDNCTransfers)
 	mux.HandleFunc("GET /api/v1/dnc/transfers/{id}/events", handler.GetDNCTransferEvents)
+	mux.HandleFunc("GET /api/v1/dnc/transfers/{id}/timeline", handler.GetDNCTransferTimeline)
+	mux.HandleFunc("GET /api/v1/dnc/analytics", handler.GetDNCAnalytics)
 
 	return mux
 }
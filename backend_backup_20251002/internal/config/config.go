@@ -4,7 +4,9 @@ package config
 import (
 	"log"
 	"strings"
+	"time"
 
+	"cnc-monitor/contract"
 	"github.com/spf13/viper"
 )
 
@@ -27,9 +29,36 @@ type DBConfig struct {
 }
 
 type NATSConfig struct {
-	URL          string `mapstructure:"url"`
-	StreamName   string `mapstructure:"stream_name"`
-	ConsumerName string `mapstructure:"consumer_name"`
+	URL           string       `mapstructure:"url"`
+	StreamName    string       `mapstructure:"stream_name"`
+	ConsumerName  string       `mapstructure:"consumer_name"`
+	SubjectPrefix string       `mapstructure:"subject_prefix"` // Edge agents publish under <prefix>.<machine_id>.>
+	Credentials   string       `mapstructure:"credentials"`    // .creds file for the backend's NATS user
+	ConfigBucket  string       `mapstructure:"config_bucket"`  // Key-value bucket holding the agents' desired configuration
+	TLS           TLSConfig    `mapstructure:"tls"`
+	Stream        StreamConfig `mapstructure:"stream"`
+}
+
+// StreamConfig sets the limits of the shared stream (see contract.StreamSpec).
+// The backend creates the stream when it is missing; an existing stream that
+// differs is only changed when Update is set, otherwise the drift is logged.
+type StreamConfig struct {
+	Retention  string        `mapstructure:"retention"` // limits, interest or workqueue
+	MaxAge     time.Duration `mapstructure:"max_age"`   // 0 keeps messages forever
+	MaxBytes   int64         `mapstructure:"max_bytes"` // 0 for no size limit
+	Replicas   int           `mapstructure:"replicas"`
+	Duplicates time.Duration `mapstructure:"duplicates"` // Nats-Msg-Id deduplication window
+	Update     bool          `mapstructure:"update"`     // Apply this config to an existing stream
+}
+
+// TLSConfig configures TLS and mutual TLS to the NATS server. Certificate files
+// are watched and reloaded when they change.
+type TLSConfig struct {
+	Enabled    bool   `mapstructure:"enabled"`
+	CAFile     string `mapstructure:"ca_file"`     // CA bundle used to verify the server; system roots if empty
+	CertFile   string `mapstructure:"cert_file"`   // Client certificate for mutual TLS
+	KeyFile    string `mapstructure:"key_file"`    // Client key for mutual TLS
+	ServerName string `mapstructure:"server_name"` // Overrides the host name verified against the server certificate
 }
 
 func LoadConfig() (*Config, error) {
@@ -42,6 +71,24 @@ func LoadConfig() (*Config, error) {
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
+	// Keys must be known to viper for environment overrides (e.g. NATS_TLS_ENABLED)
+	// to apply when they are absent from the config file.
+	viper.SetDefault("nats.stream_name", contract.DefaultStream)
+	viper.SetDefault("nats.subject_prefix", contract.DefaultSubjectPrefix)
+	viper.SetDefault("nats.stream.retention", contract.RetentionLimits)
+	viper.SetDefault("nats.stream.max_age", contract.DefaultMaxAge)
+	viper.SetDefault("nats.stream.max_bytes", 0)
+	viper.SetDefault("nats.stream.replicas", contract.DefaultReplicas)
+	viper.SetDefault("nats.stream.duplicates", contract.DefaultDuplicates)
+	viper.SetDefault("nats.stream.update", false)
+	viper.SetDefault("nats.credentials", "")
+	viper.SetDefault("nats.config_bucket", contract.DefaultConfigBucket)
+	viper.SetDefault("nats.tls.enabled", false)
+	viper.SetDefault("nats.tls.ca_file", "")
+	viper.SetDefault("nats.tls.cert_file", "")
+	viper.SetDefault("nats.tls.key_file", "")
+	viper.SetDefault("nats.tls.server_name", "")
+
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
 			log.Println("Config file not found; using environment variables")
@@ -57,3 +104,15 @@ func LoadConfig() (*Config, error) {
 
 	return &cfg, nil
 }
+
+// StreamSpec returns the stream the backend expects, from the contract and the
+// configured limits.
+func (c NATSConfig) StreamSpec() contract.StreamSpec {
+	spec := contract.NewStreamSpec(c.StreamName, c.SubjectPrefix)
+	spec.Retention = c.Stream.Retention
+	spec.MaxAge = c.Stream.MaxAge
+	spec.MaxBytes = c.Stream.MaxBytes
+	spec.Replicas = c.Stream.Replicas
+	spec.Duplicates = c.Stream.Duplicates
+	return spec
+}
@@ -0,0 +1,150 @@
+// internal/ingestion/agentcontrol.go
+package ingestion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/internal/config"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ErrAgentOffline is returned when no agent answers on a machine's command
+// subject.
+var ErrAgentOffline = errors.New("agent is not connected")
+
+// AgentControl manages the agents remotely. The desired configuration of each
+// machine is stored in the database and pushed to the config bucket, which the
+// agent watches; commands are sent as requests on the machine's command
+// subject. What the agents report back is handled by StatusService.
+type AgentControl struct {
+	nc   *nats.Conn
+	js   jetstream.JetStream
+	repo *Repository
+	cfg  config.NATSConfig
+
+	mu sync.Mutex
+	kv jetstream.KeyValue
+}
+
+func NewAgentControl(nc *nats.Conn, js jetstream.JetStream, repo *Repository, cfg config.NATSConfig) *AgentControl {
+	return &AgentControl{nc: nc, js: js, repo: repo, cfg: cfg}
+}
+
+// bucket returns the config bucket, creating it if it does not exist.
+func (a *AgentControl) bucket(ctx context.Context) (jetstream.KeyValue, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.kv != nil {
+		return a.kv, nil
+	}
+	kv, err := a.js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:      a.cfg.ConfigBucket,
+		Description: "Desired configuration of the edge agents, by machine ID",
+		History:     5,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("config bucket %s: %w", a.cfg.ConfigBucket, err)
+	}
+	a.kv = kv
+	return kv, nil
+}
+
+// SetDesiredConfig stores new settings for a machine's agent and pushes them
+// to the agent. The agent reports whether it applied them. The new version is
+// pushed before it is committed, so the database never holds a version the
+// bucket does not; if the commit fails, the stored version is pushed again.
+func (a *AgentControl) SetDesiredConfig(ctx context.Context, machineID string, settings map[string]interface{}) (*AgentConfig, error) {
+	kv, err := a.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	published := false
+	cfg, err := a.repo.SetDesiredAgentConfig(ctx, machineID, settings, func(cfg *AgentConfig) error {
+		if err := putDesiredConfig(ctx, kv, cfg); err != nil {
+			return fmt.Errorf("could not publish config version %d: %w", cfg.Version, err)
+		}
+		published = true
+		return nil
+	})
+	if err != nil {
+		if published {
+			a.restoreDesiredConfig(ctx, kv, machineID)
+		}
+		return nil, err
+	}
+	log.Printf("Agent control: published config version %d for %s", cfg.Version, machineID)
+	return cfg, nil
+}
+
+// restoreDesiredConfig puts the stored configuration of machineID back into
+// the bucket after a published version failed to commit, or removes the key
+// if none is stored.
+func (a *AgentControl) restoreDesiredConfig(ctx context.Context, kv jetstream.KeyValue, machineID string) {
+	cfg, err := a.repo.GetAgentConfig(ctx, machineID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		err = kv.Delete(ctx, machineID)
+	case err == nil && cfg.Version > 0:
+		err = putDesiredConfig(ctx, kv, cfg)
+	case err == nil:
+		err = kv.Delete(ctx, machineID)
+	}
+	if err != nil {
+		log.Printf("Agent control: bucket holds an uncommitted config for %s: %v", machineID, err)
+	}
+}
+
+func putDesiredConfig(ctx context.Context, kv jetstream.KeyValue, cfg *AgentConfig) error {
+	doc, err := json.Marshal(contract.DesiredConfig{
+		MachineID: cfg.MachineID,
+		Version:   cfg.Version,
+		UpdatedAt: cfg.UpdatedAt,
+		Settings:  cfg.Settings,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = kv.Put(ctx, cfg.MachineID, doc)
+	return err
+}
+
+// SendCommand sends a command to a machine's agent and waits for its result
+// until ctx ends. It returns ErrAgentOffline if the agent is not connected.
+func (a *AgentControl) SendCommand(ctx context.Context, machineID string, cmd contract.Command) (*contract.CommandResult, error) {
+	if err := cmd.Validate(); err != nil {
+		return nil, err
+	}
+	if cmd.ID == "" {
+		cmd.ID = uuid.New().String()
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := contract.Subject(a.cfg.SubjectPrefix, machineID, contract.KindCommand)
+	start := time.Now()
+	msg, err := a.nc.RequestWithContext(ctx, subject, data)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return nil, ErrAgentOffline
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result contract.CommandResult
+	if err := json.Unmarshal(msg.Data, &result); err != nil {
+		return nil, fmt.Errorf("bad answer from agent %s: %w", machineID, err)
+	}
+	log.Printf("Agent control: %s on %s took %v (ok=%t)", cmd.Name, machineID, time.Since(start), result.OK)
+	return &result, nil
+}
@@ -0,0 +1,41 @@
+// internal/ingestion/compression.go
+package ingestion
+
+import (
+	"fmt"
+
+	"cnc-monitor/contract"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxDecodedSize bounds decompressed bodies so a corrupt or hostile message cannot
+// exhaust memory. Edge batches are capped well below this before compression.
+const maxDecodedSize = 64 * 1024 * 1024
+
+// zstdDecoder is safe for concurrent DecodeAll calls.
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecodedSize))
+
+// decodeBody returns the message body decompressed according to encoding, the
+// value of its contract.ContentEncodingHeader. The edge agent sets it on batches
+// above its compression threshold; an empty encoding means the body is not
+// compressed.
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case contract.ContentEncodingZstd:
+		return zstdDecoder.DecodeAll(body, nil)
+	case contract.ContentEncodingS2:
+		n, err := s2.DecodedLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxDecodedSize {
+			return nil, fmt.Errorf("s2 body decodes to %d bytes, limit is %d", n, maxDecodedSize)
+		}
+		return s2.Decode(nil, body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
@@ -0,0 +1,71 @@
+package ingestion
+
+import (
+	"bytes"
+	"testing"
+
+	"cnc-monitor/contract"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecodeBody(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"machine_id":"M","temperature":21.5}`), 300)
+	zstdEncoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zstdEncoder.Close()
+
+	for _, tt := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{"", body},
+		{"identity", body},
+		{contract.ContentEncodingZstd, zstdEncoder.EncodeAll(body, nil)},
+		{contract.ContentEncodingS2, s2.Encode(nil, body)},
+	} {
+		got, err := decodeBody(tt.encoding, tt.body)
+		if err != nil {
+			t.Errorf("%q: %v", tt.encoding, err)
+			continue
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("%q: body does not round-trip", tt.encoding)
+		}
+	}
+
+	if _, err := decodeBody("gzip", body); err == nil {
+		t.Error("gzip body accepted")
+	}
+	if _, err := decodeBody(contract.ContentEncodingZstd, body); err == nil {
+		t.Error("plain body accepted as zstd")
+	}
+}
+
+func TestDecodeBodyLimit(t *testing.T) {
+	// Highly compressible bodies that decode to more than maxDecodedSize
+	huge := make([]byte, maxDecodedSize+1)
+	zstdEncoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zstdEncoder.Close()
+
+	for encoding, body := range map[string][]byte{
+		contract.ContentEncodingZstd: zstdEncoder.EncodeAll(huge, nil),
+		contract.ContentEncodingS2:   s2.Encode(nil, huge),
+	} {
+		if _, err := decodeBody(encoding, body); err == nil {
+			t.Errorf("%s body of %d bytes decoded past the limit", encoding, len(huge))
+		}
+	}
+
+	// At the limit bodies still decode
+	fits := huge[:maxDecodedSize]
+	got, err := decodeBody(contract.ContentEncodingS2, s2.Encode(nil, fits))
+	if err != nil || len(got) != maxDecodedSize {
+		t.Errorf("s2 body at the limit: %d bytes, %v", len(got), err)
+	}
+}
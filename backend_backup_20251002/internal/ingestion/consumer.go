@@ -4,13 +4,13 @@ package ingestion
 import (
 	"context"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"log"
 	"os"
 	"time"
 
 	"github.com/nats-io/nats.go/jetstream"
+	"cnc-monitor/contract"
 	"cnc-monitor/internal/config"
 )
 
@@ -34,24 +34,16 @@ func NewService(js jetstream.JetStream, repo *Repository, cfg config.NATSConfig)
 
 // Run starts the ingestion service consumer.
 func (s *Service) Run(ctx context.Context) {
-	// Create the stream if it doesn't exist.
-	stream, err := s.js.CreateStream(ctx, jetstream.StreamConfig{
-		Name:     s.cfg.StreamName,
-		Subjects: []string{s.cfg.StreamName + ".>"}, // e.g., "CNC_DATA.>"
-	})
+	stream, err := EnsureStream(ctx, s.js, s.cfg)
 	if err != nil {
-		log.Printf("could not create stream, will try to use existing: %v", err)
-		// Try to get existing stream
-		stream, err = s.js.Stream(ctx, s.cfg.StreamName)
-		if err != nil {
-			log.Fatalf("failed to get stream: %v", err)
-		}
+		log.Fatalf("failed to set up stream: %v", err)
 	}
 
-	// Create a durable, pull-based consumer.
+	// Create a durable, pull-based consumer for telemetry from all machines.
 	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		Durable:   s.cfg.ConsumerName,
-		AckPolicy: jetstream.AckExplicitPolicy,
+		Durable:       s.cfg.ConsumerName,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		FilterSubject: contract.FilterSubject(s.cfg.SubjectPrefix, contract.KindTelemetry),
 	})
 	if err != nil {
 		log.Fatalf("failed to create consumer: %v", err)
@@ -112,10 +104,22 @@ func (s *Service) Run(ctx context.Context) {
 // It returns a non-nil error only for retriable issues (e.g., database connection).
 // Malformed messages are terminated and errMessageTerminated is returned.
 func (s *Service) processMessage(ctx context.Context, msg jetstream.Msg) error {
-	// Debug (guarded): Log the raw message data
-	rawData := msg.Data()
+	// Agents may only publish under their own machine token (enforced by their
+	// NATS permissions); a sample claiming another machine is spoofed or misrouted.
+	subjectMachine, _, fromEdge := contract.ParseSubject(s.cfg.SubjectPrefix, msg.Subject())
+
+	encoding := msg.Headers().Get(contract.ContentEncodingHeader)
+	sampleEncoding := msg.Headers().Get(contract.SampleEncodingHeader)
+	rawData, err := decodeBody(encoding, msg.Data())
+	if err != nil {
+		log.Printf("Error decoding %s message body: %v. Message will be terminated.", encoding, err)
+		if termErr := msg.Term(); termErr != nil {
+			log.Printf("Failed to terminate message: %v", termErr)
+		}
+		return errMessageTerminated
+	}
 	if os.Getenv("CNC_DEBUG") != "" {
-		log.Printf("DEBUG: Received message length=%d, data=%q", len(rawData), string(rawData))
+		log.Printf("DEBUG: Received message encoding=%q length=%d (wire %d), data=%q", encoding, len(rawData), len(msg.Data()), string(rawData))
 	}
 
 	offset := 0
@@ -130,27 +134,27 @@ func (s *Service) processMessage(ctx context.Context, msg jetstream.Msg) error {
 		}
 
 		// Extract the 4-byte length prefix
-		jsonLen := binary.BigEndian.Uint32(rawData[offset : offset+4])
+		frameLen := binary.BigEndian.Uint32(rawData[offset : offset+4])
 		offset += 4
 
-		// Ensure the rawData contains the full JSON payload as indicated by jsonLen
-		if uint32(len(rawData)-offset) < jsonLen {
-			log.Printf("Error: Received message length mismatch. Expected %d bytes, got %d bytes after prefix. Message will be terminated.", jsonLen, len(rawData)-offset)
+		// Ensure the rawData contains the full payload as indicated by frameLen
+		if uint32(len(rawData)-offset) < frameLen {
+			log.Printf("Error: Received message length mismatch. Expected %d bytes, got %d bytes after prefix. Message will be terminated.", frameLen, len(rawData)-offset)
 			if termErr := msg.Term(); termErr != nil {
 				log.Printf("Failed to terminate message: %v", termErr)
 			}
 			return errMessageTerminated
 		}
 
-		// Extract the actual JSON payload
-		jsonPayload := rawData[offset : offset+int(jsonLen)]
-		offset += int(jsonLen)
+		// Extract the frame payload
+		payload := rawData[offset : offset+int(frameLen)]
+		offset += int(frameLen)
 
-		var data SensorData
-		if err := json.Unmarshal(jsonPayload, &data); err != nil {
-			log.Printf("Error unmarshalling message data: %v. Message will be terminated.", err)
+		data, err := decodeSample(sampleEncoding, payload)
+		if err != nil {
+			log.Printf("Error decoding %q message data: %v. Message will be terminated.", sampleEncoding, err)
 			if os.Getenv("CNC_DEBUG") != "" {
-				log.Printf("DEBUG: Failed JSON data: %q", string(jsonPayload))
+				log.Printf("DEBUG: Failed frame data: %q", string(payload))
 			}
 			// Terminate the message if it's malformed to prevent redelivery loops.
 			if termErr := msg.Term(); termErr != nil {
@@ -167,7 +171,7 @@ func (s *Service) processMessage(ctx context.Context, msg jetstream.Msg) error {
 
 		// Validate sequence number is not zero
 		if data.SequenceNumber == 0 {
-			log.Printf("ERROR: Sequence number is zero after unmarshaling. JSON: %q", string(jsonPayload))
+			log.Printf("ERROR: Sequence number is zero after decoding. Frame: %q", string(payload))
 			// Terminate the message as this indicates a data integrity issue
 			if termErr := msg.Term(); termErr != nil {
 				log.Printf("Failed to terminate message: %v", termErr)
@@ -175,14 +179,32 @@ func (s *Service) processMessage(ctx context.Context, msg jetstream.Msg) error {
 			return errMessageTerminated
 		}
 
+		if fromEdge && data.MachineID != subjectMachine {
+			log.Printf("ERROR: Sample for machine %q published on subject %q of machine %q. Message will be terminated.", data.MachineID, msg.Subject(), subjectMachine)
+			if termErr := msg.Term(); termErr != nil {
+				log.Printf("Failed to terminate message: %v", termErr)
+			}
+			return errMessageTerminated
+		}
+
 		// Persist the data using the repository.
-		if err := s.repo.InsertSensorData(ctx, data); err != nil {
+		outcome, err := s.repo.InsertSensorData(ctx, data)
+		if err != nil {
 			// This is a potentially transient error (e.g., DB down), so we return it
 			// to the caller, which will NAK the message for redelivery.
 			return err
 		}
 
-		log.Printf("Successfully processed and stored data for machine: %s", data.MachineID)
+		switch outcome {
+		case Duplicate:
+			if os.Getenv("CNC_DEBUG") != "" {
+				log.Printf("DEBUG: Duplicate reading ignored - MachineID: %s, SequenceNumber: %d", data.MachineID, data.SequenceNumber)
+			}
+		case SequenceConflict:
+			log.Printf("ERROR: Machine %s reused sequence number %d for a different reading (timestamp %s); kept in sensor_data_conflicts", data.MachineID, data.SequenceNumber, data.Timestamp)
+		default:
+			log.Printf("Successfully processed and stored data for machine: %s", data.MachineID)
+		}
 	}
 
 	return nil
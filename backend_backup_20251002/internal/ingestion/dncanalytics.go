@@ -0,0 +1,181 @@
+// internal/ingestion/dncanalytics.go
+package ingestion
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DNCTransferStats aggregates transfer outcomes for one group (machine, program and/or mode).
+// Dimensions that are not part of the grouping are left empty.
+type DNCTransferStats struct {
+	MachineID         string          `json:"machine_id,omitempty"`
+	ProgramName       string          `json:"program_name,omitempty"`
+	Mode              string          `json:"mode,omitempty"`
+	Total             int             `json:"total"`
+	Completed         int             `json:"completed"`
+	Errored           int             `json:"errored"`
+	Canceled          int             `json:"canceled"`
+	InProgress        int             `json:"in_progress"`
+	CompletionRate    float64         `json:"completion_rate"`
+	ErrorRate         float64         `json:"error_rate"`
+	CancelRate        float64         `json:"cancel_rate"`
+	MedianDurationSec float64         `json:"median_duration_sec"`
+	P95DurationSec    float64         `json:"p95_duration_sec"`
+	AvgLinesPerSec    float64         `json:"avg_lines_per_sec"`
+	TopErrors         []DNCErrorCount `json:"top_errors"`
+}
+
+// DNCErrorCount is an error string and the number of transfers that reported it.
+type DNCErrorCount struct {
+	Error     string `json:"error"`
+	Transfers int    `json:"transfers"`
+}
+
+// dncGroupColumns maps the supported group_by dimensions to columns of the dncTransferSet CTE.
+var dncGroupColumns = map[string]string{
+	"machine": "machine_id",
+	"program": "program_name",
+	"mode":    "mode",
+}
+
+// dncTransferSet selects the transfers in [$1, $2] with normalized dimensions.
+// BCC modes are block-by-block (drip) feeds, so they are reported together as "drip".
+const dncTransferSet = `
+	tr AS (
+		SELECT t.transfer_id, t.machine_id,
+			COALESCE(t.program_name, '') AS program_name,
+			CASE WHEN t.mode IN ('bcc', 'bcc_listen') THEN 'drip' ELSE COALESCE(NULLIF(t.mode, ''), 'unknown') END AS mode,
+			t.status,
+			EXTRACT(EPOCH FROM (t.completed_at - t.started_at))::DOUBLE PRECISION AS duration_sec,
+			(SELECT MAX(e.line) FROM dnc_events e WHERE e.transfer_id = t.transfer_id) AS lines_sent
+		FROM dnc_transfers t
+		WHERE t.started_at BETWEEN $1 AND $2
+	)`
+
+// ParseDNCGroupBy validates a comma separated group_by value such as "machine,program".
+func ParseDNCGroupBy(groupBy string) ([]string, error) {
+	if strings.TrimSpace(groupBy) == "" {
+		return []string{"machine"}, nil
+	}
+	var dims []string
+	seen := make(map[string]bool)
+	for _, d := range strings.Split(groupBy, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if _, ok := dncGroupColumns[d]; !ok {
+			return nil, fmt.Errorf("unsupported group_by dimension %q (use machine, program or mode)", d)
+		}
+		if !seen[d] {
+			seen[d] = true
+			dims = append(dims, d)
+		}
+	}
+	return dims, nil
+}
+
+// dncGroupSelect returns the select list for machine/program/mode and the GROUP BY list
+// for the requested dimensions, qualified with prefix. Ungrouped dimensions are selected
+// as empty strings.
+func dncGroupSelect(dims []string, prefix string) (string, string) {
+	grouped := make(map[string]bool, len(dims))
+	for _, d := range dims {
+		grouped[d] = true
+	}
+	var sel, group []string
+	for _, d := range []string{"machine", "program", "mode"} {
+		name := dncGroupColumns[d]
+		if grouped[d] {
+			sel = append(sel, prefix+name+" AS "+name)
+			group = append(group, prefix+name)
+		} else {
+			sel = append(sel, "''::TEXT AS "+name)
+		}
+	}
+	return strings.Join(sel, ", "), strings.Join(group, ", ")
+}
+
+// GetDNCTransferStats reports completion, error and cancel rates, duration percentiles,
+// throughput and the most frequent errors for transfers started in the time range,
+// grouped by the given dimensions (see ParseDNCGroupBy).
+func (r *Repository) GetDNCTransferStats(ctx context.Context, dims []string, startTime, endTime time.Time, topErrors int) ([]DNCTransferStats, error) {
+	if len(dims) == 0 {
+		dims = []string{"machine"}
+	}
+	if topErrors <= 0 || topErrors > 50 {
+		topErrors = 5
+	}
+	sel, group := dncGroupSelect(dims, "")
+
+	query := `WITH ` + dncTransferSet + `
+		SELECT ` + sel + `,
+			COUNT(*),
+			COUNT(*) FILTER (WHERE status = 'completed'),
+			COUNT(*) FILTER (WHERE status = 'error'),
+			COUNT(*) FILTER (WHERE status = 'canceled'),
+			COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY duration_sec) FILTER (WHERE status = 'completed'), 0),
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY duration_sec) FILTER (WHERE status = 'completed'), 0),
+			COALESCE(AVG(lines_sent / NULLIF(duration_sec, 0)) FILTER (WHERE status = 'completed'), 0)
+		FROM tr
+		GROUP BY ` + group + `
+		ORDER BY COUNT(*) DESC`
+	rows, err := r.db.Query(ctx, query, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []DNCTransferStats
+	index := make(map[string]int)
+	for rows.Next() {
+		var s DNCTransferStats
+		if err := rows.Scan(&s.MachineID, &s.ProgramName, &s.Mode, &s.Total, &s.Completed, &s.Errored, &s.Canceled, &s.MedianDurationSec, &s.P95DurationSec, &s.AvgLinesPerSec); err != nil {
+			return nil, err
+		}
+		s.InProgress = s.Total - s.Completed - s.Errored - s.Canceled
+		if s.Total > 0 {
+			s.CompletionRate = float64(s.Completed) / float64(s.Total)
+			s.ErrorRate = float64(s.Errored) / float64(s.Total)
+			s.CancelRate = float64(s.Canceled) / float64(s.Total)
+		}
+		s.TopErrors = []DNCErrorCount{}
+		index[dncGroupKey(s.MachineID, s.ProgramName, s.Mode)] = len(out)
+		out = append(out, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	trSel, trGroup := dncGroupSelect(dims, "tr.")
+	errQuery := `WITH ` + dncTransferSet + `,
+		errs AS (
+			SELECT ` + trSel + `, e.error, COUNT(DISTINCT e.transfer_id) AS transfers,
+				ROW_NUMBER() OVER (PARTITION BY ` + trGroup + ` ORDER BY COUNT(DISTINCT e.transfer_id) DESC, e.error) AS error_rank
+			FROM tr
+			JOIN dnc_events e ON e.transfer_id = tr.transfer_id
+			WHERE e.error IS NOT NULL AND e.error <> ''
+			GROUP BY ` + trGroup + `, e.error
+		)
+		SELECT machine_id, program_name, mode, error, transfers FROM errs WHERE error_rank <= $3`
+	errRows, err := r.db.Query(ctx, errQuery, startTime, endTime, topErrors)
+	if err != nil {
+		return nil, err
+	}
+	defer errRows.Close()
+	for errRows.Next() {
+		var machineID, programName, mode string
+		var ec DNCErrorCount
+		if err := errRows.Scan(&machineID, &programName, &mode, &ec.Error, &ec.Transfers); err != nil {
+			return nil, err
+		}
+		if i, ok := index[dncGroupKey(machineID, programName, mode)]; ok {
+			out[i].TopErrors = append(out[i].TopErrors, ec)
+		}
+	}
+	return out, errRows.Err()
+}
+
+func dncGroupKey(machineID, programName, mode string) string {
+	return machineID + "\x00" + programName + "\x00" + mode
+}
@@ -0,0 +1,291 @@
+package ingestion
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// dncServiceEvents returns the events the DNC service publishes for four
+// transfers of one program: one completed in 30s, one failed, one canceled
+// and one still running. They are in the service's wire format.
+func dncServiceEvents(machineID string, start time.Time) (ids []string, payloads []string) {
+	ts := func(sec int) string { return start.Add(time.Duration(sec) * time.Second).Format(time.RFC3339) }
+	event := func(id, event, state string, line int, sec int, errText string) string {
+		e := map[string]interface{}{
+			"transfer_id":  id,
+			"machine_id":   machineID,
+			"program_name": "PART.H",
+			"mode":         "bcc_listen",
+			"state":        state,
+			"line":         line,
+			"lines_total":  3,
+			"bytes_sent":   0,
+			"rate_lps":     0.1,
+			"eta_sec":      nil,
+			"event":        event,
+			"error":        nil,
+			"ts":           ts(sec),
+		}
+		if errText != "" {
+			e["error"] = errText
+		}
+		b, _ := json.Marshal(e)
+		return string(b)
+	}
+	for i := 0; i < 4; i++ {
+		ids = append(ids, uuid.New().String())
+	}
+	completed, failed, canceled, running := ids[0], ids[1], ids[2], ids[3]
+	payloads = []string{
+		event(completed, "start", "running", 0, 0, ""),
+		event(completed, "ack", "running", 1, 10, ""),
+		event(completed, "ack", "running", 2, 20, ""),
+		event(completed, "ack", "running", 3, 29, ""),
+		event(completed, "completed", "completed", 3, 30, ""),
+		event(failed, "start", "running", 0, 100, ""),
+		event(failed, "ack", "running", 1, 105, ""),
+		event(failed, "error", "error", 1, 120, "sender exited rc=1: TimeoutError: No DC1 received"),
+		event(canceled, "start", "running", 0, 200, ""),
+		event(canceled, "ack", "running", 1, 210, ""),
+		event(canceled, "canceled", "canceled", 1, 215, ""),
+		event(running, "start", "running", 0, 300, ""),
+		event(running, "ack", "running", 1, 310, ""),
+	}
+	return ids, payloads
+}
+
+func decodeDNCEvent(t *testing.T, payload string) DNCEvent {
+	t.Helper()
+	var wire wireDNCEvent
+	if err := json.Unmarshal([]byte(payload), &wire); err != nil {
+		t.Fatalf("decode %s: %v", payload, err)
+	}
+	return wire.event(time.Time{})
+}
+
+func TestDNCServiceEventsFinishTransfers(t *testing.T) {
+	start := time.Date(2025, 10, 1, 8, 0, 0, 0, time.UTC)
+	ids, payloads := dncServiceEvents("CNC-001", start)
+
+	transfers := make(map[string]*DNCTransfer)
+	last := make(map[string]time.Time)
+	for _, p := range payloads {
+		ev := decodeDNCEvent(t, p)
+		tr := transfers[ev.TransferID]
+		if tr == nil {
+			tr = &DNCTransfer{}
+			transfers[ev.TransferID] = tr
+		}
+		last[ev.TransferID] = ApplyDNCEvent(tr, last[ev.TransferID], ev)
+	}
+
+	want := []struct {
+		status    string
+		completed time.Duration // after start; 0 means not completed
+	}{
+		{DNCStatusCompleted, 30 * time.Second},
+		{DNCStatusError, 120 * time.Second},
+		{DNCStatusCanceled, 215 * time.Second},
+		{DNCStatusRunning, 0},
+	}
+	for i, w := range want {
+		tr := transfers[ids[i]]
+		if tr.Status != w.status {
+			t.Errorf("transfer %d: status %q, want %q", i, tr.Status, w.status)
+		}
+		if w.completed == 0 {
+			if tr.CompletedAt != nil {
+				t.Errorf("transfer %d: completed at %v, want still running", i, tr.CompletedAt)
+			}
+			continue
+		}
+		if tr.CompletedAt == nil || !tr.CompletedAt.Equal(start.Add(w.completed)) {
+			t.Errorf("transfer %d: completed at %v, want %v", i, tr.CompletedAt, start.Add(w.completed))
+		}
+	}
+	if ev := decodeDNCEvent(t, payloads[7]); ev.Error == nil || !strings.Contains(*ev.Error, "No DC1") {
+		t.Errorf("error event lost its error text: %v", ev.Error)
+	}
+}
+
+// TestDNCTransferStats drives the DNC service's events for four transfers
+// through the repository and checks the analytics. It needs a scratch
+// database, see testDatabase.
+func TestDNCTransferStats(t *testing.T) {
+	pool := testDatabase(t)
+	ctx := context.Background()
+	repo := NewRepository(pool)
+	machineID := "TEST-" + uuid.New().String()
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	ids, payloads := dncServiceEvents(machineID, start)
+	t.Cleanup(func() {
+		pool.Exec(ctx, `DELETE FROM dnc_events WHERE machine_id = $1`, machineID)
+		pool.Exec(ctx, `DELETE FROM dnc_transfers WHERE machine_id = $1`, machineID)
+	})
+
+	// A redelivered terminal event must not count twice
+	payloads = append(payloads, payloads[4])
+	for _, p := range payloads {
+		if _, err := repo.RecordDNCEvent(ctx, decodeDNCEvent(t, p)); err != nil {
+			t.Fatalf("record event: %v", err)
+		}
+	}
+
+	tr, err := repo.GetDNCTransfer(ctx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Status != DNCStatusCompleted || tr.CompletedAt == nil {
+		t.Fatalf("transfer %+v, want completed", tr)
+	}
+
+	stats, err := repo.GetDNCTransferStats(ctx, []string{"machine", "program", "mode"}, start.Add(-time.Minute), start.Add(time.Hour), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *DNCTransferStats
+	for i := range stats {
+		if stats[i].MachineID == machineID {
+			got = &stats[i]
+		}
+	}
+	if got == nil {
+		t.Fatalf("no stats for %s in %+v", machineID, stats)
+	}
+
+	if got.ProgramName != "PART.H" || got.Mode != "drip" {
+		t.Errorf("group %s/%s, want PART.H/drip", got.ProgramName, got.Mode)
+	}
+	if got.Total != 4 || got.Completed != 1 || got.Errored != 1 || got.Canceled != 1 || got.InProgress != 1 {
+		t.Errorf("counts %+v, want 4 total, 1 of each outcome", got)
+	}
+	if got.CompletionRate != 0.25 || got.ErrorRate != 0.25 || got.CancelRate != 0.25 {
+		t.Errorf("rates %v/%v/%v, want 0.25 each", got.CompletionRate, got.ErrorRate, got.CancelRate)
+	}
+	if got.MedianDurationSec != 30 || got.P95DurationSec != 30 {
+		t.Errorf("durations %v/%v, want 30s", got.MedianDurationSec, got.P95DurationSec)
+	}
+	if got.AvgLinesPerSec != 0.1 {
+		t.Errorf("throughput %v lines/s, want 0.1", got.AvgLinesPerSec)
+	}
+	wantErrors := []DNCErrorCount{{Error: "sender exited rc=1: TimeoutError: No DC1 received", Transfers: 1}}
+	if len(got.TopErrors) != 1 || got.TopErrors[0] != wantErrors[0] {
+		t.Errorf("top errors %+v, want %+v", got.TopErrors, wantErrors)
+	}
+}
+
+// TestRecordDNCEventRedelivered records every event of a transfer twice, as
+// after a redelivery or a retried publish, and checks only one row is kept. It
+// needs a scratch database, see testDatabase.
+func TestRecordDNCEventRedelivered(t *testing.T) {
+	pool := testDatabase(t)
+	ctx := context.Background()
+	repo := NewRepository(pool)
+	machineID := "TEST-" + uuid.New().String()
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	ids, payloads := dncServiceEvents(machineID, start)
+	t.Cleanup(func() {
+		pool.Exec(ctx, `DELETE FROM dnc_events WHERE machine_id = $1`, machineID)
+		pool.Exec(ctx, `DELETE FROM dnc_transfers WHERE machine_id = $1`, machineID)
+	})
+
+	for _, p := range payloads[:5] { // The completed transfer
+		ev := decodeDNCEvent(t, p)
+		for i, want := range []bool{true, false} {
+			inserted, err := repo.RecordDNCEvent(ctx, ev)
+			if err != nil {
+				t.Fatalf("record event: %v", err)
+			}
+			if inserted != want {
+				t.Errorf("%s line %d, delivery %d: inserted %v, want %v", ev.Event, ev.Line, i+1, inserted, want)
+			}
+		}
+	}
+
+	var n int
+	if err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM dnc_events WHERE transfer_id = $1`, ids[0]).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("%d event rows, want 5", n)
+	}
+	tr, err := repo.GetDNCTransfer(ctx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Status != DNCStatusCompleted || tr.CompletedAt == nil || !tr.CompletedAt.Equal(start.Add(30*time.Second)) {
+		t.Errorf("transfer %+v, want completed after 30s", tr)
+	}
+}
+
+// TestDNCTransferTimelineWindow checks that lines the controller runs after a
+// transfer completed are still attributed to it. It needs a scratch database,
+// see testDatabase.
+func TestDNCTransferTimelineWindow(t *testing.T) {
+	pool := testDatabase(t)
+	ctx := context.Background()
+	repo := NewRepository(pool)
+
+	tests := []struct {
+		name    string
+		leaveAt int // Seconds after the start at which the controller leaves the program, 0 for never
+		end     int // Seconds after the start at which the window ends
+		line3   int // Samples on the last line
+	}{
+		// The transfer completes at 30s; line 3 runs until 45s
+		{name: "program left", leaveAt: 45, end: 45, line3: 4},
+		// The next transfer starts at 100s
+		{name: "next transfer", end: 100, line3: 16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			machineID := "TEST-" + uuid.New().String()
+			start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+			ids, payloads := dncServiceEvents(machineID, start)
+			t.Cleanup(func() {
+				pool.Exec(ctx, `DELETE FROM dnc_events WHERE machine_id = $1`, machineID)
+				pool.Exec(ctx, `DELETE FROM dnc_transfers WHERE machine_id = $1`, machineID)
+				pool.Exec(ctx, `DELETE FROM sensor_data WHERE machine_id = $1`, machineID)
+			})
+			for _, p := range payloads {
+				if _, err := repo.RecordDNCEvent(ctx, decodeDNCEvent(t, p)); err != nil {
+					t.Fatalf("record event: %v", err)
+				}
+			}
+			for sec := 0; sec <= 120; sec += 5 {
+				line := 3
+				switch {
+				case tt.leaveAt > 0 && sec >= tt.leaveAt:
+					line = 0
+				case sec < 15:
+					line = 1
+				case sec < 25:
+					line = 2
+				}
+				sample := SensorData{MachineID: machineID, SequenceNumber: uint64(sec + 1), Timestamp: start.Add(time.Duration(sec) * time.Second), ActiveProgramLine: line}
+				if _, err := repo.InsertSensorData(ctx, sample); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			timeline, err := repo.GetDNCTransferTimeline(ctx, ids[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := start.Add(time.Duration(tt.end) * time.Second); !timeline.WindowEnd.Equal(want) {
+				t.Errorf("window ends %v, want %v", timeline.WindowEnd, want)
+			}
+			if len(timeline.Lines) != 3 {
+				t.Fatalf("lines %+v, want 1 to 3", timeline.Lines)
+			}
+			if got := timeline.Lines[2]; got.Line != 3 || got.Samples != tt.line3 {
+				t.Errorf("last line %d has %d samples, want %d", got.Line, got.Samples, tt.line3)
+			}
+		})
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"os"
 	"time"
 
+	"cnc-monitor/contract"
+	"cnc-monitor/internal/config"
 	"github.com/nats-io/nats.go/jetstream"
 )
 
@@ -30,34 +33,56 @@ type wireDNCEvent struct {
 	Extra       map[string]interface{} `json:"extra"`
 }
 
+// event maps the wire format to a DNCEvent. The time is part of the event's
+// natural key, so events without a readable ts use fallback, which should be
+// stable across redeliveries.
+func (w wireDNCEvent) event(fallback time.Time) DNCEvent {
+	t, err := time.Parse(time.RFC3339, w.TS)
+	if err != nil {
+		t = fallback
+	}
+	return DNCEvent{
+		Time:        t,
+		TransferID:  w.TransferID,
+		MachineID:   w.MachineID,
+		ProgramName: w.ProgramName,
+		Mode:        w.Mode,
+		State:       w.State,
+		Line:        w.Line,
+		LinesTotal:  w.LinesTotal,
+		BytesSent:   w.BytesSent,
+		RateLPS:     w.RateLPS,
+		ETASec:      w.ETASec,
+		Event:       w.Event,
+		Error:       w.Error,
+		Extra:       w.Extra,
+	}
+}
+
 type DNCProgressService struct {
 	js   jetstream.JetStream
 	repo *Repository
+	cfg  config.NATSConfig
 }
 
-func NewDNCProgressService(js jetstream.JetStream, repo *Repository) *DNCProgressService {
-	return &DNCProgressService{js: js, repo: repo}
+func NewDNCProgressService(js jetstream.JetStream, repo *Repository, cfg config.NATSConfig) *DNCProgressService {
+	return &DNCProgressService{js: js, repo: repo, cfg: cfg}
 }
 
+// Run consumes DNC progress events (<prefix>.<machine_id>.dnc) from the shared stream.
+// The DNC service sets Nats-Msg-Id, so retried publishes within the stream's
+// duplicate window are dropped by the server.
 func (s *DNCProgressService) Run(ctx context.Context) {
-	const streamName = "DNC_PROGRESS"
-	// Ensure stream exists
-	stream, err := s.js.CreateStream(ctx, jetstream.StreamConfig{
-		Name:     streamName,
-		Subjects: []string{streamName + ".>"},
-	})
+	stream, err := EnsureStream(ctx, s.js, s.cfg)
 	if err != nil {
-		log.Printf("DNC: could not create stream, trying to use existing: %v", err)
-		stream, err = s.js.Stream(ctx, streamName)
-		if err != nil {
-			log.Printf("DNC: failed to get stream: %v", err)
-			return
-		}
+		log.Printf("DNC: failed to set up stream: %v", err)
+		return
 	}
 
 	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
-		Durable:   "DNC_PROCESSOR",
-		AckPolicy: jetstream.AckExplicitPolicy,
+		Durable:       "DNC_PROCESSOR",
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		FilterSubject: contract.FilterSubject(s.cfg.SubjectPrefix, contract.KindDNC),
 	})
 	if err != nil {
 		log.Printf("DNC: failed to create consumer: %v", err)
@@ -86,34 +111,26 @@ func (s *DNCProgressService) Run(ctx context.Context) {
 					_ = msg.Term()
 					continue
 				}
-				// Parse timestamp
-				t, err := time.Parse(time.RFC3339, wire.TS)
-				if err != nil { t = time.Now().UTC() }
-				// Map to repository model
-				ev := DNCEvent{
-					Time:       t,
-					TransferID: wire.TransferID,
-					MachineID:  wire.MachineID,
-					State:      wire.State,
-					Line:       wire.Line,
-					LinesTotal: wire.LinesTotal,
-					BytesSent:  wire.BytesSent,
-					RateLPS:    wire.RateLPS,
-					ETASec:     wire.ETASec,
-					Event:      wire.Event,
-					Error:      wire.Error,
-					Extra:      wire.Extra,
-				}
-				if err := s.repo.UpsertDNCTransfer(ctx, ev); err != nil {
-					log.Printf("DNC: upsert transfer failed: %v", err)
-					_ = msg.NakWithDelay(5 * time.Second)
+				if machineID, _, ok := contract.ParseSubject(s.cfg.SubjectPrefix, msg.Subject()); ok && wire.MachineID != machineID {
+					log.Printf("DNC: event for machine %q published on subject %q, terminating msg", wire.MachineID, msg.Subject())
+					_ = msg.Term()
 					continue
 				}
-				if err := s.repo.InsertDNCEvent(ctx, ev); err != nil {
-					log.Printf("DNC: insert event failed: %v", err)
+				// Events without a readable ts fall back to the stream timestamp
+				fallback := time.Now().UTC()
+				if md, err := msg.Metadata(); err == nil {
+					fallback = md.Timestamp.UTC()
+				}
+				ev := wire.event(fallback)
+				inserted, err := s.repo.RecordDNCEvent(ctx, ev)
+				if err != nil {
+					log.Printf("DNC: record event failed: %v", err)
 					_ = msg.NakWithDelay(5 * time.Second)
 					continue
 				}
+				if !inserted && os.Getenv("CNC_DEBUG") != "" {
+					log.Printf("DEBUG: DNC: duplicate event for transfer %s (line %d, state %s) ignored", ev.TransferID, ev.Line, ev.State)
+				}
 				_ = msg.Ack()
 			}
 		}
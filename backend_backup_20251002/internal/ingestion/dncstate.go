@@ -0,0 +1,127 @@
+// internal/ingestion/dncstate.go
+package ingestion
+
+import "time"
+
+// DNC transfer statuses as reported by the DNC service.
+const (
+	DNCStatusQueued    = "queued"
+	DNCStatusRunning   = "running"
+	DNCStatusPaused    = "paused"
+	DNCStatusCompleted = "completed"
+	DNCStatusError     = "error"
+	DNCStatusCanceled  = "canceled"
+)
+
+// dncStatusRank orders statuses so that a transfer only ever moves forward.
+// Terminal statuses outrank everything else; among them canceled beats error
+// (the sender exits non-zero when it is killed by a cancel) and error beats
+// completed, so conflicting terminal events resolve the same way in any order.
+func dncStatusRank(status string) int {
+	switch status {
+	case "":
+		return -1
+	case DNCStatusQueued:
+		return 0
+	case DNCStatusCompleted:
+		return 2
+	case DNCStatusError:
+		return 3
+	case DNCStatusCanceled:
+		return 4
+	default:
+		// running, paused and anything else the service may add
+		return 1
+	}
+}
+
+// IsTerminalDNCStatus reports whether a transfer in this status is finished.
+func IsTerminalDNCStatus(status string) bool {
+	return dncStatusRank(status) >= 2
+}
+
+// ApplyDNCEvent folds a progress event into a transfer. lastEventAt is the time of
+// the newest running or paused event applied so far (zero for a new transfer); the
+// updated value is returned. Other events do not move it, or a bare ack or a late
+// queued event could hide a running/paused event from the same second. Applying
+// the same set of events in any order, with duplicates, yields the same transfer:
+//   - started_at is the earliest event time, completed_at the earliest terminal event time;
+//   - terminal statuses are never left, only replaced by a higher-ranked terminal status;
+//   - running/paused follow the newest event, so a late "running" cannot reopen a
+//     transfer and a stale "paused" cannot override a newer "running";
+//   - params are merged, with progress counters only ever increasing.
+func ApplyDNCEvent(t *DNCTransfer, lastEventAt time.Time, ev DNCEvent) time.Time {
+	if t.TransferID == "" {
+		t.TransferID = ev.TransferID
+	}
+	if t.MachineID == "" {
+		t.MachineID = ev.MachineID
+	}
+	if t.ProgramName == "" {
+		t.ProgramName = ev.ProgramName
+	}
+	if t.Mode == "" {
+		t.Mode = ev.Mode
+	}
+	if t.StartedAt.IsZero() || ev.Time.Before(t.StartedAt) {
+		t.StartedAt = ev.Time
+	}
+
+	mergeDNCParams(t, ev)
+
+	current, incoming := dncStatusRank(t.Status), dncStatusRank(ev.State)
+	switch {
+	case incoming < 0:
+		// Event without a state (e.g. a bare ack); nothing to transition.
+	case IsTerminalDNCStatus(ev.State):
+		if incoming > current {
+			t.Status = ev.State
+		}
+		if t.CompletedAt == nil || ev.Time.Before(*t.CompletedAt) {
+			completedAt := ev.Time
+			t.CompletedAt = &completedAt
+		}
+	case IsTerminalDNCStatus(t.Status):
+		// Terminal states are final.
+	case incoming > current:
+		t.Status = ev.State
+	case incoming == current && ev.Time.After(lastEventAt):
+		t.Status = ev.State
+	case incoming == current && ev.Time.Equal(lastEventAt) && ev.State > t.Status:
+		// The service stamps events with one-second resolution; break ties
+		// deterministically so replay order does not matter.
+		t.Status = ev.State
+	}
+
+	if incoming == dncStatusRank(DNCStatusRunning) && ev.Time.After(lastEventAt) {
+		lastEventAt = ev.Time
+	}
+	return lastEventAt
+}
+
+// mergeDNCParams merges progress counters and any transfer parameters carried in
+// the event's extra["params"] into the transfer params without dropping existing keys.
+func mergeDNCParams(t *DNCTransfer, ev DNCEvent) {
+	if t.Params == nil {
+		t.Params = make(map[string]interface{})
+	}
+	if p, ok := ev.Extra["params"].(map[string]interface{}); ok {
+		for k, v := range p {
+			t.Params[k] = v
+		}
+	}
+	maxParam(t.Params, "line", float64(ev.Line))
+	maxParam(t.Params, "lines_total", float64(ev.LinesTotal))
+	maxParam(t.Params, "bytes_sent", float64(ev.BytesSent))
+}
+
+// maxParam stores v under key unless a larger number is already there.
+// Values decoded from JSONB are float64, so numbers are kept as float64.
+func maxParam(params map[string]interface{}, key string, v float64) {
+	if existing, ok := params[key].(float64); ok && existing >= v {
+		return
+	}
+	if _, ok := params[key]; ok || v > 0 {
+		params[key] = v
+	}
+}
@@ -0,0 +1,193 @@
+package ingestion
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// permutations calls fn with every ordering of events.
+func permutations(events []DNCEvent, fn func([]DNCEvent)) {
+	var permute func(k int)
+	permute = func(k int) {
+		if k == len(events) {
+			fn(events)
+			return
+		}
+		for i := k; i < len(events); i++ {
+			events[k], events[i] = events[i], events[k]
+			permute(k + 1)
+			events[k], events[i] = events[i], events[k]
+		}
+	}
+	permute(0)
+}
+
+// fold applies events to a new transfer the way upsertDNCTransfer does.
+// Duplicates are applied again, which is stricter than the database, where
+// they are dropped by their natural key.
+func fold(events []DNCEvent) (DNCTransfer, time.Time) {
+	var t DNCTransfer
+	var last time.Time
+	for _, ev := range events {
+		last = ApplyDNCEvent(&t, last, ev)
+	}
+	return t, last
+}
+
+func TestApplyDNCEventOrderIndependent(t *testing.T) {
+	start := time.Date(2025, 10, 1, 8, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return start.Add(time.Duration(sec) * time.Second) }
+	errText := "sender exited rc=-15"
+	event := func(event, state string, line, sec int) DNCEvent {
+		return DNCEvent{
+			Time: at(sec), TransferID: "T1", MachineID: "CNC-001", ProgramName: "PART.H", Mode: "bcc_listen",
+			State: state, Line: line, LinesTotal: 4, BytesSent: int64(line * 10), Event: event,
+		}
+	}
+	withError := func(ev DNCEvent) DNCEvent {
+		ev.Error = &errText
+		return ev
+	}
+
+	tests := []struct {
+		name        string
+		events      []DNCEvent
+		status      string
+		startedAt   time.Time
+		completedAt *time.Time
+		line        float64
+	}{
+		{
+			name: "completed",
+			events: []DNCEvent{
+				event("start", DNCStatusRunning, 0, 0),
+				event("ack", DNCStatusRunning, 1, 5),
+				event("ack", DNCStatusRunning, 2, 10),
+				event("ack", DNCStatusRunning, 4, 19),
+				event("completed", DNCStatusCompleted, 4, 20),
+			},
+			status:      DNCStatusCompleted,
+			startedAt:   at(0),
+			completedAt: ptr(at(20)),
+			line:        4,
+		},
+		{
+			name: "canceled beats the error of the killed sender",
+			events: []DNCEvent{
+				event("start", DNCStatusRunning, 0, 0),
+				event("ack", DNCStatusRunning, 1, 5),
+				event("canceled", DNCStatusCanceled, 1, 8),
+				withError(event("error", DNCStatusError, 1, 8)),
+			},
+			status:      DNCStatusCanceled,
+			startedAt:   at(0),
+			completedAt: ptr(at(8)),
+			line:        1,
+		},
+		{
+			name: "error beats a completion",
+			events: []DNCEvent{
+				event("start", DNCStatusQueued, 0, 0),
+				event("ack", DNCStatusRunning, 2, 6),
+				event("completed", DNCStatusCompleted, 2, 9),
+				withError(event("error", DNCStatusError, 2, 7)),
+			},
+			status:      DNCStatusError,
+			startedAt:   at(0),
+			completedAt: ptr(at(7)),
+			line:        2,
+		},
+		{
+			name: "paused and running in the same second",
+			events: []DNCEvent{
+				event("start", DNCStatusQueued, 0, 0),
+				event("ack", DNCStatusRunning, 1, 3),
+				event("pause", DNCStatusPaused, 1, 4),
+				event("resume", DNCStatusRunning, 1, 4),
+				event("ack", DNCStatusRunning, 2, 4),
+				event("ack", "", 3, 5),
+			},
+			status:    DNCStatusRunning,
+			startedAt: at(0),
+			line:      3,
+		},
+		{
+			name: "late queued event",
+			events: []DNCEvent{
+				event("ack", DNCStatusRunning, 1, 5),
+				event("pause", DNCStatusPaused, 1, 6),
+				event("start", DNCStatusQueued, 0, 10),
+			},
+			status:    DNCStatusPaused,
+			startedAt: at(5),
+			line:      1,
+		},
+		{
+			name: "paused last",
+			events: []DNCEvent{
+				event("start", DNCStatusRunning, 0, 1),
+				event("ack", DNCStatusRunning, 1, 3),
+				event("pause", DNCStatusPaused, 1, 6),
+			},
+			status:    DNCStatusPaused,
+			startedAt: at(1),
+			line:      1,
+		},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, wantLast := fold(tt.events)
+			if want.Status != tt.status {
+				t.Errorf("status %q, want %q", want.Status, tt.status)
+			}
+			if !want.StartedAt.Equal(tt.startedAt) {
+				t.Errorf("started at %v, want %v", want.StartedAt, tt.startedAt)
+			}
+			if !reflect.DeepEqual(want.CompletedAt, tt.completedAt) {
+				t.Errorf("completed at %v, want %v", want.CompletedAt, tt.completedAt)
+			}
+			if want.Params["line"] != tt.line {
+				t.Errorf("line %v, want %v", want.Params["line"], tt.line)
+			}
+			if want.TransferID != "T1" || want.MachineID != "CNC-001" || want.ProgramName != "PART.H" || want.Mode != "bcc_listen" {
+				t.Errorf("identity %+v", want)
+			}
+
+			events := append([]DNCEvent(nil), tt.events...)
+			permutations(events, func(order []DNCEvent) {
+				// Redeliveries: repeat some events later in the stream
+				replay := append([]DNCEvent(nil), order...)
+				for i := 0; i < 3; i++ {
+					dup := order[rng.Intn(len(order))]
+					pos := rng.Intn(len(replay) + 1)
+					replay = append(replay[:pos], append([]DNCEvent{dup}, replay[pos:]...)...)
+				}
+				for _, stream := range [][]DNCEvent{order, replay} {
+					got, gotLast := fold(stream)
+					if !reflect.DeepEqual(got, want) || !gotLast.Equal(wantLast) {
+						t.Fatalf("order %s gave\n%+v\nwant\n%+v", describe(stream), got, want)
+					}
+				}
+			})
+		})
+	}
+}
+
+func ptr(t time.Time) *time.Time {
+	return &t
+}
+
+func describe(events []DNCEvent) string {
+	s := ""
+	for i, ev := range events {
+		if i > 0 {
+			s += ", "
+		}
+		s += ev.Event + "@" + ev.Time.Format("05")
+	}
+	return s
+}
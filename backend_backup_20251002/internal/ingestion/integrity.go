@@ -29,6 +29,7 @@ type IntegrityReport struct {
 	DataLossPercent  float64                `json:"data_loss_percent"`
 	SequenceGaps     []uint64               `json:"sequence_gaps"`
 	DuplicateCount   int                    `json:"duplicate_count"`
+	SequenceConflicts int                   `json:"sequence_conflicts"`
 	TimingDrift      TimingAnalysis         `json:"timing_drift"`
 	QualityScore     float64                `json:"quality_score"`
 	Issues           []string               `json:"issues"`
@@ -106,7 +107,15 @@ func (dic *DataIntegrityChecker) PerformIntegrityCheck(ctx context.Context, mach
 		report.DuplicateCount = duplicateCount
 	}
 
-	// 6. Calculate quality score and generate issues/recommendations
+	// 6. Check for readings rejected because their sequence number was reused
+	conflicts, err := dic.repo.CountSequenceConflicts(ctx, machineID, startTime, endTime)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to count sequence conflicts")
+	} else {
+		report.SequenceConflicts = conflicts
+	}
+
+	// 7. Calculate quality score and generate issues/recommendations
 	dic.assessQuality(report)
 
 	log.Info().
@@ -219,6 +228,13 @@ func (dic *DataIntegrityChecker) assessQuality(report *IntegrityReport) {
 		report.Recommendations = append(report.Recommendations, "Review message deduplication logic")
 	}
 
+	// Sequence reuse penalty: the rejected readings are missing from sensor_data
+	if report.SequenceConflicts > 0 {
+		score -= float64(report.SequenceConflicts) * 5.0 // 5 points per conflict
+		report.Issues = append(report.Issues, fmt.Sprintf("Reused sequence numbers detected: %d readings rejected", report.SequenceConflicts))
+		report.Recommendations = append(report.Recommendations, "Check the edge agent state_dir survives restarts and is not restored from a backup")
+	}
+
 	// Timing drift penalty
 	if report.TimingDrift.DriftRate > 5.0 {
 		score -= 10.0
@@ -268,6 +284,7 @@ func (dic *DataIntegrityChecker) GetRealtimeQualityMetrics(ctx context.Context,
 		"data_loss_percent": report.DataLossPercent,
 		"sequence_gaps":     len(report.SequenceGaps),
 		"duplicate_count":   report.DuplicateCount,
+		"sequence_conflicts": report.SequenceConflicts,
 		"timing_drift":      report.TimingDrift.DriftRate,
 		"max_jitter_ms":     report.TimingDrift.MaxJitter,
 		"last_updated":      time.Now(),
@@ -1,23 +1,52 @@
 // internal/ingestion/models.go
 package ingestion
 
-import "time"
-
-// SensorData represents a single data point from a CNC machine.
-type SensorData struct {
-	MachineID         string    `json:"machine_id"`
-	SequenceNumber    uint64    `json:"sequence_number"`    // Monotonic sequence per machine
-	Temperature       float64   `json:"temperature"`
-	SpindleSpeed      float64   `json:"spindle_speed"`
-	Timestamp         time.Time `json:"timestamp"`
-	XPosMM            float64   `json:"x_pos_mm"`
-	YPosMM            float64   `json:"y_pos_mm"`
-	ZPosMM            float64   `json:"z_pos_mm"`
-	FeedRateActual    float64   `json:"feed_rate_actual"`
-	SpindleLoadPercent float64   `json:"spindle_load_percent"`
-	MachineState      string    `json:"machine_state"`
-	ActiveProgramLine int       `json:"active_program_line"`
-	TotalPowerKW      float64   `json:"total_power_kw"`
+import (
+	"time"
+
+	"cnc-monitor/contract"
+)
+
+// SensorData represents a single data point from a CNC machine. Missing
+// names the fields and channels the agent had no usable value for; Channels
+// holds readings of channels beyond the fixed fields, stored in
+// sensor_channel_data.
+type SensorData = contract.Sample
+
+// ChannelPoint is one value of a single channel.
+type ChannelPoint struct {
+	Time           time.Time `json:"time"`
+	SequenceNumber uint64    `json:"sequence_number"`
+	Value          float64   `json:"value"`
+	Text           string    `json:"text,omitempty"` // machine_state
+}
+
+// MachineChannel is a catalog entry: a channel a machine's agent delivers.
+type MachineChannel struct {
+	MachineID   string            `json:"machine_id"`
+	Name        string            `json:"name"`
+	Sensor      string            `json:"sensor"`
+	Units       string            `json:"units,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Min         *float64          `json:"min,omitempty"`
+	Max         *float64          `json:"max,omitempty"`
+	Precision   *int              `json:"precision,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// AgentConfig is the desired configuration of a machine's agent and what the
+// agent last reported applying.
+type AgentConfig struct {
+	MachineID string                 `json:"machine_id"`
+	Version   int64                  `json:"version"` // 0 until a configuration is set
+	Settings  map[string]interface{} `json:"settings"`
+	UpdatedAt time.Time              `json:"updated_at"`
+
+	AppliedVersion *int64     `json:"applied_version,omitempty"` // Version in the agent's last report
+	Applied        *bool      `json:"applied,omitempty"`
+	ApplyError     string     `json:"apply_error,omitempty"`
+	ReportedAt     *time.Time `json:"reported_at,omitempty"`
 }
 
 // Machine represents a CNC machine with its metadata.
@@ -49,6 +78,8 @@ type DNCEvent struct {
 	Time        time.Time              `json:"time"`
 	TransferID  string                 `json:"transfer_id"`
 	MachineID   string                 `json:"machine_id"`
+	ProgramName string                 `json:"program_name,omitempty"`
+	Mode        string                 `json:"mode,omitempty"`
 	State       string                 `json:"state"`
 	Line        int                    `json:"line"`
 	LinesTotal  int                    `json:"lines_total"`
@@ -59,3 +90,26 @@ type DNCEvent struct {
 	Error       *string                `json:"error"`
 	Extra       map[string]interface{} `json:"extra"`
 }
+
+// DNCTimeline correlates a DNC transfer with the machine telemetry recorded while it ran.
+type DNCTimeline struct {
+	Transfer    DNCTransfer        `json:"transfer"`
+	WindowStart time.Time          `json:"window_start"`
+	WindowEnd   time.Time          `json:"window_end"`
+	Lines       []ProgramLineStats `json:"lines"`
+}
+
+// ProgramLineStats aggregates telemetry for the samples taken while a program line was active.
+type ProgramLineStats struct {
+	Line               int       `json:"line"`
+	SentAt             time.Time `json:"sent_at"` // When the DNC service sent the line
+	Samples            int       `json:"samples"`
+	FirstSeen          time.Time `json:"first_seen"` // First sample executing the line
+	LastSeen           time.Time `json:"last_seen"`
+	DurationSec        float64   `json:"duration_sec"`
+	AvgSpindleLoadPct  float64   `json:"avg_spindle_load_percent"`
+	PeakSpindleLoadPct float64   `json:"peak_spindle_load_percent"`
+	AvgFeedRate        float64   `json:"avg_feed_rate"`
+	AvgPowerKW         float64   `json:"avg_power_kw"`
+	PeakPowerKW        float64   `json:"peak_power_kw"`
+}
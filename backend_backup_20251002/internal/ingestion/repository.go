@@ -4,10 +4,14 @@ package ingestion
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -19,29 +23,158 @@ func NewRepository(db *pgxpool.Pool) *Repository {
 	return &Repository{db: db}
 }
 
-// InsertSensorData inserts a new sensor data record into the database with deduplication.
-func (r *Repository) InsertSensorData(ctx context.Context, data SensorData) error {
+// InsertOutcome is the result of storing a sensor reading.
+type InsertOutcome int
+
+const (
+	// Inserted means the reading was new and has been stored.
+	Inserted InsertOutcome = iota
+	// Duplicate means an identical reading with the same sequence number was
+	// already stored, e.g. after a redelivery or an offline replay.
+	Duplicate
+	// SequenceConflict means a different reading already holds the sequence
+	// number. The agent has reused a sequence (state loss or a restored backup);
+	// the rejected reading is kept in sensor_data_conflicts instead.
+	SequenceConflict
+)
+
+func (o InsertOutcome) String() string {
+	switch o {
+	case Inserted:
+		return "inserted"
+	case Duplicate:
+		return "duplicate"
+	case SequenceConflict:
+		return "sequence_conflict"
+	}
+	return "unknown"
+}
+
+// InsertSensorData inserts a new sensor data record and its extra channels into
+// the database with deduplication. When the sequence number is already taken,
+// the stored row is compared with data to tell a genuine duplicate from a
+// reused sequence.
+func (r *Repository) InsertSensorData(ctx context.Context, data SensorData) (InsertOutcome, error) {
 	// DEBUG: Log the data being inserted
 	if os.Getenv("CNC_DEBUG") != "" {
 		log.Printf("DEBUG: Inserting data - MachineID: %s, SequenceNumber: %d, Timestamp: %s", 
 			data.MachineID, data.SequenceNumber, data.Timestamp)
 	}
 	
-	query := `INSERT INTO sensor_data (time, machine_id, sequence_number, temperature, spindle_speed, x_pos_mm, y_pos_mm, z_pos_mm, feed_rate_actual, spindle_load_percent, machine_state, active_program_line, total_power_kw) 
-	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
-	          ON CONFLICT (machine_id, sequence_number) DO NOTHING`
-	_, err := r.db.Exec(ctx, query, data.Timestamp, data.MachineID, data.SequenceNumber, data.Temperature, data.SpindleSpeed, data.XPosMM, data.YPosMM, data.ZPosMM, data.FeedRateActual, data.SpindleLoadPercent, data.MachineState, data.ActiveProgramLine, data.TotalPowerKW)
-	
+	inserted, err := r.insertSample(ctx, data)
 	if err != nil {
 		if os.Getenv("CNC_DEBUG") != "" {
 			log.Printf("DEBUG: Database insertion failed for MachineID: %s, SequenceNumber: %d, Error: %v", 
 				data.MachineID, data.SequenceNumber, err)
 		}
+		return Inserted, err
 	}
-	
+	if inserted {
+		return Inserted, nil
+	}
+
+	existing, err := r.getSensorDataBySequence(ctx, data.MachineID, data.SequenceNumber)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// The conflicting row vanished (retention) between the two
+			// statements; let the caller retry.
+			return Inserted, fmt.Errorf("sequence %d of %s conflicted but is no longer stored", data.SequenceNumber, data.MachineID)
+		}
+		return Inserted, err
+	}
+	if sameReading(existing, data) {
+		return Duplicate, nil
+	}
+	if err := r.insertSequenceConflict(ctx, data, existing); err != nil {
+		return SequenceConflict, err
+	}
+	return SequenceConflict, nil
+}
+
+// insertSample stores the sensor_data row and, if it was new, the extra
+// channels in one transaction. It reports whether the row was new.
+func (r *Repository) insertSample(ctx context.Context, data SensorData) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `INSERT INTO sensor_data (time, machine_id, sequence_number, temperature, spindle_speed, x_pos_mm, y_pos_mm, z_pos_mm, feed_rate_actual, spindle_load_percent, machine_state, active_program_line, total_power_kw, missing) 
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+	          ON CONFLICT (machine_id, sequence_number) DO NOTHING`
+	tag, err := tx.Exec(ctx, query, data.Timestamp, data.MachineID, data.SequenceNumber, data.Temperature, data.SpindleSpeed, data.XPosMM, data.YPosMM, data.ZPosMM, data.FeedRateActual, data.SpindleLoadPercent, data.MachineState, data.ActiveProgramLine, data.TotalPowerKW, data.Missing)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	if len(data.Channels) > 0 {
+		names := make([]string, 0, len(data.Channels))
+		values := make([]float64, 0, len(data.Channels))
+		for name, v := range data.Channels {
+			names = append(names, name)
+			values = append(values, v)
+		}
+		query := `INSERT INTO sensor_channel_data (time, machine_id, sequence_number, channel, value)
+		          SELECT $1, $2, $3, c.channel, c.value FROM unnest($4::text[], $5::float8[]) AS c(channel, value)
+		          ON CONFLICT (machine_id, sequence_number, channel) DO NOTHING`
+		if _, err := tx.Exec(ctx, query, data.Timestamp, data.MachineID, data.SequenceNumber, names, values); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit(ctx)
+}
+
+// getSensorDataBySequence returns the stored reading of a machine with the given sequence number.
+func (r *Repository) getSensorDataBySequence(ctx context.Context, machineID string, seq uint64) (SensorData, error) {
+	query := `SELECT time, machine_id, sequence_number, temperature, spindle_speed, x_pos_mm, y_pos_mm, z_pos_mm, feed_rate_actual, spindle_load_percent, machine_state, active_program_line, total_power_kw FROM sensor_data WHERE machine_id = $1 AND sequence_number = $2`
+	var sd SensorData
+	err := r.db.QueryRow(ctx, query, machineID, seq).Scan(&sd.Timestamp, &sd.MachineID, &sd.SequenceNumber, &sd.Temperature, &sd.SpindleSpeed, &sd.XPosMM, &sd.YPosMM, &sd.ZPosMM, &sd.FeedRateActual, &sd.SpindleLoadPercent, &sd.MachineState, &sd.ActiveProgramLine, &sd.TotalPowerKW)
+	return sd, err
+}
+
+// sameReading reports whether a stored reading and an incoming one carry the
+// same content. Timestamps are compared at the database's microsecond precision.
+func sameReading(stored, in SensorData) bool {
+	return stored.Timestamp.Equal(in.Timestamp.Truncate(time.Microsecond)) &&
+		stored.Temperature == in.Temperature &&
+		stored.SpindleSpeed == in.SpindleSpeed &&
+		stored.XPosMM == in.XPosMM &&
+		stored.YPosMM == in.YPosMM &&
+		stored.ZPosMM == in.ZPosMM &&
+		stored.FeedRateActual == in.FeedRateActual &&
+		stored.SpindleLoadPercent == in.SpindleLoadPercent &&
+		stored.MachineState == in.MachineState &&
+		stored.ActiveProgramLine == in.ActiveProgramLine &&
+		stored.TotalPowerKW == in.TotalPowerKW
+}
+
+// insertSequenceConflict keeps a reading rejected for reusing a sequence number.
+// Redelivery of the same rejected reading is ignored.
+func (r *Repository) insertSequenceConflict(ctx context.Context, data, existing SensorData) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO sensor_data_conflicts (time, machine_id, sequence_number, existing_time, payload)
+	          VALUES ($1, $2, $3, $4, $5)
+	          ON CONFLICT (machine_id, sequence_number, time) DO NOTHING`
+	_, err = r.db.Exec(ctx, query, data.Timestamp, data.MachineID, data.SequenceNumber, existing.Timestamp, payload)
 	return err
 }
 
+// CountSequenceConflicts returns how many readings of a machine in a time range
+// were rejected because their sequence number was already used.
+func (r *Repository) CountSequenceConflicts(ctx context.Context, machineID string, startTime, endTime time.Time) (int, error) {
+	query := `SELECT COUNT(*) FROM sensor_data_conflicts WHERE machine_id = $1 AND time BETWEEN $2 AND $3`
+	var n int
+	err := r.db.QueryRow(ctx, query, machineID, startTime, endTime).Scan(&n)
+	return n, err
+}
+
 // GetSensorDataForMachine retrieves sensor data for a specific machine within a time range.
 func (r *Repository) GetSensorDataForMachine(ctx context.Context, machineID string, startTime, endTime time.Time) ([]SensorData, error) {
 	query := `SELECT time, machine_id, sequence_number, temperature, spindle_speed, x_pos_mm, y_pos_mm, z_pos_mm, feed_rate_actual, spindle_load_percent, machine_state, active_program_line, total_power_kw FROM sensor_data WHERE machine_id = $1 AND time BETWEEN $2 AND $3 ORDER BY sequence_number ASC`
@@ -63,6 +196,167 @@ func (r *Repository) GetSensorDataForMachine(ctx context.Context, machineID stri
 	return data, nil
 }
 
+// sensorDataColumns maps the channels stored as sensor_data columns to their
+// column. Other channels live in sensor_channel_data.
+var sensorDataColumns = map[string]string{
+	"temperature":          "temperature",
+	"spindle_speed":        "spindle_speed",
+	"x_pos_mm":             "x_pos_mm",
+	"y_pos_mm":             "y_pos_mm",
+	"z_pos_mm":             "z_pos_mm",
+	"feed_rate_actual":     "feed_rate_actual",
+	"spindle_load_percent": "spindle_load_percent",
+	"active_program_line":  "active_program_line",
+	"total_power_kw":       "total_power_kw",
+}
+
+// GetChannelData returns the values of one channel of a machine within a time
+// range, whether it is a sensor_data column or an extra channel. Samples in
+// which the channel was missing are left out.
+func (r *Repository) GetChannelData(ctx context.Context, machineID, channel string, startTime, endTime time.Time) ([]ChannelPoint, error) {
+	var query string
+	switch column, ok := sensorDataColumns[channel]; {
+	case ok:
+		query = `SELECT time, sequence_number, ` + column + `::float8, '' FROM sensor_data
+		         WHERE machine_id = $1 AND time BETWEEN $2 AND $3 AND NOT ($4 = ANY(COALESCE(missing, '{}')))
+		         ORDER BY time ASC`
+	case channel == "machine_state":
+		query = `SELECT time, sequence_number, 0::float8, COALESCE(machine_state, '') FROM sensor_data
+		         WHERE machine_id = $1 AND time BETWEEN $2 AND $3 AND NOT ($4 = ANY(COALESCE(missing, '{}')))
+		         ORDER BY time ASC`
+	default:
+		query = `SELECT time, sequence_number, value, '' FROM sensor_channel_data
+		         WHERE machine_id = $1 AND time BETWEEN $2 AND $3 AND channel = $4
+		         ORDER BY time ASC`
+	}
+	rows, err := r.db.Query(ctx, query, machineID, startTime, endTime, channel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []ChannelPoint{}
+	for rows.Next() {
+		var p ChannelPoint
+		if err := rows.Scan(&p.Time, &p.SequenceNumber, &p.Value, &p.Text); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// ReplaceChannelCatalog stores the channel catalog of a machine, replacing the
+// previous one.
+func (r *Repository) ReplaceChannelCatalog(ctx context.Context, machineID string, channels []MachineChannel) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM machine_channels WHERE machine_id = $1`, machineID); err != nil {
+		return err
+	}
+	query := `INSERT INTO machine_channels (machine_id, channel, sensor, units, description, min_value, max_value, precision, tags, updated_at)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW())
+	          ON CONFLICT (machine_id, channel) DO NOTHING`
+	for _, c := range channels {
+		tags, _ := json.Marshal(c.Tags)
+		if _, err := tx.Exec(ctx, query, machineID, c.Name, c.Sensor, c.Units, c.Description, c.Min, c.Max, c.Precision, tags); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// GetChannelCatalog returns the channels a machine's agent last reported.
+func (r *Repository) GetChannelCatalog(ctx context.Context, machineID string) ([]MachineChannel, error) {
+	query := `SELECT machine_id, channel, sensor, COALESCE(units, ''), COALESCE(description, ''), min_value, max_value, precision, tags, updated_at
+	          FROM machine_channels WHERE machine_id = $1 ORDER BY channel ASC`
+	rows, err := r.db.Query(ctx, query, machineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []MachineChannel{}
+	for rows.Next() {
+		var c MachineChannel
+		var tags []byte
+		if err := rows.Scan(&c.MachineID, &c.Name, &c.Sensor, &c.Units, &c.Description, &c.Min, &c.Max, &c.Precision, &tags, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if len(tags) > 0 {
+			_ = json.Unmarshal(tags, &c.Tags)
+		}
+		channels = append(channels, c)
+	}
+	return channels, rows.Err()
+}
+
+const agentConfigColumns = `machine_id, version, settings, updated_at, applied_version, applied, COALESCE(apply_error, ''), reported_at`
+
+func scanAgentConfig(row pgx.Row) (*AgentConfig, error) {
+	var c AgentConfig
+	var settings []byte
+	if err := row.Scan(&c.MachineID, &c.Version, &settings, &c.UpdatedAt, &c.AppliedVersion, &c.Applied, &c.ApplyError, &c.ReportedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(settings, &c.Settings); err != nil {
+		return nil, fmt.Errorf("agent config of %s: %w", c.MachineID, err)
+	}
+	return &c, nil
+}
+
+// GetAgentConfig returns the desired configuration of a machine's agent and
+// its last report. It returns pgx.ErrNoRows if neither exists.
+func (r *Repository) GetAgentConfig(ctx context.Context, machineID string) (*AgentConfig, error) {
+	query := `SELECT ` + agentConfigColumns + ` FROM agent_configs WHERE machine_id = $1`
+	return scanAgentConfig(r.db.QueryRow(ctx, query, machineID))
+}
+
+// SetDesiredAgentConfig replaces the desired configuration of a machine's
+// agent and returns it with its new version. publish is called with the new
+// version before it is committed, so a version that could not be published is
+// not stored; the row stays locked meanwhile, so versions are published in order.
+func (r *Repository) SetDesiredAgentConfig(ctx context.Context, machineID string, settings map[string]interface{}, publish func(*AgentConfig) error) (*AgentConfig, error) {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `INSERT INTO agent_configs (machine_id, version, settings, updated_at)
+	          VALUES ($1, 1, $2, NOW())
+	          ON CONFLICT (machine_id) DO UPDATE SET version = agent_configs.version + 1, settings = EXCLUDED.settings, updated_at = EXCLUDED.updated_at
+	          RETURNING ` + agentConfigColumns
+	cfg, err := scanAgentConfig(tx.QueryRow(ctx, query, machineID, data))
+	if err != nil {
+		return nil, err
+	}
+	if err := publish(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, tx.Commit(ctx)
+}
+
+// RecordAgentConfigReport stores what an agent reported applying. Reports
+// older than the stored one are ignored.
+func (r *Repository) RecordAgentConfigReport(ctx context.Context, machineID string, version int64, applied bool, applyError string, reportedAt time.Time) error {
+	query := `INSERT INTO agent_configs (machine_id, applied_version, applied, apply_error, reported_at)
+	          VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+	          ON CONFLICT (machine_id) DO UPDATE SET applied_version = EXCLUDED.applied_version, applied = EXCLUDED.applied,
+	              apply_error = EXCLUDED.apply_error, reported_at = EXCLUDED.reported_at
+	          WHERE agent_configs.reported_at IS NULL OR agent_configs.reported_at <= EXCLUDED.reported_at`
+	_, err := r.db.Exec(ctx, query, machineID, version, applied, applyError, reportedAt)
+	return err
+}
+
 // GetAllMachines retrieves all registered machines.
 func (r *Repository) GetAllMachines(ctx context.Context) ([]Machine, error) {
 	query := `SELECT id, name, location, controller_type, max_spindle_speed_rpm, axis_count, created_at, last_updated FROM machines ORDER BY name ASC`
@@ -84,6 +378,16 @@ func (r *Repository) GetAllMachines(ctx context.Context) ([]Machine, error) {
 	return machines, nil
 }
 
+// GetMachine retrieves a single machine by ID. It returns pgx.ErrNoRows if the machine does not exist.
+func (r *Repository) GetMachine(ctx context.Context, machineID string) (*Machine, error) {
+	query := `SELECT id, name, location, COALESCE(controller_type, ''), COALESCE(max_spindle_speed_rpm, 0), COALESCE(axis_count, 0), created_at, last_updated FROM machines WHERE id = $1`
+	var m Machine
+	if err := r.db.QueryRow(ctx, query, machineID).Scan(&m.ID, &m.Name, &m.Location, &m.ControllerType, &m.MaxSpindleSpeedRPM, &m.AxisCount, &m.CreatedAt, &m.LastUpdated); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
 // CreateMachine adds a new machine to the database.
 func (r *Repository) CreateMachine(ctx context.Context, machine Machine) error {
 	query := `INSERT INTO machines (id, name, location, controller_type, max_spindle_speed_rpm, axis_count) VALUES ($1, $2, $3, $4, $5, $6)`
@@ -126,38 +430,109 @@ func (r *Repository) DetectSequenceGaps(ctx context.Context, machineID string) (
 	return gaps, nil
 }
 
-// UpsertDNCTransfer updates or inserts a transfer record when progress arrives.
+// UpsertDNCTransfer folds a progress event into its transfer record.
+// Events may arrive late, out of order or more than once (NAK/redelivery); the
+// transfer state machine in ApplyDNCEvent makes the result independent of that.
 func (r *Repository) UpsertDNCTransfer(ctx context.Context, ev DNCEvent) error {
-	status := ev.State
-	if status == "completed" || status == "error" || status == "canceled" {
-		// terminal states close the transfer
-		query := `INSERT INTO dnc_transfers (transfer_id, machine_id, program_name, mode, params, status, started_at, completed_at)
-				VALUES ($1,$2,$3,$4,$5,$6, COALESCE($7, NOW()), NOW())
-				ON CONFLICT (transfer_id)
-				DO UPDATE SET status=EXCLUDED.status, completed_at=NOW(), program_name=EXCLUDED.program_name, mode=EXCLUDED.mode, params=EXCLUDED.params` 
-		params := map[string]interface{}{"line": ev.Line, "lines_total": ev.LinesTotal}
-		b, _ := json.Marshal(params)
-		_, err := r.db.Exec(ctx, query, ev.TransferID, ev.MachineID, ev.ProgramName, ev.Mode, b, status, time.Now().UTC())
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
 		return err
 	}
-	// running/paused/etc.
-	query := `INSERT INTO dnc_transfers (transfer_id, machine_id, program_name, mode, params, status, started_at)
-			VALUES ($1,$2,$3,$4,$5,$6, COALESCE($7, NOW()))
-			ON CONFLICT (transfer_id)
-			DO UPDATE SET status=EXCLUDED.status, program_name=EXCLUDED.program_name, mode=EXCLUDED.mode, params=EXCLUDED.params`
-	params := map[string]interface{}{"line": ev.Line, "lines_total": ev.LinesTotal}
-	b, _ := json.Marshal(params)
-	_, err := r.db.Exec(ctx, query, ev.TransferID, ev.MachineID, ev.ProgramName, ev.Mode, b, ev.State, time.Now().UTC())
+	defer tx.Rollback(ctx)
+
+	if err := upsertDNCTransfer(ctx, tx, ev); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// upsertDNCTransfer applies ev to the transfer row inside tx. The row is locked so
+// concurrent consumers cannot interleave read-modify-write cycles for one transfer.
+func upsertDNCTransfer(ctx context.Context, tx pgx.Tx, ev DNCEvent) error {
+	insert := `INSERT INTO dnc_transfers (transfer_id, machine_id, started_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (transfer_id) DO NOTHING`
+	if _, err := tx.Exec(ctx, insert, ev.TransferID, ev.MachineID, ev.Time); err != nil {
+		return err
+	}
+
+	query := `SELECT transfer_id, machine_id, COALESCE(program_name, ''), COALESCE(mode, ''), params, started_at, completed_at, COALESCE(status, ''), last_event_at
+			FROM dnc_transfers WHERE transfer_id = $1 FOR UPDATE`
+	var t DNCTransfer
+	var paramsBytes []byte
+	var lastEventAt *time.Time
+	if err := tx.QueryRow(ctx, query, ev.TransferID).Scan(&t.TransferID, &t.MachineID, &t.ProgramName, &t.Mode, &paramsBytes, &t.StartedAt, &t.CompletedAt, &t.Status, &lastEventAt); err != nil {
+		return err
+	}
+	if len(paramsBytes) > 0 {
+		if err := json.Unmarshal(paramsBytes, &t.Params); err != nil {
+			log.Printf("DNC: ignoring unreadable params for transfer %s: %v", t.TransferID, err)
+		}
+	}
+
+	var last time.Time
+	if lastEventAt != nil {
+		last = *lastEventAt
+	}
+	last = ApplyDNCEvent(&t, last, ev)
+
+	b, err := json.Marshal(t.Params)
+	if err != nil {
+		return err
+	}
+	update := `UPDATE dnc_transfers
+			SET program_name = NULLIF($2, ''), mode = NULLIF($3, ''), params = $4, status = NULLIF($5, ''),
+				started_at = $6, completed_at = $7, last_event_at = $8
+			WHERE transfer_id = $1`
+	_, err = tx.Exec(ctx, update, t.TransferID, t.ProgramName, t.Mode, b, t.Status, t.StartedAt, t.CompletedAt, last)
 	return err
 }
 
-// InsertDNCEvent persists a single DNC progress event.
+// InsertDNCEvent persists a single DNC progress event. Events already stored under the
+// same natural key (transfer_id, time, event, state, line) are ignored.
 func (r *Repository) InsertDNCEvent(ctx context.Context, ev DNCEvent) error {
+	_, err := insertDNCEvent(ctx, r.db, ev)
+	return err
+}
+
+// RecordDNCEvent stores a progress event and folds it into its transfer in one
+// transaction. A redelivered event is detected by the dnc_events natural key and
+// leaves both tables untouched, so NAK-and-redeliver is harmless.
+func (r *Repository) RecordDNCEvent(ctx context.Context, ev DNCEvent) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	inserted, err := insertDNCEvent(ctx, tx, ev)
+	if err != nil {
+		return false, err
+	}
+	if inserted {
+		if err := upsertDNCTransfer(ctx, tx, ev); err != nil {
+			return false, err
+		}
+	}
+	return inserted, tx.Commit(ctx)
+}
+
+// dbExecutor is the subset of pgxpool.Pool and pgx.Tx used by shared queries.
+type dbExecutor interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// insertDNCEvent inserts ev and reports whether it was new.
+func insertDNCEvent(ctx context.Context, db dbExecutor, ev DNCEvent) (bool, error) {
 	b, _ := json.Marshal(ev.Extra)
 	query := `INSERT INTO dnc_events (time, transfer_id, machine_id, state, line, lines_total, bytes_sent, rate_lps, eta_sec, event, error, extra)
-			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)`
-	_, err := r.db.Exec(ctx, query, ev.Time, ev.TransferID, ev.MachineID, ev.State, ev.Line, ev.LinesTotal, ev.BytesSent, ev.RateLPS, ev.ETASec, ev.Event, ev.Error, b)
-	return err
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
+			ON CONFLICT (transfer_id, time, event, state, line) DO NOTHING`
+	tag, err := db.Exec(ctx, query, ev.Time, ev.TransferID, ev.MachineID, ev.State, ev.Line, ev.LinesTotal, ev.BytesSent, ev.RateLPS, ev.ETASec, ev.Event, ev.Error, b)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
 }
 
 // GetDNCTransfers returns recent transfers in a time range.
@@ -188,6 +563,104 @@ func (r *Repository) GetDNCTransfers(ctx context.Context, startTime, endTime tim
 	return out, nil
 }
 
+// GetDNCTransfer returns a single transfer. It returns pgx.ErrNoRows if the transfer does not exist.
+func (r *Repository) GetDNCTransfer(ctx context.Context, transferID string) (*DNCTransfer, error) {
+	query := `SELECT transfer_id, machine_id, program_name, mode, params, started_at, completed_at, status
+			FROM dnc_transfers WHERE transfer_id = $1`
+	var t DNCTransfer
+	var paramsBytes []byte
+	if err := r.db.QueryRow(ctx, query, transferID).Scan(&t.TransferID, &t.MachineID, &t.ProgramName, &t.Mode, &paramsBytes, &t.StartedAt, &t.CompletedAt, &t.Status); err != nil {
+		return nil, err
+	}
+	if len(paramsBytes) > 0 {
+		_ = json.Unmarshal(paramsBytes, &t.Params)
+	}
+	return &t, nil
+}
+
+// dncTimelineMaxLag bounds how long after a transfer's last event its lines are
+// still attributed to it, e.g. while the machine stays on the last line.
+const dncTimelineMaxLag = 30 * time.Minute
+
+// GetDNCTransferTimeline aligns a transfer's progress events with the machine's telemetry.
+// Each sensor sample inside the transfer window is attributed to the program line the
+// controller reported executing (active_program_line), and samples are aggregated per line.
+// The DNC events give the time each line was sent; lines the transfer never sent are left
+// out. Because the controller buffers blocks, a line usually runs some time after it is sent,
+// so the window does not end with the transfer: it runs on until the controller reports a
+// line the transfer did not send, the machine's next transfer starts, or dncTimelineMaxLag
+// has passed, whichever comes first.
+// A sample's duration is the gap to the next sample, so per-line durations add up to
+// the time the machine spent on that block.
+func (r *Repository) GetDNCTransferTimeline(ctx context.Context, transferID string) (*DNCTimeline, error) {
+	transfer, err := r.GetDNCTransfer(ctx, transferID)
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := &DNCTimeline{Transfer: *transfer, WindowStart: transfer.StartedAt, Lines: []ProgramLineStats{}}
+	var sentEnd time.Time
+	if transfer.CompletedAt != nil {
+		sentEnd = *transfer.CompletedAt
+	} else {
+		// Still running (or the terminal event was lost): use the last event we have.
+		query := `SELECT COALESCE(MAX(time), NOW()) FROM dnc_events WHERE transfer_id = $1`
+		if err := r.db.QueryRow(ctx, query, transferID).Scan(&sentEnd); err != nil {
+			return nil, err
+		}
+	}
+	// LEAST skips the NULL of a missing next transfer or line change
+	query := `
+		SELECT GREATEST($3::timestamptz, LEAST($5::timestamptz, NOW(),
+			(SELECT MIN(t.started_at) FROM dnc_transfers t WHERE t.machine_id = $1 AND t.started_at > $2),
+			(SELECT MIN(s.time) FROM sensor_data s
+			 WHERE s.machine_id = $1 AND s.time > $3 AND s.time <= $5
+			   AND COALESCE(s.active_program_line, 0) NOT BETWEEN 1 AND
+			       (SELECT COALESCE(MAX(e.line), 0) FROM dnc_events e WHERE e.transfer_id = $4))))`
+	if err := r.db.QueryRow(ctx, query, transfer.MachineID, transfer.StartedAt, sentEnd, transferID, sentEnd.Add(dncTimelineMaxLag)).Scan(&timeline.WindowEnd); err != nil {
+		return nil, err
+	}
+
+	query = `
+		WITH samples AS (
+			SELECT s.time, s.active_program_line AS line, s.spindle_load_percent, s.feed_rate_actual, s.total_power_kw,
+				LEAD(s.time) OVER (ORDER BY s.time) AS next_time
+			FROM sensor_data s
+			WHERE s.machine_id = $2 AND s.time BETWEEN $3 AND $4
+		), lines AS (
+			SELECT line, COUNT(*) AS samples, MIN(time) AS first_seen, MAX(time) AS last_seen,
+				COALESCE(SUM(EXTRACT(EPOCH FROM (COALESCE(next_time, time) - time))), 0)::DOUBLE PRECISION AS duration_sec,
+				COALESCE(AVG(spindle_load_percent), 0) AS avg_load, COALESCE(MAX(spindle_load_percent), 0) AS peak_load,
+				COALESCE(AVG(feed_rate_actual), 0) AS avg_feed,
+				COALESCE(AVG(total_power_kw), 0) AS avg_power, COALESCE(MAX(total_power_kw), 0) AS peak_power
+			FROM samples
+			WHERE line > 0
+			GROUP BY line
+		)
+		SELECT l.line, l.samples, l.first_seen, l.last_seen, l.duration_sec,
+			l.avg_load, l.peak_load, l.avg_feed, l.avg_power, l.peak_power, sent.sent_at
+		FROM lines l
+		JOIN LATERAL (
+			-- A line has been sent once the DNC service acked it or any later line
+			SELECT MIN(e.time) AS sent_at FROM dnc_events e
+			WHERE e.transfer_id = $1 AND e.line >= l.line
+		) sent ON sent.sent_at IS NOT NULL
+		ORDER BY l.line ASC`
+	rows, err := r.db.Query(ctx, query, transferID, transfer.MachineID, timeline.WindowStart, timeline.WindowEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ls ProgramLineStats
+		if err := rows.Scan(&ls.Line, &ls.Samples, &ls.FirstSeen, &ls.LastSeen, &ls.DurationSec, &ls.AvgSpindleLoadPct, &ls.PeakSpindleLoadPct, &ls.AvgFeedRate, &ls.AvgPowerKW, &ls.PeakPowerKW, &ls.SentAt); err != nil {
+			return nil, err
+		}
+		timeline.Lines = append(timeline.Lines, ls)
+	}
+	return timeline, rows.Err()
+}
+
 // GetDNCEventsByTransfer returns events for a transfer in a time range.
 func (r *Repository) GetDNCEventsByTransfer(ctx context.Context, transferID string, startTime, endTime time.Time) ([]DNCEvent, error) {
 	query := `SELECT time, transfer_id, machine_id, state, line, lines_total, bytes_sent, rate_lps, eta_sec, event, error, extra
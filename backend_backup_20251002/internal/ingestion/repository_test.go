@@ -0,0 +1,112 @@
+package ingestion
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testDatabase connects to the scratch database in CNC_TEST_DATABASE_URL and
+// loads scripts/init.sql, which replaces its tables. The test is skipped when
+// no database is configured.
+func testDatabase(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("CNC_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("CNC_TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	schema, err := os.ReadFile("../../scripts/init.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Exec(ctx, string(schema)); err != nil {
+		t.Fatalf("load schema: %v", err)
+	}
+	return pool
+}
+
+func TestSameReading(t *testing.T) {
+	ts := time.Date(2025, 10, 2, 8, 0, 0, 123456789, time.UTC)
+	in := SensorData{MachineID: "M", SequenceNumber: 7, Timestamp: ts, Temperature: 41.5, MachineState: "RUNNING"}
+
+	// The database keeps microseconds, so the stored copy lost the nanoseconds
+	stored := in
+	stored.Timestamp = ts.Truncate(time.Microsecond)
+	if !sameReading(stored, in) {
+		t.Error("reading differs from its stored copy")
+	}
+
+	later := stored
+	later.Timestamp = stored.Timestamp.Add(time.Microsecond)
+	if sameReading(later, in) {
+		t.Error("readings a microsecond apart are the same")
+	}
+	hotter := stored
+	hotter.Temperature = 42
+	if sameReading(hotter, in) {
+		t.Error("readings with different temperatures are the same")
+	}
+}
+
+// TestInsertSensorDataOutcomes stores a reading, its redelivery and a
+// different reading under the same sequence number. It needs a scratch
+// database, see testDatabase.
+func TestInsertSensorDataOutcomes(t *testing.T) {
+	pool := testDatabase(t)
+	ctx := context.Background()
+	repo := NewRepository(pool)
+	machineID := "TEST-" + uuid.New().String()
+	t.Cleanup(func() {
+		pool.Exec(ctx, `DELETE FROM sensor_data WHERE machine_id = $1`, machineID)
+		pool.Exec(ctx, `DELETE FROM sensor_data_conflicts WHERE machine_id = $1`, machineID)
+	})
+
+	ts := time.Now().UTC().Truncate(time.Second).Add(123456789 * time.Nanosecond)
+	reading := SensorData{MachineID: machineID, SequenceNumber: 1, Timestamp: ts, Temperature: 41.5, MachineState: "RUNNING"}
+	reused := reading
+	reused.Timestamp = ts.Add(time.Second)
+
+	for _, step := range []struct {
+		name string
+		data SensorData
+		want InsertOutcome
+	}{
+		{"new", reading, Inserted},
+		{"redelivered", reading, Duplicate}, // Stored truncated to µs
+		{"sequence reused", reused, SequenceConflict},
+		{"conflict redelivered", reused, SequenceConflict},
+	} {
+		got, err := repo.InsertSensorData(ctx, step.data)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got != step.want {
+			t.Errorf("%s: %s, want %s", step.name, got, step.want)
+		}
+	}
+
+	stored, err := repo.GetSensorDataForMachine(ctx, machineID, ts.Add(-time.Minute), ts.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || !stored[0].Timestamp.Equal(ts.Truncate(time.Microsecond)) {
+		t.Errorf("stored %+v, want the first reading only", stored)
+	}
+	conflicts, err := repo.CountSequenceConflicts(ctx, machineID, ts.Add(-time.Minute), ts.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conflicts != 1 {
+		t.Errorf("%d conflicts recorded, want 1", conflicts)
+	}
+}
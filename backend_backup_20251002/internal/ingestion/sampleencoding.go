@@ -0,0 +1,25 @@
+// internal/ingestion/sampleencoding.go
+package ingestion
+
+import (
+	"fmt"
+
+	"cnc-monitor/contract"
+)
+
+// decodeSample decodes one length-prefixed frame of a message in the encoding
+// announced by its contract.SampleEncodingHeader. A frame in a different
+// encoding than announced is malformed.
+func decodeSample(encoding string, frame []byte) (SensorData, error) {
+	switch encoding {
+	case "":
+		encoding = contract.EncodingJSON
+	case contract.EncodingJSON, contract.EncodingBinaryV1, contract.EncodingBinaryV2:
+	default:
+		return SensorData{}, fmt.Errorf("unsupported sample encoding %q", encoding)
+	}
+	if got := contract.SampleEncoding(frame); got != encoding {
+		return SensorData{}, fmt.Errorf("%w: %s frame in a %s message", contract.ErrMalformedSample, got, encoding)
+	}
+	return contract.DecodeSample(frame)
+}
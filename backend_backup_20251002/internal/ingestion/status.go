@@ -0,0 +1,161 @@
+// internal/ingestion/status.go
+package ingestion
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/internal/config"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// StatusService consumes the documents agents publish on their status
+// subjects (<prefix>.<machine_id>.status), such as the channel catalog and
+// the agent config reports.
+type StatusService struct {
+	js   jetstream.JetStream
+	repo *Repository
+	cfg  config.NATSConfig
+}
+
+func NewStatusService(js jetstream.JetStream, repo *Repository, cfg config.NATSConfig) *StatusService {
+	return &StatusService{js: js, repo: repo, cfg: cfg}
+}
+
+// Run consumes status messages until ctx is cancelled.
+func (s *StatusService) Run(ctx context.Context) {
+	stream, err := EnsureStream(ctx, s.js, s.cfg)
+	if err != nil {
+		log.Printf("Status: failed to set up stream: %v", err)
+		return
+	}
+
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:       "STATUS_PROCESSOR",
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		FilterSubject: contract.FilterSubject(s.cfg.SubjectPrefix, contract.KindStatus),
+	})
+	if err != nil {
+		log.Printf("Status: failed to create consumer: %v", err)
+		return
+	}
+
+	log.Println("Status consumer started")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			msgs, err := consumer.Fetch(50, jetstream.FetchMaxWait(5*time.Second))
+			if err != nil {
+				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+					continue
+				}
+				log.Printf("Status: fetch error: %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			for msg := range msgs.Messages() {
+				if err := s.handle(ctx, msg); err != nil {
+					if errors.Is(err, errMessageTerminated) {
+						continue
+					}
+					log.Printf("Status: %v", err)
+					_ = msg.NakWithDelay(5 * time.Second)
+					continue
+				}
+				_ = msg.Ack()
+			}
+		}
+	}
+}
+
+// handle processes one status message. Malformed messages are terminated and
+// errMessageTerminated is returned; other errors are retriable.
+func (s *StatusService) handle(ctx context.Context, msg jetstream.Msg) error {
+	machineID, _, ok := contract.ParseSubject(s.cfg.SubjectPrefix, msg.Subject())
+	if !ok {
+		_ = msg.Term()
+		return errMessageTerminated
+	}
+
+	switch statusType := msg.Headers().Get(contract.StatusTypeHeader); statusType {
+	case contract.StatusChannelCatalog:
+		var catalog contract.ChannelCatalog
+		if err := json.Unmarshal(msg.Data(), &catalog); err != nil {
+			log.Printf("Status: bad channel catalog from %s, terminating msg: %v", machineID, err)
+			_ = msg.Term()
+			return errMessageTerminated
+		}
+		if catalog.MachineID != machineID {
+			log.Printf("Status: catalog for machine %q published on subject %q, terminating msg", catalog.MachineID, msg.Subject())
+			_ = msg.Term()
+			return errMessageTerminated
+		}
+		channels := make([]MachineChannel, len(catalog.Channels))
+		for i, c := range catalog.Channels {
+			channels[i] = MachineChannel{
+				MachineID:   machineID,
+				Name:        c.Name,
+				Sensor:      c.Sensor,
+				Units:       c.Units,
+				Description: c.Description,
+				Min:         c.Min,
+				Max:         c.Max,
+				Precision:   c.Precision,
+				Tags:        c.Tags,
+			}
+		}
+		if err := s.repo.ReplaceChannelCatalog(ctx, machineID, channels); err != nil {
+			return err
+		}
+		log.Printf("Status: stored channel catalog of %s (%d channels)", machineID, len(channels))
+	case contract.StatusAlert:
+		var alert contract.Alert
+		if err := json.Unmarshal(msg.Data(), &alert); err != nil {
+			log.Printf("Status: bad alert from %s, terminating msg: %v", machineID, err)
+			_ = msg.Term()
+			return errMessageTerminated
+		}
+		log.Printf("Status: %s alert from %s/%s: %s", alert.Level, machineID, alert.Source, alert.Message)
+	case contract.StatusAgentConfig:
+		var report contract.AgentConfigReport
+		if err := json.Unmarshal(msg.Data(), &report); err != nil {
+			log.Printf("Status: bad agent config report from %s, terminating msg: %v", machineID, err)
+			_ = msg.Term()
+			return errMessageTerminated
+		}
+		if report.MachineID != machineID {
+			log.Printf("Status: agent config report for machine %q published on subject %q, terminating msg", report.MachineID, msg.Subject())
+			_ = msg.Term()
+			return errMessageTerminated
+		}
+		if report.Time.IsZero() {
+			report.Time = time.Now()
+		}
+		if err := s.repo.RecordAgentConfigReport(ctx, machineID, report.Version, report.Applied, report.Error, report.Time); err != nil {
+			return err
+		}
+		if report.Applied {
+			log.Printf("Status: %s applied config version %d", machineID, report.Version)
+		} else {
+			log.Printf("Status: %s rejected config version %d: %s", machineID, report.Version, report.Error)
+		}
+	case contract.StatusAgentState:
+		var st contract.AgentState
+		if err := json.Unmarshal(msg.Data(), &st); err != nil {
+			log.Printf("Status: bad agent state from %s, terminating msg: %v", machineID, err)
+			_ = msg.Term()
+			return errMessageTerminated
+		}
+		log.Printf("Status: %s went from %s to %s (conditions %v, failing sensors %v)", machineID, st.Previous, st.State, st.Conditions, st.Failing)
+	default:
+		// Unknown document types are skipped so newer agents do not stall the consumer.
+		log.Printf("Status: ignoring %q status from %s", statusType, machineID)
+	}
+	return nil
+}
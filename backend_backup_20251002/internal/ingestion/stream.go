@@ -0,0 +1,112 @@
+// internal/ingestion/stream.go
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/internal/config"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// EnsureStream returns the shared stream, creating it from the contract if it
+// does not exist. An existing stream is verified against the configured spec:
+// drift is logged, and applied only when nats.stream.update is set. A stream
+// that does not capture the contract subjects is an error, since ingestion
+// would silently see nothing.
+func EnsureStream(ctx context.Context, js jetstream.JetStream, cfg config.NATSConfig) (jetstream.Stream, error) {
+	spec := cfg.StreamSpec()
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	want := streamConfig(spec)
+
+	stream, err := js.Stream(ctx, spec.Name)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		// CreateStream is idempotent for an identical config, so services
+		// starting together do not conflict.
+		stream, err = js.CreateStream(ctx, want)
+		if err != nil {
+			return nil, fmt.Errorf("create stream %s: %w", spec.Name, err)
+		}
+		log.Printf("Created stream %s for subjects %v", spec.Name, spec.Subjects)
+		return stream, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get stream %s: %w", spec.Name, err)
+	}
+
+	diffs := spec.Diff(streamSpec(stream.CachedInfo().Config))
+	if len(diffs) == 0 {
+		return stream, nil
+	}
+	if cfg.Stream.Update {
+		stream, err = js.UpdateStream(ctx, want)
+		if err != nil {
+			return nil, fmt.Errorf("update stream %s (%s): %w", spec.Name, strings.Join(diffs, "; "), err)
+		}
+		log.Printf("Updated stream %s: %s", spec.Name, strings.Join(diffs, "; "))
+		return stream, nil
+	}
+
+	log.Printf("WARNING: stream %s differs from config (set nats.stream.update to apply): %s", spec.Name, strings.Join(diffs, "; "))
+	actual := stream.CachedInfo().Config.Subjects
+	for _, kind := range contract.Kinds {
+		probe := contract.Subject(cfg.SubjectPrefix, "probe", kind)
+		if !contract.Captures(actual, probe) {
+			return nil, fmt.Errorf("stream %s subjects %v do not capture %s", spec.Name, actual, contract.FilterSubject(cfg.SubjectPrefix, kind))
+		}
+	}
+	// A stream capturing commands would acknowledge them in place of the agent
+	if contract.Captures(actual, contract.Subject(cfg.SubjectPrefix, "probe", contract.KindCommand)) {
+		log.Printf("WARNING: stream %s subjects %v capture agent commands; set nats.stream.update to fix", spec.Name, actual)
+	}
+	return stream, nil
+}
+
+var retentionPolicies = map[string]jetstream.RetentionPolicy{
+	contract.RetentionLimits:    jetstream.LimitsPolicy,
+	contract.RetentionInterest:  jetstream.InterestPolicy,
+	contract.RetentionWorkQueue: jetstream.WorkQueuePolicy,
+}
+
+func streamConfig(spec contract.StreamSpec) jetstream.StreamConfig {
+	maxBytes := spec.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = -1
+	}
+	return jetstream.StreamConfig{
+		Name:       spec.Name,
+		Subjects:   spec.Subjects,
+		Retention:  retentionPolicies[spec.Retention],
+		Storage:    jetstream.FileStorage,
+		MaxAge:     spec.MaxAge,
+		MaxBytes:   maxBytes,
+		Replicas:   spec.Replicas,
+		Duplicates: spec.Duplicates,
+	}
+}
+
+func streamSpec(sc jetstream.StreamConfig) contract.StreamSpec {
+	spec := contract.StreamSpec{
+		Name:       sc.Name,
+		Subjects:   sc.Subjects,
+		MaxAge:     sc.MaxAge,
+		MaxBytes:   sc.MaxBytes,
+		Replicas:   sc.Replicas,
+		Duplicates: sc.Duplicates,
+	}
+	if spec.MaxBytes < 0 {
+		spec.MaxBytes = 0
+	}
+	for name, policy := range retentionPolicies {
+		if policy == sc.Retention {
+			spec.Retention = name
+		}
+	}
+	return spec
+}
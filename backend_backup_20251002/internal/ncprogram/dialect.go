@@ -0,0 +1,108 @@
+// internal/ncprogram/dialect.go
+package ncprogram
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Change describes a single modification made to a program during sanitization.
+// LineNumber is the 0-based index of the line in the original program,
+// or -1 for lines that were added.
+type Change struct {
+	LineNumber int    `json:"line_number"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	Reason     string `json:"reason"`
+}
+
+// SanitizeResult collects the changes and issues found while sanitizing a program.
+// It mirrors the result produced by the Python DNC feeder.
+type SanitizeResult struct {
+	Dialect  string   `json:"dialect"`
+	Changes  []Change `json:"changes"`
+	Warnings []string `json:"warnings"`
+	Errors   []string `json:"errors"`
+}
+
+// HasChanges reports whether sanitization modified the program.
+func (r *SanitizeResult) HasChanges() bool {
+	return len(r.Changes) > 0
+}
+
+// HasErrors reports whether the program should not be sent to the controller.
+func (r *SanitizeResult) HasErrors() bool {
+	return len(r.Errors) > 0
+}
+
+func (r *SanitizeResult) addChange(line int, before, after, reason string) {
+	r.Changes = append(r.Changes, Change{LineNumber: line, Before: before, After: after, Reason: reason})
+}
+
+func (r *SanitizeResult) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (r *SanitizeResult) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Dialect prepares NC program text for a particular controller family.
+type Dialect interface {
+	// Name returns the dialect identifier, e.g. "heidenhain" or "fanuc".
+	Name() string
+	// Sanitize returns the cleaned program text together with a report of what changed.
+	Sanitize(text string) (string, *SanitizeResult)
+}
+
+// controlCharsRE matches control characters except TAB, LF and CR.
+var controlCharsRE = regexp.MustCompile("[\x00-\x08\x0B\x0C\x0E-\x1F\x7F]")
+
+// splitLines splits program text on LF or CRLF line endings.
+func splitLines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// stripControlChars removes control characters from a line, recording the change.
+func stripControlChars(result *SanitizeResult, i int, line string) string {
+	clean := controlCharsRE.ReplaceAllString(line, "")
+	if clean != line {
+		result.addChange(i, line, clean, "Removed control characters")
+	}
+	return clean
+}
+
+// isASCII reports whether s contains only 7-bit characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 0x7F {
+			return false
+		}
+	}
+	return true
+}
+
+// ForController selects the dialect for a machine's controller_type.
+// Unknown or empty controller types fall back to HEIDENHAIN, which is
+// what the DNC feeder has always assumed.
+func ForController(controllerType string) Dialect {
+	ct := strings.ToLower(strings.TrimSpace(controllerType))
+	switch {
+	case ct == "", strings.Contains(ct, "heidenhain"), strings.Contains(ct, "tnc"):
+		return Heidenhain{}
+	case strings.Contains(ct, "fanuc"):
+		return NewISO(Fanuc)
+	case strings.Contains(ct, "siemens"), strings.Contains(ct, "sinumerik"):
+		return NewISO(Siemens)
+	case strings.Contains(ct, "iso"), strings.Contains(ct, "gcode"), strings.Contains(ct, "g-code"), strings.Contains(ct, "rs274"):
+		return NewISO(GenericISO)
+	default:
+		return Heidenhain{}
+	}
+}
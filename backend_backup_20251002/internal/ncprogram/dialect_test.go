@@ -0,0 +1,173 @@
+package ncprogram
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestForController(t *testing.T) {
+	tests := map[string]string{
+		"":                   "heidenhain",
+		"HEIDENHAIN TNC 640": "heidenhain",
+		"TNC 426":            "heidenhain",
+		"Fanuc 0i-MF":        "fanuc",
+		"Siemens 840D":       "siemens",
+		"SINUMERIK 828D":     "siemens",
+		"Generic ISO":        "iso",
+		"grbl g-code":        "iso",
+		"Mazatrol":           "heidenhain",
+	}
+	for controller, want := range tests {
+		if got := ForController(controller).Name(); got != want {
+			t.Errorf("ForController(%q) = %s, want %s", controller, got, want)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialect  Dialect
+		in       string
+		want     string
+		changes  int
+		warnings int
+		errors   int
+	}{
+		{
+			name:    "heidenhain normalizes program statements",
+			dialect: Heidenhain{},
+			in:      "0 begin pgm part mm\r\n1 L X+0 R0 FMAX\r\n2 end pgm Other mm\r\n",
+			want:    "0 BEGIN PGM PART mm\n1 L X+0 R0 FMAX\n2 END PGM PART mm",
+			changes: 2,
+		},
+		{
+			name:    "heidenhain strips control characters",
+			dialect: Heidenhain{},
+			in:      "0 BEGIN PGM A MM\n1 L X+0\x07\n2 END PGM A MM",
+			want:    "0 BEGIN PGM A MM\n1 L X+0\n2 END PGM A MM",
+			changes: 1,
+		},
+		{
+			name:    "heidenhain mismatched program statements",
+			dialect: Heidenhain{},
+			in:      "0 BEGIN PGM A MM\n1 L X+0",
+			want:    "0 BEGIN PGM A MM\n1 L X+0",
+			errors:  1,
+		},
+		{
+			name:     "heidenhain long line",
+			dialect:  Heidenhain{},
+			in:       "0 BEGIN PGM A MM\n1 L X+0 " + strings.Repeat("Y", 130) + "\n2 END PGM A MM",
+			want:     "0 BEGIN PGM A MM\n1 L X+0 " + strings.Repeat("Y", 130) + "\n2 END PGM A MM",
+			warnings: 1,
+		},
+		{
+			name:    "fanuc strips block numbers and upper-cases",
+			dialect: NewISO(Fanuc),
+			in:      "%\nO1000\nn10 g0 x1 (START)\nN20 M30\n%",
+			want:    "%\nO1000\nG0 X1 (START)\nM30\n%",
+			changes: 2,
+		},
+		{
+			name:    "fanuc converts comments and adds delimiters",
+			dialect: NewISO(Fanuc),
+			in:      "O1000\nG0 X1 ; go (home)\nM30",
+			want:    "%\nO1000\nG0 X1 (go home)\nM30\n%",
+			changes: 3,
+		},
+		{
+			name:    "fanuc drops blocks left empty",
+			dialect: NewISO(Fanuc),
+			in:      "%\nN10\nM30\n%",
+			want:    "%\nM30\n%",
+			changes: 1,
+		},
+		{
+			name:    "fanuc line length limit",
+			dialect: NewISO(Fanuc),
+			in:      "%\nG1 X1 (" + strings.Repeat("A", 130) + ")\n%",
+			want:    "%\nG1 X1 (" + strings.Repeat("A", 130) + ")\n%",
+			errors:  1,
+		},
+		{
+			name:    "fanuc unterminated comment",
+			dialect: NewISO(Fanuc),
+			in:      "%\nG0 (OOPS\n%",
+			want:    "%\nG0 (OOPS\n%",
+			errors:  1,
+		},
+		{
+			name:    "siemens removes delimiters and converts comments",
+			dialect: NewISO(Siemens),
+			in:      "%\nN10 G0 X1 (RAPID) (HOME)\nM30\n%",
+			want:    "G0 X1 ; RAPID HOME\nM30",
+			changes: 3,
+		},
+		{
+			name:    "siemens keeps assignments",
+			dialect: NewISO(Siemens),
+			in:      "R1=10 ; radius\nG1 X=R1",
+			want:    "R1=10 ; radius\nG1 X=R1",
+		},
+		{
+			name:    "generic iso keeps block numbers and case",
+			dialect: NewISO(GenericISO),
+			in:      "%\nn10 g0 x1 (start)\n%",
+			want:    "%\nn10 g0 x1 (start)\n%",
+		},
+		{
+			name:    "lone percent after blank lines gets its end",
+			dialect: NewISO(GenericISO),
+			in:      "\n\n%\nG0 X1",
+			want:    "\n\n%\nG0 X1\n%",
+			changes: 1,
+		},
+		{
+			name:    "lone percent",
+			dialect: NewISO(GenericISO),
+			in:      "\n%",
+			want:    "\n%\n%",
+			changes: 1,
+		},
+		{
+			name:    "empty program",
+			dialect: NewISO(Fanuc),
+			in:      "",
+			want:    "%\n%",
+			changes: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, result := tt.dialect.Sanitize(tt.in)
+			if got != tt.want {
+				t.Errorf("Sanitize =\n%q\nwant\n%q", got, tt.want)
+			}
+			if result.Dialect != tt.dialect.Name() {
+				t.Errorf("result dialect = %s, want %s", result.Dialect, tt.dialect.Name())
+			}
+			if len(result.Changes) != tt.changes {
+				t.Errorf("changes = %+v, want %d", result.Changes, tt.changes)
+			}
+			if len(result.Warnings) != tt.warnings {
+				t.Errorf("warnings = %q, want %d", result.Warnings, tt.warnings)
+			}
+			if len(result.Errors) != tt.errors {
+				t.Errorf("errors = %q, want %d", result.Errors, tt.errors)
+			}
+		})
+	}
+}
+
+func TestSanitizeIdempotent(t *testing.T) {
+	in := "O1000\nn10 g0 x1 ; go\nN20 M30"
+	for _, d := range []Dialect{Heidenhain{}, NewISO(Fanuc), NewISO(Siemens), NewISO(GenericISO)} {
+		once, _ := d.Sanitize(in)
+		twice, result := d.Sanitize(once)
+		if twice != once || result.HasChanges() {
+			t.Errorf("%s: second pass changed %q to %q", d.Name(), once, twice)
+		}
+	}
+}
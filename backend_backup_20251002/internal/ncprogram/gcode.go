@@ -0,0 +1,264 @@
+// internal/ncprogram/gcode.go
+package ncprogram
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TokenKind classifies a lexical element of an ISO (RS-274) block.
+type TokenKind int
+
+const (
+	// TokenWord is an address letter followed by a value, e.g. G01, X-12.5, N100.
+	TokenWord TokenKind = iota
+	// TokenComment is a parenthesised comment or a ';' comment running to end of line.
+	TokenComment
+	// TokenPercent is the '%' tape start/end delimiter.
+	TokenPercent
+	// TokenBlockDelete is the optional block skip '/' at the start of a block.
+	TokenBlockDelete
+	// TokenText is anything the lexer passes through verbatim, such as macro
+	// expressions (#100=[#1+2]) or Siemens assignments (R1=10).
+	TokenText
+)
+
+// String returns the name of the token kind.
+func (k TokenKind) String() string {
+	switch k {
+	case TokenWord:
+		return "word"
+	case TokenComment:
+		return "comment"
+	case TokenPercent:
+		return "percent"
+	case TokenBlockDelete:
+		return "block_delete"
+	case TokenText:
+		return "text"
+	default:
+		return "unknown"
+	}
+}
+
+// Token is a single lexical element of a block. Text always holds the
+// exact source text so that blocks can be reassembled without loss.
+type Token struct {
+	Kind   TokenKind
+	Letter byte   // Upper-case address letter for TokenWord
+	Value  string // Numeric value for TokenWord, body for TokenComment
+	Text   string
+}
+
+// Block is one line of an ISO program.
+type Block struct {
+	LineNumber int // 0-based line index in the source text
+	Tokens     []Token
+}
+
+// Number returns the N block number if the block has one.
+func (b Block) Number() (string, bool) {
+	for _, t := range b.Tokens {
+		if t.Kind == TokenWord && t.Letter == 'N' {
+			return t.Value, true
+		}
+	}
+	return "", false
+}
+
+// Words returns the address words of the block in order.
+func (b Block) Words() []Token {
+	var words []Token
+	for _, t := range b.Tokens {
+		if t.Kind == TokenWord {
+			words = append(words, t)
+		}
+	}
+	return words
+}
+
+// IsDelimiter reports whether the block consists only of a '%' delimiter.
+func (b Block) IsDelimiter() bool {
+	return len(b.Tokens) == 1 && b.Tokens[0].Kind == TokenPercent
+}
+
+// String reassembles the block, separating tokens with a single space.
+// A block skip '/' stays attached to the following token.
+func (b Block) String() string {
+	var sb strings.Builder
+	for i, t := range b.Tokens {
+		if i > 0 && b.Tokens[i-1].Kind != TokenBlockDelete {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(t.Text)
+	}
+	return sb.String()
+}
+
+// LexError reports a malformed block.
+type LexError struct {
+	Line    int // 0-based
+	Column  int // 0-based
+	Message string
+}
+
+func (e *LexError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line+1, e.Column+1, e.Message)
+}
+
+// Lex splits a single block into tokens.
+func Lex(line string) ([]Token, error) {
+	var tokens []Token
+	i := 0
+	n := len(line)
+
+	for i < n {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+
+		case c == '%':
+			tokens = append(tokens, Token{Kind: TokenPercent, Text: "%"})
+			i++
+
+		case c == '/' && len(tokens) == 0:
+			tokens = append(tokens, Token{Kind: TokenBlockDelete, Text: "/"})
+			i++
+
+		case c == '(':
+			end := strings.IndexByte(line[i:], ')')
+			if end < 0 {
+				return tokens, &LexError{Column: i, Message: "unterminated comment"}
+			}
+			text := line[i : i+end+1]
+			tokens = append(tokens, Token{Kind: TokenComment, Value: text[1 : len(text)-1], Text: text})
+			i += end + 1
+
+		case c == ';':
+			text := line[i:]
+			tokens = append(tokens, Token{Kind: TokenComment, Value: text[1:], Text: text})
+			i = n
+
+		case isLetter(c):
+			j := i + 1
+			if j < n && isNumberStart(line[j]) {
+				j = scanNumber(line, j)
+				if j < n && !isSeparator(line[j]) {
+					// Something like G1=... or X1.2.3; keep it verbatim.
+					j = scanText(line, i)
+					tokens = append(tokens, Token{Kind: TokenText, Text: line[i:j]})
+				} else {
+					tokens = append(tokens, Token{
+						Kind:   TokenWord,
+						Letter: upper(c),
+						Value:  line[i+1 : j],
+						Text:   line[i:j],
+					})
+				}
+				i = j
+				continue
+			}
+			j = scanText(line, i)
+			tokens = append(tokens, Token{Kind: TokenText, Text: line[i:j]})
+			i = j
+
+		default:
+			j := scanText(line, i)
+			if j == i {
+				j++
+			}
+			tokens = append(tokens, Token{Kind: TokenText, Text: line[i:j]})
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+// Parse lexes every line of text into blocks. Lines that fail to lex are
+// still returned, with the tokens read before the error, and the errors
+// are collected rather than aborting the parse.
+func Parse(text string) ([]Block, []error) {
+	lines := splitLines(text)
+	blocks := make([]Block, 0, len(lines))
+	var errs []error
+
+	for i, line := range lines {
+		tokens, err := Lex(line)
+		if err != nil {
+			if lexErr, ok := err.(*LexError); ok {
+				lexErr.Line = i
+			}
+			errs = append(errs, err)
+		}
+		blocks = append(blocks, Block{LineNumber: i, Tokens: tokens})
+	}
+
+	return blocks, errs
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - ('a' - 'A')
+	}
+	return c
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNumberStart(c byte) bool {
+	return isDigit(c) || c == '-' || c == '+' || c == '.'
+}
+
+func isSeparator(c byte) bool {
+	return c == ' ' || c == '\t' || c == '(' || c == ';' || isLetter(c)
+}
+
+// scanNumber returns the end of a signed decimal number starting at i.
+func scanNumber(s string, i int) int {
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
+	}
+	seenDot := false
+	for i < len(s) {
+		if isDigit(s[i]) {
+			i++
+		} else if s[i] == '.' && !seenDot {
+			seenDot = true
+			i++
+		} else {
+			break
+		}
+	}
+	return i
+}
+
+// scanText returns the end of a verbatim run, stopping at whitespace or a
+// comment. Brackets and parentheses glued to the run, as in #1=[#2+1] or
+// MSG("TEXT"), are kept inside it.
+func scanText(s string, i int) int {
+	start := i
+	depth := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '[' || (c == '(' && i > start):
+			depth++
+		case c == ']' || c == ')':
+			if depth > 0 {
+				depth--
+			}
+		case depth == 0 && (c == ' ' || c == '\t' || c == '(' || c == ';'):
+			return i
+		}
+		i++
+	}
+	return i
+}
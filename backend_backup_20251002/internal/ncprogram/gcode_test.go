@@ -0,0 +1,144 @@
+package ncprogram
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []Token
+		text string // Reassembled block if it differs from line
+	}{
+		{
+			name: "words",
+			line: "N10 G01 X-12.5 y+.5 F200",
+			want: []Token{
+				{Kind: TokenWord, Letter: 'N', Value: "10", Text: "N10"},
+				{Kind: TokenWord, Letter: 'G', Value: "01", Text: "G01"},
+				{Kind: TokenWord, Letter: 'X', Value: "-12.5", Text: "X-12.5"},
+				{Kind: TokenWord, Letter: 'Y', Value: "+.5", Text: "y+.5"},
+				{Kind: TokenWord, Letter: 'F', Value: "200", Text: "F200"},
+			},
+		},
+		{
+			name: "words without spaces",
+			line: "G0X1Y2",
+			want: []Token{
+				{Kind: TokenWord, Letter: 'G', Value: "0", Text: "G0"},
+				{Kind: TokenWord, Letter: 'X', Value: "1", Text: "X1"},
+				{Kind: TokenWord, Letter: 'Y', Value: "2", Text: "Y2"},
+			},
+			text: "G0 X1 Y2",
+		},
+		{
+			name: "percent",
+			line: "%",
+			want: []Token{{Kind: TokenPercent, Text: "%"}},
+		},
+		{
+			name: "parenthesised comment",
+			line: "G00 (RAPID) X0",
+			want: []Token{
+				{Kind: TokenWord, Letter: 'G', Value: "00", Text: "G00"},
+				{Kind: TokenComment, Value: "RAPID", Text: "(RAPID)"},
+				{Kind: TokenWord, Letter: 'X', Value: "0", Text: "X0"},
+			},
+		},
+		{
+			name: "end-of-line comment",
+			line: "G1 X1 ; feed (slow)",
+			want: []Token{
+				{Kind: TokenWord, Letter: 'G', Value: "1", Text: "G1"},
+				{Kind: TokenWord, Letter: 'X', Value: "1", Text: "X1"},
+				{Kind: TokenComment, Value: " feed (slow)", Text: "; feed (slow)"},
+			},
+		},
+		{
+			name: "block delete",
+			line: "/M01",
+			want: []Token{
+				{Kind: TokenBlockDelete, Text: "/"},
+				{Kind: TokenWord, Letter: 'M', Value: "01", Text: "M01"},
+			},
+		},
+		{
+			name: "macro expression",
+			line: "#100=[#1+2] G0",
+			want: []Token{
+				{Kind: TokenText, Text: "#100=[#1+2]"},
+				{Kind: TokenWord, Letter: 'G', Value: "0", Text: "G0"},
+			},
+		},
+		{
+			name: "siemens assignment and call",
+			line: `R1=10 MSG("DONE")`,
+			want: []Token{
+				{Kind: TokenText, Text: "R1=10"},
+				{Kind: TokenText, Text: `MSG("DONE")`},
+			},
+		},
+		{
+			name: "empty",
+			line: "  \t",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Lex(tt.line)
+			if err != nil {
+				t.Fatalf("Lex(%q): %v", tt.line, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lex(%q) =\n%+v\nwant\n%+v", tt.line, got, tt.want)
+			}
+			text := tt.text
+			if text == "" && tt.want != nil {
+				text = tt.line
+			}
+			if s := (Block{Tokens: got}).String(); s != text {
+				t.Errorf("reassembled %q, want %q", s, text)
+			}
+		})
+	}
+}
+
+func TestLexUnterminatedComment(t *testing.T) {
+	_, err := Lex("G0 (NO END")
+	lexErr, ok := err.(*LexError)
+	if !ok {
+		t.Fatalf("error = %v, want *LexError", err)
+	}
+	if lexErr.Column != 3 {
+		t.Errorf("column = %d, want 3", lexErr.Column)
+	}
+}
+
+func TestParse(t *testing.T) {
+	blocks, errs := Parse("%\r\nN5 G0 X0\r\nG1 (BAD\r\n%\r\n")
+	if len(blocks) != 4 {
+		t.Fatalf("got %d blocks, want 4", len(blocks))
+	}
+	if !blocks[0].IsDelimiter() || !blocks[3].IsDelimiter() {
+		t.Error("first and last blocks should be delimiters")
+	}
+	if n, ok := blocks[1].Number(); !ok || n != "5" {
+		t.Errorf("block number = %q, %t; want 5", n, ok)
+	}
+	if words := blocks[1].Words(); len(words) != 3 {
+		t.Errorf("got %d words, want 3", len(words))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1", len(errs))
+	}
+	if lexErr := errs[0].(*LexError); lexErr.Line != 2 {
+		t.Errorf("error line = %d, want 2", lexErr.Line)
+	}
+	if len(blocks[2].Tokens) != 1 {
+		t.Errorf("tokens before the error = %d, want 1", len(blocks[2].Tokens))
+	}
+}
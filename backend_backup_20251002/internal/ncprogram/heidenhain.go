@@ -0,0 +1,77 @@
+// internal/ncprogram/heidenhain.go
+package ncprogram
+
+import (
+	"regexp"
+	"strings"
+)
+
+// heidenhainMaxLineLength is the traditional block length limit for TNC controls.
+const heidenhainMaxLineLength = 132
+
+var (
+	beginPgmRE = regexp.MustCompile(`(?i)^(\s*\d*\s*)BEGIN\s+PGM\s+(\S+)(.*)$`)
+	endPgmRE   = regexp.MustCompile(`(?i)^(\s*\d*\s*)END\s+PGM\s+(\S+)(.*)$`)
+)
+
+// Heidenhain sanitizes HEIDENHAIN TNC conversational programs.
+// The rules match feeder_core/sanitize.py so that both sides agree.
+type Heidenhain struct{}
+
+// Name implements Dialect.
+func (Heidenhain) Name() string {
+	return "heidenhain"
+}
+
+// Sanitize implements Dialect.
+func (Heidenhain) Sanitize(text string) (string, *SanitizeResult) {
+	result := &SanitizeResult{Dialect: "heidenhain"}
+	lines := splitLines(text)
+	out := make([]string, 0, len(lines))
+
+	beginName := ""
+	beginCount, endCount := 0, 0
+
+	for i, original := range lines {
+		line := stripControlChars(result, i, original)
+
+		if m := beginPgmRE.FindStringSubmatch(line); m != nil {
+			beginCount++
+			beginName = strings.ToUpper(m[2])
+			normalized := m[1] + "BEGIN PGM " + beginName + m[3]
+			if normalized != line {
+				result.addChange(i, line, normalized, "Normalized BEGIN PGM statement")
+			}
+			out = append(out, normalized)
+			continue
+		}
+
+		if m := endPgmRE.FindStringSubmatch(line); m != nil {
+			endCount++
+			name := beginName
+			if name == "" {
+				name = strings.ToUpper(m[2])
+			}
+			normalized := m[1] + "END PGM " + name + m[3]
+			if normalized != line {
+				result.addChange(i, line, normalized, "Normalized END PGM statement")
+			}
+			out = append(out, normalized)
+			continue
+		}
+
+		if !isASCII(line) {
+			result.warnf("Line %d: Contains non-ASCII characters", i+1)
+		}
+		if len(line) > heidenhainMaxLineLength {
+			result.warnf("Line %d: Exceeds %d character limit (%d chars)", i+1, heidenhainMaxLineLength, len(line))
+		}
+		out = append(out, line)
+	}
+
+	if beginCount != endCount {
+		result.errorf("Mismatched BEGIN/END statements: %d BEGIN, %d END", beginCount, endCount)
+	}
+
+	return strings.Join(out, "\n"), result
+}
@@ -0,0 +1,220 @@
+// internal/ncprogram/iso.go
+package ncprogram
+
+import (
+	"strings"
+)
+
+// ISOProfile captures the differences between ISO (RS-274) controller families.
+type ISOProfile struct {
+	Name              string
+	CommentStyle      byte // '(' for parenthesised comments, ';' for end-of-line comments
+	StripComments     bool // Drop comments entirely, e.g. to save controller memory
+	StripBlockNumbers bool // Remove N words; drip feeding does not need them
+	UpperCase         bool // Upper-case address letters
+	PercentDelimiters bool // Program must start and end with a '%' line
+	MaxLineLength     int  // Maximum block length accepted by the controller, 0 = unlimited
+}
+
+var (
+	// Fanuc covers Fanuc and Fanuc-compatible controls (Haas, Brother, Mitsubishi in ISO mode).
+	Fanuc = ISOProfile{
+		Name:              "fanuc",
+		CommentStyle:      '(',
+		StripBlockNumbers: true,
+		UpperCase:         true,
+		PercentDelimiters: true,
+		MaxLineLength:     128,
+	}
+
+	// Siemens covers Sinumerik controls, which use ';' comments and no tape delimiters.
+	Siemens = ISOProfile{
+		Name:              "siemens",
+		CommentStyle:      ';',
+		StripBlockNumbers: true,
+		UpperCase:         true,
+		PercentDelimiters: false,
+		MaxLineLength:     512,
+	}
+
+	// GenericISO leaves the program as close to the source as possible.
+	GenericISO = ISOProfile{
+		Name:              "iso",
+		CommentStyle:      '(',
+		PercentDelimiters: true,
+		MaxLineLength:     256,
+	}
+)
+
+// ISO sanitizes ISO G-code programs according to an ISOProfile.
+type ISO struct {
+	profile ISOProfile
+}
+
+// NewISO creates an ISO dialect for the given controller profile.
+func NewISO(profile ISOProfile) *ISO {
+	return &ISO{profile: profile}
+}
+
+// Name implements Dialect.
+func (d *ISO) Name() string {
+	return d.profile.Name
+}
+
+// Profile returns the controller profile used by the dialect.
+func (d *ISO) Profile() ISOProfile {
+	return d.profile
+}
+
+// Sanitize implements Dialect.
+func (d *ISO) Sanitize(text string) (string, *SanitizeResult) {
+	result := &SanitizeResult{Dialect: d.profile.Name}
+	lines := splitLines(text)
+	out := make([]string, 0, len(lines)+2)
+
+	for i, original := range lines {
+		line := stripControlChars(result, i, original)
+
+		tokens, err := Lex(line)
+		if err != nil {
+			if lexErr, ok := err.(*LexError); ok {
+				lexErr.Line = i
+			}
+			result.errorf("%v", err)
+			out = append(out, line)
+			continue
+		}
+
+		after := line
+		if kept, reasons := d.rewrite(tokens); len(reasons) > 0 {
+			after = Block{Tokens: kept}.String()
+			result.addChange(i, line, after, strings.Join(reasons, "; "))
+			if after == "" && strings.TrimSpace(line) != "" {
+				// The block only contained things we stripped; drop the line.
+				continue
+			}
+		}
+
+		if !isASCII(after) {
+			result.warnf("Line %d: Contains non-ASCII characters", i+1)
+		}
+		if d.profile.MaxLineLength > 0 && len(after) > d.profile.MaxLineLength {
+			result.errorf("Line %d: Exceeds %s limit of %d characters (%d chars)", i+1, d.profile.Name, d.profile.MaxLineLength, len(after))
+		}
+		out = append(out, after)
+	}
+
+	if d.profile.PercentDelimiters {
+		out = ensureDelimiters(result, out)
+	}
+
+	return strings.Join(out, "\n"), result
+}
+
+// rewrite applies the profile to the tokens of one block and returns the
+// tokens to keep together with the reasons for any change.
+func (d *ISO) rewrite(tokens []Token) ([]Token, []string) {
+	var (
+		kept     = make([]Token, 0, len(tokens))
+		trailing []Token
+		reasons  []string
+	)
+	addReason := func(reason string) {
+		for _, r := range reasons {
+			if r == reason {
+				return
+			}
+		}
+		reasons = append(reasons, reason)
+	}
+
+	for _, t := range tokens {
+		switch t.Kind {
+		case TokenPercent:
+			if !d.profile.PercentDelimiters && len(tokens) == 1 {
+				addReason("Removed % tape delimiter")
+				continue
+			}
+
+		case TokenWord:
+			if t.Letter == 'N' && d.profile.StripBlockNumbers {
+				addReason("Removed block number")
+				continue
+			}
+			if d.profile.UpperCase && t.Text[0] != t.Letter {
+				t.Text = string(t.Letter) + t.Value
+				addReason("Upper-cased address letter")
+			}
+
+		case TokenComment:
+			if d.profile.StripComments {
+				addReason("Removed comment")
+				continue
+			}
+			if t.Text[0] != d.profile.CommentStyle {
+				t = convertComment(t, d.profile.CommentStyle)
+				addReason("Converted comment to " + string(d.profile.CommentStyle) + " style")
+			}
+			if t.Text[0] == ';' {
+				// End-of-line comments must stay at the end of the block.
+				trailing = append(trailing, t)
+				continue
+			}
+		}
+		kept = append(kept, t)
+	}
+
+	if len(trailing) > 0 {
+		if len(trailing) > 1 {
+			merged := make([]string, 0, len(trailing))
+			for _, t := range trailing {
+				merged = append(merged, strings.TrimSpace(t.Value))
+			}
+			trailing = []Token{{Kind: TokenComment, Value: " " + strings.Join(merged, " "), Text: "; " + strings.Join(merged, " ")}}
+			addReason("Merged end-of-line comments")
+		}
+		kept = append(kept, trailing...)
+	}
+
+	return kept, reasons
+}
+
+// convertComment rewrites a comment token into the requested style.
+func convertComment(t Token, style byte) Token {
+	body := strings.TrimSpace(t.Value)
+	if style == '(' {
+		// Fanuc comments cannot nest.
+		body = strings.NewReplacer("(", "", ")", "").Replace(body)
+		return Token{Kind: TokenComment, Value: body, Text: "(" + body + ")"}
+	}
+	return Token{Kind: TokenComment, Value: " " + body, Text: "; " + body}
+}
+
+// ensureDelimiters makes sure the program starts and ends with a lone '%' line.
+func ensureDelimiters(result *SanitizeResult, lines []string) []string {
+	first, last := -1, -1
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+	}
+
+	if first < 0 || strings.TrimSpace(lines[first]) != "%" {
+		result.addChange(-1, "", "%", "Added leading % delimiter")
+		lines = append([]string{"%"}, lines...)
+		first = 0
+		if last >= 0 {
+			last++
+		}
+	}
+	// A lone '%' is the start of the program, never also its end
+	if last <= first || strings.TrimSpace(lines[last]) != "%" {
+		result.addChange(-1, "", "%", "Added trailing % delimiter")
+		lines = append(lines, "%")
+	}
+	return lines
+}
@@ -11,7 +11,19 @@ import (
 )
 
 func NewNATSConnection(natsConfig config.NATSConfig) (*nats.Conn, jetstream.JetStream, error) {
-	nc, err := nats.Connect(natsConfig.URL)
+	opts := []nats.Option{nats.Name("CNC Monitor Backend")}
+	if natsConfig.Credentials != "" {
+		opts = append(opts, nats.UserCredentials(natsConfig.Credentials))
+	}
+	if natsConfig.TLS.Enabled {
+		tlsConfig, err := NewTLSConfig(natsConfig.TLS)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to configure NATS TLS: %w", err)
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+
+	nc, err := nats.Connect(natsConfig.URL, opts...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to connect to NATS: %w", err)
 	}
@@ -0,0 +1,17 @@
+// internal/platform/messaging/tls.go
+package messaging
+
+import (
+	"crypto/tls"
+	"log"
+
+	"cnc-monitor/contract"
+	"cnc-monitor/internal/config"
+)
+
+// NewTLSConfig builds a client tls.Config from cfg that picks up rotated
+// certificates on the next (re)connect; see contract.NewTLSConfig.
+func NewTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	files := contract.TLSFiles{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile, CAFile: cfg.CAFile, ServerName: cfg.ServerName}
+	return contract.NewTLSConfig(files, log.Printf)
+}
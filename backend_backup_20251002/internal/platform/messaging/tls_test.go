@@ -0,0 +1,197 @@
+package messaging
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cnc-monitor/contract/tlstest"
+	"cnc-monitor/internal/config"
+	"github.com/nats-io/nats.go"
+)
+
+// natsServer runs a nats-server that requires client certificates.
+type natsServer struct {
+	dir  string
+	port int
+	cmd  *exec.Cmd
+}
+
+// startNATSServer starts a nats-server with a server certificate of ca that
+// only accepts client certificates of ca. The test is skipped if nats-server
+// is not installed.
+func startNATSServer(t *testing.T, ca *tlstest.CA) *natsServer {
+	t.Helper()
+	if _, err := exec.LookPath("nats-server"); err != nil {
+		t.Skip("nats-server not in PATH")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	s := &natsServer{dir: t.TempDir(), port: port}
+	s.start(t, ca)
+	t.Cleanup(s.stop)
+	return s
+}
+
+func (s *natsServer) url() string {
+	return fmt.Sprintf("tls://localhost:%d", s.port)
+}
+
+// start (re)starts the server with a fresh certificate of ca.
+func (s *natsServer) start(t *testing.T, ca *tlstest.CA) {
+	t.Helper()
+	cert, key, caFile := filepath.Join(s.dir, "server.crt"), filepath.Join(s.dir, "server.key"), filepath.Join(s.dir, "ca.crt")
+	ca.Issue(t, cert, key, "nats", "localhost", "127.0.0.1")
+	ca.WriteCA(t, caFile)
+	conf := filepath.Join(s.dir, "nats.conf")
+	err := os.WriteFile(conf, []byte(fmt.Sprintf(`
+host: 127.0.0.1
+port: %d
+tls {
+  cert_file: %q
+  key_file: %q
+  ca_file: %q
+  verify: true
+  timeout: 2
+}
+`, s.port, cert, key, caFile)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.cmd = exec.Command("nats-server", "-c", conf)
+	if err := s.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", s.port), time.Second)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			s.stop()
+			t.Fatalf("nats-server did not start: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (s *natsServer) stop() {
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+		s.cmd = nil
+	}
+}
+
+// issueClient writes a client certificate of ca and the CA bundle the
+// client verifies the server with into dir.
+func issueClient(t *testing.T, dir string, ca, serverCA *tlstest.CA) config.TLSConfig {
+	t.Helper()
+	cfg := config.TLSConfig{
+		Enabled:  true,
+		CertFile: filepath.Join(dir, "client.crt"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+	ca.Issue(t, cfg.CertFile, cfg.KeyFile, "backend")
+	serverCA.WriteCA(t, cfg.CAFile)
+	return cfg
+}
+
+func TestNATSConnectionMutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t, "cnc-ca")
+	other := tlstest.NewCA(t, "other-ca")
+	server := startNATSServer(t, ca)
+
+	tests := []struct {
+		name    string
+		tls     func(dir string) config.TLSConfig
+		wantErr bool
+	}{
+		{
+			name: "client certificate of the server's CA",
+			tls:  func(dir string) config.TLSConfig { return issueClient(t, dir, ca, ca) },
+		},
+		{
+			name:    "client certificate of another CA",
+			tls:     func(dir string) config.TLSConfig { return issueClient(t, dir, other, ca) },
+			wantErr: true,
+		},
+		{
+			name: "no client certificate",
+			tls: func(dir string) config.TLSConfig {
+				cfg := issueClient(t, dir, ca, ca)
+				cfg.CertFile, cfg.KeyFile = "", ""
+				return cfg
+			},
+			wantErr: true,
+		},
+		{
+			name:    "server certificate of an untrusted CA",
+			tls:     func(dir string) config.TLSConfig { return issueClient(t, dir, ca, other) },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc, _, err := NewNATSConnection(config.NATSConfig{URL: server.url(), TLS: tt.tls(t.TempDir())})
+			if err == nil {
+				nc.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("connect: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNATSConnectionCertificateRotation(t *testing.T) {
+	oldCA := tlstest.NewCA(t, "cnc-ca-2024")
+	newCA := tlstest.NewCA(t, "cnc-ca-2025")
+	server := startNATSServer(t, oldCA)
+
+	dir := t.TempDir()
+	cfg := issueClient(t, dir, oldCA, oldCA)
+	tc, err := NewTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reconnected := make(chan struct{}, 1)
+	nc, err := nats.Connect(server.url(), nats.Secure(tc),
+		nats.MaxReconnects(-1), nats.ReconnectWait(100*time.Millisecond),
+		nats.ReconnectHandler(func(*nats.Conn) { reconnected <- struct{}{} }))
+	if err != nil {
+		t.Fatalf("connect before rotation: %v", err)
+	}
+	defer nc.Close()
+
+	// Rotate the server and client to the new CA; the live connection must
+	// reconnect with the rotated files through the same tls.Config
+	server.stop()
+	issueClient(t, dir, newCA, newCA)
+	server.start(t, newCA)
+
+	select {
+	case <-reconnected:
+	case <-time.After(15 * time.Second):
+		t.Fatalf("no reconnect after rotation, last error: %v", nc.LastError())
+	}
+	if err := nc.Publish("rotation.check", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Errorf("flush after rotation: %v", err)
+	}
+}
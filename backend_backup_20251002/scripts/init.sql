@@ -15,11 +15,72 @@ CREATE TABLE sensor_data (
     machine_state TEXT,
     active_program_line INTEGER,
     total_power_kw DOUBLE PRECISION,
+    -- Fields and channels the agent had no usable value for (their columns hold 0)
+    missing TEXT[],
     
     -- Unique constraint to prevent duplicate sequence numbers per machine
     UNIQUE(machine_id, sequence_number)
 );
 
+CREATE INDEX idx_sensor_data_machine_time ON sensor_data(machine_id, time DESC);
+
+-- Channels beyond the fixed sensor_data columns, one row per value
+CREATE TABLE IF NOT EXISTS sensor_channel_data (
+    time TIMESTAMPTZ NOT NULL,
+    machine_id TEXT NOT NULL,
+    sequence_number BIGINT NOT NULL,
+    channel TEXT NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    UNIQUE(machine_id, sequence_number, channel)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sensor_channel_data_channel_time ON sensor_channel_data(machine_id, channel, time DESC);
+
+-- Channel catalog: the channels each machine's agent delivers, built from its
+-- sensor metadata and replaced whenever the agent publishes a new catalog
+CREATE TABLE IF NOT EXISTS machine_channels (
+    machine_id TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    sensor TEXT NOT NULL,
+    units TEXT,
+    description TEXT,
+    min_value DOUBLE PRECISION,
+    max_value DOUBLE PRECISION,
+    precision INTEGER,
+    tags JSONB,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (machine_id, channel)
+);
+
+-- Desired configuration of each machine's agent, pushed to the agents over the
+-- config bucket, and the version the agent last reported applying.
+CREATE TABLE IF NOT EXISTS agent_configs (
+    machine_id TEXT PRIMARY KEY,
+    version BIGINT NOT NULL DEFAULT 0,
+    settings JSONB NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    applied_version BIGINT,
+    applied BOOLEAN,
+    apply_error TEXT,
+    reported_at TIMESTAMPTZ
+);
+
+-- Readings rejected because their sequence number was already used by a
+-- different reading (an agent that lost its sequence state). Genuine duplicates
+-- are dropped; these are kept for inspection.
+CREATE TABLE IF NOT EXISTS sensor_data_conflicts (
+    time TIMESTAMPTZ NOT NULL,
+    machine_id TEXT NOT NULL,
+    sequence_number BIGINT NOT NULL,
+    -- Timestamp of the stored reading holding the sequence number
+    existing_time TIMESTAMPTZ NOT NULL,
+    payload JSONB NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE(machine_id, sequence_number, time)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sensor_data_conflicts_machine_time ON sensor_data_conflicts(machine_id, time DESC);
+
 CREATE TABLE machines (
     id TEXT PRIMARY KEY,
     name TEXT NOT NULL,
@@ -53,9 +114,14 @@ CREATE TABLE IF NOT EXISTS dnc_transfers (
     params JSONB,
     started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     completed_at TIMESTAMPTZ,
-    status TEXT
+    status TEXT,
+    -- Time of the newest running/paused event applied; used to order running/paused updates
+    last_event_at TIMESTAMPTZ
 );
 
+-- Upgrade path for databases created before last_event_at existed
+ALTER TABLE dnc_transfers ADD COLUMN IF NOT EXISTS last_event_at TIMESTAMPTZ;
+
 CREATE TABLE IF NOT EXISTS dnc_events (
     time TIMESTAMPTZ NOT NULL,
     transfer_id TEXT NOT NULL,
@@ -71,6 +137,16 @@ CREATE TABLE IF NOT EXISTS dnc_events (
     extra JSONB
 );
 
+-- Remove duplicates left by redelivery before the natural key existed
+DELETE FROM dnc_events a USING dnc_events b
+WHERE a.ctid < b.ctid
+  AND a.transfer_id = b.transfer_id AND a.time = b.time
+  AND a.event IS NOT DISTINCT FROM b.event
+  AND a.state IS NOT DISTINCT FROM b.state
+  AND a.line IS NOT DISTINCT FROM b.line;
+
+-- Natural key: a redelivered progress event must not create a second row
+CREATE UNIQUE INDEX IF NOT EXISTS uq_dnc_events_natural ON dnc_events(transfer_id, time, event, state, line);
 CREATE INDEX IF NOT EXISTS idx_dnc_events_machine_time ON dnc_events(machine_id, time DESC);
 CREATE INDEX IF NOT EXISTS idx_dnc_events_transfer_time ON dnc_events(transfer_id, time DESC);
 
@@ -0,0 +1,131 @@
+// scripts/mint_edge_creds.go
+//
+// Mints per-machine NATS credentials for an edge agent. The agent may only
+// publish under <prefix>.<machine_id>.>, so it cannot impersonate another machine,
+// and may only read its own key of the config bucket and commands.
+//
+// Decentralized (operator/JWT) auth, writes a .creds file for nats.credentials:
+//
+//	go run scripts/mint_edge_creds.go -machine CNC-PI-002 -account-seed account.nk -out CNC-PI-002.creds
+//
+// Server-config (NKey) auth, writes a seed file for nats.nkey_seed_file and prints
+// the authorization entry to add to nats-server.conf:
+//
+//	go run scripts/mint_edge_creds.go -machine CNC-PI-002 -nkey -out CNC-PI-002.nk
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"cnc-monitor/contract"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+func main() {
+	machineID := flag.String("machine", "", "Machine ID of the edge agent (required)")
+	prefix := flag.String("prefix", contract.DefaultSubjectPrefix, "Edge subject prefix")
+	stream := flag.String("stream", contract.DefaultStream, "JetStream stream the agent publishes to")
+	bucket := flag.String("bucket", contract.DefaultConfigBucket, "Key-value bucket holding the agents' desired configuration")
+	accountSeedFile := flag.String("account-seed", "", "Account (or account signing key) seed file used to sign the user JWT")
+	issuerAccount := flag.String("issuer-account", "", "Account public key, when -account-seed is a signing key")
+	expiry := flag.Duration("expiry", 0, "Credential lifetime, 0 for no expiry")
+	nkeyOnly := flag.Bool("nkey", false, "Mint a bare NKey user for server-config auth instead of a JWT")
+	out := flag.String("out", "", "Output file (default stdout)")
+	flag.Parse()
+
+	if err := contract.ValidateMachineID(*machineID); err != nil {
+		log.Fatalf("-machine: %v", err)
+	}
+
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		log.Fatalf("Error creating user key: %v", err)
+	}
+	userPub, _ := user.PublicKey()
+	userSeed, _ := user.Seed()
+
+	allowPub := edgePublishSubjects(*prefix, *machineID, *stream, *bucket)
+	allowSub := []string{"_INBOX.>", contract.Subject(*prefix, *machineID, contract.KindCommand)}
+
+	var output []byte
+	if *nkeyOnly {
+		output = userSeed
+		fmt.Fprintf(os.Stderr, "Add to the authorization block of nats-server.conf:\n\n")
+		fmt.Fprintf(os.Stderr, "  { nkey: %s\n    permissions: { publish: { allow: %s }, subscribe: { allow: %s }, allow_responses: true } }\n\n",
+			userPub, quoteList(allowPub), quoteList(allowSub))
+	} else {
+		if *accountSeedFile == "" {
+			log.Fatal("-account-seed is required unless -nkey is set")
+		}
+		seed, err := os.ReadFile(*accountSeedFile)
+		if err != nil {
+			log.Fatalf("Error reading account seed: %v", err)
+		}
+		account, err := nkeys.FromSeed([]byte(strings.TrimSpace(string(seed))))
+		if err != nil {
+			log.Fatalf("Error parsing account seed: %v", err)
+		}
+
+		claims := jwt.NewUserClaims(userPub)
+		claims.Name = *machineID
+		claims.Tags.Add("cnc-edge", "machine:"+strings.ToLower(*machineID))
+		claims.Pub.Allow.Add(allowPub...)
+		claims.Sub.Allow.Add(allowSub...)
+		// Answer command requests
+		claims.Resp = &jwt.ResponsePermission{MaxMsgs: 1, Expires: time.Minute}
+		claims.IssuerAccount = *issuerAccount
+		if *expiry > 0 {
+			claims.Expires = time.Now().Add(*expiry).Unix()
+		}
+
+		userJWT, err := claims.Encode(account)
+		if err != nil {
+			log.Fatalf("Error signing user JWT: %v", err)
+		}
+		output, err = jwt.FormatUserConfig(userJWT, userSeed)
+		if err != nil {
+			log.Fatalf("Error formatting credentials: %v", err)
+		}
+	}
+
+	if *out == "" {
+		os.Stdout.Write(output)
+		return
+	}
+	if err := os.WriteFile(*out, output, 0600); err != nil {
+		log.Fatalf("Error writing %s: %v", *out, err)
+	}
+	log.Printf("Wrote credentials for %s (user %s) to %s", *machineID, userPub, *out)
+}
+
+// edgePublishSubjects lists what an agent needs to publish: its own subjects,
+// the JetStream API calls it makes against the stream (info on start-up) and
+// those of watching its key in the config bucket. The watch is an ephemeral
+// ordered consumer with a generated name, so deleting it cannot be scoped to
+// the machine; it is not allowed, and the server removes the consumer once
+// the agent stops listening.
+func edgePublishSubjects(prefix, machineID, stream, bucket string) []string {
+	kvStream := "KV_" + bucket
+	return []string{
+		contract.MachineSubjects(prefix, machineID),
+		"$JS.API.INFO",
+		"$JS.API.STREAM.INFO." + stream,
+		"$JS.API.STREAM.INFO." + kvStream,
+		"$JS.API.CONSUMER.CREATE." + kvStream + ".*." + contract.ConfigKeySubject(bucket, machineID),
+		"$JS.FC." + kvStream + ".>",
+	}
+}
+
+func quoteList(subjects []string) string {
+	quoted := make([]string, len(subjects))
+	for i, s := range subjects {
+		quoted[i] = fmt.Sprintf("%q", s)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
@@ -13,12 +13,13 @@ import (
 
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
+	"cnc-monitor/contract"
 	"cnc-monitor/internal/ingestion"
 )
 
 const (
 	natsURL        = "nats://localhost:4222"
-	streamName     = "CNC_DATA"
+	subjectPrefix  = contract.DefaultSubjectPrefix
 	numGoroutines  = 10
 	messagesPerGoroutine = 1000
 	testDuration   = 10 * time.Second
@@ -77,7 +78,7 @@ func main() {
 				}
 
 				// Publish without artificial delay
-				subject := fmt.Sprintf("%s.perf", streamName)
+				subject := contract.Subject(subjectPrefix, data.MachineID, contract.KindTelemetry)
 				if _, err := js.Publish(context.Background(), subject, jsonData); err != nil {
 					log.Printf("Error publishing: %v", err)
 					continue
@@ -3,16 +3,19 @@ package main
 
 import (
 "context"
+"encoding/binary"
 "encoding/json"
 "log"
 "time"
 
+"cnc-monitor/contract"
 "github.com/nats-io/nats.go"
 "github.com/nats-io/nats.go/jetstream"
 )
 
 type SensorData struct {
 	MachineID         string    `json:"machine_id"`
+	SequenceNumber    uint64    `json:"sequence_number"`
 	Temperature       float64   `json:"temperature"`
 	SpindleSpeed      float64   `json:"spindle_speed"`
 	Timestamp         time.Time `json:"timestamp"`
@@ -40,6 +43,7 @@ func main() {
 
 	data := SensorData{
 		MachineID:         "CNC-001",
+		SequenceNumber:    uint64(time.Now().UnixNano()),
 		Temperature:       45.5,
 		SpindleSpeed:      1200.0,
 		Timestamp:         time.Now().UTC(),
@@ -58,8 +62,12 @@ func main() {
 		log.Fatalf("Error marshalling JSON: %v", err)
 	}
 
-	// Publish to a subject that matches the stream config, e.g., "CNC_DATA.metrics"
-	_, err = js.Publish(context.Background(), "CNC_DATA.metrics", jsonData)
+	// Ingestion expects length-prefixed frames on the machine's telemetry subject,
+	// e.g. "CNC.EDGE.CNC-001.telemetry".
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(jsonData)))
+	frame = append(frame, jsonData...)
+	subject := contract.Subject(contract.DefaultSubjectPrefix, data.MachineID, contract.KindTelemetry)
+	_, err = js.Publish(context.Background(), subject, frame)
 	if err != nil {
 		log.Fatalf("Error publishing message: %v", err)
 	}
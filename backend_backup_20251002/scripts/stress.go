@@ -8,11 +8,12 @@ import (
 	"sync"
 	"time"
 	"github.com/nats-io/nats.go"
+	"cnc-monitor/contract"
 	"cnc-monitor/internal/ingestion"
 )
 const (
 	natsURL        = "nats://localhost:4222"
-	streamName     = "CNC_DATA"
+	subjectPrefix  = contract.DefaultSubjectPrefix
 	numMachines    = 5
 	messagesPerMachine = 20
 	publishDelay   = 100 * time.Millisecond
@@ -55,7 +56,7 @@ func main() {
 					continue
 				}
 				// Publish the message
-				subject := fmt.Sprintf("%s.%s", streamName, machineName)
+				subject := contract.Subject(subjectPrefix, machineName, contract.KindTelemetry)
 				if err := nc.Publish(subject, jsonData); err != nil {
 					log.Printf("[Machine: %s] Error publishing message: %v", machineName, err)
 				} else {
@@ -70,7 +71,7 @@ func main() {
 	// --- Test Error Handling: Publish a malformed message ---
 	log.Println("Now testing error handling by publishing a malformed message...")
 	malformedData := []byte("{\"machine_id\": \"CNC-MALFORMED\", \"temperature\": \"not-a-float\"}")
-	subject := fmt.Sprintf("%s.malformed", streamName)
+	subject := contract.Subject(subjectPrefix, "CNC-MALFORMED", contract.KindTelemetry)
 	if err := nc.Publish(subject, malformedData); err != nil {
 		log.Printf("Error publishing malformed message: %v", err)
 	} else {
@@ -7,7 +7,7 @@ from pathlib import Path
 class Config:
     program_dir: Path
     nats_url: str
-    nats_stream: str
+    nats_subject_prefix: str
     machine_id: str
     sender_path: str
     log_level: str
@@ -18,7 +18,8 @@ def load_config() -> Config:
     program_dir.mkdir(parents=True, exist_ok=True)
 
     nats_url = os.getenv("NATS_URL", "nats://localhost:4222")
-    nats_stream = os.getenv("NATS_STREAM", "DNC_PROGRESS")
+    # Shared subject contract: events go to <prefix>.<machine_id>.dnc (see contract/ in the backend)
+    nats_subject_prefix = os.getenv("NATS_SUBJECT_PREFIX", "CNC.EDGE")
     machine_id = os.getenv("MACHINE_ID", "CNC-PI-001")
     sender_path = os.getenv("HEIDENHAIN_SENDER", "/home/pi/heidenhain_sender.py")
     log_level = os.getenv("LOG_LEVEL", "info")
@@ -26,7 +27,7 @@ def load_config() -> Config:
     return Config(
         program_dir=program_dir,
         nats_url=nats_url,
-        nats_stream=nats_stream,
+        nats_subject_prefix=nats_subject_prefix,
         machine_id=machine_id,
         sender_path=sender_path,
         log_level=log_level,
@@ -57,7 +57,7 @@ async def startup():
         js = nc.jetstream()
         app.state.nc = nc
         app.state.js = js
-        app.state.publisher = NatsPublisher(js, cfg.nats_stream, cfg.machine_id)
+        app.state.publisher = NatsPublisher(js, cfg.nats_subject_prefix, cfg.machine_id)
         print(f"Connected to NATS at {cfg.nats_url}")
     except Exception as e:
         print(f"NATS connection failed (non-fatal): {e}")
@@ -2,14 +2,27 @@ import json
 from typing import Any, Dict
 
 
+def event_msg_id(payload: Dict[str, Any]) -> str:
+    """Natural key of a progress event, used as the JetStream Nats-Msg-Id.
+
+    Matches the unique key of the backend's dnc_events table, so a retried
+    publish is dropped by the stream's duplicate window and a redelivered
+    message is ignored by the consumer.
+    """
+    parts = []
+    for key in ("transfer_id", "ts", "event", "state", "line"):
+        value = payload.get(key)
+        parts.append("" if value is None else str(value))
+    return ":".join(parts)
+
+
 class NatsPublisher:
-    def __init__(self, js, stream: str, machine_id: str):
+    def __init__(self, js, subject_prefix: str, machine_id: str):
         self.js = js
-        self.stream = stream
+        self.subject_prefix = subject_prefix
         self.machine_id = machine_id
 
     async def publish_event(self, payload: Dict[str, Any]):
-        subject = f"{self.stream}.{payload.get('machine_id', self.machine_id)}"
+        subject = f"{self.subject_prefix}.{payload.get('machine_id', self.machine_id)}.dnc"
         data = json.dumps(payload, ensure_ascii=False).encode("utf-8")
-        await self.js.publish(subject, data)
-
+        await self.js.publish(subject, data, headers={"Nats-Msg-Id": event_msg_id(payload)})